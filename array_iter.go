@@ -0,0 +1,172 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "sort"
+
+// InternalKV is an internal key and its value.
+type InternalKV struct {
+	Key   InternalKey
+	Value []byte
+}
+
+// ArrayIter is an internal iterator over an in-memory slice of key/value
+// pairs. It can be used to present entries which are not held in a memtable or
+// sstable, such as pending writes, as an input to a merging iterator.
+//
+// The key/value pairs are not copied, and must not be modified while the
+// iterator is in use.
+type ArrayIter struct {
+	cmp Compare
+	kvs []InternalKV
+	// The entries within the bounds of the iterator are kvs[start:end]. The
+	// iterator is positioned at kvs[index], and is exhausted in the reverse or
+	// forward direction if index is start-1 or end respectively.
+	start int
+	end   int
+	index int
+}
+
+// ArrayIter implements the internalIterator interface.
+var _ internalIterator = (*ArrayIter)(nil)
+
+// NewArrayIter returns an iterator over the specified key/value pairs, which
+// must be sorted in internal key order according to cmp: in increasing order
+// of user key, and in decreasing order of sequence number for identical user
+// keys.
+func NewArrayIter(cmp Compare, kvs []InternalKV) *ArrayIter {
+	return &ArrayIter{
+		cmp:   cmp,
+		kvs:   kvs,
+		end:   len(kvs),
+		index: -1,
+	}
+}
+
+// search returns the position of the first entry whose user key is greater
+// than or equal to key.
+func (i *ArrayIter) search(key []byte) int {
+	return sort.Search(len(i.kvs), func(j int) bool {
+		return i.cmp(i.kvs[j].Key.UserKey, key) >= 0
+	})
+}
+
+// SeekGE implements internalIterator.SeekGE, as documented in the pebble
+// package.
+func (i *ArrayIter) SeekGE(key []byte) (*InternalKey, []byte) {
+	i.index = i.search(key)
+	if i.index < i.start {
+		i.index = i.start
+	} else if i.index > i.end {
+		i.index = i.end
+	}
+	return i.current()
+}
+
+// SeekPrefixGE implements internalIterator.SeekPrefixGE, as documented in the
+// pebble package. The iterator does not have a filter, so it is equivalent to
+// SeekGE.
+func (i *ArrayIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
+	return i.SeekGE(key)
+}
+
+// SeekLT implements internalIterator.SeekLT, as documented in the pebble
+// package.
+func (i *ArrayIter) SeekLT(key []byte) (*InternalKey, []byte) {
+	i.index = i.search(key) - 1
+	if i.index >= i.end {
+		i.index = i.end - 1
+	} else if i.index < i.start-1 {
+		i.index = i.start - 1
+	}
+	return i.current()
+}
+
+// First implements internalIterator.First, as documented in the pebble
+// package.
+func (i *ArrayIter) First() (*InternalKey, []byte) {
+	i.index = i.start
+	return i.current()
+}
+
+// Last implements internalIterator.Last, as documented in the pebble package.
+func (i *ArrayIter) Last() (*InternalKey, []byte) {
+	i.index = i.end - 1
+	return i.current()
+}
+
+// Next implements internalIterator.Next, as documented in the pebble package.
+func (i *ArrayIter) Next() (*InternalKey, []byte) {
+	if i.index < i.end {
+		i.index++
+	}
+	return i.current()
+}
+
+// Prev implements internalIterator.Prev, as documented in the pebble package.
+func (i *ArrayIter) Prev() (*InternalKey, []byte) {
+	if i.index >= i.start {
+		i.index--
+	}
+	return i.current()
+}
+
+func (i *ArrayIter) current() (*InternalKey, []byte) {
+	if !i.Valid() {
+		return nil, nil
+	}
+	return &i.kvs[i.index].Key, i.kvs[i.index].Value
+}
+
+// Key implements internalIterator.Key, as documented in the pebble package.
+func (i *ArrayIter) Key() *InternalKey {
+	if !i.Valid() {
+		return nil
+	}
+	return &i.kvs[i.index].Key
+}
+
+// Value implements internalIterator.Value, as documented in the pebble
+// package.
+func (i *ArrayIter) Value() []byte {
+	if !i.Valid() {
+		return nil
+	}
+	return i.kvs[i.index].Value
+}
+
+// Valid implements internalIterator.Valid, as documented in the pebble
+// package.
+func (i *ArrayIter) Valid() bool {
+	return i.index >= i.start && i.index < i.end
+}
+
+// Error implements internalIterator.Error, as documented in the pebble
+// package. An ArrayIter never encounters an error.
+func (i *ArrayIter) Error() error {
+	return nil
+}
+
+// Close implements internalIterator.Close, as documented in the pebble
+// package.
+func (i *ArrayIter) Close() error {
+	return nil
+}
+
+// SetBounds implements internalIterator.SetBounds, as documented in the pebble
+// package. The position of the iterator is undefined until it is repositioned.
+func (i *ArrayIter) SetBounds(lower, upper []byte) {
+	i.start, i.end = 0, len(i.kvs)
+	if lower != nil {
+		i.start = i.search(lower)
+	}
+	if upper != nil {
+		i.end = i.search(upper)
+	}
+	if i.end < i.start {
+		i.end = i.start
+	}
+	i.index = i.start - 1
+}
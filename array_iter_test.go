@@ -0,0 +1,78 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/internal/datadriven"
+	"golang.org/x/exp/rand"
+)
+
+func TestArrayIter(t *testing.T) {
+	var kvs []InternalKV
+	datadriven.RunTest(t, "testdata/array_iter", func(d *datadriven.TestData) string {
+		switch d.Cmd {
+		case "define":
+			kvs = kvs[:0]
+			for _, key := range strings.Fields(d.Input) {
+				j := strings.Index(key, ":")
+				kvs = append(kvs, InternalKV{
+					Key:   base.ParseInternalKey(key[:j]),
+					Value: []byte(key[j+1:]),
+				})
+			}
+			return ""
+
+		case "iter":
+			iter := NewArrayIter(DefaultComparer.Compare, kvs)
+			defer iter.Close()
+			return runInternalIterCmd(d, iter)
+
+		default:
+			return fmt.Sprintf("unknown command: %s", d.Cmd)
+		}
+	})
+}
+
+func TestArrayIterMerging(t *testing.T) {
+	// Shuffle testKeyValuePairs into one or more array iterators, which are
+	// merged by a merging iterator to recover the original key/value pairs in
+	// both directions.
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		splits := make([][]InternalKV, 1+r.Intn(2+len(testKeyValuePairs)))
+		for _, kv := range testKeyValuePairs {
+			j := r.Intn(len(splits))
+			splits[j] = append(splits[j], InternalKV{Key: fakeIkey(kv)})
+		}
+		iters := make([]internalIterator, len(splits))
+		for j := range splits {
+			iters[j] = NewArrayIter(DefaultComparer.Compare, splits[j])
+		}
+		iter := newMergingIter(DefaultComparer.Compare, iters...)
+
+		var forward, backward []string
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			forward = append(forward, fmt.Sprintf("%s:%d", key.UserKey, key.SeqNum()))
+		}
+		for key, _ := iter.Last(); key != nil; key, _ = iter.Prev() {
+			backward = append([]string{fmt.Sprintf("%s:%d", key.UserKey, key.SeqNum())}, backward...)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Join(testKeyValuePairs, " ")
+		if got := strings.Join(forward, " "); got != expected {
+			t.Fatalf("%d: forward: got %q, want %q", i, got, expected)
+		}
+		if got := strings.Join(backward, " "); got != expected {
+			t.Fatalf("%d: backward: got %q, want %q", i, got, expected)
+		}
+	}
+}
@@ -4,6 +4,8 @@
 
 package cache
 
+import "sync"
+
 const (
 	// The min size of a byte slice held in an allocCache instance. Byte slices
 	// smaller than this value will not be cached.
@@ -75,3 +77,44 @@ func (c *allocCache) free(b []byte) {
 	c.bufs = append(c.bufs, b)
 	c.size += n
 }
+
+// BufferPool is a pool of byte slices which may be shared by the sstable
+// Readers of a process, reducing the allocations performed when blocks are
+// decompressed. A BufferPool holds O(num-cpus) allocCaches. A nil BufferPool
+// passes allocations through to the Go runtime allocator. A BufferPool is safe
+// for concurrent use.
+type BufferPool struct {
+	pool sync.Pool
+}
+
+// NewBufferPool creates a new BufferPool.
+func NewBufferPool() *BufferPool {
+	p := &BufferPool{}
+	p.pool.New = func() interface{} {
+		return &allocCache{}
+	}
+	return p
+}
+
+// Alloc allocates a byte slice of the specified size, possibly reusing
+// previously freed memory.
+func (p *BufferPool) Alloc(n int) []byte {
+	if p == nil {
+		return make([]byte, n)
+	}
+	a := p.pool.Get().(*allocCache)
+	b := a.alloc(n)
+	p.pool.Put(a)
+	return b
+}
+
+// Free returns the specified slice of memory to the pool. The buffer will
+// possibly be reused, making it invalid to use the buffer after calling Free.
+func (p *BufferPool) Free(b []byte) {
+	if p == nil {
+		return
+	}
+	a := p.pool.Get().(*allocCache)
+	a.free(b)
+	p.pool.Put(a)
+}
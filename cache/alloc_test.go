@@ -30,3 +30,24 @@ func TestAllocCache(t *testing.T) {
 		t.Fatalf("expected cache size to be zero, found %d", c.size)
 	}
 }
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool()
+	b := p.Alloc(2000)
+	if len(b) != 2000 {
+		t.Fatalf("expected length 2000, but found %d", len(b))
+	}
+	p.Free(b)
+	// The pool is backed by a sync.Pool, so the freed buffer is not
+	// guaranteed to be reused, but the allocation must still succeed.
+	if b := p.Alloc(1500); len(b) != 1500 {
+		t.Fatalf("expected length 1500, but found %d", len(b))
+	}
+
+	// A nil BufferPool passes allocations through to the runtime.
+	var nilPool *BufferPool
+	if b := nilPool.Alloc(10); len(b) != 10 {
+		t.Fatalf("expected length 10, but found %d", len(b))
+	}
+	nilPool.Free(b)
+}
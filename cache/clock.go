@@ -0,0 +1,62 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// NewClock creates a new cache of the specified size which uses the CLOCK
+// (second-chance) replacement policy rather than CLOCK-Pro. CLOCK approximates
+// LRU: a hit only sets the reference bit of the entry, and the entries are
+// kept in a circular list which is swept by a single hand when space is
+// needed. An entry whose reference bit is set is given a second chance by
+// clearing the bit, while an entry whose bit is clear is evicted.
+//
+// Unlike CLOCK-Pro, CLOCK does not track recently evicted entries, so it uses
+// less memory for metadata, but it is not resistant to scans. The returned
+// Cache is otherwise identical to one returned by New, and can be used
+// wherever a Cache is accepted, such as Options.Cache.
+func NewClock(size int64) *Cache {
+	return newClockShards(size, 2*runtime.NumCPU())
+}
+
+// NewClockWithShards creates a new CLOCK cache of the specified size which is
+// divided into the specified number of shards. See NewWithShards.
+func NewClockWithShards(size int64, shards int) *Cache {
+	if shards <= 0 {
+		shards = 1
+	}
+	return newClockShards(size, shards)
+}
+
+func newClockShards(size int64, shards int) *Cache {
+	c := newShards(size, shards)
+	for i := range c.shards {
+		c.shards[i].clock = true
+	}
+	return c
+}
+
+// runHandClock advances the hand of a CLOCK shard by one entry, evicting the
+// entry under the hand if it has not been referenced since the hand last
+// passed it. All of the entries in a CLOCK shard are cold entries.
+func (c *shard) runHandClock() {
+	e := c.handCold
+	if atomic.LoadInt32(&e.ref) == 1 {
+		atomic.StoreInt32(&e.ref, 0)
+		c.handCold = e.next()
+		return
+	}
+
+	c.evicted(e, EvictionCapacity)
+	e.setValue(nil, c.free)
+	// Removing the entry under the hand moves the hand to the previous entry.
+	c.remove(e)
+	if c.handCold != nil {
+		c.handCold = c.handCold.next()
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// lruCache is a minimal LRU cache used as a baseline for the CLOCK cache. A
+// hit moves the entry to the front of the list, which requires an exclusive
+// lock.
+type lruCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	blocks  map[key]*list.Element
+	list    list.List
+}
+
+type lruEntry struct {
+	key   key
+	value []byte
+}
+
+func newLRUCache(size int64) *lruCache {
+	return &lruCache{maxSize: size, blocks: make(map[key]*list.Element)}
+}
+
+func (c *lruCache) Get(fileNum, offset uint64) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.blocks[key{fileNum: fileNum, offset: offset}]
+	if e == nil {
+		return nil
+	}
+	c.list.MoveToFront(e)
+	return e.Value.(*lruEntry).value
+}
+
+func (c *lruCache) Set(fileNum, offset uint64, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := key{fileNum: fileNum, offset: offset}
+	if e := c.blocks[k]; e != nil {
+		c.size -= int64(len(e.Value.(*lruEntry).value))
+		c.list.Remove(e)
+	}
+	c.blocks[k] = c.list.PushFront(&lruEntry{key: k, value: value})
+	c.size += int64(len(value))
+	for c.size > c.maxSize {
+		e := c.list.Back()
+		c.list.Remove(e)
+		delete(c.blocks, e.Value.(*lruEntry).key)
+		c.size -= int64(len(e.Value.(*lruEntry).value))
+	}
+}
+
+func TestClock(t *testing.T) {
+	cache := newClockShards(3, 1)
+	for i := uint64(0); i < 3; i++ {
+		cache.Set(i, 0, []byte{'a'}).Release()
+	}
+	// Referencing block 0 gives it a second chance, so block 1 is the first
+	// block to be evicted.
+	h := cache.Get(0, 0)
+	h.Release()
+	cache.Set(3, 0, []byte{'a'}).Release()
+
+	for i, expected := range []bool{true, false, true, true} {
+		h := cache.Get(uint64(i), 0)
+		if found := h.Get() != nil; found != expected {
+			t.Fatalf("%d: expected %t, but found %t", i, expected, found)
+		}
+		h.Release()
+	}
+	if size := cache.Size(); size != 3 {
+		t.Fatalf("expected size 3, but found %d", size)
+	}
+
+	cache.EvictFile(0)
+	if size := cache.Size(); size != 2 {
+		t.Fatalf("expected size 2, but found %d", size)
+	}
+}
+
+func TestClockHitRate(t *testing.T) {
+	// A skewed workload over 10000 blocks, of which 1000 fit in the cache.
+	const blocks = 10000
+	const size = 1000
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, 1.1, 1, blocks-1)
+	keys := make([]uint64, 200000)
+	for i := range keys {
+		keys[i] = zipf.Uint64()
+	}
+
+	value := []byte{'a'}
+	hitRate := func(get func(uint64) bool, set func(uint64)) float64 {
+		var hits int
+		for _, k := range keys {
+			if get(k) {
+				hits++
+			} else {
+				set(k)
+			}
+		}
+		return float64(hits) / float64(len(keys))
+	}
+
+	clock := newClockShards(size, 1)
+	clockRate := hitRate(func(k uint64) bool {
+		h := clock.Get(k, 0)
+		defer h.Release()
+		return h.Get() != nil
+	}, func(k uint64) {
+		clock.Set(k, 0, value).Release()
+	})
+
+	lru := newLRUCache(size)
+	lruRate := hitRate(func(k uint64) bool {
+		return lru.Get(k, 0) != nil
+	}, func(k uint64) {
+		lru.Set(k, 0, value)
+	})
+
+	// CLOCK approximates LRU, so its hit rate is expected to be close to that
+	// of LRU.
+	if clockRate < 0.95*lruRate {
+		t.Fatalf("expected CLOCK hit rate close to LRU hit rate %.3f, but found %.3f",
+			lruRate, clockRate)
+	}
+}
+
+// BenchmarkCacheHit measures the throughput of concurrent cache hits. A hit in
+// the LRU cache moves the entry to the front of the list under an exclusive
+// lock, while a hit in the CLOCK and CLOCK-Pro caches only sets the reference
+// bit of the entry under a shared lock.
+func BenchmarkCacheHit(b *testing.B) {
+	const blocks = 1024
+	value := make([]byte, 16)
+	// The caches have room for twice as many blocks as are accessed, so that
+	// every Get hits.
+	const size = 2 * blocks * 16
+
+	run := func(b *testing.B, get func(uint64) bool, set func(uint64)) {
+		for i := uint64(0); i < blocks; i++ {
+			set(i)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			rng := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				if !get(uint64(rng.Intn(blocks))) {
+					panic("unexpected cache miss")
+				}
+			}
+		})
+	}
+	for _, c := range []struct {
+		name  string
+		cache *Cache
+	}{
+		{"clockpro", newShards(size, 1)},
+		{"clock", newClockShards(size, 1)},
+	} {
+		cache := c.cache
+		b.Run(c.name, func(b *testing.B) {
+			run(b, func(k uint64) bool {
+				h := cache.Get(k, 0)
+				defer h.Release()
+				return h.Get() != nil
+			}, func(k uint64) {
+				cache.Set(k, 0, value).Release()
+			})
+		})
+	}
+	b.Run("lru", func(b *testing.B) {
+		cache := newLRUCache(size)
+		run(b, func(k uint64) bool {
+			return cache.Get(k, 0) != nil
+		}, func(k uint64) {
+			cache.Set(k, 0, value)
+		})
+	})
+}
@@ -20,9 +20,11 @@ It is MIT licensed, like the original.
 package cache // import "github.com/petermattis/pebble/cache"
 
 import (
+	"container/heap"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -87,6 +89,11 @@ type entry struct {
 	size  int64
 	ptype entryType
 	ref   int32
+	// expiration is the time, in nanoseconds since the Unix epoch, after which
+	// the entry is evicted, or 0 if the entry does not expire. expiryIndex is
+	// the index of the entry in shard.expiries if expiration is non-zero.
+	expiration  int64
+	expiryIndex int
 }
 
 func (e *entry) init() *entry {
@@ -159,6 +166,36 @@ func (e *entry) Get() []byte {
 	return v.buf
 }
 
+func (e *entry) expired(now func() time.Time) bool {
+	return e.expiration != 0 && e.expiration <= now().UnixNano()
+}
+
+// expiryHeap is a min-heap of the entries with an expiration, ordered by
+// expiration.
+type expiryHeap []*entry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiration < h[j].expiration }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIndex = i
+	h[j].expiryIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.expiryIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
 // Handle provides a strong reference to an entry in the cache. The reference
 // does not pin the entry in the cache, but it does prevent the underlying byte
 // slice from being reused.
@@ -186,6 +223,15 @@ func (h Handle) Release() {
 	}
 }
 
+// Acquire returns an additional strong reference to the value referenced by
+// the handle. The returned handle must be released independently of h.
+func (h Handle) Acquire() Handle {
+	if h.value != nil {
+		h.value.acquire()
+	}
+	return h
+}
+
 // Weak returns a weak handle and clears the strong reference, preventing the
 // underlying data storage from being reused. Clearing the strong reference
 // allows the underlying data to be evicted and GC'd, but the buffer will not
@@ -208,11 +254,20 @@ type WeakHandle interface {
 
 type shard struct {
 	free func([]byte)
+	// clock is true if the shard uses the CLOCK policy rather than CLOCK-Pro.
+	// See NewClock.
+	clock bool
+	// onEvict is called when a value is removed from the shard. See
+	// Cache.SetEvictionCallback.
+	onEvict EvictionCallback
 
 	mu sync.RWMutex
 
 	maxSize  int64
 	coldSize int64
+	// reserved is the number of bytes reserved by Cache.Reserve, which reduces
+	// the space available for blocks.
+	reserved int64
 	blocks   map[key]*entry    // fileNum+offset -> block
 	files    map[uint64]*entry // fileNum -> list of blocks
 
@@ -223,14 +278,22 @@ type shard struct {
 	countHot  int64
 	countCold int64
 	countTest int64
+
+	// expiries holds the entries which were set with a TTL. Expired entries are
+	// evicted lazily by Get, Set and Size.
+	expiries expiryHeap
+	now      func() time.Time
 }
 
 func (c *shard) Get(fileNum, offset uint64) Handle {
 	c.mu.RLock()
 	e := c.blocks[key{fileNum: fileNum, offset: offset}]
 	var value *value
+	var expired bool
 	if e != nil {
-		value = e.getValue()
+		if expired = e.expired(c.now); !expired {
+			value = e.getValue()
+		}
 		if value != nil {
 			value.acquire()
 			atomic.StoreInt32(&e.ref, 1)
@@ -239,12 +302,21 @@ func (c *shard) Get(fileNum, offset uint64) Handle {
 		}
 	}
 	c.mu.RUnlock()
+	if expired {
+		c.mu.Lock()
+		c.evictExpired()
+		c.mu.Unlock()
+	}
 	return Handle{value: value, free: c.free}
 }
 
-func (c *shard) Set(fileNum, offset uint64, value []byte) Handle {
+// Set sets the value for the specified file and offset. A non-zero expiration
+// is the time, in nanoseconds since the Unix epoch, after which the entry is
+// evicted.
+func (c *shard) Set(fileNum, offset uint64, value []byte, expiration int64) Handle {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.evictExpired()
 
 	k := key{fileNum: fileNum, offset: offset}
 	e := c.blocks[k]
@@ -261,6 +333,7 @@ func (c *shard) Set(fileNum, offset uint64, value []byte) Handle {
 
 	case e.getValue() != nil:
 		// cache entry was a hot or cold page
+		c.evicted(e, EvictionOverwrite)
 		e.setValue(v, c.free)
 		atomic.StoreInt32(&e.ref, 1)
 		delta := int64(len(value)) - e.size
@@ -275,8 +348,8 @@ func (c *shard) Set(fileNum, offset uint64, value []byte) Handle {
 	default:
 		// cache entry was a test page
 		c.coldSize += e.size
-		if c.coldSize > c.maxSize {
-			c.coldSize = c.maxSize
+		if target := c.targetSize(); c.coldSize > target {
+			c.coldSize = target
 		}
 		atomic.StoreInt32(&e.ref, 0)
 		e.setValue(v, c.free)
@@ -287,6 +360,7 @@ func (c *shard) Set(fileNum, offset uint64, value []byte) Handle {
 		c.countHot += e.size
 	}
 
+	c.setExpiration(e, expiration)
 	return Handle{entry: e, value: v, free: c.free}
 }
 
@@ -300,25 +374,59 @@ func (c *shard) EvictFile(fileNum uint64) {
 		return
 	}
 	for b, n := blocks, (*entry)(nil); ; b = n {
-		switch b.ptype {
-		case etHot:
-			c.countHot -= b.size
-		case etCold:
-			c.countCold -= b.size
-		case etTest:
-			c.countTest -= b.size
-		}
 		n = b.fileLink.next
-		c.metaDel(b)
+		c.evicted(b, EvictionFile)
+		c.remove(b)
 		if b == n {
 			break
 		}
 	}
 }
 
+// remove removes the entry from the cache, regardless of its type.
+func (c *shard) remove(e *entry) {
+	switch e.ptype {
+	case etHot:
+		c.countHot -= e.size
+	case etCold:
+		c.countCold -= e.size
+	case etTest:
+		c.countTest -= e.size
+	}
+	c.metaDel(e)
+}
+
+// setExpiration sets the expiration of the entry, adding it to or removing it
+// from the expiry heap as necessary.
+func (c *shard) setExpiration(e *entry, expiration int64) {
+	if e.expiration != 0 {
+		heap.Remove(&c.expiries, e.expiryIndex)
+	}
+	e.expiration = expiration
+	if expiration != 0 {
+		heap.Push(&c.expiries, e)
+	}
+}
+
+// evictExpired evicts the entries whose expiration has passed. The value of
+// an evicted entry is cleared so that weak handles to it no longer return it.
+func (c *shard) evictExpired() {
+	if len(c.expiries) == 0 {
+		return
+	}
+	now := c.now().UnixNano()
+	for len(c.expiries) > 0 && c.expiries[0].expiration <= now {
+		e := c.expiries[0]
+		c.evicted(e, EvictionExpired)
+		e.setValue(nil, c.free)
+		c.remove(e)
+	}
+}
+
 // Size returns the current space used by the cache.
 func (c *shard) Size() int64 {
 	c.mu.Lock()
+	c.evictExpired()
 	size := c.countHot + c.countCold
 	c.mu.Unlock()
 	return size
@@ -334,11 +442,15 @@ func (c *shard) metaAdd(key key, e *entry) {
 		c.handHot = e
 		c.handCold = e
 		c.handTest = e
+	} else if c.clock {
+		// A new entry is placed behind the hand so that it is the last entry to
+		// be considered for eviction.
+		c.handCold.link(e)
 	} else {
 		c.handHot.link(e)
 	}
 
-	if c.handCold == c.handHot {
+	if !c.clock && c.handCold == c.handHot {
 		c.handCold = c.handCold.prev()
 	}
 
@@ -351,6 +463,7 @@ func (c *shard) metaAdd(key key, e *entry) {
 
 func (c *shard) metaDel(e *entry) {
 	delete(c.blocks, e.key)
+	c.setExpiration(e, 0)
 
 	if e == c.handHot {
 		c.handHot = c.handHot.prev()
@@ -376,9 +489,35 @@ func (c *shard) metaDel(e *entry) {
 	}
 }
 
+// reserve adjusts the number of bytes reserved in the shard by n, evicting
+// blocks if the shard is over its target size.
+func (c *shard) reserve(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reserved += n
+	if target := c.targetSize(); c.coldSize > target {
+		c.coldSize = target
+	}
+	c.evict()
+}
+
+// targetSize returns the space available for blocks, which is the max size of
+// the shard less any reservations. The target size is always positive so that
+// evict terminates when the reservations exceed the max size.
+func (c *shard) targetSize() int64 {
+	if target := c.maxSize - c.reserved; target > 0 {
+		return target
+	}
+	return 1
+}
+
 func (c *shard) evict() {
-	for c.maxSize <= c.countHot+c.countCold {
-		c.runHandCold()
+	for c.targetSize() <= c.countHot+c.countCold && c.handCold != nil {
+		if c.clock {
+			c.runHandClock()
+		} else {
+			c.runHandCold()
+		}
 	}
 }
 
@@ -395,6 +534,7 @@ func (c *shard) runHandCold() {
 			c.countCold -= e.size
 			c.countHot += e.size
 		} else {
+			c.evicted(e, EvictionCapacity)
 			e.setValue(nil, c.free)
 			e.ptype = etTest
 			c.countCold -= e.size
@@ -407,7 +547,7 @@ func (c *shard) runHandCold() {
 
 	c.handCold = c.handCold.next()
 
-	for c.maxSize-c.coldSize <= c.countHot {
+	for c.targetSize()-c.coldSize <= c.countHot && c.handHot != nil {
 		c.runHandHot()
 	}
 }
@@ -458,11 +598,35 @@ func (c *shard) runHandTest() {
 	c.handTest = c.handTest.next()
 }
 
+// TagStats holds the cache counters attributed to a query or tenant by
+// GetWithTag and SetWithTag. The counters are owned by the caller rather than
+// the cache, and so live for as long as the caller retains them, regardless of
+// which values are in the cache. The counters are updated atomically, and a
+// TagStats may be shared by concurrent lookups; Load returns a consistent copy
+// of each counter.
+type TagStats struct {
+	// The number of Get calls which found a value in the cache.
+	Hits int64
+	// The number of Get calls which did not find a value in the cache.
+	Misses int64
+	// The number of values added to the cache by Set.
+	Sets int64
+}
+
+// Load atomically loads the counters.
+func (s *TagStats) Load() TagStats {
+	return TagStats{
+		Hits:   atomic.LoadInt64(&s.Hits),
+		Misses: atomic.LoadInt64(&s.Misses),
+		Sets:   atomic.LoadInt64(&s.Sets),
+	}
+}
+
 // Cache ...
 type Cache struct {
 	maxSize   int64
 	shards    []shard
-	allocPool *sync.Pool
+	allocPool *BufferPool
 }
 
 // New creates a new cache of the specified size. Memory for the cache is
@@ -471,15 +635,26 @@ func New(size int64) *Cache {
 	return newShards(size, 2*runtime.NumCPU())
 }
 
+// NewWithShards creates a new cache of the specified size which is divided
+// into the specified number of shards. Each shard is protected by its own
+// mutex and holds an equal share of the capacity, and a block is assigned to a
+// shard by a hash of its file number and offset. More shards reduce the
+// contention between concurrent cache operations, but as each shard evicts
+// independently, the eviction decisions approximate those of a single shard
+// less closely. New uses twice the number of CPUs. A non-positive number of
+// shards is treated as 1.
+func NewWithShards(size int64, shards int) *Cache {
+	if shards <= 0 {
+		shards = 1
+	}
+	return newShards(size, shards)
+}
+
 func newShards(size int64, shards int) *Cache {
 	c := &Cache{
-		maxSize: size,
-		shards:  make([]shard, shards),
-		allocPool: &sync.Pool{
-			New: func() interface{} {
-				return &allocCache{}
-			},
-		},
+		maxSize:   size,
+		shards:    make([]shard, shards),
+		allocPool: NewBufferPool(),
 	}
 	free := c.Free
 	for i := range c.shards {
@@ -489,6 +664,7 @@ func newShards(size int64, shards int) *Cache {
 			coldSize: size / int64(len(c.shards)),
 			blocks:   make(map[key]*entry),
 			files:    make(map[uint64]*entry),
+			now:      time.Now,
 		}
 	}
 	return c
@@ -523,6 +699,21 @@ func (c *Cache) Get(fileNum, offset uint64) Handle {
 	return c.getShard(fileNum, offset).Get(fileNum, offset)
 }
 
+// GetWithTag is like Get, but also attributes the cache hit or miss to the
+// specified counters. Nil counters are not updated.
+func (c *Cache) GetWithTag(stats *TagStats, fileNum, offset uint64) Handle {
+	h := c.Get(fileNum, offset)
+	if c == nil || stats == nil {
+		return h
+	}
+	if h.Get() != nil {
+		atomic.AddInt64(&stats.Hits, 1)
+	} else {
+		atomic.AddInt64(&stats.Misses, 1)
+	}
+	return h
+}
+
 // Set sets the cache value for the specified file and offset, overwriting an
 // existing value if present. A Handle is returned which provides faster
 // retrieval of the cached value than Get (lock-free and avoidance of the map
@@ -531,7 +722,36 @@ func (c *Cache) Set(fileNum, offset uint64, value []byte) Handle {
 	if c == nil {
 		return Handle{value: newValue(value)}
 	}
-	return c.getShard(fileNum, offset).Set(fileNum, offset, value)
+	return c.getShard(fileNum, offset).Set(fileNum, offset, value, 0 /* expiration */)
+}
+
+// SetWithTTL is like Set, but the value is evicted from the cache once the
+// specified TTL has elapsed, regardless of how recently it was accessed. This
+// is useful for data which is known to become cold after a time window. A
+// non-positive TTL is equivalent to Set. Expired values are evicted lazily: Get
+// does not return an expired value, and expired values are removed by
+// subsequent operations on the cache. Weak handles to an expired value
+// continue to return it until it is removed.
+func (c *Cache) SetWithTTL(fileNum, offset uint64, value []byte, ttl time.Duration) Handle {
+	if c == nil {
+		return Handle{value: newValue(value)}
+	}
+	s := c.getShard(fileNum, offset)
+	var expiration int64
+	if ttl > 0 {
+		expiration = s.now().Add(ttl).UnixNano()
+	}
+	return s.Set(fileNum, offset, value, expiration)
+}
+
+// SetWithTag is like Set, but also attributes the addition of the value to the
+// cache to the specified counters. Nil counters are not updated.
+func (c *Cache) SetWithTag(stats *TagStats, fileNum, offset uint64, value []byte) Handle {
+	h := c.Set(fileNum, offset, value)
+	if c != nil && stats != nil {
+		atomic.AddInt64(&stats.Sets, 1)
+	}
+	return h
 }
 
 // EvictFile evicts all of the cache values for the specified file.
@@ -564,16 +784,39 @@ func (c *Cache) Size() int64 {
 	return size
 }
 
+// Reserve reserves n bytes of the cache's capacity for memory used outside of
+// the cache, such as memtables, allowing a single budget to govern both. The
+// reservation shrinks the space available for blocks, evicting blocks as
+// necessary, without allocating any memory. The returned function releases
+// the reservation and must be called exactly once.
+func (c *Cache) Reserve(n int64) (release func()) {
+	if c == nil {
+		return func() {}
+	}
+	// Round up the per-shard reservation. Reservations are expected to be large
+	// relative to the number of shards, so this doesn't matter in practice.
+	shardN := (n + int64(len(c.shards)) - 1) / int64(len(c.shards))
+	for i := range c.shards {
+		c.shards[i].reserve(shardN)
+	}
+	var released int32
+	return func() {
+		if !atomic.CompareAndSwapInt32(&released, 0, 1) {
+			panic("pebble: cache reservation already released")
+		}
+		for i := range c.shards {
+			c.shards[i].reserve(-shardN)
+		}
+	}
+}
+
 // Alloc allocates a byte slice of the specified size, possibly reusing
 // previously allocated but unused memory.
 func (c *Cache) Alloc(n int) []byte {
 	if c == nil {
 		return make([]byte, n)
 	}
-	a := c.allocPool.Get().(*allocCache)
-	b := a.alloc(n)
-	c.allocPool.Put(a)
-	return b
+	return c.allocPool.Alloc(n)
 }
 
 // Free frees the specified slice of memory. The buffer will possibly be
@@ -582,7 +825,5 @@ func (c *Cache) Free(b []byte) {
 	if c == nil {
 		return
 	}
-	a := c.allocPool.Get().(*allocCache)
-	a.free(b)
-	c.allocPool.Put(a)
+	c.allocPool.Free(b)
 }
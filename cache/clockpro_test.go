@@ -6,9 +6,13 @@ package cache
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCache(t *testing.T) {
@@ -90,3 +94,292 @@ func TestEvictFile(t *testing.T) {
 		t.Fatalf("expected cache size %d, but found %d", expected, size)
 	}
 }
+
+func TestReserve(t *testing.T) {
+	cache := newShards(100, 2)
+	fill := func(fileNum uint64) {
+		for i := uint64(0); i < 18; i++ {
+			cache.Set(fileNum, i, bytes.Repeat([]byte("a"), 5)).Release()
+		}
+	}
+
+	fill(0)
+	if expected, size := int64(90), cache.Size(); expected != size {
+		t.Fatalf("expected cache size %d, but found %d", expected, size)
+	}
+
+	// Reserving space evicts blocks to make room for the reservation.
+	release := cache.Reserve(50)
+	if size := cache.Size(); size > 50 {
+		t.Fatalf("expected cache size <= 50, but found %d", size)
+	}
+	fill(1)
+	if size := cache.Size(); size > 50 {
+		t.Fatalf("expected cache size <= 50, but found %d", size)
+	}
+
+	// Reservations larger than the cache do not hang eviction.
+	release2 := cache.Reserve(200)
+	if size := cache.Size(); size > 10 {
+		t.Fatalf("expected cache size <= 10, but found %d", size)
+	}
+	release2()
+
+	// Releasing the reservation restores the capacity.
+	release()
+	fill(2)
+	if size := cache.Size(); size <= 50 {
+		t.Fatalf("expected cache size > 50, but found %d", size)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expected panic on double release")
+		}
+	}()
+	release()
+}
+
+func TestSetWithTTL(t *testing.T) {
+	cache := newShards(100, 1)
+	now := time.Unix(0, 0)
+	cache.shards[0].now = func() time.Time { return now }
+
+	cache.SetWithTTL(0, 0, bytes.Repeat([]byte("a"), 5), time.Second).Release()
+	cache.SetWithTTL(0, 1, bytes.Repeat([]byte("b"), 5), 2*time.Second).Release()
+	cache.Set(0, 2, bytes.Repeat([]byte("c"), 5)).Release()
+	// Overwriting a value with Set clears its TTL.
+	cache.SetWithTTL(0, 3, bytes.Repeat([]byte("d"), 5), time.Second).Release()
+	cache.Set(0, 3, bytes.Repeat([]byte("d"), 5)).Release()
+	if expected, size := int64(20), cache.Size(); expected != size {
+		t.Fatalf("expected cache size %d, but found %d", expected, size)
+	}
+
+	get := func(offset uint64) string {
+		h := cache.Get(0, offset)
+		defer h.Release()
+		return string(h.Get())
+	}
+
+	// The cache is not under pressure, so only expiration evicts values.
+	now = now.Add(time.Second)
+	if v := get(0); v != "" {
+		t.Fatalf("expected expired value to be evicted, but found %s", v)
+	}
+	if v := get(1); v != "bbbbb" {
+		t.Fatalf("expected bbbbb, but found %s", v)
+	}
+	if expected, size := int64(15), cache.Size(); expected != size {
+		t.Fatalf("expected cache size %d, but found %d", expected, size)
+	}
+
+	// Size evicts expired values without an intervening Get.
+	now = now.Add(time.Second)
+	if expected, size := int64(10), cache.Size(); expected != size {
+		t.Fatalf("expected cache size %d, but found %d", expected, size)
+	}
+	if v := get(2); v != "ccccc" {
+		t.Fatalf("expected ccccc, but found %s", v)
+	}
+	if v := get(3); v != "ddddd" {
+		t.Fatalf("expected ddddd, but found %s", v)
+	}
+}
+
+func TestTagStats(t *testing.T) {
+	cache := newShards(100, 1)
+	var statsA, statsB TagStats
+
+	// A misses on two blocks and adds them to the cache.
+	for i := uint64(0); i < 2; i++ {
+		h := cache.GetWithTag(&statsA, i, 0)
+		if v := h.Get(); v != nil {
+			t.Fatalf("expected miss, but found %s", v)
+		}
+		cache.SetWithTag(&statsA, i, 0, bytes.Repeat([]byte("a"), 5)).Release()
+	}
+	// B hits on the blocks added by A and misses on another.
+	for i := uint64(0); i < 3; i++ {
+		cache.GetWithTag(&statsB, i, 0).Release()
+	}
+	// Untagged lookups are not attributed.
+	cache.Get(0, 0).Release()
+	cache.GetWithTag(nil, 0, 0).Release()
+	cache.SetWithTag(nil, 3, 0, nil).Release()
+
+	if expected, stats := (TagStats{Hits: 0, Misses: 2, Sets: 2}), statsA.Load(); expected != stats {
+		t.Fatalf("expected %+v, but found %+v", expected, stats)
+	}
+	if expected, stats := (TagStats{Hits: 2, Misses: 1, Sets: 0}), statsB.Load(); expected != stats {
+		t.Fatalf("expected %+v, but found %+v", expected, stats)
+	}
+
+	// The counters are not affected by the removal of the values from the
+	// cache.
+	cache.EvictFile(0)
+	cache.EvictFile(1)
+	for i := uint64(0); i < 100; i++ {
+		cache.SetWithTag(&statsB, 10+i, 0, bytes.Repeat([]byte("b"), 10)).Release()
+	}
+	if expected, stats := (TagStats{Hits: 0, Misses: 2, Sets: 2}), statsA.Load(); expected != stats {
+		t.Fatalf("expected %+v, but found %+v", expected, stats)
+	}
+	if expected, stats := (TagStats{Hits: 2, Misses: 1, Sets: 100}), statsB.Load(); expected != stats {
+		t.Fatalf("expected %+v, but found %+v", expected, stats)
+	}
+}
+
+func TestTagStatsConcurrent(t *testing.T) {
+	cache := newShards(1<<10, 4)
+	var stats TagStats
+	const numGoroutines, numOps = 8, 1000
+
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < numOps; j++ {
+				fileNum := uint64(i*numOps + j)
+				cache.GetWithTag(&stats, fileNum, 0).Release()
+				cache.SetWithTag(&stats, fileNum, 0, bytes.Repeat([]byte("a"), 100)).Release()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every block is missed and then set, while the cache evicts blocks
+	// concurrently.
+	const n = numGoroutines * numOps
+	if expected, s := (TagStats{Misses: n, Sets: n}), stats.Load(); expected != s {
+		t.Fatalf("expected %+v, but found %+v", expected, s)
+	}
+}
+
+func TestNewWithShards(t *testing.T) {
+	for _, c := range []struct {
+		shards   int
+		expected int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 1},
+		{7, 7},
+		{16, 16},
+	} {
+		for _, cache := range []*Cache{
+			NewWithShards(1600, c.shards),
+			NewClockWithShards(1600, c.shards),
+		} {
+			if n := len(cache.shards); n != c.expected {
+				t.Fatalf("%d: expected %d shards, but found %d", c.shards, c.expected, n)
+			}
+		}
+	}
+
+	// The blocks are spread across the shards, and a block is always found in
+	// the shard to which it was added.
+	cache := NewWithShards(1<<20, 16)
+	for i := uint64(0); i < 1000; i++ {
+		cache.Set(i/10, i%10, []byte(strconv.Itoa(int(i)))).Release()
+	}
+	for i := range cache.shards {
+		if n := len(cache.shards[i].blocks); n == 0 {
+			t.Fatalf("expected blocks in shard %d", i)
+		}
+	}
+	for i := uint64(0); i < 1000; i++ {
+		h := cache.Get(i/10, i%10)
+		if v := string(h.Get()); v != strconv.Itoa(int(i)) {
+			t.Fatalf("expected %d, but found %s", i, v)
+		}
+		h.Release()
+	}
+}
+
+// BenchmarkCacheShards measures the throughput of a mix of concurrent cache
+// hits and misses as the number of shards increases. Each miss adds the block
+// to the cache under the exclusive lock of its shard, so the throughput of a
+// cache with a single shard is limited by the contention for its lock.
+func BenchmarkCacheShards(b *testing.B) {
+	const blocks = 1 << 14
+	value := make([]byte, 16)
+	// The cache has room for half of the blocks accessed.
+	const size = blocks * 16 / 2
+
+	for _, shards := range []int{1, 2, 4, 8, 16, 32, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := NewWithShards(size, shards)
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					k := uint64(rng.Intn(blocks))
+					h := cache.Get(k, 0)
+					if h.Get() == nil {
+						h = cache.Set(k, 0, value)
+					}
+					h.Release()
+				}
+			})
+		})
+	}
+}
+
+type testBlockLoader struct {
+	cache   *Cache
+	fileNum uint64
+	loaded  []uint64
+}
+
+func (l *testBlockLoader) LoadBlocks(offsets []uint64) error {
+	for _, offset := range offsets {
+		l.cache.Set(l.fileNum, offset, []byte{byte(l.fileNum), byte(offset)}).Release()
+		l.loaded = append(l.loaded, offset)
+	}
+	return nil
+}
+
+func TestWarmSet(t *testing.T) {
+	cache := newShards(100, 1)
+	for fileNum := uint64(1); fileNum <= 3; fileNum++ {
+		for offset := uint64(0); offset < 5; offset++ {
+			cache.Set(fileNum, offset, []byte{byte(fileNum), byte(offset)}).Release()
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := cache.SaveWarmSet(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the warm set into a new cache. File 2 no longer exists and one of
+	// the blocks of file 3 is already present in the cache.
+	warm := newShards(100, 1)
+	warm.Set(3, 4, []byte{3, 4}).Release()
+	loaders := map[uint64]*testBlockLoader{
+		1: {cache: warm, fileNum: 1},
+		3: {cache: warm, fileNum: 3},
+	}
+	err := warm.LoadWarmSet(&buf, func(fileNum uint64) BlockLoader {
+		if l := loaders[fileNum]; l != nil {
+			return l
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(loaders[3].loaded); v != 4 {
+		t.Fatalf("expected 4 blocks loaded for file 3, but found %d", v)
+	}
+
+	for fileNum := uint64(1); fileNum <= 3; fileNum++ {
+		for offset := uint64(0); offset < 5; offset++ {
+			h := warm.Get(fileNum, offset)
+			if present := h.Get() != nil; present != (fileNum != 2) {
+				t.Fatalf("%d/%d: expected present=%t, but found %t", fileNum, offset, fileNum != 2, present)
+			}
+			h.Release()
+		}
+	}
+}
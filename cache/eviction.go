@@ -0,0 +1,75 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+// EvictionReason is the reason a value was removed from the cache.
+type EvictionReason int8
+
+const (
+	// EvictionCapacity is the removal of a value to make room for other values,
+	// or for a reservation made by Cache.Reserve.
+	EvictionCapacity EvictionReason = iota
+	// EvictionExpired is the removal of a value set by Cache.SetWithTTL whose
+	// TTL has elapsed.
+	EvictionExpired
+	// EvictionFile is the removal of a value by Cache.EvictFile.
+	EvictionFile
+	// EvictionOverwrite is the replacement of a value by a subsequent Set of
+	// the same file and offset.
+	EvictionOverwrite
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionCapacity:
+		return "capacity"
+	case EvictionExpired:
+		return "expired"
+	case EvictionFile:
+		return "file"
+	case EvictionOverwrite:
+		return "overwrite"
+	default:
+		return "unknown"
+	}
+}
+
+// EvictionCallback is called when the value cached for the specified file and
+// offset is removed from the cache. The callback is called synchronously,
+// while the cache holds the lock of the shard containing the value, so it must
+// be fast and must not call back into the cache. The value must not be
+// retained or modified by the callback, as its memory may be reused once the
+// callback returns.
+type EvictionCallback func(fileNum, offset uint64, value []byte, reason EvictionReason)
+
+// SetEvictionCallback sets the callback which is called when a value is
+// removed from the cache, such as to maintain external accounting of the
+// memory used by the cache. The reason argument distinguishes the values
+// evicted due to capacity pressure from those which are removed explicitly. A
+// nil callback disables the notifications. SetEvictionCallback is safe to call
+// concurrently with the use of the cache.
+func (c *Cache) SetEvictionCallback(fn EvictionCallback) {
+	if c == nil {
+		return
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.onEvict = fn
+		s.mu.Unlock()
+	}
+}
+
+// evicted notifies the eviction callback, if any, that the value of the entry
+// is being removed. The shard lock must be held, and the value must not yet
+// have been cleared from the entry.
+func (c *shard) evicted(e *entry, reason EvictionReason) {
+	if c.onEvict == nil {
+		return
+	}
+	if v := e.getValue(); v != nil {
+		c.onEvict(e.key.fileNum, e.key.offset, v.buf, reason)
+	}
+}
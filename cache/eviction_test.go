@@ -0,0 +1,95 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvictionCallback(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		cache *Cache
+	}{
+		{"clockpro", newShards(100, 1)},
+		{"clock", newClockShards(100, 1)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cache := c.cache
+			now := time.Unix(0, 0)
+			cache.shards[0].now = func() time.Time { return now }
+
+			// The callback maintains external accounting of the bytes cached,
+			// which must agree with the size of the cache.
+			var live int64
+			counts := make(map[EvictionReason]int)
+			cache.SetEvictionCallback(func(fileNum, offset uint64, value []byte, reason EvictionReason) {
+				if int(offset)%10 != 0 || len(value) != 10 {
+					t.Fatalf("unexpected eviction of %d/%d with %d bytes", fileNum, offset, len(value))
+				}
+				live -= int64(len(value))
+				counts[reason]++
+			})
+			set := func(fileNum, offset uint64) {
+				cache.Set(fileNum, offset, make([]byte, 10)).Release()
+				live += 10
+			}
+			check := func(reason EvictionReason, expected int) {
+				t.Helper()
+				// Size removes the expired values before computing the size.
+				if size := cache.Size(); live != size {
+					t.Fatalf("expected size %d, but found %d", live, size)
+				}
+				if counts[reason] != expected {
+					t.Fatalf("expected %d %s evictions, but found %d", expected, reason, counts[reason])
+				}
+			}
+
+			// Filling the cache beyond its capacity evicts values.
+			for i := uint64(0); i < 20; i++ {
+				set(1, i*10)
+			}
+			if counts[EvictionCapacity] == 0 {
+				t.Fatalf("expected capacity evictions")
+			}
+			check(EvictionCapacity, counts[EvictionCapacity])
+
+			// Overwriting a cached value replaces it.
+			for i := uint64(19); ; i-- {
+				if h := cache.Get(1, i*10); h.Get() != nil {
+					h.Release()
+					set(1, i*10)
+					break
+				}
+			}
+			check(EvictionOverwrite, 1)
+
+			// Evicting a file removes its values.
+			cached := int(live / 10)
+			cache.EvictFile(1)
+			check(EvictionFile, cached)
+			if live != 0 {
+				t.Fatalf("expected no cached bytes, but found %d", live)
+			}
+
+			// Expired values are removed.
+			cache.SetWithTTL(2, 0, make([]byte, 10), time.Second).Release()
+			live += 10
+			now = now.Add(2 * time.Second)
+			check(EvictionExpired, 1)
+
+			// Without a callback, evictions are not reported.
+			capacity := counts[EvictionCapacity]
+			cache.SetEvictionCallback(nil)
+			for i := uint64(0); i < 20; i++ {
+				cache.Set(3, i*10, make([]byte, 10)).Release()
+			}
+			if counts[EvictionCapacity] != capacity {
+				t.Fatalf("expected no further capacity evictions")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// BlockLoader loads the blocks of a file into the cache.
+type BlockLoader interface {
+	// LoadBlocks reads the blocks at the specified offsets into the cache.
+	LoadBlocks(offsets []uint64) error
+}
+
+// SaveWarmSet writes the keys (file number and offset) of the blocks resident
+// in the cache to w. The contents of the blocks are not written. Hot blocks
+// are written before cold blocks so that the blocks most likely to be accessed
+// are loaded first by LoadWarmSet.
+func (c *Cache) SaveWarmSet(w io.Writer) error {
+	if c == nil {
+		return nil
+	}
+
+	var hot, cold []key
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for k, e := range s.blocks {
+			if e.getValue() == nil {
+				// Test entries do not hold a value.
+				continue
+			}
+			if e.ptype == etHot {
+				hot = append(hot, k)
+			} else {
+				cold = append(cold, k)
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	bw := bufio.NewWriter(w)
+	var buf [2 * binary.MaxVarintLen64]byte
+	for _, keys := range [][]key{hot, cold} {
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].fileNum != keys[j].fileNum {
+				return keys[i].fileNum < keys[j].fileNum
+			}
+			return keys[i].offset < keys[j].offset
+		})
+		for _, k := range keys {
+			n := binary.PutUvarint(buf[:], k.fileNum)
+			n += binary.PutUvarint(buf[n:], k.offset)
+			if _, err := bw.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadWarmSet reads a warm set written by SaveWarmSet from r and loads the
+// recorded blocks into the cache. The loaders function returns the
+// BlockLoader for a file number. It may return nil if the file no longer
+// exists, in which case the blocks of the file are skipped. Blocks which are
+// already present in the cache are not reloaded.
+func (c *Cache) LoadWarmSet(r io.Reader, loaders func(fileNum uint64) BlockLoader) error {
+	if c == nil {
+		return nil
+	}
+
+	// Group the blocks by file, preserving the order in which the files were
+	// first encountered.
+	var fileNums []uint64
+	offsets := make(map[uint64][]uint64)
+	br := bufio.NewReader(r)
+	for {
+		fileNum, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset, err := binary.ReadUvarint(br)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if h := c.Get(fileNum, offset); h.Get() != nil {
+			h.Release()
+			continue
+		}
+		if _, ok := offsets[fileNum]; !ok {
+			fileNums = append(fileNums, fileNum)
+		}
+		offsets[fileNum] = append(offsets[fileNum], offset)
+	}
+
+	for _, fileNum := range fileNums {
+		l := loaders(fileNum)
+		if l == nil {
+			continue
+		}
+		if err := l.LoadBlocks(offsets[fileNum]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1079,3 +1079,85 @@ func TestCompactionAllowZeroSeqNum(t *testing.T) {
 			}
 		})
 }
+
+func TestBuildTable(t *testing.T) {
+	mem := vfs.NewMem()
+	build := func(iter sstable.InternalIterator) (*sstable.Reader, error) {
+		f, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, LevelOptions{})
+		if err := sstable.BuildTable(w, iter); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		f, err = mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sstable.NewReader(f, 0, nil), nil
+	}
+	collect := func(iter internalIterator) string {
+		var buf bytes.Buffer
+		for key, value := iter.First(); key != nil; key, value = iter.Next() {
+			if buf.Len() > 0 {
+				buf.WriteString(" ")
+			}
+			fmt.Fprintf(&buf, "%s#%d,%s", key.UserKey, key.SeqNum(), key.Kind())
+			if key.Kind() == InternalKeyKindRangeDelete {
+				fmt.Fprintf(&buf, "-%s", value)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	t.Run("points", func(t *testing.T) {
+		r, err := build(newFakeIterator(nil, "a:3", "a:2", "b:1", "c:4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		expected := "a#3,SET a#2,SET b#1,SET c#4,SET"
+		if v := collect(r.NewIter(nil, nil)); v != expected {
+			t.Fatalf("expected %s, but found %s", expected, v)
+		}
+	})
+
+	t.Run("range-deletions", func(t *testing.T) {
+		iter := &fakeIter{}
+		for _, kv := range []string{
+			"a.RANGEDEL.5:d", "b.SET.4:", "b.RANGEDEL.3:f", "c.SET.2:",
+		} {
+			j := strings.Index(kv, ":")
+			iter.keys = append(iter.keys, base.ParseInternalKey(kv[:j]))
+			iter.vals = append(iter.vals, []byte(kv[j+1:]))
+		}
+		r, err := build(iter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		expected := "b#4,SET c#2,SET"
+		if v := collect(r.NewIter(nil, nil)); v != expected {
+			t.Fatalf("expected %s, but found %s", expected, v)
+		}
+		// The overlapping tombstones are fragmented.
+		expected = "a#5,RANGEDEL-b b#5,RANGEDEL-d b#3,RANGEDEL-d d#3,RANGEDEL-f"
+		if v := collect(r.NewRangeDelIter()); v != expected {
+			t.Fatalf("expected %s, but found %s", expected, v)
+		}
+	})
+
+	t.Run("out-of-order", func(t *testing.T) {
+		_, err := build(newFakeIterator(nil, "a:1", "c:1", "b:1"))
+		if err == nil || !strings.Contains(err.Error(), "keys must be added in order") {
+			t.Fatalf("expected out of order error, but found %v", err)
+		}
+	})
+}
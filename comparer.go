@@ -24,6 +24,12 @@ type Successor = base.Successor
 // Split exports the base.Split type.
 type Split = base.Split
 
+// CompressKey exports the base.CompressKey type.
+type CompressKey = base.CompressKey
+
+// DecompressKey exports the base.DecompressKey type.
+type DecompressKey = base.DecompressKey
+
 // Comparer exports the base.Comparer type.
 type Comparer = base.Comparer
 
@@ -554,6 +554,7 @@ func (d *DB) newIterInternal(
 
 	buf.merging.init(d.cmp, iters...)
 	buf.merging.snapshot = seqNum
+	buf.merging.excluded = dbi.opts.ExcludedSeqNums
 	dbi.iter = &buf.merging
 	return dbi
 }
@@ -10,9 +10,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -506,6 +508,81 @@ func TestGetMerge(t *testing.T) {
 	}
 }
 
+func TestIterExcludedSeqNums(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Merge the operands 1 through 6 into the same key, recording the sequence
+	// number of each operand. The first three operands are flushed to an
+	// sstable. A snapshot is taken after each operand to prevent the flush from
+	// combining them.
+	key := []byte("a")
+	seqNums := make(map[string]uint64)
+	var snapshots []*Snapshot
+	for i := 1; i <= 6; i++ {
+		val := strconv.Itoa(i)
+		if err := d.Merge(key, []byte(val), nil); err != nil {
+			t.Fatal(err)
+		}
+		seqNums[val] = atomic.LoadUint64(&d.mu.versions.visibleSeqNum) - 1
+		snapshots = append(snapshots, d.NewSnapshot())
+		if i == 3 {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	testCases := []struct {
+		excluded [][2]string
+		expected string
+	}{
+		{nil, "123456"},
+		{[][2]string{{"2", "2"}}, "13456"},
+		{[][2]string{{"1", "2"}, {"4", "5"}}, "36"},
+		{[][2]string{{"2", "4"}, {"6", "6"}}, "15"},
+		{[][2]string{{"1", "6"}}, ""},
+	}
+	for _, c := range testCases {
+		// The excluded ranges are specified as inclusive operand ranges.
+		var excluded []SeqNumRange
+		for _, r := range c.excluded {
+			excluded = append(excluded, SeqNumRange{
+				Start: seqNums[r[0]],
+				End:   seqNums[r[1]] + 1,
+			})
+		}
+		iter := d.NewIter(&IterOptions{ExcludedSeqNums: excluded})
+		// NB: the operands are sorted as only the set of surviving operands is
+		// of interest.
+		var result string
+		if iter.First() {
+			b := append([]byte(nil), iter.Value()...)
+			sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+			result = string(b)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if c.expected != result {
+			t.Fatalf("%v: expected %q, but found %q", c.excluded, c.expected, result)
+		}
+	}
+
+	for _, s := range snapshots {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestIterLeak(t *testing.T) {
 	for _, leak := range []bool{true, false} {
 		t.Run(fmt.Sprintf("leak=%t", leak), func(t *testing.T) {
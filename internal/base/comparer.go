@@ -86,6 +86,20 @@ type Successor func(dst, a []byte) []byte
 // 4) if b begins with a, then prefix(b) = prefix(a).
 type Split func(a []byte) int
 
+// CompressKey appends a compressed encoding of the user key to dst and returns
+// the result. It is used by the sstable Writer to shrink the keys stored in
+// data blocks. The keys are decompressed when a data block is loaded, so
+// Compare and the other Comparer functions only ever see decompressed keys.
+// The encoding is required to be order-preserving: for keys a and b,
+// Compare(a, b) < 0 iff bytes.Compare(CompressKey(a), CompressKey(b)) < 0.
+// This keeps the encoded entries of a block in order, and allows the prefix
+// compression of a block to share the common prefixes of compressed keys.
+type CompressKey func(dst, key []byte) []byte
+
+// DecompressKey appends the user key encoded by CompressKey to dst and returns
+// the result, or an error if the encoding is invalid.
+type DecompressKey func(dst, key []byte) ([]byte, error)
+
 // Comparer defines a total ordering over the space of []byte keys: a 'less
 // than' relationship.
 type Comparer struct {
@@ -96,6 +110,13 @@ type Comparer struct {
 	Split          Split
 	Successor      Successor
 
+	// CompressKey and DecompressKey are optional. If both are specified, the
+	// keys in the data blocks of an sstable are compressed using CompressKey
+	// when the table is written, and decompressed using DecompressKey when the
+	// table is read.
+	CompressKey   CompressKey
+	DecompressKey DecompressKey
+
 	// Name is the name of the comparer.
 	//
 	// The Level-DB on-disk format stores the comparer name, and opening a
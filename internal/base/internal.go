@@ -36,6 +36,15 @@ const (
 	InternalKeyKindRangeDelete = 15
 	// InternalKeyKindColumnFamilyBlobIndex                    = 16
 	// InternalKeyKindBlobIndex                                = 17
+	// InternalKeyKindSetWithDelete                            = 18
+
+	// The range key kinds use the same values as CockroachDB's Pebble. Range
+	// keys are only stored in the range-key block of an sstable, never in the
+	// data blocks, memtables or batches. The kinds are larger than
+	// InternalKeyKindMax and are not valid kinds of point keys.
+	InternalKeyKindRangeKeyDelete = 19
+	InternalKeyKindRangeKeyUnset  = 20
+	InternalKeyKindRangeKeySet    = 21
 
 	// This maximum value isn't part of the file format. It's unlikely,
 	// but future extensions may increase this value.
@@ -67,13 +76,16 @@ const (
 )
 
 var internalKeyKindNames = []string{
-	InternalKeyKindDelete:      "DEL",
-	InternalKeyKindSet:         "SET",
-	InternalKeyKindMerge:       "MERGE",
-	InternalKeyKindLogData:     "LOGDATA",
-	InternalKeyKindRangeDelete: "RANGEDEL",
-	InternalKeyKindMax:         "MAX",
-	InternalKeyKindInvalid:     "INVALID",
+	InternalKeyKindDelete:         "DEL",
+	InternalKeyKindSet:            "SET",
+	InternalKeyKindMerge:          "MERGE",
+	InternalKeyKindLogData:        "LOGDATA",
+	InternalKeyKindRangeDelete:    "RANGEDEL",
+	InternalKeyKindMax:            "MAX",
+	InternalKeyKindRangeKeyDelete: "RANGEKEYDEL",
+	InternalKeyKindRangeKeyUnset:  "RANGEKEYUNSET",
+	InternalKeyKindRangeKeySet:    "RANGEKEYSET",
+	InternalKeyKindInvalid:        "INVALID",
 }
 
 func (k InternalKeyKind) String() string {
@@ -130,12 +142,15 @@ func MakeRangeDeleteSentinelKey(userKey []byte) InternalKey {
 }
 
 var kindsMap = map[string]InternalKeyKind{
-	"DEL":      InternalKeyKindDelete,
-	"RANGEDEL": InternalKeyKindRangeDelete,
-	"SET":      InternalKeyKindSet,
-	"MERGE":    InternalKeyKindMerge,
-	"INVALID":  InternalKeyKindInvalid,
-	"MAX":      InternalKeyKindMax,
+	"DEL":           InternalKeyKindDelete,
+	"RANGEDEL":      InternalKeyKindRangeDelete,
+	"SET":           InternalKeyKindSet,
+	"MERGE":         InternalKeyKindMerge,
+	"INVALID":       InternalKeyKindInvalid,
+	"MAX":           InternalKeyKindMax,
+	"RANGEKEYDEL":   InternalKeyKindRangeKeyDelete,
+	"RANGEKEYUNSET": InternalKeyKindRangeKeyUnset,
+	"RANGEKEYSET":   InternalKeyKindRangeKeySet,
 }
 
 // ParseInternalKey parses the string representation of an internal key. The
@@ -40,6 +40,9 @@ func TestInvalidInternalKey(t *testing.T) {
 		"foo",
 		"foo\x08\x07\x06\x05\x04\x03\x02",
 		"foo\x12\x07\x06\x05\x04\x03\x02\x01",
+		// The range key kinds are not valid kinds of point keys.
+		"foo\x13\x07\x06\x05\x04\x03\x02\x01",
+		"foo\x15\x07\x06\x05\x04\x03\x02\x01",
 	}
 	for _, tc := range testCases {
 		k := DecodeInternalKey([]byte(tc))
@@ -20,6 +20,7 @@ const (
 	DefaultCompression Compression = iota
 	NoCompression
 	SnappyCompression
+	ZstdCompression
 	nCompression
 )
 
@@ -31,6 +32,31 @@ func (c Compression) String() string {
 		return "NoCompression"
 	case SnappyCompression:
 		return "Snappy"
+	case ZstdCompression:
+		return "ZSTD"
+	default:
+		return "Unknown"
+	}
+}
+
+// ChecksumType is the per-block checksum algorithm to use.
+type ChecksumType int
+
+const (
+	DefaultChecksum ChecksumType = iota
+	CRC32cChecksum
+	XXHash64Checksum
+	nChecksumType
+)
+
+func (c ChecksumType) String() string {
+	switch c {
+	case DefaultChecksum:
+		return "Default"
+	case CRC32cChecksum:
+		return "CRC32c"
+	case XXHash64Checksum:
+		return "XXHash64"
 	default:
 		return "Unknown"
 	}
@@ -129,8 +155,63 @@ type TablePropertyCollector interface {
 	Name() string
 }
 
+// BlockCipher encrypts and authenticates the blocks of sstables for encryption
+// at rest. The blocks of each sstable are encrypted by the TableCipher returned
+// by ForTable for a random salt, which is generated when the sstable is written
+// and stored unencrypted at the start of the sstable. Each sstable is therefore
+// encrypted differently even though the same BlockCipher is used for every
+// sstable.
+type BlockCipher interface {
+	// SaltLen returns the length of the salt passed to ForTable.
+	SaltLen() int
+
+	// ForTable returns the TableCipher which encrypts the blocks of the sstable
+	// with the specified salt.
+	ForTable(salt []byte) (TableCipher, error)
+}
+
+// TableCipher encrypts and authenticates the blocks of a single sstable. A
+// block is sealed after it has been compressed, and opened after it has been
+// read and before it is decompressed. The block checksum covers the sealed
+// block.
+type TableCipher interface {
+	// Overhead returns the number of bytes added to a block by Seal.
+	Overhead() int
+
+	// Seal encrypts and authenticates block, which will be stored at the
+	// specified offset within the sstable, appending the result to dst and
+	// returning the updated slice.
+	Seal(dst, block []byte, offset uint64) []byte
+
+	// Open authenticates and decrypts a block sealed by Seal and stored at the
+	// specified offset within the sstable, appending the result to dst and
+	// returning the updated slice. An error is returned if the block fails
+	// authentication.
+	Open(dst, sealed []byte, offset uint64) ([]byte, error)
+}
+
 // LevelOptions holds the optional per-level parameters.
 type LevelOptions struct {
+	// BackgroundFilter builds the filter block on a background goroutine
+	// concurrently with the writing of data blocks, rather than hashing each
+	// key into the filter on the caller's goroutine. The keys are copied and
+	// handed to the background goroutine in batches, and the filter is joined
+	// when the table is closed. The table written is identical to the one
+	// written without this option. The FilterWriter must not retain the keys
+	// passed to AddKey. Has no effect if FilterPolicy is nil.
+	//
+	// The default value is false.
+	BackgroundFilter bool
+
+	// BlockKeyRanges enables writing a meta block which records the exact
+	// smallest and largest user keys of each data block. The keys of the index
+	// block are separators which only bound the keys of the blocks, so tools
+	// requiring the exact range of each block read the meta block instead (see
+	// sstable.Reader.BlockKeyRanges).
+	//
+	// The default value is false.
+	BlockKeyRanges bool
+
 	// BlockRestartInterval is the number of keys between restart points
 	// for delta encoding of keys.
 	//
@@ -149,11 +230,41 @@ type LevelOptions struct {
 	// The default value is 90
 	BlockSizeThreshold int
 
+	// ChecksumType defines the per-block checksum to use, which is verified
+	// whenever a block is read. XXHash64Checksum is cheaper to verify than
+	// CRC32cChecksum, which matters for large scans, but is only supported by
+	// the RocksDB table format. As with RocksDB's kxxHash64 checksum type, the
+	// lower 32 bits of the xxHash64 checksum are stored in the block trailer,
+	// so the tables can be read by RocksDB.
+	//
+	// The default value (DefaultChecksum) uses CRC32c checksums.
+	ChecksumType ChecksumType
+
 	// Compression defines the per-block compression to use.
 	//
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
 
+	// DisableSyncOnClose stops the sstable Writer from syncing the underlying
+	// file after the footer has been written. By default the table is durable
+	// once Close returns, and an error from the sync is returned from Close.
+	// When set, the caller is responsible for syncing the file.
+	//
+	// The default value is false.
+	DisableSyncOnClose bool
+
+	// FilterEmbedThreshold is the size in bytes below which the filter of a
+	// table is embedded in the index block rather than written as a separate
+	// meta block. The filter is embedded if the filter and the index together
+	// are smaller than the threshold. For small tables this avoids the
+	// overhead of the separate filter block and its metaindex entry, and a
+	// single block read serves both the index and the filter. A table with an
+	// embedded filter cannot be read by RocksDB. Has no effect if FilterPolicy
+	// is nil.
+	//
+	// The default value is 0, which never embeds the filter.
+	FilterEmbedThreshold int
+
 	// FilterPolicy defines a filter algorithm (such as a Bloom filter) that can
 	// reduce disk reads for Get calls.
 	//
@@ -172,8 +283,116 @@ type LevelOptions struct {
 	// filters should be preferred except under constrained memory situations.
 	FilterType FilterType
 
+	// FooterChecksum enables writing a checksum of the metaindex and index
+	// block handles into the padding of the table footer. A Reader validates
+	// the handles against the checksum before reading the blocks they point
+	// to, failing fast on a corrupted footer rather than reading the wrong
+	// blocks. The checksum is recorded in the footer version, so the table can
+	// not be read by readers which are unaware of it. Footer checksums require
+	// the RocksDB table format.
+	//
+	// The default value is false.
+	FooterChecksum bool
+
+	// IndexBlockRestartInterval is the number of keys between restart points
+	// for delta encoding of the keys of the index block, independent of the
+	// BlockRestartInterval used for data blocks. An interval of 1 stores every
+	// separator key in full, so that a seek in the index is a binary search
+	// over restart points without any linear scan. A larger interval shrinks
+	// the index block at the expense of slower seeks.
+	//
+	// The default value is 1.
+	IndexBlockRestartInterval int
+
+	// IndexFirstKeys causes each entry of the index block to be keyed by the
+	// first key of the data blocks it covers, rather than by a separator key
+	// which is greater than or equal to the last key of those blocks. The
+	// convention is recorded in the table properties, and a Reader positions
+	// its seeks accordingly: with first keys, the blocks containing a key are
+	// found through the last index entry whose key precedes it. A first-key
+	// index allows a scan to learn the first key of a block without reading
+	// the block, at the cost of index keys which cannot be shortened.
+	//
+	// The default value is false.
+	IndexFirstKeys bool
+
+	// IndexSparsity is the number of consecutive data blocks covered by each
+	// entry of the index block. An index entry for a group of blocks holds the
+	// handles of all of the blocks in the group, but only a single separator
+	// key, which reduces the size of the index for tables with many blocks. A
+	// seek uses the index to find the group containing the key and then scans
+	// linearly across the blocks in the group, reading up to IndexSparsity
+	// blocks. A value of 1 or less writes a dense index with an entry per data
+	// block. Tables written with an IndexSparsity greater than 1 cannot be read
+	// by RocksDB.
+	//
+	// The default value is 1.
+	IndexSparsity int
+
+	// MaxKeysPerBlock is the maximum number of entries in each data block. A
+	// data block is finished once it holds MaxKeysPerBlock entries, even if it
+	// is smaller than BlockSize. This bounds the number of entries scanned
+	// within a block by a seek when the keys and values are tiny.
+	//
+	// The default value is 0, which does not limit the number of entries.
+	MaxKeysPerBlock int
+
+	// MinCompressionRatio is the minimum ratio of the uncompressed size to the
+	// compressed size of the first few data blocks of a table below which the
+	// sstable Writer stops compressing blocks. The remaining blocks of such a
+	// table are stored uncompressed, avoiding the cost of decompressing blocks
+	// which barely compress, such as blocks of encrypted values, on every
+	// read. The fallback is recorded in the table properties. Has no effect if
+	// Compression is NoCompression.
+	//
+	// The default value is 0, which never stops compressing blocks.
+	MinCompressionRatio float64
+
+	// PrefixMapThreshold is the maximum number of distinct key prefixes, as
+	// determined by Comparer.Split, for which the sstable Writer records a map
+	// from each prefix to the range of index entries containing the keys with
+	// that prefix. The map is stored in a meta block and lets SeekPrefixGE
+	// reject a prefix which is absent from the table without consulting the
+	// filter or the index, and position the index directly when the keys with
+	// a prefix lie within a single index entry. The map is not written if the
+	// table contains more distinct prefixes than the threshold, if the
+	// Comparer has no Split function, or if IndexBlockRestartInterval is
+	// greater than 1.
+	//
+	// The default value is 0, which disables the map.
+	PrefixMapThreshold int
+
+	// RecordLargestValueSize causes the sstable Writer to record the length of
+	// the largest value of a point entry in the table properties, where it can
+	// be used by a reader to size its value buffers. The Writer tracks the
+	// length in its metadata regardless. The property is not recorded by
+	// default so that the properties of a table written with the default
+	// options match those of the same table written by RocksDB.
+	//
+	// The default value is false.
+	RecordLargestValueSize bool
+
+	// TablePropertyCollectors is a list of TablePropertyCollector creation
+	// functions, which are used in addition to the collectors of
+	// Options.TablePropertyCollectors. Each collector adds its properties to a
+	// separate map, and the maps are merged into the user properties of the
+	// table. Writing the table fails if two collectors add the same property.
+	//
+	// The default value is nil.
+	TablePropertyCollectors []func() TablePropertyCollector
+
 	// The target file size for the level.
 	TargetFileSize int64
+
+	// UserKeyIndex enables writing an additional index block which maps the
+	// first user key of each data block to the block's handle. Point lookups
+	// use this index to locate the data block for a key by binary searching
+	// user keys, avoiding the decoding of internal key trailers. The regular
+	// index is still written, so tables remain readable by readers unaware of
+	// the user-key index.
+	//
+	// The default value is false.
+	UserKeyIndex bool
 }
 
 // EnsureDefaults ensures that the default values for all of the options have
@@ -192,9 +411,18 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	if o.BlockSizeThreshold <= 0 {
 		o.BlockSizeThreshold = 90
 	}
+	if o.ChecksumType <= DefaultChecksum || o.ChecksumType >= nChecksumType {
+		o.ChecksumType = CRC32cChecksum
+	}
 	if o.Compression <= DefaultCompression || o.Compression >= nCompression {
 		o.Compression = SnappyCompression
 	}
+	if o.IndexBlockRestartInterval <= 0 {
+		o.IndexBlockRestartInterval = 1
+	}
+	if o.IndexSparsity <= 0 {
+		o.IndexSparsity = 1
+	}
 	if o.TargetFileSize <= 0 {
 		o.TargetFileSize = 2 << 20 // 2 MB
 	}
@@ -205,6 +433,25 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 // apply to the DB at large; per-query options are defined by the IterOptions
 // and WriteOptions types.
 type Options struct {
+	// BlockCipher, if non-nil, encrypts the blocks of the sstables written and
+	// decrypts the blocks of the sstables read. Every block of an sstable is
+	// encrypted, so an sstable written with a BlockCipher can only be read with
+	// an equivalent BlockCipher.
+	//
+	// The default value is nil.
+	BlockCipher BlockCipher
+
+	// BufferPool, if non-nil, is the pool from which sstable Readers allocate
+	// the buffers used to read, decrypt and decompress blocks. The scratch
+	// buffers holding a block as stored in the sstable are returned to the pool
+	// as soon as the block has been decoded. Sharing a BufferPool between many
+	// Readers reduces the memory allocated by workloads reading compressed or
+	// encrypted blocks from many sstables. If nil, the buffers are allocated
+	// from the Cache.
+	//
+	// The default value is nil.
+	BufferPool *cache.BufferPool
+
 	// Sync sstables and the WAL periodically in order to smooth out writes to
 	// disk. This option does not provide any persistency guarantee, but is used
 	// to avoid latency spikes if the OS automatically decides to write out a
@@ -213,6 +460,10 @@ type Options struct {
 	// The default value is 512KB.
 	BytesPerSync int
 
+	// Cache is used to cache the blocks of sstables. The replacement policy is
+	// selected by the constructor used to create the cache: cache.New uses
+	// CLOCK-Pro, while cache.NewClock uses CLOCK.
+	//
 	// TODO(peter): provide a cache interface.
 	Cache *cache.Cache
 
@@ -267,6 +518,15 @@ type Options struct {
 	// The default logger uses the Go standard library log package.
 	Logger Logger
 
+	// MaxBlockSize is the maximum size of a block an sstable Reader will
+	// allocate a buffer for, both for the block as stored and for its
+	// decompressed contents. A block handle or compressed block header
+	// claiming a larger size is treated as corruption rather than risking a
+	// huge allocation. Zero or a negative value disables the limit.
+	//
+	// The default value is 0.
+	MaxBlockSize int
+
 	// MaxManifestFileSize is the maximum size the MANIFEST file is allowed to
 	// become. When the MANIFEST exceeds this size it is rolled over and a new
 	// MANIFEST is created.
@@ -300,6 +560,38 @@ type Options struct {
 	// default is 4 MB/s.
 	MinFlushRate int
 
+	// ReadaheadSize is the number of bytes read from an sstable when an
+	// iterator performs readahead. A larger readahead reduces the number of
+	// reads issued by scans at the expense of reading data which may not be
+	// needed.
+	//
+	// The default value is 256KB.
+	ReadaheadSize int
+
+	// ReadaheadThreshold is the number of data blocks an sstable iterator must
+	// load consecutively in sequential order, such as when stepping through a
+	// table with Next, before it begins to perform readahead. Seeking the
+	// iterator disables readahead until sequential access is detected again.
+	// This avoids wasting I/O on point lookups while accelerating scans. A
+	// negative value disables readahead.
+	//
+	// The default value is 2.
+	ReadaheadThreshold int
+
+	// StreamingDecompressionThreshold is the decompressed size above which an
+	// sstable Reader decompresses a zlib or zstd compressed block in fixed-size
+	// chunks, allocating the buffer for the decompressed block only once the
+	// block has been decompressed. Below the threshold, the buffer is allocated
+	// up front using the size recorded in the block header. Chunked
+	// decompression bounds the memory committed to a block to the amount of
+	// data it actually decompresses to, rather than trusting a header which may
+	// be corrupt. Snappy compressed blocks cannot be decompressed incrementally
+	// and are unaffected. Zero or a negative value disables chunked
+	// decompression.
+	//
+	// The default value is 0.
+	StreamingDecompressionThreshold int
+
 	// TableFormat specifies the format version for sstables. The default is
 	// TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
@@ -380,6 +672,12 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.MinFlushRate == 0 {
 		o.MinFlushRate = 4 << 20 // 4 MB/s
 	}
+	if o.ReadaheadSize <= 0 {
+		o.ReadaheadSize = 256 << 10 // 256 KB
+	}
+	if o.ReadaheadThreshold == 0 {
+		o.ReadaheadThreshold = 2
+	}
 	if o.FS == nil {
 		o.FS = vfs.Default
 	}
@@ -0,0 +1,163 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package xxhash implements the 64-bit variant of the xxHash algorithm with a
+// seed of zero, as used for block checksums by tables using the xxHash64
+// checksum type.
+//
+// To calculate the uint64 checksum of some data:
+//	var u uint64 = xxhash.Sum64(data)
+// In pebble, as in RocksDB, the lower 32 bits of the value are then stored in
+// little-endian format in the block trailer.
+package xxhash // import "github.com/petermattis/pebble/internal/xxhash"
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The primes are variables rather than constants so that the arithmetic on
+// them wraps around rather than overflowing at compile time.
+var (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// Digest incrementally computes the xxHash64 checksum of the data written to
+// it. The zero value is not ready to use; see New.
+type Digest struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	n              int // number of buffered bytes in mem
+}
+
+// New returns a new Digest.
+func New() *Digest {
+	d := &Digest{}
+	d.Reset()
+	return d
+}
+
+// Reset clears the state of the Digest.
+func (d *Digest) Reset() {
+	d.v1 = prime1 + prime2
+	d.v2 = prime2
+	d.v3 = 0
+	d.v4 = -prime1
+	d.total = 0
+	d.n = 0
+}
+
+// Write adds b to the data being checksummed. It never returns an error.
+func (d *Digest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+
+	if d.n+n < 32 {
+		d.n += copy(d.mem[d.n:], b)
+		return n, nil
+	}
+
+	if d.n > 0 {
+		c := copy(d.mem[d.n:], b)
+		d.v1 = round(d.v1, binary.LittleEndian.Uint64(d.mem[0:8]))
+		d.v2 = round(d.v2, binary.LittleEndian.Uint64(d.mem[8:16]))
+		d.v3 = round(d.v3, binary.LittleEndian.Uint64(d.mem[16:24]))
+		d.v4 = round(d.v4, binary.LittleEndian.Uint64(d.mem[24:32]))
+		b = b[c:]
+		d.n = 0
+	}
+
+	for ; len(b) >= 32; b = b[32:] {
+		d.v1 = round(d.v1, binary.LittleEndian.Uint64(b[0:8]))
+		d.v2 = round(d.v2, binary.LittleEndian.Uint64(b[8:16]))
+		d.v3 = round(d.v3, binary.LittleEndian.Uint64(b[16:24]))
+		d.v4 = round(d.v4, binary.LittleEndian.Uint64(b[24:32]))
+	}
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+// Sum64 returns the checksum of the data written so far.
+func (d *Digest) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		h = bits.RotateLeft64(d.v1, 1) + bits.RotateLeft64(d.v2, 7) +
+			bits.RotateLeft64(d.v3, 12) + bits.RotateLeft64(d.v4, 18)
+		h = mergeRound(h, d.v1)
+		h = mergeRound(h, d.v2)
+		h = mergeRound(h, d.v3)
+		h = mergeRound(h, d.v4)
+	} else {
+		h = d.v3 + prime5
+	}
+	h += d.total
+	return finalize(h, d.mem[:d.n])
+}
+
+// Sum64 returns the xxHash64 checksum of b.
+func Sum64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1 := prime1 + prime2
+		v2 := prime2
+		v3 := uint64(0)
+		v4 := -prime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = round(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = round(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = round(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = round(v4, binary.LittleEndian.Uint64(b[24:32]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = mergeRound(h, v1)
+		h = mergeRound(h, v2)
+		h = mergeRound(h, v3)
+		h = mergeRound(h, v4)
+	} else {
+		h = prime5
+	}
+	h += uint64(n)
+	return finalize(h, b)
+}
+
+// finalize mixes the remaining fewer than 32 bytes of input b into h.
+func finalize(h uint64, b []byte) uint64 {
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
+
+func round(acc, input uint64) uint64 {
+	acc += input * prime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime1
+}
+
+func mergeRound(acc, val uint64) uint64 {
+	acc ^= round(0, val)
+	return acc*prime1 + prime4
+}
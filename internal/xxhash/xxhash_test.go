@@ -0,0 +1,49 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package xxhash
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSum64(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+	for _, c := range testCases {
+		if v := Sum64([]byte(c.in)); v != c.expected {
+			t.Errorf("%q: expected %016x, but found %016x", c.in, c.expected, v)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	data := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 10))
+	for n := 0; n <= len(data); n += 7 {
+		expected := Sum64(data[:n])
+		// Write the data in chunks of varying sizes.
+		for chunk := 1; chunk <= 40; chunk += 13 {
+			d := New()
+			for b := data[:n]; len(b) > 0; {
+				c := chunk
+				if c > len(b) {
+					c = len(b)
+				}
+				d.Write(b[:c])
+				b = b[c:]
+			}
+			if v := d.Sum64(); v != expected {
+				t.Fatalf("n=%d chunk=%d: expected %016x, but found %016x", n, chunk, expected, v)
+			}
+		}
+	}
+}
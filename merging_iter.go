@@ -7,6 +7,7 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"sort"
 
 	"github.com/petermattis/pebble/internal/base"
 	"github.com/petermattis/pebble/internal/rangedel"
@@ -178,12 +179,35 @@ import (
 type mergingIter struct {
 	dir             int
 	snapshot        uint64
+	excluded        []SeqNumRange
 	iters           []internalIterator
 	rangeDelIters   []internalIterator
 	largestUserKeys [][]byte
 	heap            mergingIterHeap
 	err             error
 	prefix          []byte
+
+	// seekState holds, for each level, the key the level's iterator was last
+	// positioned at by SeekGE. See canSkipSeekGE.
+	seekState []mergingIterSeekState
+
+	// State for Peek. When peeked is true the underlying iterators have been
+	// advanced to peekKey, and cur and curValue hold a copy of the entry the
+	// merging iterator is logically positioned at.
+	peeked    bool
+	peekKey   *InternalKey
+	peekValue []byte
+	cur       InternalKey
+	curValue  []byte
+	curBuf    []byte
+}
+
+// mergingIterSeekState records the key passed to the last SeekGE of a level's
+// iterator. The state is only valid until the iterator is moved by another
+// operation.
+type mergingIterSeekState struct {
+	key   []byte
+	valid bool
 }
 
 // mergingIter implements the internalIterator interface.
@@ -206,11 +230,162 @@ func newMergingIter(cmp Compare, iters ...internalIterator) *mergingIter {
 func (m *mergingIter) init(cmp Compare, iters ...internalIterator) {
 	m.snapshot = InternalKeySeqNumMax
 	m.iters = iters
+	m.seekState = make([]mergingIterSeekState, len(iters))
 	m.heap.cmp = cmp
 	m.heap.items = make([]mergingIterItem, 0, len(iters))
 	m.initMinHeap()
 }
 
+// AddIterator adds iter to the set of iterators being merged. The iterator is
+// added as the lowest level, below any existing levels, and thus the range
+// tombstones of the existing levels apply to its entries. If the merging
+// iterator is positioned, iter is positioned so that the entries of iter which
+// the merging iterator has not yet passed in the current direction are
+// surfaced by subsequent calls to Next (or Prev), leaving the current position
+// of the merging iterator unchanged. If the merging iterator is not
+// positioned, iter is positioned by the next positioning operation.
+func (m *mergingIter) AddIterator(iter internalIterator) {
+	m.unpeek()
+	// NB: the slices are copied on modification as they may be shared with the
+	// creator of the merging iterator.
+	level := len(m.iters)
+	m.iters = append(m.iters[:level:level], iter)
+	m.seekState = append(m.seekState, mergingIterSeekState{})
+	if m.rangeDelIters != nil {
+		m.rangeDelIters = append(m.rangeDelIters[:level:level], nil)
+	}
+	if m.largestUserKeys != nil {
+		m.largestUserKeys = append(m.largestUserKeys[:level:level], nil)
+	}
+	if m.heap.len() == 0 {
+		return
+	}
+
+	cur := m.heap.items[0].key
+	var key *InternalKey
+	var value []byte
+	if m.prefix != nil {
+		key, value = iter.SeekPrefixGE(m.prefix, cur.UserKey)
+	} else {
+		key, value = iter.SeekGE(cur.UserKey)
+	}
+	if m.dir == 1 {
+		// Skip past the entries which are less than or equal to the current key.
+		for ; key != nil; key, value = iter.Next() {
+			if base.InternalCompare(m.heap.cmp, cur, *key) < 0 {
+				break
+			}
+		}
+	} else {
+		// Find the first entry which is greater than or equal to the current key
+		// and step back to the entry before it.
+		for ; key != nil; key, value = iter.Next() {
+			if base.InternalCompare(m.heap.cmp, cur, *key) <= 0 {
+				break
+			}
+		}
+		if key != nil {
+			key, value = iter.Prev()
+		} else {
+			key, value = iter.Last()
+		}
+	}
+	if key == nil {
+		m.err = iter.Error()
+		return
+	}
+	m.heap.push(mergingIterItem{
+		index: level,
+		key:   *key,
+		value: value,
+	})
+}
+
+// RemoveIterator removes iter from the set of iterators being merged, dropping
+// its remaining entries. If the merging iterator is positioned at an entry of
+// iter, it is moved to the next entry in the current direction which is visible
+// and not deleted by a range tombstone. The removed
+// iterator, and the range deletion iterator for its level if any, are not
+// closed.
+func (m *mergingIter) RemoveIterator(iter internalIterator) {
+	m.unpeek()
+	level := -1
+	for i := range m.iters {
+		if m.iters[i] == iter {
+			level = i
+			break
+		}
+	}
+	if level == -1 {
+		return
+	}
+
+	// NB: the slices are copied as they may be shared with the creator of the
+	// merging iterator.
+	m.iters = append(m.iters[:level:level], m.iters[level+1:]...)
+	m.seekState = append(m.seekState[:level], m.seekState[level+1:]...)
+	if m.rangeDelIters != nil {
+		m.rangeDelIters = append(m.rangeDelIters[:level:level], m.rangeDelIters[level+1:]...)
+	}
+	if m.largestUserKeys != nil {
+		m.largestUserKeys = append(m.largestUserKeys[:level:level], m.largestUserKeys[level+1:]...)
+	}
+	wasTop := m.heap.len() > 0 && m.heap.items[0].index == level
+	for i := range m.heap.items {
+		if m.heap.items[i].index == level {
+			m.heap.remove(i)
+			break
+		}
+	}
+	for i := range m.heap.items {
+		if m.heap.items[i].index > level {
+			m.heap.items[i].index--
+		}
+	}
+	if !wasTop || m.heap.len() == 0 {
+		return
+	}
+
+	// The new top of the heap has not been checked against the snapshot, the
+	// excluded sequence numbers or the range tombstones, so reposition the
+	// range-del iterators for it and skip forward (or backward) to the next
+	// entry which is returned.
+	if m.dir == 1 {
+		m.initMinRangeDelIters(-1)
+		m.findNextEntry()
+	} else {
+		m.initMaxRangeDelIters(-1)
+		m.findPrevEntry()
+	}
+}
+
+// resetSeekState forgets the keys passed to the last SeekGE of every level,
+// forcing the next SeekGE to seek every level. It must be called whenever the
+// iterators of the levels are moved other than by seekGE or nextEntry.
+func (m *mergingIter) resetSeekState() {
+	for i := range m.seekState {
+		m.seekState[i].valid = false
+	}
+}
+
+// canSkipSeekGE returns true if seeking the iterator at the specified level to
+// key would leave it at its current position. This is the case when the
+// iterator was last positioned by a SeekGE to a key less than or equal to key,
+// and is positioned at a key which is greater than or equal to key, or is
+// exhausted. A forward scan performed using SeekGE with increasing keys thus
+// only seeks the levels which the scan has moved past.
+func (m *mergingIter) canSkipSeekGE(level int, key []byte) bool {
+	s := &m.seekState[level]
+	if !s.valid || m.heap.cmp(s.key, key) > 0 {
+		return false
+	}
+	iter := m.iters[level]
+	if !iter.Valid() {
+		return iter.Error() == nil
+	}
+	return m.heap.cmp(key, iter.Key().UserKey) <= 0
+}
+
 func (m *mergingIter) initHeap() {
 	m.heap.items = m.heap.items[:0]
 	for i, t := range m.iters {
@@ -286,6 +461,7 @@ func (m *mergingIter) switchToMinHeap() {
 	// The current key is a:2 and i2 is pointed at a:1. When we switch to forward
 	// iteration, we want to return a key that is greater than a:2.
 
+	m.resetSeekState()
 	key := m.heap.items[0].key
 	cur := m.iters[m.heap.items[0].index]
 
@@ -327,6 +503,7 @@ func (m *mergingIter) switchToMaxHeap() {
 	//
 	// The current key is b:2 and i2 is pointing at b:1. When we switch to
 	// reverse iteration, we want to return a key that is less than b:2.
+	m.resetSeekState()
 	key := m.heap.items[0].key
 	cur := m.iters[m.heap.items[0].index]
 
@@ -355,6 +532,7 @@ func (m *mergingIter) switchToMaxHeap() {
 
 func (m *mergingIter) nextEntry(item *mergingIterItem) {
 	oldTopLevel := item.index
+	m.seekState[item.index].valid = false
 	iter := m.iters[item.index]
 	if key, value := iter.Next(); key != nil {
 		item.key, item.value = *key, value
@@ -407,13 +585,29 @@ func (m *mergingIter) isNextEntryDeleted(item *mergingIterItem) bool {
 	return false
 }
 
+// visible returns true if key is visible at the snapshot of the iterator and
+// its sequence number does not fall within one of the excluded ranges.
+func (m *mergingIter) visible(key *InternalKey) bool {
+	if !key.Visible(m.snapshot) {
+		return false
+	}
+	if len(m.excluded) == 0 {
+		return true
+	}
+	seqNum := key.SeqNum()
+	i := sort.Search(len(m.excluded), func(i int) bool {
+		return seqNum < m.excluded[i].End
+	})
+	return i == len(m.excluded) || seqNum < m.excluded[i].Start
+}
+
 func (m *mergingIter) findNextEntry() (*InternalKey, []byte) {
 	for m.heap.len() > 0 && m.err == nil {
 		item := &m.heap.items[0]
 		if m.rangeDelIters != nil && m.isNextEntryDeleted(item) {
 			continue
 		}
-		if item.key.Visible(m.snapshot) {
+		if m.visible(&item.key) {
 			return &item.key, item.value
 		}
 		m.nextEntry(item)
@@ -481,7 +675,7 @@ func (m *mergingIter) findPrevEntry() (*InternalKey, []byte) {
 		if m.rangeDelIters != nil && m.isPrevEntryDeleted(item) {
 			continue
 		}
-		if item.key.Visible(m.snapshot) {
+		if m.visible(&item.key) {
 			return &item.key, item.value
 		}
 		m.prevEntry(item)
@@ -513,10 +707,13 @@ func (m *mergingIter) seekGE(key []byte, level int) {
 
 	for ; level < len(m.iters); level++ {
 		iter := m.iters[level]
-		if m.prefix != nil {
+		if s := &m.seekState[level]; m.prefix != nil {
 			iter.SeekPrefixGE(m.prefix, key)
-		} else {
+			s.valid = false
+		} else if !m.canSkipSeekGE(level, key) {
 			iter.SeekGE(key)
+			s.key = append(s.key[:0], key...)
+			s.valid = true
 		}
 
 		if m.rangeDelIters != nil {
@@ -540,12 +737,14 @@ func (m *mergingIter) seekGE(key []byte, level int) {
 }
 
 func (m *mergingIter) SeekGE(key []byte) (*InternalKey, []byte) {
+	m.peeked = false
 	m.prefix = nil
 	m.seekGE(key, 0 /* start level */)
 	return m.findNextEntry()
 }
 
 func (m *mergingIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
+	m.peeked = false
 	m.prefix = prefix
 	m.seekGE(key, 0 /* start level */)
 	return m.findNextEntry()
@@ -555,6 +754,7 @@ func (m *mergingIter) seekLT(key []byte, level int) {
 	// See the comment in seekLT regarding using tombstones to adjust the seek
 	// target per level.
 	m.prefix = nil
+	m.resetSeekState()
 	for ; level < len(m.iters); level++ {
 		m.iters[level].SeekLT(key)
 
@@ -574,14 +774,17 @@ func (m *mergingIter) seekLT(key []byte, level int) {
 }
 
 func (m *mergingIter) SeekLT(key []byte) (*InternalKey, []byte) {
+	m.peeked = false
 	m.prefix = nil
 	m.seekLT(key, 0 /* start level */)
 	return m.findPrevEntry()
 }
 
 func (m *mergingIter) First() (*InternalKey, []byte) {
+	m.peeked = false
 	m.prefix = nil
 	m.heap.items = m.heap.items[:0]
+	m.resetSeekState()
 	for _, t := range m.iters {
 		// TODO(peter): save key and value so we don't have to access t.Key() and
 		// t.Value() in initHeap().
@@ -592,7 +795,9 @@ func (m *mergingIter) First() (*InternalKey, []byte) {
 }
 
 func (m *mergingIter) Last() (*InternalKey, []byte) {
+	m.peeked = false
 	m.prefix = nil
+	m.resetSeekState()
 	for _, t := range m.iters {
 		// TODO(peter): save key and value so we don't have to access t.Key() and
 		// t.Value() in initHeap().
@@ -603,6 +808,10 @@ func (m *mergingIter) Last() (*InternalKey, []byte) {
 }
 
 func (m *mergingIter) Next() (*InternalKey, []byte) {
+	if m.peeked {
+		m.peeked = false
+		return m.peekKey, m.peekValue
+	}
 	if m.err != nil {
 		return nil, nil
 	}
@@ -621,6 +830,7 @@ func (m *mergingIter) Next() (*InternalKey, []byte) {
 }
 
 func (m *mergingIter) Prev() (*InternalKey, []byte) {
+	m.unpeek()
 	if m.err != nil {
 		return nil, nil
 	}
@@ -638,15 +848,86 @@ func (m *mergingIter) Prev() (*InternalKey, []byte) {
 	return m.findPrevEntry()
 }
 
+// Peek returns the entry that a subsequent call to Next would return, without
+// changing the position of the iterator: Key and Value continue to return the
+// current entry. Repeated calls to Peek return the same entry. Peek returns
+// nil if the iterator is not positioned or there is no next entry.
+//
+// Peek is intended for forward iteration. The underlying iterators are
+// advanced to the peeked entry, so a subsequent call to Prev has to step back
+// over it.
+func (m *mergingIter) Peek() (*InternalKey, []byte) {
+	if m.peeked {
+		return m.peekKey, m.peekValue
+	}
+	if !m.Valid() {
+		return nil, nil
+	}
+	// Advancing the underlying iterators may invalidate the memory backing the
+	// current key and value, so make a copy of them.
+	item := &m.heap.items[0]
+	n := len(item.key.UserKey)
+	m.curBuf = append(append(m.curBuf[:0], item.key.UserKey...), item.value...)
+	m.cur = InternalKey{UserKey: m.curBuf[:n:n], Trailer: item.key.Trailer}
+	m.curValue = m.curBuf[n:]
+	m.peekKey, m.peekValue = m.Next()
+	m.peeked = true
+	return m.peekKey, m.peekValue
+}
+
+// unpeek repositions the underlying iterators at the current entry if they
+// were advanced by Peek.
+func (m *mergingIter) unpeek() {
+	if !m.peeked {
+		return
+	}
+	m.peeked = false
+	if m.peekKey != nil {
+		m.Prev()
+	} else if m.err == nil {
+		// Peeking exhausted the iterator, which means the current entry is the
+		// last one.
+		m.Last()
+	}
+}
+
+// MinSeqNumInHeap returns the smallest sequence number among the entries at
+// which the child iterators are currently positioned, including the current
+// entry. Entries with smaller sequence numbers may still be returned by the
+// child iterators later in the iteration. During a compaction, the value can
+// be used to determine whether an older tombstone still has anything left to
+// delete. Returns InternalKeySeqNumMax if the iterator is exhausted.
+func (m *mergingIter) MinSeqNumInHeap() uint64 {
+	min := InternalKeySeqNumMax
+	if m.peeked {
+		min = m.cur.SeqNum()
+	}
+	for i := range m.heap.items {
+		if seqNum := m.heap.items[i].key.SeqNum(); seqNum < min {
+			min = seqNum
+		}
+	}
+	return min
+}
+
 func (m *mergingIter) Key() *InternalKey {
+	if m.peeked {
+		return &m.cur
+	}
 	return &m.heap.items[0].key
 }
 
 func (m *mergingIter) Value() []byte {
+	if m.peeked {
+		return m.curValue
+	}
 	return m.heap.items[0].value
 }
 
 func (m *mergingIter) Valid() bool {
+	if m.peeked {
+		return true
+	}
 	return m.heap.len() > 0 && m.err == nil
 }
 
@@ -677,6 +958,8 @@ func (m *mergingIter) Close() error {
 }
 
 func (m *mergingIter) SetBounds(lower, upper []byte) {
+	m.peeked = false
+	m.resetSeekState()
 	for _, iter := range m.iters {
 		iter.SetBounds(lower, upper)
 	}
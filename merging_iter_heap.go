@@ -53,6 +53,22 @@ func (h *mergingIterHeap) fix(i int) {
 	}
 }
 
+func (h *mergingIterHeap) push(item mergingIterItem) {
+	h.items = append(h.items, item)
+	h.up(h.len() - 1)
+}
+
+func (h *mergingIterHeap) remove(i int) {
+	n := h.len() - 1
+	if n != i {
+		h.swap(i, n)
+		h.items = h.items[:n]
+		h.fix(i)
+		return
+	}
+	h.items = h.items[:n]
+}
+
 func (h *mergingIterHeap) pop() *mergingIterItem {
 	n := h.len() - 1
 	h.swap(0, n)
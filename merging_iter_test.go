@@ -13,6 +13,7 @@ import (
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/internal/base"
 	"github.com/petermattis/pebble/internal/datadriven"
+	"github.com/petermattis/pebble/internal/rangedel"
 	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/vfs"
 	"golang.org/x/exp/rand"
@@ -124,6 +125,497 @@ func TestMergingIterNextPrev(t *testing.T) {
 	}
 }
 
+func TestMergingIterMinSeqNumInHeap(t *testing.T) {
+	// The data matches the definition in TestMergingIterNextPrev.
+	testCases := []struct {
+		iters    []string
+		expected string
+	}{
+		{
+			[]string{
+				"a.SET.2:2 a.SET.1:1 b.SET.2:2 b.SET.1:1 c.SET.2:2 c.SET.1:1",
+			},
+			"a#2:2 a#1:1 b#2:2 b#1:1 c#2:2 c#1:1 .:72057594037927935",
+		},
+		{
+			[]string{
+				"a.SET.2:2 b.SET.2:2",
+				"a.SET.1:1 b.SET.1:1",
+				"c.SET.2:2 c.SET.1:1",
+			},
+			"a#2:1 a#1:1 b#2:1 b#1:1 c#2:2 c#1:1 .:72057594037927935",
+		},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			iters := make([]internalIterator, len(c.iters))
+			for i := range c.iters {
+				f := &fakeIter{}
+				iters[i] = f
+				for _, key := range strings.Fields(c.iters[i]) {
+					j := strings.Index(key, ":")
+					f.keys = append(f.keys, base.ParseInternalKey(key[:j]))
+					f.vals = append(f.vals, []byte(key[j+1:]))
+				}
+			}
+			iter := newMergingIter(DefaultComparer.Compare, iters...)
+			defer iter.Close()
+
+			var results []string
+			key, _ := iter.First()
+			for ; key != nil; key, _ = iter.Next() {
+				results = append(results, fmt.Sprintf("%s#%d:%d", key.UserKey, key.SeqNum(), iter.MinSeqNumInHeap()))
+			}
+			results = append(results, fmt.Sprintf(".:%d", iter.MinSeqNumInHeap()))
+			if s := strings.Join(results, " "); c.expected != s {
+				t.Fatalf("expected\n%s\nbut found\n%s", c.expected, s)
+			}
+		})
+	}
+}
+
+func TestMergingIterAddRemove(t *testing.T) {
+	format := func(key *InternalKey) string {
+		if key == nil {
+			return "."
+		}
+		return fmt.Sprintf("%s:%d", key.UserKey, key.SeqNum())
+	}
+	collect := func(key *InternalKey, step func() (*InternalKey, []byte)) string {
+		var keys []string
+		for ; key != nil; key, _ = step() {
+			keys = append(keys, format(key))
+		}
+		return strings.Join(keys, " ")
+	}
+
+	t.Run("add-forward", func(t *testing.T) {
+		m := newMergingIter(DefaultComparer.Compare,
+			newFakeIterator(nil, "a:1", "c:1", "e:1"),
+			newFakeIterator(nil, "b:1", "d:1", "f:1"))
+		m.First()
+		if key, _ := m.Next(); format(key) != "b:1" {
+			t.Fatalf("expected b:1, but found %s", format(key))
+		}
+		// Keys at or before the current position are not surfaced.
+		m.AddIterator(newFakeIterator(nil, "a:2", "b:2", "b:0", "c:2", "cc:1", "g:1"))
+		key, _ := m.Next()
+		if v := collect(key, m.Next); v != "b:0 c:2 c:1 cc:1 d:1 e:1 f:1 g:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+
+	t.Run("add-reverse", func(t *testing.T) {
+		m := newMergingIter(DefaultComparer.Compare,
+			newFakeIterator(nil, "a:1", "c:1", "e:1"),
+			newFakeIterator(nil, "b:1", "d:1", "f:1"))
+		m.Last()
+		if key, _ := m.Prev(); format(key) != "e:1" {
+			t.Fatalf("expected e:1, but found %s", format(key))
+		}
+		m.AddIterator(newFakeIterator(nil, "a:0", "e:2", "e:0", "ee:1", "g:1"))
+		key, _ := m.Prev()
+		if v := collect(key, m.Prev); v != "e:2 d:1 c:1 b:1 a:0 a:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+
+	t.Run("add-unpositioned", func(t *testing.T) {
+		m := newMergingIter(DefaultComparer.Compare,
+			newFakeIterator(nil, "b:1", "d:1"))
+		m.AddIterator(newFakeIterator(nil, "a:1", "c:1"))
+		key, _ := m.First()
+		if v := collect(key, m.Next); v != "a:1 b:1 c:1 d:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		iters := []internalIterator{
+			newFakeIterator(nil, "a:1", "d:1", "g:1"),
+			newFakeIterator(nil, "b:1", "e:1", "h:1"),
+			newFakeIterator(nil, "c:1", "f:1", "i:1"),
+		}
+		m := newMergingIter(DefaultComparer.Compare, iters...)
+		if key, _ := m.SeekGE([]byte("b")); format(key) != "b:1" {
+			t.Fatalf("expected b:1, but found %s", format(key))
+		}
+		// Removing an iterator other than the current one leaves the position
+		// unchanged.
+		m.RemoveIterator(iters[0])
+		if key := m.Key(); format(key) != "b:1" {
+			t.Fatalf("expected b:1, but found %s", format(key))
+		}
+		// Removing the current iterator moves to the next entry.
+		m.RemoveIterator(iters[1])
+		if v := collect(m.Key(), m.Next); v != "c:1 f:1 i:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+		key, _ := m.Last()
+		if v := collect(key, m.Prev); v != "i:1 f:1 c:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+
+	t.Run("remove-snapshot", func(t *testing.T) {
+		iters := []internalIterator{
+			newFakeIterator(nil, "a:1", "d:1"),
+			newFakeIterator(nil, "b:5", "e:1"),
+		}
+		m := newMergingIter(DefaultComparer.Compare, iters...)
+		m.snapshot = 3
+		if key, _ := m.First(); format(key) != "a:1" {
+			t.Fatalf("expected a:1, but found %s", format(key))
+		}
+		// The next entry, b:5, is not visible at the snapshot.
+		m.RemoveIterator(iters[0])
+		if v := collect(m.Key(), m.Next); v != "e:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+
+	t.Run("remove-snapshot-reverse", func(t *testing.T) {
+		iters := []internalIterator{
+			newFakeIterator(nil, "b:1", "e:1"),
+			newFakeIterator(nil, "a:1", "d:5"),
+		}
+		m := newMergingIter(DefaultComparer.Compare, iters...)
+		m.snapshot = 3
+		if key, _ := m.Last(); format(key) != "e:1" {
+			t.Fatalf("expected e:1, but found %s", format(key))
+		}
+		m.RemoveIterator(iters[0])
+		if v := collect(m.Key(), m.Prev); v != "a:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+
+	t.Run("remove-excluded", func(t *testing.T) {
+		iters := []internalIterator{
+			newFakeIterator(nil, "a:1", "d:1"),
+			newFakeIterator(nil, "b:2", "e:1"),
+		}
+		m := newMergingIter(DefaultComparer.Compare, iters...)
+		m.excluded = []SeqNumRange{{Start: 2, End: 3}}
+		m.First()
+		m.RemoveIterator(iters[0])
+		if v := collect(m.Key(), m.Next); v != "e:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+
+	t.Run("remove-range-del", func(t *testing.T) {
+		iters := []internalIterator{
+			newFakeIterator(nil, "a:1", "f:1"),
+			newFakeIterator(nil, "d:1"),
+			newFakeIterator(nil, "b:1", "c:1", "e:1"),
+		}
+		m := newMergingIter(DefaultComparer.Compare, iters...)
+		// The tombstone [b,d) in the middle level deletes b and c in the lowest
+		// level.
+		m.rangeDelIters = []internalIterator{
+			nil,
+			rangedel.NewIter(DefaultComparer.Compare, []rangedel.Tombstone{{
+				Start: base.MakeInternalKey([]byte("b"), 2, InternalKeyKindRangeDelete),
+				End:   []byte("d"),
+			}}),
+			nil,
+		}
+		m.largestUserKeys = make([][]byte, 3)
+		if key, _ := m.First(); format(key) != "a:1" {
+			t.Fatalf("expected a:1, but found %s", format(key))
+		}
+		m.RemoveIterator(iters[0])
+		if v := collect(m.Key(), m.Next); v != "d:1 e:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+		key, _ := m.Last()
+		if v := collect(key, m.Prev); v != "e:1 d:1" {
+			t.Fatalf("unexpected keys: %s", v)
+		}
+	})
+}
+
+func TestMergingIterPeek(t *testing.T) {
+	newIter := func() *mergingIter {
+		var iters []internalIterator
+		for _, line := range []string{
+			"a.SET.2:a2 c.SET.1:c1 e.SET.1:e1",
+			"a.SET.1:a1 b.SET.1:b1 d.SET.1:d1",
+		} {
+			f := &fakeIter{}
+			for _, key := range strings.Fields(line) {
+				j := strings.Index(key, ":")
+				f.keys = append(f.keys, base.ParseInternalKey(key[:j]))
+				f.vals = append(f.vals, []byte(key[j+1:]))
+			}
+			iters = append(iters, f)
+		}
+		return newMergingIter(DefaultComparer.Compare, iters...)
+	}
+	format := func(key *InternalKey, value []byte) string {
+		if key == nil {
+			return "."
+		}
+		return fmt.Sprintf("%s:%d:%s", key.UserKey, key.SeqNum(), value)
+	}
+
+	t.Run("next", func(t *testing.T) {
+		m := newIter()
+		var keys []string
+		for key, value := m.First(); key != nil; key, value = m.Next() {
+			cur := format(key, value)
+			keys = append(keys, cur)
+			peek := format(m.Peek())
+			// Repeated peeks are stable and leave the current entry unchanged.
+			for i := 0; i < 3; i++ {
+				if v := format(m.Peek()); v != peek {
+					t.Fatalf("expected %s, but found %s", peek, v)
+				}
+				if v := format(m.Key(), m.Value()); v != cur {
+					t.Fatalf("expected %s, but found %s", cur, v)
+				}
+				if !m.Valid() {
+					t.Fatalf("expected valid iterator")
+				}
+			}
+			// Next returns the peeked entry.
+			if v := format(m.Key(), m.Value()); v != cur {
+				t.Fatalf("expected %s, but found %s", cur, v)
+			}
+			next, nextValue := m.Next()
+			if v := format(next, nextValue); v != peek {
+				t.Fatalf("expected %s, but found %s", peek, v)
+			}
+			if next == nil {
+				break
+			}
+			key, value = m.Prev()
+			if v := format(key, value); v != cur {
+				t.Fatalf("expected %s, but found %s", cur, v)
+			}
+		}
+		expected := "a:2:a2 a:1:a1 b:1:b1 c:1:c1 d:1:d1 e:1:e1"
+		if v := strings.Join(keys, " "); v != expected {
+			t.Fatalf("expected %s, but found %s", expected, v)
+		}
+	})
+
+	t.Run("prev", func(t *testing.T) {
+		m := newIter()
+		// Peeking and then stepping backward returns the entry before the current
+		// one, including when the peek exhausted the iterator.
+		for _, c := range []struct {
+			seek     string
+			expected string
+		}{
+			{"c", "b:1:b1"},
+			{"e", "d:1:d1"},
+		} {
+			m.SeekGE([]byte(c.seek))
+			m.Peek()
+			if v := format(m.Prev()); v != c.expected {
+				t.Fatalf("expected %s, but found %s", c.expected, v)
+			}
+		}
+	})
+
+	t.Run("unpositioned", func(t *testing.T) {
+		m := newIter()
+		if key, _ := m.Peek(); key != nil {
+			t.Fatalf("expected nil, but found %s", key)
+		}
+		if v := format(m.First()); v != "a:2:a2" {
+			t.Fatalf("expected a:2:a2, but found %s", v)
+		}
+	})
+}
+
+func TestMergingIterExcludedSeqNums(t *testing.T) {
+	m := newMergingIter(DefaultComparer.Compare,
+		newFakeIterator(nil, "a:6", "a:4", "a:2", "b:5", "c:1"),
+		newFakeIterator(nil, "a:5", "a:3", "a:1", "b:4", "b:2"))
+	m.excluded = []SeqNumRange{{Start: 2, End: 4}, {Start: 5, End: 6}}
+
+	var keys []string
+	for key, _ := m.First(); key != nil; key, _ = m.Next() {
+		keys = append(keys, fmt.Sprintf("%s:%d", key.UserKey, key.SeqNum()))
+	}
+	if v := strings.Join(keys, " "); v != "a:6 a:4 a:1 b:4 c:1" {
+		t.Fatalf("unexpected forward keys: %s", v)
+	}
+
+	keys = keys[:0]
+	for key, _ := m.Last(); key != nil; key, _ = m.Prev() {
+		keys = append(keys, fmt.Sprintf("%s:%d", key.UserKey, key.SeqNum()))
+	}
+	if v := strings.Join(keys, " "); v != "c:1 b:4 a:1 a:4 a:6" {
+		t.Fatalf("unexpected reverse keys: %s", v)
+	}
+}
+
+func TestMergingIterTombstoneCoveringTable(t *testing.T) {
+	mem := vfs.NewMem()
+	build := func(name string, fn func(w *sstable.Writer) error) *sstable.Reader {
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, LevelOptions{})
+		if err := fn(w); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sstable.NewReader(f, 0, nil)
+	}
+	add := func(w *sstable.Writer, keys ...string) error {
+		for _, k := range keys {
+			if err := w.Add(fakeIkey(k), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The lower table, which is entirely shadowed by the covering tombstone.
+	lower := build("lower", func(w *sstable.Writer) error {
+		return add(w, "b:1", "c:1", "d:1")
+	})
+	defer lower.Close()
+	// The upper table holds keys adjacent to the span of the lower table. The
+	// keys at sequence number 2 are older than the covering tombstone.
+	upper := build("upper", func(w *sstable.Writer) error {
+		if err := w.AddTombstoneCoveringTable(lower, 3); err != nil {
+			return err
+		}
+		return add(w, "a:2", "b:5", "d\x00:2", "e:2")
+	})
+	defer upper.Close()
+
+	m := newMergingIter(DefaultComparer.Compare,
+		upper.NewIter(nil /* lower */, nil /* upper */),
+		lower.NewIter(nil /* lower */, nil /* upper */))
+	m.rangeDelIters = []internalIterator{upper.NewRangeDelIter(), nil}
+	m.largestUserKeys = make([][]byte, 2)
+	defer m.Close()
+
+	var keys []string
+	for key, _ := m.First(); key != nil; key, _ = m.Next() {
+		keys = append(keys, fmt.Sprintf("%q:%d", key.UserKey, key.SeqNum()))
+	}
+	expected := `"a":2 "b":5 "d\x00":2 "e":2`
+	if v := strings.Join(keys, " "); expected != v {
+		t.Fatalf("expected %s, but found %s", expected, v)
+	}
+}
+
+// seekCountingIter counts the SeekGE calls of an iterator.
+type seekCountingIter struct {
+	internalIterator
+	seeks int
+}
+
+func (i *seekCountingIter) SeekGE(key []byte) (*InternalKey, []byte) {
+	i.seeks++
+	return i.internalIterator.SeekGE(key)
+}
+
+func TestMergingIterSeekGESkip(t *testing.T) {
+	seed := uint64(time.Now().UnixNano())
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed: %d", seed)
+
+	// Each level holds a random subset of the keys, with a sequence number
+	// unique to the level.
+	const levels = 4
+	newLevels := func() []internalIterator {
+		r := rand.New(rand.NewSource(seed))
+		iters := make([]internalIterator, levels)
+		for level := range iters {
+			var keys []string
+			for k := 0; k < 200; k++ {
+				if r.Intn(levels) == 0 {
+					keys = append(keys, fmt.Sprintf("%04d:%d", k, levels-level))
+				}
+			}
+			iters[level] = &seekCountingIter{internalIterator: newFakeIterator(nil, keys...)}
+		}
+		return iters
+	}
+	iters := newLevels()
+	m := newMergingIter(DefaultComparer.Compare, iters...)
+	// The reference iterator re-seeks every level on every SeekGE.
+	ref := newMergingIter(DefaultComparer.Compare, newLevels()...)
+
+	format := func(key *InternalKey, value []byte) string {
+		if key == nil {
+			return "."
+		}
+		return fmt.Sprintf("%s:%d", key.UserKey, key.SeqNum())
+	}
+	var target int
+	var seekGEs int
+	for i := 0; i < 5000; i++ {
+		var op string
+		var got, expected string
+		switch n := rng.Intn(20); {
+		case n < 14:
+			// Most seeks move forward, emulating a scan using seeks.
+			if rng.Intn(8) == 0 {
+				target = rng.Intn(210)
+			} else {
+				target += rng.Intn(4)
+			}
+			key := []byte(fmt.Sprintf("%04d", target))
+			op = fmt.Sprintf("seek-ge %s", key)
+			ref.resetSeekState()
+			expected = format(ref.SeekGE(key))
+			got = format(m.SeekGE(key))
+			seekGEs++
+		case n < 16:
+			op = "next"
+			expected = format(ref.Next())
+			got = format(m.Next())
+		case n < 17:
+			op = "prev"
+			expected = format(ref.Prev())
+			got = format(m.Prev())
+		case n < 18:
+			key := []byte(fmt.Sprintf("%04d", rng.Intn(210)))
+			op = fmt.Sprintf("seek-lt %s", key)
+			expected = format(ref.SeekLT(key))
+			got = format(m.SeekLT(key))
+		case n < 19:
+			key := []byte(fmt.Sprintf("%04d", rng.Intn(210)))
+			op = fmt.Sprintf("seek-prefix-ge %s", key)
+			expected = format(ref.SeekPrefixGE(key, key))
+			got = format(m.SeekPrefixGE(key, key))
+		default:
+			op = "first"
+			expected = format(ref.First())
+			got = format(m.First())
+		}
+		if expected != got {
+			t.Fatalf("%d: %s: expected %s, but found %s", i, op, expected, got)
+		}
+	}
+
+	// Some of the seeks of the levels were skipped.
+	var seeks int
+	for _, iter := range iters {
+		seeks += iter.(*seekCountingIter).seeks
+	}
+	if seeks >= seekGEs*levels {
+		t.Fatalf("expected fewer than %d seeks of the levels, but found %d", seekGEs*levels, seeks)
+	}
+}
+
 func buildMergingIterTables(
 	b *testing.B, blockSize, restartInterval, count int,
 ) ([]*sstable.Reader, [][]byte) {
@@ -197,16 +689,27 @@ func BenchmarkMergingIterSeekGE(b *testing.B) {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
 							readers, keys := buildMergingIterTables(b, blockSize, restartInterval, count)
-							iters := make([]internalIterator, len(readers))
-							for i := range readers {
-								iters[i] = readers[i].NewIter(nil /* lower */, nil /* upper */)
-							}
-							m := newMergingIter(DefaultComparer.Compare, iters...)
-							rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+							// The increasing seeks step through the keys in order, emulating a
+							// forward scan performed using seeks.
+							for _, increasing := range []bool{false, true} {
+								b.Run(fmt.Sprintf("increasing=%t", increasing),
+									func(b *testing.B) {
+										iters := make([]internalIterator, len(readers))
+										for i := range readers {
+											iters[i] = readers[i].NewIter(nil /* lower */, nil /* upper */)
+										}
+										m := newMergingIter(DefaultComparer.Compare, iters...)
+										rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
 
-							b.ResetTimer()
-							for i := 0; i < b.N; i++ {
-								m.SeekGE(keys[rng.Intn(len(keys))])
+										b.ResetTimer()
+										for i := 0; i < b.N; i++ {
+											if increasing {
+												m.SeekGE(keys[i%len(keys)])
+											} else {
+												m.SeekGE(keys[rng.Intn(len(keys))])
+											}
+										}
+									})
 							}
 						})
 				}
@@ -14,6 +14,17 @@ const (
 	DefaultCompression = base.DefaultCompression
 	NoCompression      = base.NoCompression
 	SnappyCompression  = base.SnappyCompression
+	ZstdCompression    = base.ZstdCompression
+)
+
+// ChecksumType exports the base.ChecksumType type.
+type ChecksumType = base.ChecksumType
+
+// Exported ChecksumType constants.
+const (
+	DefaultChecksum  = base.DefaultChecksum
+	CRC32cChecksum   = base.CRC32cChecksum
+	XXHash64Checksum = base.XXHash64Checksum
 )
 
 // FilterType exports the base.FilterType type.
@@ -67,6 +78,17 @@ type IterOptions struct {
 	// iteration based on the user properties. Return true to scan the table and
 	// false to skip scanning.
 	TableFilter func(userProps map[string]string) bool
+	// ExcludedSeqNums specifies ranges of sequence numbers whose point keys are
+	// hidden from the iterator, as if they had never been written. This allows
+	// reading the DB state without the effects of specific committed
+	// operations. The ranges must be sorted and must not overlap. Range
+	// deletion tombstones are not affected by the excluded ranges.
+	ExcludedSeqNums []SeqNumRange
+}
+
+// SeqNumRange is the half-open range of sequence numbers [Start, End).
+type SeqNumRange struct {
+	Start, End uint64
 }
 
 // GetLowerBound returns the LowerBound or nil if the receiver is nil.
@@ -109,6 +109,7 @@ type blockIter struct {
 	cmp          Compare
 	offset       int32
 	nextOffset   int32
+	seekOffset   int32
 	restarts     int32
 	numRestarts  int32
 	globalSeqNum uint64
@@ -122,6 +123,9 @@ type blockIter struct {
 	cachedBuf    []byte
 	cacheHandle  cache.Handle
 	err          error
+	// kindMask restricts the entries returned by the positioning methods to
+	// those whose kind is in the mask. A zero mask returns every entry.
+	kindMask KindMask
 }
 
 func newBlockIter(cmp Compare, block block) (*blockIter, error) {
@@ -150,6 +154,16 @@ func (i *blockIter) init(cmp Compare, block block, globalSeqNum uint64) error {
 	return nil
 }
 
+// resetForReuse returns a zero blockIter which retains the scratch buffers of
+// i, but none of its references to block data or the cache.
+func (i *blockIter) resetForReuse() blockIter {
+	return blockIter{
+		fullKey:   i.fullKey[:0],
+		cached:    i.cached[:0],
+		cachedBuf: i.cachedBuf[:0],
+	}
+}
+
 func (i *blockIter) setCacheHandle(h cache.Handle) {
 	i.cacheHandle.Release()
 	i.cacheHandle = h
@@ -238,6 +252,8 @@ func (i *blockIter) readEntry() {
 		i.key = i.fullKey
 	}
 	ptr = unsafe.Pointer(uintptr(ptr) + uintptr(unshared))
+	// NB: getBytes returns a non-nil slice for a zero-length value, so that an
+	// empty value is never confused with the absence of a value.
 	i.val = getBytes(ptr, int(value))
 	i.nextOffset = int32(uintptr(ptr)-uintptr(i.ptr)) + int32(value)
 }
@@ -369,19 +385,34 @@ func (i *blockIter) SeekGE(key []byte) (*InternalKey, []byte) {
 	if index > 0 {
 		i.offset = int32(binary.LittleEndian.Uint32(i.data[i.restarts+4*(index-1):]))
 	}
+	i.seekOffset = i.offset
 	i.readEntry()
 	i.decodeInternalKey(i.key)
 
 	// Iterate from that restart point to somewhere >= the key sought.
 	for ; i.Valid(); i.Next() {
 		if base.InternalCompare(i.cmp, i.ikey, ikey) >= 0 {
-			return &i.ikey, i.val
+			return i.skipForward(&i.ikey, i.val)
 		}
 	}
 
 	return nil, nil
 }
 
+// seekSkipped returns the number of entries the most recent SeekGE scanned
+// past between the restart point at which it began and the current position.
+func (i *blockIter) seekSkipped() int {
+	n := 0
+	for offset := i.seekOffset; offset < i.offset && offset < i.restarts; n++ {
+		ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(offset))
+		_, ptr = decodeVarint(ptr)
+		unshared, ptr := decodeVarint(ptr)
+		value, ptr := decodeVarint(ptr)
+		offset = int32(uintptr(ptr)-uintptr(i.ptr)) + int32(unshared) + int32(value)
+	}
+	return n
+}
+
 // SeekPrefixGE implements internalIterator.SeekPrefixGE, as documented in the
 // pebble package.
 func (i *blockIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
@@ -499,8 +530,7 @@ func (i *blockIter) SeekLT(key []byte) (*InternalKey, []byte) {
 		if i.cmp(i.ikey.UserKey, ikey.UserKey) >= 0 {
 			// The current key is greater than or equal to our search key. Back up to
 			// the previous key which was less than our search key.
-			i.Prev()
-			return &i.ikey, i.val
+			return i.Prev()
 		}
 
 		if i.nextOffset >= i.restarts {
@@ -512,12 +542,22 @@ func (i *blockIter) SeekLT(key []byte) (*InternalKey, []byte) {
 	if !i.Valid() {
 		return nil, nil
 	}
-	return &i.ikey, i.val
+	return i.skipBackward(&i.ikey, i.val)
 }
 
 // First implements internalIterator.First, as documented in the pebble
 // package.
 func (i *blockIter) First() (*InternalKey, []byte) {
+	key, val := i.first()
+	if key == nil {
+		return nil, nil
+	}
+	return i.skipForward(key, val)
+}
+
+// first positions the iterator at the first entry, regardless of the kind
+// mask.
+func (i *blockIter) first() (*InternalKey, []byte) {
 	i.offset = 0
 	if !i.Valid() {
 		return nil, nil
@@ -527,6 +567,14 @@ func (i *blockIter) First() (*InternalKey, []byte) {
 	return &i.ikey, i.val
 }
 
+// seekRestart positions the iterator at the entry at the j'th restart point.
+func (i *blockIter) seekRestart(j int32) (*InternalKey, []byte) {
+	i.offset = int32(binary.LittleEndian.Uint32(i.data[i.restarts+4*j:]))
+	i.readEntry()
+	i.decodeInternalKey(i.key)
+	return &i.ikey, i.val
+}
+
 // Last implements internalIterator.Last, as documented in the pebble package.
 func (i *blockIter) Last() (*InternalKey, []byte) {
 	// Seek forward from the last restart point.
@@ -546,34 +594,65 @@ func (i *blockIter) Last() (*InternalKey, []byte) {
 	}
 
 	i.decodeInternalKey(i.key)
-	return &i.ikey, i.val
+	return i.skipBackward(&i.ikey, i.val)
 }
 
 // Next implements internalIterator.Next, as documented in the pebble
 // package.
 func (i *blockIter) Next() (*InternalKey, []byte) {
-	i.offset = i.nextOffset
-	if !i.Valid() {
-		return nil, nil
-	}
-	i.readEntry()
-	// Manually inlined version of i.decodeInternalKey(i.key).
-	if n := len(i.key) - 8; n >= 0 {
-		i.ikey.Trailer = binary.LittleEndian.Uint64(i.key[n:])
-		i.ikey.UserKey = i.key[:n:n]
-		if i.globalSeqNum != 0 {
-			i.ikey.SetSeqNum(i.globalSeqNum)
+	for {
+		i.offset = i.nextOffset
+		if !i.Valid() {
+			return nil, nil
+		}
+		i.readEntry()
+		// Manually inlined version of i.decodeInternalKey(i.key).
+		if n := len(i.key) - 8; n >= 0 {
+			i.ikey.Trailer = binary.LittleEndian.Uint64(i.key[n:])
+			i.ikey.UserKey = i.key[:n:n]
+			if i.globalSeqNum != 0 {
+				i.ikey.SetSeqNum(i.globalSeqNum)
+			}
+		} else {
+			i.ikey.Trailer = uint64(InternalKeyKindInvalid)
+			i.ikey.UserKey = nil
+		}
+		if i.kindMask.Contains(i.ikey.Kind()) {
+			return &i.ikey, i.val
 		}
-	} else {
-		i.ikey.Trailer = uint64(InternalKeyKindInvalid)
-		i.ikey.UserKey = nil
 	}
-	return &i.ikey, i.val
 }
 
 // Prev implements internalIterator.Prev, as documented in the pebble
 // package.
 func (i *blockIter) Prev() (*InternalKey, []byte) {
+	key, val := i.prev()
+	for key != nil && !i.kindMask.Contains(key.Kind()) {
+		key, val = i.prev()
+	}
+	return key, val
+}
+
+// skipForward advances the iterator past the current entry if its kind is not
+// in the kind mask.
+func (i *blockIter) skipForward(key *InternalKey, val []byte) (*InternalKey, []byte) {
+	if i.kindMask.Contains(key.Kind()) {
+		return key, val
+	}
+	return i.Next()
+}
+
+// skipBackward moves the iterator before the current entry if its kind is not
+// in the kind mask.
+func (i *blockIter) skipBackward(key *InternalKey, val []byte) (*InternalKey, []byte) {
+	if i.kindMask.Contains(key.Kind()) {
+		return key, val
+	}
+	return i.Prev()
+}
+
+// prev moves the iterator to the previous entry, regardless of the kind mask.
+func (i *blockIter) prev() (*InternalKey, []byte) {
 	if n := len(i.cached) - 1; n > 0 && i.cached[n].offset == i.offset {
 		i.nextOffset = i.offset
 		e := &i.cached[n-1]
@@ -0,0 +1,98 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+// BlockFill describes the size of a data block relative to the target block
+// size.
+type BlockFill struct {
+	// Offset and Length locate the block within the file. The length excludes
+	// the block trailer.
+	Offset uint64
+	Length uint64
+	// Fill is the length of the block divided by the target block size. A block
+	// larger than the target size, such as a block holding an oversized value,
+	// has a fill above 1.
+	Fill float64
+}
+
+// BlockFillStats summarizes how close the data blocks of a table came to the
+// target block size. It is intended to help tune TableOptions.BlockSize.
+type BlockFillStats struct {
+	// TargetSize is the target block size the blocks are measured against.
+	TargetSize int
+	// Blocks holds the fill of each data block, in order.
+	Blocks []BlockFill
+	// MinFill, MaxFill and MeanFill are the minimum, maximum and mean fill of
+	// the data blocks. All are zero if the table has no data blocks.
+	MinFill  float64
+	MaxFill  float64
+	MeanFill float64
+	// NumUnderfilled is the number of data blocks, other than the last, whose
+	// fill is below TableOptions.BlockSizeThreshold. Such a block was finished
+	// well short of the target size, for example because the following entry
+	// was too large to fit, or because the block reached
+	// TableOptions.MaxKeysPerBlock.
+	NumUnderfilled int
+}
+
+// BlockFillStats returns statistics on how full the data blocks of the table
+// are relative to the target block size. The statistics are derived from the
+// block handles in the index, so no data blocks are read. The size of a block
+// is its length in the file, which for a compressed table is its compressed
+// length. The table does not record the options it was written with, so the
+// target size and the threshold for under-filled blocks are taken from the
+// options of the first level of the Options passed to NewReader.
+func (r *Reader) BlockFillStats() (BlockFillStats, error) {
+	if r.err != nil {
+		return BlockFillStats{}, r.err
+	}
+	lo := r.opts.Level(0)
+	stats := BlockFillStats{TargetSize: lo.BlockSize}
+	threshold := float64(lo.BlockSizeThreshold) / 100
+
+	indexBlock, err := r.readIndex()
+	if err != nil {
+		return BlockFillStats{}, err
+	}
+	var index blockIter
+	if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+		return BlockFillStats{}, err
+	}
+	var group []blockHandle
+	for key, value := index.First(); key != nil; key, value = index.Next() {
+		if group, err = r.decodeIndexEntry(group[:0], value); err != nil {
+			index.Close()
+			return BlockFillStats{}, err
+		}
+		for _, bh := range group {
+			stats.Blocks = append(stats.Blocks, BlockFill{
+				Offset: bh.offset,
+				Length: bh.length,
+				Fill:   float64(bh.length) / float64(lo.BlockSize),
+			})
+		}
+	}
+	if err := index.Close(); err != nil {
+		return BlockFillStats{}, err
+	}
+
+	var total float64
+	for i, b := range stats.Blocks {
+		if i == 0 || b.Fill < stats.MinFill {
+			stats.MinFill = b.Fill
+		}
+		if b.Fill > stats.MaxFill {
+			stats.MaxFill = b.Fill
+		}
+		total += b.Fill
+		if i < len(stats.Blocks)-1 && b.Fill < threshold {
+			stats.NumUnderfilled++
+		}
+	}
+	if n := len(stats.Blocks); n > 0 {
+		stats.MeanFill = total / float64(n)
+	}
+	return stats, nil
+}
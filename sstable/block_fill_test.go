@@ -0,0 +1,87 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestReaderBlockFillStats(t *testing.T) {
+	const blockSize = 1024
+	// With a block size threshold of 50%, a block which is more than half full
+	// is finished early if the next entry does not fit.
+	lo := TableOptions{
+		BlockSize:          blockSize,
+		BlockSizeThreshold: 50,
+		Compression:        NoCompression,
+	}
+	o := &Options{Levels: []TableOptions{{BlockSize: blockSize}}}
+	r := newTestReader(t, o, lo, func(w *Writer) error {
+		value := bytes.Repeat([]byte("v"), 50)
+		for i := 0; i < 100; i++ {
+			v := value
+			if i == 43 {
+				// The block holding the entries from 32 to 42 is about 70% full when
+				// the oversized value is added, forcing the block to be finished.
+				v = bytes.Repeat([]byte("x"), 4*blockSize)
+			}
+			if err := w.Set([]byte(fmt.Sprintf("%04d", i)), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+	stats, err := r.BlockFillStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.TargetSize != blockSize {
+		t.Fatalf("expected target size %d, but found %d", blockSize, stats.TargetSize)
+	}
+	if n := uint64(len(stats.Blocks)); n != r.Properties.NumDataBlocks {
+		t.Fatalf("expected %d blocks, but found %d", r.Properties.NumDataBlocks, n)
+	}
+	var dataSize uint64
+	for _, b := range stats.Blocks {
+		dataSize += b.Length + blockTrailerLen
+	}
+	if dataSize != r.Properties.DataSize {
+		t.Fatalf("expected data size %d, but found %d", r.Properties.DataSize, dataSize)
+	}
+
+	// The block preceding the oversized value is the only under-filled block,
+	// and the oversized value occupies a block of its own.
+	if stats.NumUnderfilled != 1 {
+		t.Fatalf("expected 1 under-filled block, but found %d", stats.NumUnderfilled)
+	}
+	var under, over []int
+	for i, b := range stats.Blocks {
+		if i < len(stats.Blocks)-1 && b.Fill < 0.9 {
+			under = append(under, i)
+		}
+		if b.Fill > 1 {
+			over = append(over, i)
+		}
+	}
+	if len(under) != 1 || len(over) != 1 || over[0] != under[0]+1 {
+		t.Fatalf("unexpected under-filled blocks %v and over-filled blocks %v", under, over)
+	}
+	if fill := stats.Blocks[under[0]].Fill; fill < 0.6 || fill > 0.8 {
+		t.Fatalf("expected under-filled block fill near 0.7, but found %.2f", fill)
+	}
+	if stats.MaxFill != stats.Blocks[over[0]].Fill || stats.MaxFill < 4 {
+		t.Fatalf("unexpected max fill %.2f", stats.MaxFill)
+	}
+	if stats.MinFill > stats.Blocks[under[0]].Fill || stats.MinFill <= 0 {
+		t.Fatalf("unexpected min fill %.2f", stats.MinFill)
+	}
+	if stats.MeanFill <= stats.MinFill || stats.MeanFill >= stats.MaxFill {
+		t.Fatalf("unexpected mean fill %.2f", stats.MeanFill)
+	}
+}
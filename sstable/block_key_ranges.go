@@ -0,0 +1,105 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// The block key ranges meta block is an optional raw block recording the
+// exact smallest and largest user keys of each data block of a table (see
+// TableOptions.BlockKeyRanges). The index block cannot be used for this, as
+// its keys are separators which may lie anywhere between the last key of a
+// block and the first key of the following block.
+//
+// The block is keyed by the big-endian encoded 4-byte ordinal of each data
+// block, in increasing order. The value of each entry is:
+//
+//   <block-handle><smallest-len><smallest><largest>
+//
+// where block-handle is the encoded handle of the data block, and smallest-len
+// is the uvarint encoded length of smallest.
+
+var errCorruptBlockKeyRange = errors.New("pebble/table: invalid table (bad block key range)")
+
+// BlockKeyRange is the range of user keys of a data block.
+type BlockKeyRange struct {
+	// The offset and length of the data block within the table, excluding the
+	// block trailer.
+	Offset, Length uint64
+	// The smallest and largest user keys in the block.
+	Smallest, Largest []byte
+}
+
+// finishBlockKeyRanges returns the contents of the block key ranges block, or
+// nil if the block key ranges are not recorded or the table has no data
+// blocks.
+func (w *Writer) finishBlockKeyRanges() []byte {
+	if !w.blockKeyRanges || len(w.dataBlocks) == 0 {
+		return nil
+	}
+	b := rawBlockWriter{
+		blockWriter: blockWriter{restartInterval: 1},
+	}
+	var key [4]byte
+	var value []byte
+	for i, d := range w.dataBlocks {
+		binary.BigEndian.PutUint32(key[:], uint32(i))
+		n := encodeBlockHandle(w.tmp[:], d.bh)
+		value = append(value[:0], w.tmp[:n]...)
+		n = binary.PutUvarint(w.tmp[:], uint64(len(d.smallest)))
+		value = append(append(append(value, w.tmp[:n]...), d.smallest...), d.largest...)
+		b.add(InternalKey{UserKey: key[:]}, value)
+	}
+	return b.finish()
+}
+
+// BlockKeyRanges returns the exact smallest and largest user keys of each data
+// block of the table, in the order of the blocks. Nil is returned if the table
+// was written without TableOptions.BlockKeyRanges. The returned keys are
+// copies which are owned by the caller.
+func (r *Reader) BlockKeyRanges() ([]BlockKeyRange, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.blockKeyRanges.bh.length == 0 {
+		return nil, nil
+	}
+	b, err := r.readWeakCachedBlock(&r.blockKeyRanges, nil /* transform */)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := newRawBlockIter(bytes.Compare, b)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []BlockKeyRange
+	for valid := iter.First(); valid; valid = iter.Next() {
+		v := iter.Value()
+		bh, m := decodeBlockHandle(v)
+		if m == 0 {
+			iter.Close()
+			return nil, errCorruptBlockKeyRange
+		}
+		v = v[m:]
+		n, m := binary.Uvarint(v)
+		if m <= 0 || uint64(len(v)-m) < n {
+			iter.Close()
+			return nil, errCorruptBlockKeyRange
+		}
+		ranges = append(ranges, BlockKeyRange{
+			Offset:   bh.offset,
+			Length:   bh.length,
+			Smallest: append([]byte(nil), v[m:m+int(n)]...),
+			Largest:  append([]byte(nil), v[m+int(n):]...),
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/internal/base"
+)
+
+// checkBlockKeyRanges checks that the block key ranges of the table match the
+// keys found by iterating over each of its data blocks.
+func checkBlockKeyRanges(t *testing.T, r *Reader) {
+	if !r.Features().HasBlockKeyRanges {
+		t.Fatalf("expected block key ranges")
+	}
+	ranges, err := r.BlockKeyRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readDataBlocks(t, r)
+	if len(ranges) != len(blocks) {
+		t.Fatalf("expected %d block key ranges, but found %d", len(blocks), len(ranges))
+	}
+	for i, kr := range ranges {
+		h, err := r.readBlock(blockHandle{offset: kr.Offset, length: kr.Length},
+			nil /* transform */, nil /* readahead */, nil /* stats */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys [][]byte
+		err = countBlockEntries(r, h.Get(), func(key *InternalKey, _ []byte) {
+			keys = append(keys, append([]byte(nil), key.UserKey...))
+		})
+		h.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != len(blocks[i]) {
+			t.Fatalf("block %d: expected %d keys at offset %d, but found %d",
+				i, len(blocks[i]), kr.Offset, len(keys))
+		}
+		smallest, largest := keys[0], keys[len(keys)-1]
+		if !bytes.Equal(kr.Smallest, smallest) || !bytes.Equal(kr.Largest, largest) {
+			t.Fatalf("block %d: expected [%s,%s], but found [%s,%s]",
+				i, smallest, largest, kr.Smallest, kr.Largest)
+		}
+	}
+}
+
+func TestBlockKeyRanges(t *testing.T) {
+	kv := func(key string, seqNum uint64) internalKV {
+		return internalKV{
+			Key:   base.MakeInternalKey([]byte(key), seqNum, InternalKeyKindSet),
+			Value: []byte(key),
+		}
+	}
+
+	t.Run("blocks", func(t *testing.T) {
+		// The versions of a key may be split across blocks, in which case the
+		// ranges of the blocks share a user key.
+		r := newReaderFromBlocks(t, [][]internalKV{
+			{kv("a", 1)},
+			{kv("b", 3), kv("c", 4), kv("d", 6)},
+			{kv("d", 5), kv("e", 7)},
+			{kv("f", 8)},
+		}, TableOptions{BlockKeyRanges: true})
+		defer r.Close()
+		checkBlockKeyRanges(t, r)
+	})
+
+	for _, lo := range []TableOptions{
+		{BlockSize: 64, BlockKeyRanges: true},
+		{BlockSize: 256, BlockKeyRanges: true, Compression: NoCompression},
+		{BlockSize: 128, BlockKeyRanges: true, IndexSparsity: 3},
+	} {
+		t.Run(fmt.Sprintf("block-size=%d", lo.BlockSize), func(t *testing.T) {
+			r := newTestReader(t, nil, lo, func(w *Writer) error {
+				for i := 0; i < 500; i++ {
+					key := []byte(fmt.Sprintf("%05d", i*7))
+					if err := w.Set(key, bytes.Repeat(key, i%5)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			checkBlockKeyRanges(t, r)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		r := newReaderFromBlocks(t, [][]internalKV{{kv("a", 1)}}, TableOptions{})
+		defer r.Close()
+		if r.Features().HasBlockKeyRanges {
+			t.Fatalf("expected no block key ranges")
+		}
+		if ranges, err := r.BlockKeyRanges(); err != nil || ranges != nil {
+			t.Fatalf("expected no block key ranges, but found %v, %v", ranges, err)
+		}
+	})
+}
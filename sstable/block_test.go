@@ -7,6 +7,7 @@ package sstable
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -233,6 +234,110 @@ func TestBlockIterKeyStability(t *testing.T) {
 	require.EqualValues(t, expected, keys)
 }
 
+// decodeFuzzBlockEntries decodes a fuzzer provided byte stream into a sorted
+// set of unique key/value pairs. Each entry is encoded as a byte specifying
+// how many bytes of the previous key to share, a length-prefixed key suffix and
+// a length-prefixed value. Sharing a prefix with the previous key produces the
+// long common prefixes that exercise the shared/unshared key encoding.
+func decodeFuzzBlockEntries(data []byte) (keys [][]byte, vals [][]byte) {
+	next := func(n int) []byte {
+		if n > len(data) {
+			n = len(data)
+		}
+		b := data[:n]
+		data = data[n:]
+		return b
+	}
+	nextByte := func() int {
+		if b := next(1); len(b) == 1 {
+			return int(b[0])
+		}
+		return 0
+	}
+
+	var prev []byte
+	m := make(map[string][]byte)
+	for len(data) > 0 {
+		shared := nextByte() % (len(prev) + 1)
+		key := append(append([]byte(nil), prev[:shared]...), next(nextByte()%32)...)
+		val := append([]byte(nil), next(nextByte()%32)...)
+		m[string(key)] = val
+		prev = key
+	}
+	for k := range m {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	for _, k := range keys {
+		vals = append(vals, m[string(k)])
+	}
+	return keys, vals
+}
+
+// FuzzBlockRoundTrip verifies that the block iterator decodes exactly the
+// key/value pairs that were encoded by the block writer, regardless of the
+// restart interval and the prefix structure of the keys.
+func FuzzBlockRoundTrip(f *testing.F) {
+	f.Add([]byte(""), uint8(0))
+	f.Add([]byte("\x00\x05apple\x00\x03\x05ricot\x00\x00\x06banana\x00"), uint8(16))
+	f.Add([]byte("\x00\x03aaa\x01\x03\x01a\x01b\x04\x00\x02\x05\x01c\x00"), uint8(1))
+	f.Add(bytes.Repeat([]byte("\xff\x01a\x01v"), 100), uint8(3))
+
+	f.Fuzz(func(t *testing.T, data []byte, restartInterval uint8) {
+		keys, vals := decodeFuzzBlockEntries(data)
+		ikeys := make([]InternalKey, len(keys))
+		w := &blockWriter{restartInterval: 1 + int(restartInterval)%32}
+		for i := range keys {
+			ikeys[i] = base.MakeInternalKey(keys[i], uint64(i), InternalKeyKindSet)
+			w.add(ikeys[i], vals[i])
+		}
+
+		iter, err := newBlockIter(bytes.Compare, w.finish())
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(op string, i int, key *InternalKey, val []byte) {
+			if i < 0 || i >= len(ikeys) {
+				if key != nil {
+					t.Fatalf("%s: expected exhausted iterator, but found %s", op, key)
+				}
+				return
+			}
+			if key == nil {
+				t.Fatalf("%s: expected %s, but found exhausted iterator", op, ikeys[i])
+			}
+			if base.InternalCompare(bytes.Compare, ikeys[i], *key) != 0 {
+				t.Fatalf("%s: expected key %s, but found %s", op, ikeys[i], key)
+			}
+			if !bytes.Equal(vals[i], val) {
+				t.Fatalf("%s: expected value %q, but found %q", op, vals[i], val)
+			}
+		}
+
+		key, val := iter.First()
+		for i := 0; i <= len(ikeys); i++ {
+			check("next", i, key, val)
+			key, val = iter.Next()
+		}
+		key, val = iter.Last()
+		for i := len(ikeys) - 1; i >= -1; i-- {
+			check("prev", i, key, val)
+			key, val = iter.Prev()
+		}
+		for i := range keys {
+			key, val = iter.SeekGE(keys[i])
+			check("seek-ge", i, key, val)
+			key, val = iter.SeekLT(keys[i])
+			check("seek-lt", i-1, key, val)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
 func BenchmarkBlockIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
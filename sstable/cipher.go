@@ -0,0 +1,120 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// aesGCMSaltLen is the length of the random salt from which the key of each
+// sstable is derived.
+const aesGCMSaltLen = 32
+
+// aesGCMCipher implements BlockCipher using AES-GCM.
+type aesGCMCipher struct {
+	key []byte
+}
+
+// NewAESGCMCipher returns a BlockCipher which encrypts and authenticates
+// blocks using AES-GCM with a key derived from the specified 16, 24 or 32 byte
+// key. The key of each sstable is derived using HMAC-SHA256 from the key and
+// the random salt of the sstable, and the nonce for each block is the offset of
+// the block within the sstable. Every key and nonce pair is therefore unique,
+// even across sstables, and the key may be used for any number of sstables.
+func NewAESGCMCipher(key []byte) (BlockCipher, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	return aesGCMCipher{key: append([]byte(nil), key...)}, nil
+}
+
+func (c aesGCMCipher) SaltLen() int {
+	return aesGCMSaltLen
+}
+
+func (c aesGCMCipher) ForTable(salt []byte) (TableCipher, error) {
+	if len(salt) != aesGCMSaltLen {
+		return nil, fmt.Errorf("invalid salt length %d", len(salt))
+	}
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil)[:len(c.key)])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCMTableCipher{aead: aead}, nil
+}
+
+// aesGCMTableCipher implements TableCipher using AES-GCM.
+type aesGCMTableCipher struct {
+	aead cipher.AEAD
+}
+
+func (c aesGCMTableCipher) nonce(buf []byte, offset uint64) []byte {
+	nonce := buf[:c.aead.NonceSize()]
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.LittleEndian.PutUint64(nonce, offset)
+	return nonce
+}
+
+func (c aesGCMTableCipher) Overhead() int {
+	return c.aead.Overhead()
+}
+
+func (c aesGCMTableCipher) Seal(dst, block []byte, offset uint64) []byte {
+	var buf [16]byte
+	return c.aead.Seal(dst, c.nonce(buf[:], offset), block, nil)
+}
+
+func (c aesGCMTableCipher) Open(dst, sealed []byte, offset uint64) ([]byte, error) {
+	var buf [16]byte
+	return c.aead.Open(dst, c.nonce(buf[:], offset), sealed, nil)
+}
+
+// newTableCipher returns the TableCipher for a new sstable along with the
+// random salt, which is written at the start of the sstable.
+func newTableCipher(c BlockCipher) (TableCipher, []byte, error) {
+	salt := make([]byte, c.SaltLen())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	tc, err := c.ForTable(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tc, salt, nil
+}
+
+// readTableCipher returns the TableCipher for the sstable read through f,
+// using the salt stored at the start of the sstable.
+func readTableCipher(f io.ReaderAt, size int64, c BlockCipher) (TableCipher, error) {
+	saltLen := c.SaltLen()
+	if size < int64(saltLen+minFooterLen) {
+		return nil, errors.New("pebble/table: invalid table (file size is too small)")
+	}
+	salt := make([]byte, saltLen)
+	if _, err := f.ReadAt(salt, 0); err != nil {
+		return nil, fmt.Errorf("pebble/table: invalid table (could not read salt): %v", err)
+	}
+	tc, err := c.ForTable(salt)
+	if err != nil {
+		return nil, fmt.Errorf("pebble/table: invalid table (bad salt): %v", err)
+	}
+	return tc, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestBlockCipher(t *testing.T) {
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []Compression{NoCompression, SnappyCompression} {
+		t.Run(compression.String(), func(t *testing.T) {
+			mem := vfs.NewMem()
+			writeTestTable(t, mem, "test", &Options{BlockCipher: c}, TableOptions{
+				BlockSize:   128,
+				Compression: compression,
+			}, func(w *Writer) error {
+				for i := 0; i < 100; i++ {
+					key := []byte(fmt.Sprintf("key-%04d", i))
+					if err := w.Set(key, []byte(fmt.Sprintf("value-%04d", i))); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+			f, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, stat.Size())
+			if _, err := f.ReadAt(data, 0); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("value-")) || bytes.Contains(data, []byte("rocksdb.")) {
+				t.Fatalf("expected encrypted table contents")
+			}
+
+			// The table round trips with the cipher.
+			r := NewReader(f, 0, &Options{BlockCipher: c})
+			var count int
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			for key, value := iter.First(); key != nil; key, value = iter.Next() {
+				if expected := fmt.Sprintf("value-%04d", count); string(value) != expected {
+					t.Fatalf("expected %s, but found %s", expected, value)
+				}
+				count++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if count != 100 {
+				t.Fatalf("expected 100 entries, but found %d", count)
+			}
+			if r.Properties.NumEntries != 100 {
+				t.Fatalf("expected 100 entries, but found %d", r.Properties.NumEntries)
+			}
+			dataBH, err := firstDataBlockHandle(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Tamper with the first data block, updating the block checksum so that
+			// the modification is only detected by the cipher.
+			data[dataBH.offset] ^= 1
+			trailer := data[dataBH.offset+dataBH.length:]
+			checksum := crc.New(data[dataBH.offset : dataBH.offset+dataBH.length+1]).Value()
+			binary.LittleEndian.PutUint32(trailer[1:], checksum)
+			f, err = mem.Create("tampered")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f, err = mem.Open("tampered")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = NewReader(f, 0, &Options{BlockCipher: c})
+			const expected = "block decryption failed"
+			if _, err := r.get([]byte("key-0000")); err == nil || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("expected %q, but found %v", expected, err)
+			}
+			if v, err := r.get([]byte("key-0099")); err != nil || string(v) != "value-0099" {
+				t.Fatalf("expected value-0099, but found %q (%v)", v, err)
+			}
+			r.Close()
+		})
+	}
+}
+
+func firstDataBlockHandle(r *Reader) (blockHandle, error) {
+	index, err := r.readIndex()
+	if err != nil {
+		return blockHandle{}, err
+	}
+	iter, err := newBlockIter(r.compare, index)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	_, v := iter.First()
+	bh, _ := decodeBlockHandle(v)
+	return bh, nil
+}
+
+func TestBlockCipherTableKeys(t *testing.T) {
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte("k"), 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Options{BlockCipher: c}
+
+	mem := vfs.NewMem()
+	build := func(name string) {
+		writeTestTable(t, mem, name, o, TableOptions{BlockSize: 128}, func(w *Writer) error {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key-%04d", i))
+				if err := w.Set(key, []byte(fmt.Sprintf("value-%04d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	open := func(name string) *Reader {
+		return openTestTable(t, mem, name, o)
+	}
+	firstBlock := func(name string) []byte {
+		r := open(name)
+		defer r.Close()
+		bh, err := firstDataBlockHandle(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, bh.length)
+		if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	check := func(name string) {
+		r := open(name)
+		defer r.Close()
+		for i := 0; i < 100; i++ {
+			v, err := r.get([]byte(fmt.Sprintf("key-%04d", i)))
+			if expected := fmt.Sprintf("value-%04d", i); err != nil || string(v) != expected {
+				t.Fatalf("%s: expected %s, but found %q (%v)", name, expected, v, err)
+			}
+		}
+	}
+
+	// Identical tables written with the same cipher are encrypted with
+	// different keys, so the same block at the same offset is encrypted
+	// differently.
+	build("a")
+	build("b")
+	check("a")
+	check("b")
+	if bytes.Equal(firstBlock("a"), firstBlock("b")) {
+		t.Fatalf("expected the tables to be encrypted with different keys")
+	}
+
+	// A table with a rebuilt filter is encrypted with a new key.
+	r := open("a")
+	f, err := mem.Create("rebuilt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildFilter(r, f, nil /* policy */); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check("rebuilt")
+	if bytes.Equal(firstBlock("a"), firstBlock("rebuilt")) {
+		t.Fatalf("expected the rebuilt table to be encrypted with a new key")
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A table may interleave the keys of several column families, which are
+// written using Writer.AddCF and read using Reader.NewCFIter. The user key of
+// each entry of a column family is prefixed with the big-endian encoded 4-byte
+// ID of the column family, so that the keys of a column family are contiguous
+// and ordered by ID when compared bytewise.
+//
+// The column family ranges meta block is a raw block keyed by the encoded ID
+// of each column family in the table, in increasing order. The value of each
+// entry is:
+//
+//   <smallest-len><smallest><largest>
+//
+// where smallest and largest are the smallest and largest user keys of the
+// column family, without the column family prefix, and smallest-len is the
+// uvarint encoded length of smallest.
+
+// cfPrefixLen is the length of the column family prefix of a user key.
+const cfPrefixLen = 4
+
+var errCorruptCFRange = errors.New("pebble/table: invalid table (bad column family range)")
+
+// cfRange is the range of user keys of a column family.
+type cfRange struct {
+	id                uint32
+	smallest, largest []byte
+}
+
+// AddCF adds a point key/value pair to the column family cfID of the table.
+// The user key is stored with the column family ID as a prefix, and the keys
+// must be added in order of column family ID, and in order of key within a
+// column family. The table must use a comparer which compares keys bytewise,
+// such as the default comparer, so that the keys of the column families are
+// ordered by ID.
+func (w *Writer) AddCF(cfID uint32, key InternalKey, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if key.Kind() == InternalKeyKindRangeDelete || isRangeKey(key.Kind()) {
+		w.err = fmt.Errorf("pebble: column family keys must be point keys: %s", key)
+		return w.err
+	}
+	w.cfKeyBuf = appendCFKey(w.cfKeyBuf[:0], cfID, key.UserKey)
+	if err := w.addPoint(InternalKey{UserKey: w.cfKeyBuf, Trailer: key.Trailer}, value); err != nil {
+		return err
+	}
+
+	if n := len(w.cfRanges); n > 0 && w.cfRanges[n-1].id == cfID {
+		w.cfRanges[n-1].largest = append(w.cfRanges[n-1].largest[:0], key.UserKey...)
+		return nil
+	}
+	w.cfRanges = append(w.cfRanges, cfRange{
+		id:       cfID,
+		smallest: append([]byte(nil), key.UserKey...),
+		largest:  append([]byte(nil), key.UserKey...),
+	})
+	return nil
+}
+
+// appendCFKey appends the user key with the prefix for column family cfID to
+// dst.
+func appendCFKey(dst []byte, cfID uint32, key []byte) []byte {
+	var prefix [cfPrefixLen]byte
+	binary.BigEndian.PutUint32(prefix[:], cfID)
+	return append(append(dst, prefix[:]...), key...)
+}
+
+// finishCFRanges returns the contents of the column family ranges block, or
+// nil if no keys were added to a column family.
+func (w *Writer) finishCFRanges() []byte {
+	if len(w.cfRanges) == 0 {
+		return nil
+	}
+	b := rawBlockWriter{
+		blockWriter: blockWriter{restartInterval: 1},
+	}
+	var key [cfPrefixLen]byte
+	var value []byte
+	for _, cf := range w.cfRanges {
+		binary.BigEndian.PutUint32(key[:], cf.id)
+		n := binary.PutUvarint(w.tmp[:], uint64(len(cf.smallest)))
+		value = append(append(append(value[:0], w.tmp[:n]...), cf.smallest...), cf.largest...)
+		b.add(InternalKey{UserKey: key[:]}, value)
+	}
+	return b.finish()
+}
+
+// lookupCFRange returns the smallest and largest user keys of the column
+// family cfID, without the column family prefix. ok is false if the table
+// does not contain any keys of the column family.
+func (r *Reader) lookupCFRange(cfID uint32) (smallest, largest []byte, ok bool, err error) {
+	if r.cfRanges.bh.length == 0 {
+		return nil, nil, false, nil
+	}
+	b, err := r.readWeakCachedBlock(&r.cfRanges, nil /* transform */)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	iter, err := newRawBlockIter(bytes.Compare, b)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var key [cfPrefixLen]byte
+	binary.BigEndian.PutUint32(key[:], cfID)
+	if !iter.SeekGE(key[:]) || !bytes.Equal(iter.Key().UserKey, key[:]) {
+		return nil, nil, false, iter.Close()
+	}
+	v := iter.Value()
+	n, m := binary.Uvarint(v)
+	if m <= 0 || uint64(len(v)-m) < n {
+		iter.Close()
+		return nil, nil, false, errCorruptCFRange
+	}
+	smallest = v[m : m+int(n)]
+	largest = v[m+int(n):]
+	return smallest, largest, true, iter.Close()
+}
+
+// CFIterator iterates over the point entries of a single column family of a
+// table. The keys returned by the iterator, and the keys passed to its seek
+// methods, do not include the column family prefix.
+type CFIterator struct {
+	cfID  uint32
+	iter  *Iterator
+	lower []byte
+	upper []byte
+	key   InternalKey
+	buf   []byte
+	err   error
+}
+
+// NewCFIter returns an iterator over the point entries of the column family
+// cfID, which were added to the table by Writer.AddCF. The iterator is bounded
+// by the range of the column family recorded in the table, so it never
+// returns the entries of another column family. The iterator is empty if the
+// table does not contain the column family.
+func (r *Reader) NewCFIter(cfID uint32) *CFIterator {
+	i := &CFIterator{cfID: cfID}
+	smallest, largest, ok, err := r.lookupCFRange(cfID)
+	if err != nil {
+		i.err = err
+		return i
+	}
+	if !ok {
+		return i
+	}
+	// The upper bound is the immediate successor of the largest key of the
+	// column family.
+	i.lower = appendCFKey(nil, cfID, smallest)
+	i.upper = append(appendCFKey(nil, cfID, largest), 0)
+	i.iter = r.NewIter(i.lower, i.upper)
+	return i
+}
+
+// strip returns the key with the column family prefix removed.
+func (i *CFIterator) strip(key *InternalKey, value []byte) (*InternalKey, []byte) {
+	if key == nil {
+		return nil, nil
+	}
+	if len(key.UserKey) < cfPrefixLen {
+		i.err = errCorruptCFRange
+		return nil, nil
+	}
+	i.key = InternalKey{UserKey: key.UserKey[cfPrefixLen:], Trailer: key.Trailer}
+	return &i.key, value
+}
+
+// SeekGE moves the iterator to the first entry whose key is greater than or
+// equal to the given key.
+func (i *CFIterator) SeekGE(key []byte) (*InternalKey, []byte) {
+	if i.iter == nil || i.err != nil {
+		return nil, nil
+	}
+	i.buf = appendCFKey(i.buf[:0], i.cfID, key)
+	if bytes.Compare(i.buf, i.lower) < 0 {
+		return i.First()
+	}
+	return i.strip(i.iter.SeekGE(i.buf))
+}
+
+// SeekLT moves the iterator to the last entry whose key is less than the
+// given key.
+func (i *CFIterator) SeekLT(key []byte) (*InternalKey, []byte) {
+	if i.iter == nil || i.err != nil {
+		return nil, nil
+	}
+	i.buf = appendCFKey(i.buf[:0], i.cfID, key)
+	if bytes.Compare(i.buf, i.upper) > 0 {
+		return i.Last()
+	}
+	return i.strip(i.iter.SeekLT(i.buf))
+}
+
+// First moves the iterator to the first entry of the column family.
+func (i *CFIterator) First() (*InternalKey, []byte) {
+	if i.iter == nil || i.err != nil {
+		return nil, nil
+	}
+	return i.strip(i.iter.SeekGE(i.lower))
+}
+
+// Last moves the iterator to the last entry of the column family.
+func (i *CFIterator) Last() (*InternalKey, []byte) {
+	if i.iter == nil || i.err != nil {
+		return nil, nil
+	}
+	return i.strip(i.iter.SeekLT(i.upper))
+}
+
+// Next moves the iterator to the next entry.
+func (i *CFIterator) Next() (*InternalKey, []byte) {
+	if i.iter == nil || i.err != nil {
+		return nil, nil
+	}
+	return i.strip(i.iter.Next())
+}
+
+// Prev moves the iterator to the previous entry.
+func (i *CFIterator) Prev() (*InternalKey, []byte) {
+	if i.iter == nil || i.err != nil {
+		return nil, nil
+	}
+	return i.strip(i.iter.Prev())
+}
+
+// Error returns any accumulated error.
+func (i *CFIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	if i.iter != nil {
+		return i.iter.Error()
+	}
+	return nil
+}
+
+// Close closes the iterator, returning any accumulated error.
+func (i *CFIterator) Close() error {
+	var err error
+	if i.iter != nil {
+		err = i.iter.Close()
+	}
+	if i.err != nil {
+		err = i.err
+	}
+	*i = CFIterator{}
+	return err
+}
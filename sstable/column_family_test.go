@@ -0,0 +1,85 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/petermattis/pebble/internal/base"
+)
+
+func TestColumnFamilies(t *testing.T) {
+	// The column families 1 and 2 contain overlapping user keys, and span
+	// several data blocks.
+	expected := map[uint32][]string{}
+	r := newTestReader(t, nil, TableOptions{BlockSize: 128}, func(w *Writer) error {
+		for _, cf := range []uint32{1, 2} {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("%04d", int(cf)*50+i)
+				value := fmt.Sprintf("cf%d-%s", cf, key)
+				ikey := base.MakeInternalKey([]byte(key), 1, InternalKeyKindSet)
+				if err := w.AddCF(cf, ikey, []byte(value)); err != nil {
+					return err
+				}
+				expected[cf] = append(expected[cf], key+":"+value)
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	for _, cf := range []uint32{0, 1, 2, 3} {
+		iter := r.NewCFIter(cf)
+		var forward, backward []string
+		for key, value := iter.First(); key != nil; key, value = iter.Next() {
+			forward = append(forward, string(key.UserKey)+":"+string(value))
+		}
+		for key, value := iter.Last(); key != nil; key, value = iter.Prev() {
+			backward = append([]string{string(key.UserKey) + ":" + string(value)}, backward...)
+		}
+		if !reflect.DeepEqual(expected[cf], forward) {
+			t.Fatalf("%d: expected\n%v\nbut found\n%v", cf, expected[cf], forward)
+		}
+		if !reflect.DeepEqual(expected[cf], backward) {
+			t.Fatalf("%d: expected\n%v\nbut found\n%v", cf, expected[cf], backward)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Seeks do not move beyond the keys of the column family.
+	iter := r.NewCFIter(1)
+	if key, value := iter.SeekGE([]byte("0100")); key == nil || string(value) != "cf1-0100" {
+		t.Fatalf("expected 0100, but found %s", key)
+	}
+	if key, _ := iter.SeekGE([]byte("0150")); key != nil {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if key, _ := iter.SeekLT([]byte("0050")); key != nil {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if key, _ := iter.SeekLT([]byte("9999")); key == nil || string(key.UserKey) != "0149" {
+		t.Fatalf("expected 0149, but found %s", key)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	iter = r.NewCFIter(2)
+	if key, value := iter.SeekGE([]byte("0000")); key == nil || string(value) != "cf2-0100" {
+		t.Fatalf("expected 0100, but found %s", key)
+	}
+	if key, value := iter.SeekLT([]byte("0149")); key == nil || string(value) != "cf2-0148" {
+		t.Fatalf("expected 0148, but found %s", key)
+	}
+	if key, _ := iter.SeekLT([]byte("0100")); key != nil {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
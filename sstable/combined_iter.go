@@ -0,0 +1,154 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "github.com/petermattis/pebble/internal/base"
+
+// CombinedIterator iterates over the point entries and the range deletion
+// tombstones of a table as a single stream in internal key order. A tombstone
+// is returned as an entry whose key is the tombstone start key, of kind
+// InternalKeyKindRangeDelete, and whose value is the tombstone end key. The
+// kind of the key returned distinguishes tombstones from point entries.
+//
+// Tombstones are ordered by their start key only, so a tombstone is returned
+// before the point entries it covers. CombinedIterator only supports forward
+// iteration.
+type CombinedIterator struct {
+	cmp       Compare
+	points    *Iterator
+	rangeDels *blockIter
+	// The current entry of each of the child iterators. A nil key indicates the
+	// child iterator is exhausted.
+	pointKey      *InternalKey
+	pointValue    []byte
+	rangeDelKey   *InternalKey
+	rangeDelValue []byte
+	// The current entry of the combined iterator.
+	key   *InternalKey
+	value []byte
+	err   error
+}
+
+// NewCombinedIter returns an iterator over the point entries and range
+// deletion tombstones of the table, interleaved in key order.
+func (r *Reader) NewCombinedIter() *CombinedIterator {
+	i := &CombinedIterator{
+		cmp:    r.compare,
+		points: r.NewIter(nil /* lower */, nil /* upper */),
+	}
+	if r.rangeDel.bh.length != 0 {
+		b, err := r.readRangeDel()
+		if err != nil {
+			i.err = err
+			return i
+		}
+		i.rangeDels = &blockIter{}
+		i.err = i.rangeDels.init(r.compare, b, r.Properties.GlobalSeqNum)
+	}
+	return i
+}
+
+// pick sets the current entry to the smaller of the current entries of the
+// child iterators.
+func (i *CombinedIterator) pick() (*InternalKey, []byte) {
+	switch {
+	case i.pointKey == nil:
+		i.key, i.value = i.rangeDelKey, i.rangeDelValue
+	case i.rangeDelKey == nil:
+		i.key, i.value = i.pointKey, i.pointValue
+	case base.InternalCompare(i.cmp, *i.rangeDelKey, *i.pointKey) < 0:
+		i.key, i.value = i.rangeDelKey, i.rangeDelValue
+	default:
+		i.key, i.value = i.pointKey, i.pointValue
+	}
+	return i.key, i.value
+}
+
+// First moves the iterator to the first entry, returning its key and value if
+// the iterator is pointing at a valid entry, and (nil, nil) otherwise.
+func (i *CombinedIterator) First() (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	i.pointKey, i.pointValue = i.points.First()
+	if i.rangeDels != nil {
+		i.rangeDelKey, i.rangeDelValue = i.rangeDels.First()
+	}
+	return i.pick()
+}
+
+// SeekGE moves the iterator to the first entry whose key is greater than or
+// equal to the given key. A tombstone is only found if its start key is
+// greater than or equal to key.
+func (i *CombinedIterator) SeekGE(key []byte) (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	i.pointKey, i.pointValue = i.points.SeekGE(key)
+	if i.rangeDels != nil {
+		i.rangeDelKey, i.rangeDelValue = i.rangeDels.SeekGE(key)
+	}
+	return i.pick()
+}
+
+// Next moves the iterator to the next entry, returning its key and value if
+// the iterator is pointing at a valid entry, and (nil, nil) otherwise.
+func (i *CombinedIterator) Next() (*InternalKey, []byte) {
+	switch {
+	case i.err != nil || i.key == nil:
+		return nil, nil
+	case i.key == i.pointKey:
+		i.pointKey, i.pointValue = i.points.Next()
+	default:
+		i.rangeDelKey, i.rangeDelValue = i.rangeDels.Next()
+	}
+	return i.pick()
+}
+
+// Key returns the key of the current entry, or nil if the iterator is not
+// positioned at an entry.
+func (i *CombinedIterator) Key() *InternalKey {
+	return i.key
+}
+
+// Value returns the value of the current entry. For a tombstone, the value is
+// the tombstone end key.
+func (i *CombinedIterator) Value() []byte {
+	return i.value
+}
+
+// Valid returns true if the iterator is positioned at a valid entry.
+func (i *CombinedIterator) Valid() bool {
+	return i.key != nil && i.err == nil
+}
+
+// Error returns any accumulated error.
+func (i *CombinedIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	if err := i.points.Error(); err != nil {
+		return err
+	}
+	if i.rangeDels != nil {
+		return i.rangeDels.Error()
+	}
+	return nil
+}
+
+// Close closes the iterator, returning any accumulated error.
+func (i *CombinedIterator) Close() error {
+	err := i.points.Close()
+	if i.rangeDels != nil {
+		if err2 := i.rangeDels.Close(); err == nil {
+			err = err2
+		}
+	}
+	if i.err != nil {
+		err = i.err
+	}
+	*i = CombinedIterator{}
+	return err
+}
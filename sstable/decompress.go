@@ -0,0 +1,58 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "io"
+
+// decompressChunkSize is the size of the chunks in which a block is
+// decompressed by decompressChunked.
+const decompressChunkSize = 64 << 10
+
+// streamDecompression returns true if a compressed block whose header claims
+// a decompressed size of decodedLen is decompressed in chunks (see
+// Options.StreamingDecompressionThreshold).
+func (r *Reader) streamDecompression(decodedLen uint64) bool {
+	t := r.opts.StreamingDecompressionThreshold
+	return t > 0 && decodedLen > uint64(t)
+}
+
+// decompressChunked reads the decompressed contents of a block whose header
+// claims a decompressed size of decodedLen from rd. See readGrowing.
+func (r *Reader) decompressChunked(rd io.Reader, decodedLen uint64) ([]byte, error) {
+	return readGrowing(rd, decodedLen, r.alloc, r.free)
+}
+
+// readGrowing reads exactly decodedLen bytes from rd into a buffer allocated
+// by alloc. The buffer starts at decompressChunkSize bytes and doubles as it
+// fills, so a block which decompresses to less than its claimed size fails
+// without allocating that size. Rather than doubling to more than half of
+// decodedLen, the buffer grows to decodedLen, which bounds the memory held at
+// once to 1.5 times decodedLen. The buffers outgrown are released using free.
+func readGrowing(
+	rd io.Reader, decodedLen uint64, alloc func(int) []byte, free func([]byte),
+) ([]byte, error) {
+	clamp := func(size uint64) uint64 {
+		if 2*size > decodedLen {
+			return decodedLen
+		}
+		return size
+	}
+	buf := alloc(int(clamp(decompressChunkSize)))
+	var n int
+	for {
+		m, err := io.ReadFull(rd, buf[n:])
+		if n += m; err != nil {
+			free(buf)
+			return nil, err
+		}
+		if uint64(n) == decodedLen {
+			return buf, nil
+		}
+		grown := alloc(int(clamp(2 * uint64(len(buf)))))
+		copy(grown, buf[:n])
+		free(buf)
+		buf = grown
+	}
+}
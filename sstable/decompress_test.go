@@ -0,0 +1,165 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/rand"
+)
+
+func TestStreamingDecompression(t *testing.T) {
+	// A single large, compressible data block spanning many decompression
+	// chunks.
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("value-%d.", i%7)), 1000)
+	}
+	const numKeys = 300
+	r := newTestReader(t, &Options{StreamingDecompressionThreshold: 1 << 10}, TableOptions{
+		BlockSize:   8 << 20,
+		Compression: ZstdCompression,
+	}, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%04d", i)), value(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if n := r.Properties.NumDataBlocks; n != 1 {
+		t.Fatalf("expected 1 data block, but found %d", n)
+	}
+	if size := r.Properties.DataSize; size*10 > numKeys*uint64(len(value(0))) {
+		t.Fatalf("expected the data block to be compressed, but found %d bytes", size)
+	}
+
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	var n int
+	for key, val := iter.First(); key != nil; key, val = iter.Next() {
+		if expected := fmt.Sprintf("%04d", n); string(key.UserKey) != expected {
+			t.Fatalf("expected key %s, but found %s", expected, key.UserKey)
+		}
+		if !bytes.Equal(val, value(n)) {
+			t.Fatalf("%s: unexpected value", key.UserKey)
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != numKeys {
+		t.Fatalf("expected %d keys, but found %d", numKeys, n)
+	}
+
+	// A zlib compressed block is decompressed in chunks in the same way.
+	var raw []byte
+	for i := 0; i < 100; i++ {
+		raw = append(raw, value(i)...)
+	}
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	zlibBlock := append(tmp[:binary.PutUvarint(tmp[:], uint64(len(raw)))], buf.Bytes()...)
+	decoded, err := r.decodeZlib(zlibBlock, nil /* dict */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, decoded) {
+		t.Fatalf("zlib block decompressed incorrectly")
+	}
+
+	// A block which decompresses to less than its claimed size is rejected,
+	// without allocating the claimed size.
+	const claimed = 1 << 30
+	for _, c := range []struct {
+		name   string
+		decode func(b []byte) ([]byte, error)
+		body   []byte
+	}{
+		{"zlib", func(b []byte) ([]byte, error) { return r.decodeZlib(b, nil /* dict */) }, buf.Bytes()},
+		{"zstd", func(b []byte) ([]byte, error) { return r.decodeZstd(b, nil /* dict */) }, encodeZstd(nil, raw)[binary.PutUvarint(tmp[:], uint64(len(raw))):]},
+	} {
+		b := append(tmp[:binary.PutUvarint(tmp[:], claimed)], c.body...)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := c.decode(b); err == nil {
+			t.Fatalf("%s: expected error", c.name)
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated >= claimed/4 {
+			t.Fatalf("%s: expected a small allocation, but allocated %d bytes", c.name, allocated)
+		}
+	}
+}
+
+func TestReadGrowing(t *testing.T) {
+	rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	for _, decodedLen := range []int{
+		0, 1, decompressChunkSize - 1, decompressChunkSize, decompressChunkSize + 1,
+		2*decompressChunkSize + 1, 300 << 10, 1<<20 + 1, 4<<20 - 1,
+	} {
+		t.Run(fmt.Sprint(decodedLen), func(t *testing.T) {
+			data := make([]byte, decodedLen)
+			rng.Read(data)
+
+			// The memory held at once is tracked through the allocation and
+			// release of the buffers.
+			var live, peak int
+			alloc := func(n int) []byte {
+				if live += n; live > peak {
+					peak = live
+				}
+				return make([]byte, n)
+			}
+			free := func(b []byte) {
+				live -= len(b)
+			}
+
+			decoded, err := readGrowing(bytes.NewReader(data), uint64(decodedLen), alloc, free)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, decoded) {
+				t.Fatalf("decompressed incorrectly")
+			}
+			if live != decodedLen {
+				t.Fatalf("expected %d bytes held, but found %d", decodedLen, live)
+			}
+			if limit := decodedLen + decodedLen/2; peak > limit {
+				t.Fatalf("expected a peak of at most %d bytes, but found %d", limit, peak)
+			}
+
+			// A short read releases the buffers.
+			live, peak = 0, 0
+			if decodedLen > 0 {
+				if _, err := readGrowing(bytes.NewReader(data[:decodedLen-1]), uint64(decodedLen), alloc, free); err == nil {
+					t.Fatalf("expected error")
+				}
+				if live != 0 {
+					t.Fatalf("expected no bytes held, but found %d", live)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+
+	"github.com/petermattis/pebble/internal/base"
+)
+
+// ReadersEqual returns true if the tables read by a and b have the same
+// logical contents: the same point entries, range deletions and range keys,
+// with the same internal keys (including sequence numbers and kinds) and
+// values. Physical differences between the tables, such as their block sizes,
+// compression, checksums, filters and properties, are ignored. The contents
+// are compared using the comparer of a. The tables are walked in lockstep, so
+// ReadersEqual returns as soon as a difference is found.
+func ReadersEqual(a, b *Reader) (bool, error) {
+	if a.err != nil {
+		return false, a.err
+	}
+	if b.err != nil {
+		return false, b.err
+	}
+
+	ai := a.NewIter(nil /* lower */, nil /* upper */)
+	bi := b.NewIter(nil /* lower */, nil /* upper */)
+	equal := iterEntriesEqual(a.compare, ai, bi)
+	err := firstError(ai.Close(), bi.Close())
+	if !equal || err != nil {
+		return false, err
+	}
+
+	for _, blocks := range []func(r *Reader) (block, error){
+		func(r *Reader) (block, error) {
+			if r.rangeDel.bh.length == 0 {
+				return nil, nil
+			}
+			return r.readRangeDel()
+		},
+		func(r *Reader) (block, error) {
+			if r.rangeKey.bh.length == 0 {
+				return nil, nil
+			}
+			return r.readRangeKey()
+		},
+	} {
+		equal, err := blocksEqual(a, b, blocks)
+		if !equal || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// blocksEqual returns true if the meta blocks of a and b returned by blocks
+// have the same entries. A table without the block is considered to have an
+// empty block.
+func blocksEqual(a, b *Reader, blocks func(r *Reader) (block, error)) (bool, error) {
+	ab, err := blocks(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := blocks(b)
+	if err != nil {
+		return false, err
+	}
+	if ab == nil || bb == nil {
+		return ab == nil && bb == nil, nil
+	}
+	var ai, bi blockIter
+	if err := ai.init(a.compare, ab, a.Properties.GlobalSeqNum); err != nil {
+		return false, err
+	}
+	if err := bi.init(b.compare, bb, b.Properties.GlobalSeqNum); err != nil {
+		return false, err
+	}
+	equal := iterEntriesEqual(a.compare, &ai, &bi)
+	return equal, firstError(ai.Close(), bi.Close())
+}
+
+// entryIterator is the subset of the iterator interface used by
+// iterEntriesEqual.
+type entryIterator interface {
+	First() (*InternalKey, []byte)
+	Next() (*InternalKey, []byte)
+}
+
+// iterEntriesEqual returns true if a and b return the same sequence of
+// internal keys and values.
+func iterEntriesEqual(cmp Compare, a, b entryIterator) bool {
+	ak, av := a.First()
+	bk, bv := b.First()
+	for ak != nil && bk != nil {
+		if base.InternalCompare(cmp, *ak, *bk) != 0 || ak.Trailer != bk.Trailer ||
+			!bytes.Equal(av, bv) {
+			return false
+		}
+		ak, av = a.Next()
+		bk, bv = b.Next()
+	}
+	return ak == nil && bk == nil
+}
+
+// firstError returns the first non-nil error, or nil if there is none.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestReadersEqual(t *testing.T) {
+	mem := vfs.NewMem()
+	// build writes a table containing 500 keys and a range deletion. The
+	// modify function may alter the sequence number, kind and value of each
+	// key, or skip the key by returning false.
+	build := func(
+		name string, lo TableOptions, modify func(i int, key *InternalKey, value *[]byte) bool,
+	) *Reader {
+		writeTestTable(t, mem, name, nil, lo, func(w *Writer) error {
+			for i := 0; i < 500; i++ {
+				key := base.MakeInternalKey([]byte(fmt.Sprintf("%04d", i)), uint64(i), InternalKeyKindSet)
+				value := []byte(fmt.Sprintf("value-%d", i))
+				if modify != nil && !modify(i, &key, &value) {
+					continue
+				}
+				if err := w.Add(key, value); err != nil {
+					return err
+				}
+			}
+			return w.DeleteRange([]byte("0100"), []byte("0200"))
+		})
+		return openTestTable(t, mem, name, nil)
+	}
+
+	original := build("original", TableOptions{}, nil)
+	defer original.Close()
+
+	testCases := []struct {
+		name     string
+		lo       TableOptions
+		modify   func(i int, key *InternalKey, value *[]byte) bool
+		expected bool
+	}{
+		{"identical", TableOptions{}, nil, true},
+		{"recompressed", TableOptions{
+			BlockSize:    128,
+			Compression:  NoCompression,
+			FilterPolicy: bloom.FilterPolicy(10),
+		}, nil, true},
+		{"value", TableOptions{}, func(i int, key *InternalKey, value *[]byte) bool {
+			if i == 250 {
+				*value = []byte("modified")
+			}
+			return true
+		}, false},
+		{"seqnum", TableOptions{}, func(i int, key *InternalKey, value *[]byte) bool {
+			if i == 499 {
+				key.SetSeqNum(1000)
+			}
+			return true
+		}, false},
+		{"kind", TableOptions{}, func(i int, key *InternalKey, value *[]byte) bool {
+			if i == 0 {
+				key.SetKind(InternalKeyKindMerge)
+			}
+			return true
+		}, false},
+		{"missing", TableOptions{}, func(i int, key *InternalKey, value *[]byte) bool {
+			return i != 499
+		}, false},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			r := build(c.name, c.lo, c.modify)
+			defer r.Close()
+			for _, pair := range [][2]*Reader{{original, r}, {r, original}} {
+				equal, err := ReadersEqual(pair[0], pair[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if equal != c.expected {
+					t.Fatalf("expected %t, but found %t", c.expected, equal)
+				}
+			}
+		})
+	}
+
+	// Tables which differ only in their range deletions are not equal.
+	r := newTestReader(t, nil, TableOptions{}, func(w *Writer) error {
+		for i := 0; i < 500; i++ {
+			key := base.MakeInternalKey([]byte(fmt.Sprintf("%04d", i)), uint64(i), InternalKeyKindSet)
+			if err := w.Add(key, []byte(fmt.Sprintf("value-%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+	if equal, err := ReadersEqual(original, r); err != nil || equal {
+		t.Fatalf("expected unequal tables, but found %t, %v", equal, err)
+	}
+}
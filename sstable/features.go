@@ -0,0 +1,109 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "strings"
+
+// IndexType is the type of the index of a table, as recorded in the
+// "rocksdb.block.based.table.index.type" property.
+type IndexType uint32
+
+// The index types defined by RocksDB. Pebble only writes and reads
+// BinarySearchIndex tables.
+const (
+	BinarySearchIndex IndexType = iota
+	HashSearchIndex
+	TwoLevelIndex
+)
+
+func (t IndexType) String() string {
+	switch t {
+	case BinarySearchIndex:
+		return "binary-search"
+	case HashSearchIndex:
+		return "hash-search"
+	case TwoLevelIndex:
+		return "two-level"
+	}
+	return "unknown"
+}
+
+// TableFeatures summarizes the format features used by a table. The features
+// are derived from the footer, metaindex and properties of the table, which
+// are read when the table is opened, and do not require a scan of the table.
+type TableFeatures struct {
+	// The format of the table, as determined by the footer magic number.
+	Format TableFormat
+	// The name of the compression algorithm used by the table, as recorded in
+	// the table properties. Empty if the table does not record it.
+	Compression string
+	// HasCompressionDict is true if the data blocks are compressed against a
+	// dictionary stored in a meta block, as written by RocksDB when dictionary
+	// compression is enabled.
+	HasCompressionDict bool
+	// The name of the policy used to build the table filter. Empty if the
+	// table does not have a filter. Note that the filter is only used by the
+	// Reader if the policy is configured in the Reader's options.
+	FilterPolicy string
+	// The type of the filter. Only valid if FilterPolicy is non-empty.
+	FilterType FilterType
+	// FilterEmbedded is true if the filter is embedded in the index block
+	// rather than written as a separate meta block (see
+	// TableOptions.FilterEmbedThreshold).
+	FilterEmbedded bool
+	// The type of the index block.
+	IndexType IndexType
+	// IndexFirstKeys is true if the index entries are keyed by the first key
+	// of the blocks they cover rather than by separator keys (see
+	// TableOptions.IndexFirstKeys).
+	IndexFirstKeys bool
+	// HasRangeDeletions is true if the table has a range deletion block.
+	HasRangeDeletions bool
+	// LegacyRangeDeletions is true if the range deletion block is in the
+	// legacy RocksDB format containing unfragmented range tombstones, which is
+	// fragmented on the fly by the Reader.
+	LegacyRangeDeletions bool
+	// HasUserKeyIndex is true if the table has a user-key index (see
+	// TableOptions.UserKeyIndex).
+	HasUserKeyIndex bool
+	// HasRangeKeys is true if the table has a range-key block.
+	HasRangeKeys bool
+	// HasBlockKeyRanges is true if the table records the key ranges of its
+	// data blocks (see TableOptions.BlockKeyRanges).
+	HasBlockKeyRanges bool
+}
+
+// Features returns the format features used by the table.
+func (r *Reader) Features() TableFeatures {
+	return r.features
+}
+
+func (f *TableFeatures) init(format TableFormat, meta map[string]blockHandle, props *Properties) {
+	f.Format = format
+	f.Compression = props.CompressionName
+	f.IndexType = IndexType(props.IndexType)
+	f.IndexFirstKeys = props.IndexFirstKeys
+	if props.FilterEmbedded {
+		f.FilterPolicy = props.FilterPolicyName
+		f.FilterType = TableFilter
+		f.FilterEmbedded = true
+	}
+	for name := range meta {
+		if strings.HasPrefix(name, "fullfilter.") {
+			f.FilterPolicy = strings.TrimPrefix(name, "fullfilter.")
+			f.FilterType = TableFilter
+		}
+	}
+	if _, ok := meta[metaRangeDelV2Name]; ok {
+		f.HasRangeDeletions = true
+	} else if _, ok := meta[metaRangeDelName]; ok {
+		f.HasRangeDeletions = true
+		f.LegacyRangeDeletions = true
+	}
+	_, f.HasCompressionDict = meta[metaCompressionDictName]
+	_, f.HasUserKeyIndex = meta[metaUserKeyIndexName]
+	_, f.HasRangeKeys = meta[metaRangeKeyName]
+	_, f.HasBlockKeyRanges = meta[metaBlockKeyRangesName]
+}
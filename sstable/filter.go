@@ -4,6 +4,13 @@
 
 package sstable
 
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/exp/rand"
+)
+
 type filterWriter interface {
 	addKey(key []byte)
 	finishBlock(blockOffset uint64) error
@@ -12,8 +19,128 @@ type filterWriter interface {
 	policyName() string
 }
 
+// backgroundFilterBatchSize is the number of keys in each batch of keys
+// handed to the background goroutine of a backgroundFilterWriter.
+const backgroundFilterBatchSize = 1024
+
+// backgroundFilterBatch is a batch of operations on a filterWriter: a
+// sequence of keys, optionally followed by the finishing of a block.
+type backgroundFilterBatch struct {
+	data        []byte
+	offsets     []int
+	finishBlock bool
+	blockOffset uint64
+}
+
+func (b *backgroundFilterBatch) reset() {
+	b.data = b.data[:0]
+	b.offsets = b.offsets[:0]
+	b.finishBlock = false
+}
+
+// backgroundFilterWriter wraps a filterWriter, applying the operations on it
+// in order on a background goroutine.
+type backgroundFilterWriter struct {
+	filterWriter
+	batch   *backgroundFilterBatch
+	batches chan *backgroundFilterBatch
+	free    chan *backgroundFilterBatch
+	done    chan struct{}
+	stopped bool
+	// err is the first error returned by finishBlock. It is only accessed by
+	// the background goroutine until done is closed.
+	err error
+}
+
+func newBackgroundFilterWriter(w filterWriter) *backgroundFilterWriter {
+	const numBatches = 4
+	f := &backgroundFilterWriter{
+		filterWriter: w,
+		batch:        &backgroundFilterBatch{},
+		batches:      make(chan *backgroundFilterBatch, numBatches),
+		free:         make(chan *backgroundFilterBatch, numBatches),
+		done:         make(chan struct{}),
+	}
+	for i := 1; i < numBatches; i++ {
+		f.free <- &backgroundFilterBatch{}
+	}
+	go f.run()
+	return f
+}
+
+func (f *backgroundFilterWriter) run() {
+	defer close(f.done)
+	for b := range f.batches {
+		var start int
+		for _, end := range b.offsets {
+			f.filterWriter.addKey(b.data[start:end])
+			start = end
+		}
+		if b.finishBlock {
+			if err := f.filterWriter.finishBlock(b.blockOffset); err != nil && f.err == nil {
+				f.err = err
+			}
+		}
+		b.reset()
+		f.free <- b
+	}
+}
+
+func (f *backgroundFilterWriter) send() {
+	f.batches <- f.batch
+	f.batch = <-f.free
+}
+
+func (f *backgroundFilterWriter) addKey(key []byte) {
+	b := f.batch
+	b.data = append(b.data, key...)
+	b.offsets = append(b.offsets, len(b.data))
+	if len(b.offsets) >= backgroundFilterBatchSize {
+		f.send()
+	}
+}
+
+func (f *backgroundFilterWriter) finishBlock(blockOffset uint64) error {
+	if f.stopped {
+		// The Writer finishes the index and meta blocks after the filter.
+		return f.filterWriter.finishBlock(blockOffset)
+	}
+	f.batch.finishBlock = true
+	f.batch.blockOffset = blockOffset
+	f.send()
+	return nil
+}
+
+func (f *backgroundFilterWriter) finish() ([]byte, error) {
+	if len(f.batch.offsets) > 0 {
+		f.send()
+	}
+	f.stop()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.filterWriter.finish()
+}
+
+// stop waits for the background goroutine to apply all of the batches sent to
+// it and exit. It is safe to call stop multiple times.
+func (f *backgroundFilterWriter) stop() {
+	if f.stopped {
+		return
+	}
+	f.stopped = true
+	close(f.batches)
+	<-f.done
+}
+
 type tableFilterReader struct {
 	policy FilterPolicy
+	// wholeKey and prefix record whether the filter contains whole user keys
+	// and the prefixes of user keys respectively. A filter must only be
+	// queried in a mode in which it was built, as querying a prefix filter
+	// with a whole key, or vice versa, yields false negatives.
+	wholeKey bool
+	prefix   bool
 }
 
 func newTableFilterReader(policy FilterPolicy) *tableFilterReader {
@@ -26,6 +153,31 @@ func (f *tableFilterReader) mayContain(data, key []byte) bool {
 	return f.policy.MayContain(TableFilter, data, key)
 }
 
+// initMode determines the modes in which the filter may be queried from the
+// table properties. The prefixes in the filter are only usable if they were
+// extracted by the Split function of the Reader, which is identified by the
+// name of the comparer. Tables without the filtering properties, such as
+// those written by LevelDB, contain whole keys.
+func (f *tableFilterReader) initMode(props *Properties, comparer *Comparer) {
+	f.wholeKey = props.WholeKeyFiltering || !props.PrefixFiltering
+	f.prefix = props.PrefixFiltering && comparer.Split != nil &&
+		props.PrefixExtractorName == comparer.Name
+}
+
+// lookupKey returns the key with which the filter is queried for a point
+// lookup of the user key, and false if the filter cannot be used for point
+// lookups.
+func (f *tableFilterReader) lookupKey(key []byte, split Split) ([]byte, bool) {
+	switch {
+	case f.wholeKey:
+		return key, true
+	case f.prefix:
+		return key[:split(key)], true
+	default:
+		return nil, false
+	}
+}
+
 type tableFilterWriter struct {
 	policy FilterPolicy
 	writer FilterWriter
@@ -64,3 +216,57 @@ func (f *tableFilterWriter) metaName() string {
 func (f *tableFilterWriter) policyName() string {
 	return f.policy.Name()
 }
+
+// EstimateFilterFPR empirically estimates the false positive rate of the
+// table filter of r. The filter is queried with the specified number of
+// random keys which are absent from the table, and the fraction of the keys
+// which pass the filter is returned. The filter is queried in the same way
+// as by a point lookup, which for a prefix filter uses the prefixes of the
+// keys. A table without a usable filter has a false positive rate of 1.
+func EstimateFilterFPR(r *Reader, probes int, rng *rand.Rand) (float64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if probes <= 0 {
+		return 0, fmt.Errorf("pebble/table: invalid number of probes %d", probes)
+	}
+	if r.tableFilter == nil {
+		return 1, nil
+	}
+	if _, ok := r.tableFilter.lookupKey(nil, r.split); !ok {
+		// The filter cannot be used, so every key passes.
+		return 1, nil
+	}
+	data, err := r.readFilter()
+	if err != nil {
+		return 0, err
+	}
+
+	// The iterator is used to discard the random keys which are present in
+	// the table. Only the keys which pass the filter need to be checked.
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	key := make([]byte, 16)
+	var passed int
+	for n, attempts := 0, 0; n < probes; attempts++ {
+		if attempts >= 10*probes {
+			iter.Close()
+			return 0, errors.New("pebble/table: unable to generate keys absent from the table")
+		}
+		rng.Read(key)
+		lookupKey, _ := r.tableFilter.lookupKey(key, r.split)
+		if r.tableFilter.mayContain(data, lookupKey) {
+			if ikey, _ := iter.SeekGE(lookupKey); ikey != nil {
+				found, _ := r.tableFilter.lookupKey(ikey.UserKey, r.split)
+				if r.compare(found, lookupKey) == 0 {
+					continue
+				}
+			}
+			passed++
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	return float64(passed) / float64(probes), nil
+}
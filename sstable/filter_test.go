@@ -0,0 +1,54 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"golang.org/x/exp/rand"
+)
+
+func TestEstimateFilterFPR(t *testing.T) {
+	build := func(policy FilterPolicy) *Reader {
+		var levels []TableOptions
+		if policy != nil {
+			levels = []TableOptions{{FilterPolicy: policy}}
+		}
+		lo := TableOptions{FilterPolicy: policy}
+		return newTestReader(t, &Options{Levels: levels}, lo, func(w *Writer) error {
+			for i := 0; i < 10000; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("%05d", i)), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	testCases := []struct {
+		policy   FilterPolicy
+		min, max float64
+	}{
+		{bloom.FilterPolicy(100), 0, 0.001},
+		{bloom.FilterPolicy(10), 0.001, 0.03},
+		{bloom.FilterPolicy(1), 0.4, 0.8},
+		{nil, 1, 1},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprint(c.policy), func(t *testing.T) {
+			r := build(c.policy)
+			defer r.Close()
+			fpr, err := EstimateFilterFPR(r, 10000, rand.New(rand.NewSource(1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fpr < c.min || fpr > c.max {
+				t.Fatalf("expected false positive rate in [%.3f,%.3f], but found %.4f", c.min, c.max, fpr)
+			}
+		})
+	}
+}
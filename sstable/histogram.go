@@ -0,0 +1,118 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+// SampleKeys is an IterOption which configures an Iterator to build an
+// equi-depth histogram of the keys it returns while scanning forward, by
+// sampling every SampleKeys'th entry. The histogram is returned by
+// Iterator.Histogram, and allows statistics about the distribution of the keys
+// of a table to be gathered by a scan which is performed anyway, rather than
+// by a dedicated pass. The histogram describes a single forward scan: First
+// and the SeekGE variants begin a new scan, discarding the histogram of the
+// previous one, and the entries they and Next return are sampled. Last, SeekLT
+// and Prev end the scan, discarding its histogram, and no entries are sampled
+// until the next scan begins. A value less than 1 disables sampling.
+type SampleKeys int
+
+func (n SampleKeys) iterApply(i *Iterator) {
+	if n < 1 {
+		i.sampler = nil
+		return
+	}
+	i.sampler = &keySampler{every: uint64(n)}
+}
+
+// KeyHistogram is an equi-depth histogram of the keys returned by an Iterator
+// configured with SampleKeys. Each bucket but the last holds the same number of
+// entries.
+type KeyHistogram struct {
+	Buckets []HistogramBucket
+}
+
+// HistogramBucket is a bucket of a KeyHistogram.
+type HistogramBucket struct {
+	// UpperBound is the user key of the sampled entry which ends the bucket.
+	// The bucket holds the entries returned after the end of the preceding
+	// bucket, up to and including the sampled entry. UpperBound is nil for the
+	// final bucket if the scan ended between samples, in which case the bucket
+	// holds the remaining entries returned by the scan.
+	UpperBound []byte
+	// Count is the number of entries in the bucket.
+	Count uint64
+}
+
+// keySampler builds the histogram of an Iterator configured with SampleKeys.
+type keySampler struct {
+	every   uint64
+	n       uint64
+	buckets []HistogramBucket
+	// scanning is true if a forward scan is in progress, in which case the
+	// entries returned by the iterator are sampled.
+	scanning bool
+}
+
+// reset discards the histogram, and begins a new forward scan if scanning is
+// true.
+func (s *keySampler) reset(scanning bool) {
+	s.n = 0
+	s.buckets = nil
+	s.scanning = scanning
+}
+
+func (s *keySampler) record(key *InternalKey) {
+	if !s.scanning {
+		return
+	}
+	s.n++
+	if s.n == s.every {
+		s.buckets = append(s.buckets, HistogramBucket{
+			UpperBound: append([]byte(nil), key.UserKey...),
+			Count:      s.n,
+		})
+		s.n = 0
+	}
+}
+
+// startScan begins a new forward scan, discarding the histogram of the
+// iterator, if the iterator is configured with SampleKeys. It is called by
+// First and the SeekGE variants.
+func (i *Iterator) startScan() {
+	if i.sampler != nil {
+		i.sampler.reset(true /* scanning */)
+	}
+}
+
+// endScan ends the forward scan, discarding the histogram of the iterator, if
+// the iterator is configured with SampleKeys. It is called by the backward
+// positioning methods.
+func (i *Iterator) endScan() {
+	if i.sampler != nil {
+		i.sampler.reset(false /* scanning */)
+	}
+}
+
+// sample records the entry returned by a forward positioning method in the
+// histogram of the iterator, if the iterator is configured with SampleKeys.
+func (i *Iterator) sample(key *InternalKey, val []byte) (*InternalKey, []byte) {
+	if i.sampler != nil && key != nil {
+		i.sampler.record(key)
+	}
+	return key, val
+}
+
+// Histogram returns the histogram of the keys returned by the iterator so far,
+// or nil if the iterator is not configured with SampleKeys. The histogram must
+// be retrieved before the iterator is closed.
+func (i *Iterator) Histogram() *KeyHistogram {
+	s := i.sampler
+	if s == nil {
+		return nil
+	}
+	h := &KeyHistogram{Buckets: append([]HistogramBucket(nil), s.buckets...)}
+	if s.n > 0 {
+		h.Buckets = append(h.Buckets, HistogramBucket{Count: s.n})
+	}
+	return h
+}
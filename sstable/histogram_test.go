@@ -0,0 +1,118 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestIteratorHistogram(t *testing.T) {
+	// The keys are skewed: nine tenths of the keys have the prefix "a", with
+	// the remainder spread across the prefixes "b" through "k".
+	var keys []string
+	for i := 0; i < 900; i++ {
+		keys = append(keys, fmt.Sprintf("a%04d", i))
+	}
+	for i := 0; i < 150; i++ {
+		keys = append(keys, fmt.Sprintf("%c%04d", 'b'+i/15, i))
+	}
+
+	r := newTestReader(t, nil, TableOptions{BlockSize: 256}, func(w *Writer) error {
+		for _, key := range keys {
+			if err := w.Set([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	scan := func(iter *Iterator, lower []byte) (int, *KeyHistogram) {
+		var n int
+		var key *InternalKey
+		if lower != nil {
+			key, _ = iter.SeekGE(lower)
+		} else {
+			key, _ = iter.First()
+		}
+		for ; key != nil; key, _ = iter.Next() {
+			n++
+		}
+		h := iter.Histogram()
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return n, h
+	}
+
+	// Each bucket of a full scan holds 100 keys, so nine buckets cover the
+	// keys with the prefix "a". The final 50 keys fall in a partial bucket.
+	n, h := scan(r.NewIter(nil /* lower */, nil /* upper */, SampleKeys(100)), nil)
+	if n != len(keys) {
+		t.Fatalf("expected %d keys, but found %d", len(keys), n)
+	}
+	var expected []HistogramBucket
+	for j := 99; j < len(keys); j += 100 {
+		expected = append(expected, HistogramBucket{UpperBound: []byte(keys[j]), Count: 100})
+	}
+	expected = append(expected, HistogramBucket{Count: 50})
+	if !reflect.DeepEqual(expected, h.Buckets) {
+		t.Fatalf("expected buckets\n%v\nbut found\n%v", expected, h.Buckets)
+	}
+	var prefixes string
+	for _, b := range h.Buckets[:len(h.Buckets)-1] {
+		prefixes += string(b.UpperBound[0])
+	}
+	if prefixes != "aaaaaaaaah" {
+		t.Fatalf("expected bucket prefixes aaaaaaaaah, but found %s", prefixes)
+	}
+
+	// Repositioning the iterator begins a new scan, so repeated scans by the
+	// same iterator produce the histogram of a single scan.
+	iter := r.NewIter(nil /* lower */, nil /* upper */, SampleKeys(100))
+	for j := 0; j < 3; j++ {
+		for key, _ := iter.SeekGE([]byte("a0500")); key != nil && j < 2; key, _ = iter.Next() {
+		}
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		}
+	}
+	if repeated := iter.Histogram(); !reflect.DeepEqual(h, repeated) {
+		t.Fatalf("expected buckets\n%v\nbut found\n%v", h.Buckets, repeated.Buckets)
+	}
+	// Moving backward ends the scan, and the entries returned by Next are not
+	// sampled until a new scan begins.
+	iter.SeekGE([]byte("b"))
+	iter.Prev()
+	for j := 0; j < 200; j++ {
+		iter.Next()
+	}
+	if h := iter.Histogram(); len(h.Buckets) != 0 {
+		t.Fatalf("expected empty histogram, but found %v", h.Buckets)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bounded scan samples only the keys within its bounds.
+	n, h = scan(r.NewIter([]byte("b"), []byte("e"), SampleKeys(10)), []byte("b"))
+	if n != 45 {
+		t.Fatalf("expected 45 keys, but found %d", n)
+	}
+	expected = expected[:0]
+	for j := 909; j < 945; j += 10 {
+		expected = append(expected, HistogramBucket{UpperBound: []byte(keys[j]), Count: 10})
+	}
+	expected = append(expected, HistogramBucket{Count: 5})
+	if !reflect.DeepEqual(expected, h.Buckets) {
+		t.Fatalf("expected buckets\n%v\nbut found\n%v", expected, h.Buckets)
+	}
+
+	// Without SampleKeys, the iterator does not build a histogram.
+	if _, h := scan(r.NewIter(nil /* lower */, nil /* upper */), nil); h != nil {
+		t.Fatalf("expected no histogram, but found %v", h)
+	}
+}
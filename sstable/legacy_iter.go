@@ -0,0 +1,78 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+// LegacyIterAdapter adapts the Iterator API, which returns the key and value
+// from the positioning methods (Seek*, First, Last, Next, Prev), to the older
+// API in which the positioning methods return a boolean corresponding to Valid
+// and the key and value are retrieved with Key and Value. It is intended to
+// ease the migration of code written against the older API.
+type LegacyIterAdapter struct {
+	*Iterator
+}
+
+// NewLegacyIterAdapter returns an adapter for the specified iterator. Closing
+// the adapter closes the underlying iterator.
+func NewLegacyIterAdapter(i *Iterator) *LegacyIterAdapter {
+	return &LegacyIterAdapter{Iterator: i}
+}
+
+// SeekGE moves the iterator to the first entry whose key is greater than or
+// equal to the given key, returning true if the iterator is pointing at a valid
+// entry and false otherwise.
+func (i *LegacyIterAdapter) SeekGE(key []byte) bool {
+	k, _ := i.Iterator.SeekGE(key)
+	return k != nil
+}
+
+// SeekPrefixGE moves the iterator to the first entry whose key is greater than
+// or equal to the given key and which has the given prefix, returning true if
+// the iterator is pointing at a valid entry and false otherwise.
+func (i *LegacyIterAdapter) SeekPrefixGE(prefix, key []byte) bool {
+	k, _ := i.Iterator.SeekPrefixGE(prefix, key)
+	return k != nil
+}
+
+// SeekLT moves the iterator to the last entry whose key is less than the given
+// key, returning true if the iterator is pointing at a valid entry and false
+// otherwise.
+func (i *LegacyIterAdapter) SeekLT(key []byte) bool {
+	k, _ := i.Iterator.SeekLT(key)
+	return k != nil
+}
+
+// First moves the iterator to the first entry, returning true if the iterator
+// is pointing at a valid entry and false otherwise.
+func (i *LegacyIterAdapter) First() bool {
+	k, _ := i.Iterator.First()
+	return k != nil
+}
+
+// Last moves the iterator to the last entry, returning true if the iterator is
+// pointing at a valid entry and false otherwise.
+func (i *LegacyIterAdapter) Last() bool {
+	k, _ := i.Iterator.Last()
+	return k != nil
+}
+
+// Next moves the iterator to the next entry, returning true if the iterator is
+// pointing at a valid entry and false otherwise.
+func (i *LegacyIterAdapter) Next() bool {
+	k, _ := i.Iterator.Next()
+	return k != nil
+}
+
+// Prev moves the iterator to the previous entry, returning true if the
+// iterator is pointing at a valid entry and false otherwise.
+func (i *LegacyIterAdapter) Prev() bool {
+	k, _ := i.Iterator.Prev()
+	return k != nil
+}
+
+// Key returns the key of the current entry. It is only valid to call Key when
+// Valid returns true.
+func (i *LegacyIterAdapter) Key() InternalKey {
+	return *i.Iterator.Key()
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/internal/base"
+)
+
+// MultiGetParallel looks up each of the keys in the table, returning the value
+// of the newest entry for each key. The values and errors are returned in the
+// order of keys: the error for a key which is not present in the table is
+// base.ErrNotFound. The returned values are copies which are owned by the
+// caller.
+//
+// The lookups are spread across up to parallelism goroutines, so that the
+// reads of the data blocks holding different keys proceed concurrently rather
+// than one after another. This hides the latency of the reads when the table
+// is stored on a remote or otherwise high-latency file. A parallelism of 1 or
+// less performs the lookups serially on the calling goroutine.
+//
+// Before any data block is read, all of the keys are checked against the
+// table filter, which is read once for the whole batch. Keys which the filter
+// excludes are not looked up.
+func (r *Reader) MultiGetParallel(keys [][]byte, parallelism int) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	pending, err := r.filterKeys(keys, errs)
+	if err != nil {
+		for j := range errs {
+			errs[j] = err
+		}
+		return values, errs
+	}
+
+	lookup := func(k int) {
+		j := pending[k]
+		values[j], errs[j] = r.getUnfiltered(keys[j])
+	}
+
+	if parallelism > len(pending) {
+		parallelism = len(pending)
+	}
+	if parallelism <= 1 {
+		for k := range pending {
+			lookup(k)
+		}
+		return values, errs
+	}
+
+	// Each goroutine repeatedly claims the next key to look up.
+	next := int64(-1)
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for k := 0; k < parallelism; k++ {
+		go func() {
+			defer wg.Done()
+			for {
+				j := int(atomic.AddInt64(&next, 1))
+				if j >= len(pending) {
+					return
+				}
+				lookup(j)
+			}
+		}()
+	}
+	wg.Wait()
+	return values, errs
+}
+
+// filterKeys returns the indexes of the keys which may be present in the table,
+// setting the error for each of the other keys to base.ErrNotFound. A key may
+// be present if it lies within the bounds of the table and is not excluded by
+// the table filter.
+func (r *Reader) filterKeys(keys [][]byte, errs []error) ([]int, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var data block
+	if r.tableFilter != nil {
+		var err error
+		if data, err = r.readFilter(); err != nil {
+			return nil, err
+		}
+	}
+	pending := make([]int, 0, len(keys))
+	for j, key := range keys {
+		if !r.contains(key) {
+			errs[j] = base.ErrNotFound
+			continue
+		}
+		if data != nil {
+			if lookupKey, ok := r.tableFilter.lookupKey(key, r.split); ok &&
+				!r.tableFilter.mayContain(data, lookupKey) {
+				errs[j] = base.ErrNotFound
+				continue
+			}
+		}
+		pending = append(pending, j)
+	}
+	return pending, nil
+}
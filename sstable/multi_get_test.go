@@ -0,0 +1,211 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestMultiGetParallel(t *testing.T) {
+	// Each value fills a data block, so every key lies in a distinct block.
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte('a' + i%26)}, 300)
+	}
+	mem := vfs.NewMem()
+	lo := TableOptions{BlockSize: 256, Compression: NoCompression}
+	writeTestTable(t, mem, "test", nil, lo, func(w *Writer) error {
+		for i := 0; i < 100; i += 2 {
+			if err := w.Set([]byte(fmt.Sprintf("%03d", i)), value(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// The keys include absent keys, and a key which is looked up twice.
+	var keys [][]byte
+	for i := 0; i < 32; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%03d", 3*i)))
+	}
+	keys = append(keys, []byte("006"))
+
+	const latency = 5 * time.Millisecond
+	multiGet := func(parallelism int) ([][]byte, []error, time.Duration) {
+		f1, err := mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The data blocks are not cached, so every lookup reads from the file.
+		f := &latencyFile{File: f1}
+		r := NewReader(f, 0, nil, BlockCaching(CacheMetaBlocks))
+		defer r.Close()
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		f.latency = latency
+		start := time.Now()
+		values, errs := r.MultiGetParallel(keys, parallelism)
+		return values, errs, time.Since(start)
+	}
+
+	serialValues, serialErrs, serial := multiGet(1)
+	for j, key := range keys {
+		var i int
+		fmt.Sscanf(string(key), "%03d", &i)
+		if i%2 != 0 {
+			if serialErrs[j] != base.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %v", key, serialErrs[j])
+			}
+			continue
+		}
+		if serialErrs[j] != nil || !bytes.Equal(serialValues[j], value(i)) {
+			t.Fatalf("%s: unexpected value %q, %v", key, serialValues[j], serialErrs[j])
+		}
+	}
+
+	values, errs, parallel := multiGet(8)
+	if !reflect.DeepEqual(serialValues, values) || !reflect.DeepEqual(serialErrs, errs) {
+		t.Fatalf("parallel results differ from serial results")
+	}
+	// The serial lookups incur the latency of each block read in turn.
+	if parallel >= serial/2 {
+		t.Fatalf("expected parallel lookups to take less than %s, but took %s", serial/2, parallel)
+	}
+}
+
+func TestMultiGetParallelFilter(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{
+		BlockSize:    256,
+		Compression:  NoCompression,
+		FilterPolicy: bloom.FilterPolicy(20),
+	}, func(w *Writer) error {
+		for i := 0; i < 1000; i += 2 {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, bytes.Repeat(key, 16)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &latencyFile{File: f1}
+	r := NewReader(f, 0, &Options{
+		Levels: []TableOptions{{FilterPolicy: bloom.FilterPolicy(20)}},
+	})
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	// The absent keys are excluded by the filter without reading any data
+	// blocks. Without a block cache, the filter is read once for the batch.
+	var absent [][]byte
+	for i := 7; i < 1000; i += 20 {
+		absent = append(absent, []byte(fmt.Sprintf("%04d", i)))
+	}
+	for _, parallelism := range []int{1, 8} {
+		atomic.StoreInt64(&f.reads, 0)
+		_, errs := r.MultiGetParallel(absent, parallelism)
+		for j, err := range errs {
+			if err != base.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %v", absent[j], err)
+			}
+		}
+		if reads := atomic.LoadInt64(&f.reads); reads != 1 {
+			t.Fatalf("parallelism=%d: expected 1 read, but found %d", parallelism, reads)
+		}
+	}
+
+	// Present keys interleaved with absent keys are found, and the parallel
+	// lookups match the serial lookups.
+	var keys [][]byte
+	for i := 0; i < 1000; i += 7 {
+		keys = append(keys, []byte(fmt.Sprintf("%04d", i)))
+	}
+	serialValues, serialErrs := r.MultiGetParallel(keys, 1)
+	for j, key := range keys {
+		var i int
+		fmt.Sscanf(string(key), "%04d", &i)
+		if i%2 != 0 {
+			if serialErrs[j] != base.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %v", key, serialErrs[j])
+			}
+			continue
+		}
+		if serialErrs[j] != nil || !bytes.Equal(serialValues[j], bytes.Repeat(key, 16)) {
+			t.Fatalf("%s: unexpected value %q, %v", key, serialValues[j], serialErrs[j])
+		}
+	}
+	values, errs := r.MultiGetParallel(keys, 8)
+	if !reflect.DeepEqual(serialValues, values) || !reflect.DeepEqual(serialErrs, errs) {
+		t.Fatalf("parallel results differ from serial results")
+	}
+}
+
+func TestMultiGetParallelEviction(t *testing.T) {
+	// Each value fills a data block, so every key lies in a distinct block.
+	// The blocks are large enough for their memory to be reused by the
+	// allocator once they are evicted.
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%03d", i)), 500)
+	}
+	const numKeys = 200
+	var keys [][]byte
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 1024}, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%03d", i))
+			keys = append(keys, key)
+			if err := w.Set(key, value(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// The cache holds the index block and a few data blocks, so the data
+	// blocks are evicted as soon as they are released, and their memory is
+	// reused by concurrent lookups. Without a BufferPool, the blocks are read
+	// into memory allocated from the cache, which includes the memory of
+	// evicted blocks.
+	for _, bufferPool := range []*cache.BufferPool{nil, cache.NewBufferPool()} {
+		t.Run(fmt.Sprintf("buffer-pool=%t", bufferPool != nil), func(t *testing.T) {
+			r := openTestTable(t, mem, "test", &Options{
+				Cache:      cache.NewWithShards(64<<10, 4),
+				BufferPool: bufferPool,
+			})
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			for iter := 0; iter < 20; iter++ {
+				values, errs := r.MultiGetParallel(keys, 8)
+				for i := range keys {
+					if errs[i] != nil {
+						t.Fatalf("%s: %v", keys[i], errs[i])
+					}
+					if !bytes.Equal(values[i], value(i)) {
+						t.Fatalf("%s: unexpected value %q", keys[i], values[i])
+					}
+				}
+			}
+		})
+	}
+}
@@ -6,6 +6,12 @@ package sstable
 
 import "github.com/petermattis/pebble/internal/base"
 
+// BlockCipher exports the base.BlockCipher type.
+type BlockCipher = base.BlockCipher
+
+// TableCipher exports the base.TableCipher type.
+type TableCipher = base.TableCipher
+
 // Compression exports the base.Compression type.
 type Compression = base.Compression
 
@@ -14,6 +20,17 @@ const (
 	DefaultCompression = base.DefaultCompression
 	NoCompression      = base.NoCompression
 	SnappyCompression  = base.SnappyCompression
+	ZstdCompression    = base.ZstdCompression
+)
+
+// ChecksumType exports the base.ChecksumType type.
+type ChecksumType = base.ChecksumType
+
+// Exported ChecksumType constants.
+const (
+	DefaultChecksum  = base.DefaultChecksum
+	CRC32cChecksum   = base.CRC32cChecksum
+	XXHash64Checksum = base.XXHash64Checksum
 )
 
 // FilterType exports the base.FilterType type.
@@ -0,0 +1,196 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/petermattis/pebble/internal/base"
+)
+
+// partialReadTailSize is the number of bytes at the end of a data block read
+// by the first read of a partial block read, in the expectation that the
+// restart points of the block fit within them.
+const partialReadTailSize = 256
+
+// partialReadKeySize is the number of bytes read at a restart point of a data
+// block by a partial block read, which holds the key of the entry at the
+// restart point unless the key is long.
+const partialReadKeySize = 64
+
+var errCorruptPartialBlock = errors.New("pebble/table: invalid table (corrupt block)")
+
+// getPartial looks up key in the data block referenced by the index entry
+// indexValue, reading only the portion of the block needed to do so. First the
+// block type and the restart points at the end of the block are read. Then the
+// restart points are binary searched, reading the key at each probed restart
+// point, and finally the entries between the restart points surrounding the
+// key are read and searched.
+//
+// The returned ok is false if the block cannot be partially read, such as when
+// the block is compressed or encrypted, or is already present in the cache, in
+// which case the caller should read the whole block. Otherwise found specifies
+// whether key was found in the block.
+func (r *Reader) getPartial(indexValue, key []byte) (value []byte, found, ok bool, err error) {
+	if r.cipher != nil || r.pinned != nil || r.metaOnly {
+		return nil, false, false, nil
+	}
+	group, err := r.decodeIndexEntry(nil, indexValue)
+	if err != nil || len(group) != 1 {
+		return nil, false, false, err
+	}
+	bh := group[0]
+	if bh.length < 4 {
+		return nil, false, false, nil
+	}
+	if h := r.blockCache(CacheDataBlocks).Get(r.fileNum, bh.offset); h.Get() != nil {
+		h.Release()
+		return nil, false, false, nil
+	}
+
+	// Read the tail of the block along with the trailer, which holds the block
+	// type.
+	tailLen := bh.length
+	if tailLen > partialReadTailSize {
+		tailLen = partialReadTailSize
+	}
+	tail := make([]byte, tailLen+blockTrailerLen)
+	if _, err := r.file.ReadAt(tail, int64(bh.offset+bh.length-tailLen)); err != nil {
+		return nil, false, false, err
+	}
+	if tail[tailLen] != noCompressionBlockType {
+		return nil, false, false, nil
+	}
+	tail = tail[:tailLen]
+	numRestarts := uint64(binary.LittleEndian.Uint32(tail[len(tail)-4:]))
+	if numRestarts == 0 || 4*(numRestarts+1) > bh.length {
+		return nil, false, true, errCorruptPartialBlock
+	}
+	restartsLen := 4 * (numRestarts + 1)
+	if restartsLen > tailLen {
+		tail = make([]byte, restartsLen)
+		if _, err := r.file.ReadAt(tail, int64(bh.offset+bh.length-restartsLen)); err != nil {
+			return nil, false, true, err
+		}
+	}
+	restartsOffset := bh.length - restartsLen
+	restarts := tail[len(tail)-int(restartsLen):]
+	restart := func(j int) uint64 {
+		return uint64(binary.LittleEndian.Uint32(restarts[4*j:]))
+	}
+
+	// Find the first restart point whose user key is >= key. The entry at a
+	// restart point does not share a prefix with the preceding entry.
+	var searchErr error
+	j := sort.Search(int(numRestarts), func(j int) bool {
+		if searchErr != nil {
+			return true
+		}
+		var k []byte
+		k, searchErr = r.readRestartKey(bh.offset, restart(j), restartsOffset)
+		if searchErr != nil {
+			return true
+		}
+		return r.compare(base.DecodeInternalKey(k).UserKey, key) >= 0
+	})
+	if searchErr != nil {
+		return nil, false, true, searchErr
+	}
+
+	// The first entry whose user key is >= key lies between the restart point
+	// preceding j and the entry at restart point j, so the entries between the
+	// restart points j-1 and j+1 are read.
+	lo, hi := j, j+1
+	if lo > 0 {
+		lo--
+	}
+	if hi > int(numRestarts) {
+		hi = int(numRestarts)
+	}
+	start, end := restart(lo), restartsOffset
+	if hi < int(numRestarts) {
+		end = restart(hi)
+	}
+	if start >= end || end > restartsOffset {
+		return nil, false, true, errCorruptPartialBlock
+	}
+	// The restart points are read without verifying the checksum of the block,
+	// so they are checked to be increasing before they are used.
+	for k := lo + 1; k < hi; k++ {
+		if restart(k) <= restart(k-1) || restart(k) >= end {
+			return nil, false, true, errCorruptPartialBlock
+		}
+	}
+
+	// The entries are assembled into a block with their own restart points so
+	// that they can be searched with a blockIter.
+	n := hi - lo
+	b := make([]byte, end-start+4*uint64(n+1))
+	if _, err := r.file.ReadAt(b[:end-start], int64(bh.offset+start)); err != nil {
+		return nil, false, true, err
+	}
+	for k := 0; k < n; k++ {
+		binary.LittleEndian.PutUint32(b[end-start+4*uint64(k):], uint32(restart(lo+k)-start))
+	}
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(n))
+
+	var iter blockIter
+	if err := iter.init(r.compare, b, r.Properties.GlobalSeqNum); err != nil {
+		return nil, false, true, err
+	}
+	ikey, v := iter.SeekGE(key)
+	if ikey != nil && r.compare(ikey.UserKey, key) == 0 {
+		value = v
+		found = true
+	}
+	return value, found, true, iter.Close()
+}
+
+// readRestartKey reads the key of the entry at the restart point at offset
+// within the data block at blockOffset. The entries of the block end at
+// restartsOffset.
+func (r *Reader) readRestartKey(blockOffset, offset, restartsOffset uint64) ([]byte, error) {
+	// The entry starts with the shared key length, which is 0 at a restart
+	// point, the unshared key length and the value length. A short key is read
+	// along with the lengths. The offset is read without verifying the checksum
+	// of the block, so it is checked to lie within the entries of the block.
+	if offset >= restartsOffset {
+		return nil, errCorruptPartialBlock
+	}
+	n := uint64(partialReadKeySize)
+	if offset+n > restartsOffset {
+		n = restartsOffset - offset
+	}
+	buf := make([]byte, n)
+	if _, err := r.file.ReadAt(buf, int64(blockOffset+offset)); err != nil {
+		return nil, err
+	}
+	shared, n0 := binary.Uvarint(buf)
+	if n0 <= 0 || shared != 0 {
+		return nil, errCorruptPartialBlock
+	}
+	unshared, n1 := binary.Uvarint(buf[n0:])
+	if n1 <= 0 {
+		return nil, errCorruptPartialBlock
+	}
+	_, n2 := binary.Uvarint(buf[n0+n1:])
+	if n2 <= 0 {
+		return nil, errCorruptPartialBlock
+	}
+	keyOffset := uint64(n0 + n1 + n2)
+	if unshared > restartsOffset-offset-keyOffset {
+		return nil, errCorruptPartialBlock
+	}
+	if keyOffset+unshared <= n {
+		return buf[keyOffset : keyOffset+unshared], nil
+	}
+	k := make([]byte, unshared)
+	if _, err := r.file.ReadAt(k, int64(blockOffset+offset+keyOffset)); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "errors"
+
+// PrefixCountIterator wraps an Iterator, counting the entries with each
+// distinct key prefix as the iterator is scanned forward. The prefix of a key
+// is determined by the Split function of the table's Comparer. Whenever the
+// scan moves past the last entry with a prefix, the prefix and the number of
+// entries seen with it are passed to the callback, which allows the keys per
+// prefix to be counted without a second pass over the data. Each version of a
+// user key is counted as a separate entry.
+//
+// The counts only cover the entries returned by the iterator, so a prefix
+// whose entries are only partially scanned, such as when the scan starts with
+// a seek into the middle of the prefix, is only partially counted.
+type PrefixCountIterator struct {
+	iter   *Iterator
+	split  Split
+	fn     func(prefix []byte, count int64)
+	prefix []byte
+	count  int64
+	err    error
+}
+
+// NewPrefixCountIter returns a PrefixCountIterator which wraps iter and calls
+// fn with each distinct prefix and its count. The prefix passed to fn is only
+// valid for the duration of the call. The returned iterator takes ownership
+// of iter.
+func NewPrefixCountIter(
+	iter *Iterator, fn func(prefix []byte, count int64),
+) *PrefixCountIterator {
+	i := &PrefixCountIterator{iter: iter, fn: fn}
+	if iter.reader != nil {
+		i.split = iter.reader.split
+	}
+	if i.split == nil {
+		i.err = errors.New("pebble/table: counting prefixes requires a Comparer with a Split function")
+	}
+	return i
+}
+
+// flush passes the count of the current prefix, if any, to the callback.
+func (i *PrefixCountIterator) flush() {
+	if i.count > 0 {
+		i.fn(i.prefix, i.count)
+	}
+	i.prefix = i.prefix[:0]
+	i.count = 0
+}
+
+// observe counts the entry at which the iterator is positioned.
+func (i *PrefixCountIterator) observe(key *InternalKey, value []byte) (*InternalKey, []byte) {
+	if key == nil {
+		i.flush()
+		return nil, nil
+	}
+	prefix := key.UserKey[:i.split(key.UserKey)]
+	if i.count > 0 && i.iter.cmp(i.prefix, prefix) != 0 {
+		i.flush()
+	}
+	if i.count == 0 {
+		i.prefix = append(i.prefix[:0], prefix...)
+	}
+	i.count++
+	return key, value
+}
+
+// SeekGE moves the iterator to the first entry whose key is greater than or
+// equal to the given key. The count of the prefix being scanned, if any, is
+// passed to the callback before the seek, and counting starts afresh.
+func (i *PrefixCountIterator) SeekGE(key []byte) (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	i.flush()
+	return i.observe(i.iter.SeekGE(key))
+}
+
+// First moves the iterator to the first entry. The count of the prefix being
+// scanned, if any, is passed to the callback before the iterator is
+// repositioned, and counting starts afresh.
+func (i *PrefixCountIterator) First() (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	i.flush()
+	return i.observe(i.iter.First())
+}
+
+// Next moves the iterator to the next entry. When the iterator is exhausted,
+// the count of the last prefix is passed to the callback.
+func (i *PrefixCountIterator) Next() (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	return i.observe(i.iter.Next())
+}
+
+// Error returns any accumulated error.
+func (i *PrefixCountIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+// Close closes the iterator, returning any accumulated error. The count of the
+// prefix being scanned, if any, is passed to the callback.
+func (i *PrefixCountIterator) Close() error {
+	if i.err == nil {
+		i.flush()
+	}
+	err := i.iter.Close()
+	if i.err != nil {
+		err = i.err
+	}
+	*i = PrefixCountIterator{}
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestPrefixCountIter(t *testing.T) {
+	// The prefix of a key is the portion up to and including the first '/'.
+	comparer := *base.DefaultComparer
+	comparer.Name = "pebble.test.slash-prefix"
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '/'); i >= 0 {
+			return i + 1
+		}
+		return len(a)
+	}
+
+	// The small blocks ensure that most of the prefixes span several data
+	// blocks.
+	counts := []struct {
+		prefix string
+		count  int64
+	}{
+		{"a/", 1}, {"b/", 37}, {"c/", 2}, {"d/", 150}, {"e/", 1},
+	}
+	expected := make(map[string]int64)
+	mem := vfs.NewMem()
+	o := &Options{Comparer: &comparer}
+	writeTestTable(t, mem, "test", o, TableOptions{BlockSize: 64}, func(w *Writer) error {
+		for _, c := range counts {
+			for i := int64(0); i < c.count; i++ {
+				key := []byte(fmt.Sprintf("%s%04d", c.prefix, i))
+				if err := w.Set(key, key); err != nil {
+					return err
+				}
+			}
+			expected[c.prefix] = c.count
+		}
+		return nil
+	})
+	r := openTestTable(t, mem, "test", o)
+	defer r.Close()
+	if r.Properties.NumDataBlocks < 10 {
+		t.Fatalf("expected many data blocks, but found %d", r.Properties.NumDataBlocks)
+	}
+
+	scan := func(seek string) (map[string]int64, []string) {
+		found := make(map[string]int64)
+		var order []string
+		iter := NewPrefixCountIter(r.NewIter(nil /* lower */, nil /* upper */),
+			func(prefix []byte, count int64) {
+				if _, ok := found[string(prefix)]; ok {
+					t.Fatalf("prefix %s emitted twice", prefix)
+				}
+				found[string(prefix)] = count
+				order = append(order, string(prefix))
+			})
+		var key *InternalKey
+		if seek == "" {
+			key, _ = iter.First()
+		} else {
+			key, _ = iter.SeekGE([]byte(seek))
+		}
+		for ; key != nil; key, _ = iter.Next() {
+		}
+		// The count of the last prefix is emitted once the iterator is
+		// exhausted, before it is closed.
+		if len(order) != len(found) || order[len(order)-1] != "e/" {
+			t.Fatalf("expected the last prefix to be emitted, but found %v", order)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return found, order
+	}
+
+	found, order := scan("")
+	if !reflect.DeepEqual(expected, found) {
+		t.Fatalf("expected %v, but found %v", expected, found)
+	}
+	if expectedOrder := []string{"a/", "b/", "c/", "d/", "e/"}; !reflect.DeepEqual(expectedOrder, order) {
+		t.Fatalf("expected %v, but found %v", expectedOrder, order)
+	}
+
+	// A scan starting within a prefix only counts the scanned entries.
+	found, _ = scan("d/0100")
+	if expected := map[string]int64{"d/": 50, "e/": 1}; !reflect.DeepEqual(expected, found) {
+		t.Fatalf("expected %v, but found %v", expected, found)
+	}
+
+	// Counting prefixes requires a Split function.
+	noSplit := comparer
+	noSplit.Split = nil
+	r2 := openTestTable(t, mem, "test", &Options{Comparer: &noSplit})
+	defer r2.Close()
+	iter := NewPrefixCountIter(r2.NewIter(nil /* lower */, nil /* upper */), func([]byte, int64) {})
+	if key, _ := iter.First(); key != nil {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if err := iter.Close(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// The prefix map is written for tables containing few distinct key prefixes
+// (see TableOptions.PrefixMapThreshold). It is a raw block, with a restart
+// point at every entry, keyed by prefix in increasing order. The value of each
+// entry is:
+//
+//   <first><last>
+//
+// where first and last are the uvarint encoded ordinals of the first and last
+// index entries containing keys with the prefix. The index block of a table
+// with a prefix map has a restart point at every entry, which allows the index
+// to be positioned at an ordinal directly.
+
+// prefixMapEntry is the range of index entries containing the keys with a
+// prefix.
+type prefixMapEntry struct {
+	prefix      []byte
+	first, last uint32
+}
+
+// maybeAddToPrefixMap records that the key with the specified user key is
+// being added to the current data block. It must be called after the previous
+// data block, if finished, has been added to the index.
+func (w *Writer) maybeAddToPrefixMap(key []byte) {
+	if w.prefixMapThreshold == 0 {
+		return
+	}
+	prefix := key[:w.split(key)]
+	ordinal := uint32(w.indexBlock.nEntries)
+	if n := len(w.prefixMap); n > 0 && w.compare(w.prefixMap[n-1].prefix, prefix) == 0 {
+		w.prefixMap[n-1].last = ordinal
+		return
+	}
+	if len(w.prefixMap) == w.prefixMapThreshold {
+		// There are too many prefixes for the map to be worthwhile.
+		w.prefixMap = nil
+		w.prefixMapThreshold = 0
+		return
+	}
+	w.prefixMap = append(w.prefixMap, prefixMapEntry{
+		prefix: append([]byte(nil), prefix...),
+		first:  ordinal,
+		last:   ordinal,
+	})
+}
+
+// finishPrefixMap returns the contents of the prefix map block, or nil if no
+// prefix map is to be written.
+func (w *Writer) finishPrefixMap() []byte {
+	if len(w.prefixMap) == 0 {
+		return nil
+	}
+	b := rawBlockWriter{
+		blockWriter: blockWriter{restartInterval: 1},
+	}
+	for _, e := range w.prefixMap {
+		n := binary.PutUvarint(w.tmp[:], uint64(e.first))
+		n += binary.PutUvarint(w.tmp[n:], uint64(e.last))
+		b.add(InternalKey{UserKey: e.prefix}, w.tmp[:n])
+	}
+	return b.finish()
+}
+
+func (r *Reader) readPrefixMap() (block, error) {
+	return r.readWeakCachedBlock(&r.prefixMap, nil /* transform */)
+}
+
+// lookupPrefixMap returns the ordinals of the first and last index entries
+// containing keys with the specified prefix. ok is false if the table does not
+// contain any keys with the prefix.
+func (r *Reader) lookupPrefixMap(prefix []byte) (first, last uint32, ok bool, err error) {
+	b, err := r.readPrefixMap()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	numEntries := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	restarts := len(b) - 4*(1+numEntries)
+	// Every entry in the prefix map is a restart point.
+	entry := func(j int) (key, value []byte) {
+		offset := int(binary.LittleEndian.Uint32(b[restarts+4*j:]))
+		// The first byte is the shared key length which is always 0.
+		unshared, n := binary.Uvarint(b[offset+1:])
+		offset += 1 + n
+		valueLen, n := binary.Uvarint(b[offset:])
+		offset += n
+		key = b[offset : offset+int(unshared)]
+		offset += int(unshared)
+		return key, b[offset : offset+int(valueLen)]
+	}
+
+	j := sort.Search(numEntries, func(j int) bool {
+		k, _ := entry(j)
+		return r.compare(k, prefix) >= 0
+	})
+	if j == numEntries {
+		return 0, 0, false, nil
+	}
+	k, v := entry(j)
+	if r.compare(k, prefix) != 0 {
+		return 0, 0, false, nil
+	}
+	f, n := binary.Uvarint(v)
+	l, m := binary.Uvarint(v[n:])
+	if n <= 0 || m <= 0 || f > l {
+		return 0, 0, false, errors.New("pebble/table: invalid table (bad prefix map entry)")
+	}
+	return uint32(f), uint32(l), true, nil
+}
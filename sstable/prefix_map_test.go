@@ -0,0 +1,195 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestPrefixMap(t *testing.T) {
+	// The prefix of a key is the portion up to and including the first '/'.
+	comparer := *base.DefaultComparer
+	comparer.Name = "pebble.test.slash-prefix"
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '/'); i >= 0 {
+			return i + 1
+		}
+		return len(a)
+	}
+	// Each of the prefixes "a/" to "e/" spans many data blocks, while the
+	// single key with the prefix "x/" lies within a single data block.
+	var keys []string
+	for _, p := range []string{"a/", "b/", "c/", "d/", "e/"} {
+		for i := 0; i < 200; i++ {
+			keys = append(keys, fmt.Sprintf("%s%04d", p, 2*i))
+		}
+	}
+	keys = append(keys, "x/0000")
+
+	mem := vfs.NewMem()
+	build := func(name string, comparer *Comparer, lo TableOptions) {
+		lo.BlockSize = 256
+		lo.FilterPolicy = bloom.FilterPolicy(10)
+		writeTestTable(t, mem, name, &Options{Comparer: comparer}, lo, func(w *Writer) error {
+			for _, k := range keys {
+				if err := w.Set([]byte(k), []byte(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	open := func(name string, comparer *Comparer) (*Reader, *offsetRecordingFile) {
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf := &offsetRecordingFile{File: f}
+		return NewReader(rf, 0, &Options{
+			Cache:    cache.New(1 << 20),
+			Comparer: comparer,
+			Levels:   []TableOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+		}), rf
+	}
+
+	build("map", &comparer, TableOptions{PrefixMapThreshold: 6})
+	build("none", &comparer, TableOptions{})
+	build("too-many", &comparer, TableOptions{PrefixMapThreshold: 5})
+	build("no-split", base.DefaultComparer, TableOptions{PrefixMapThreshold: 6})
+	build("restart-interval", &comparer, TableOptions{
+		PrefixMapThreshold:        6,
+		IndexBlockRestartInterval: 4,
+	})
+
+	// The map is only built if there are few enough prefixes, and if the
+	// prefixes and the index entries can be identified.
+	for _, c := range []struct {
+		name     string
+		comparer *Comparer
+		expected bool
+	}{
+		{"map", &comparer, true},
+		{"none", &comparer, false},
+		{"too-many", &comparer, false},
+		{"no-split", base.DefaultComparer, false},
+		{"restart-interval", &comparer, false},
+	} {
+		r, _ := open(c.name, c.comparer)
+		if err := r.err; err != nil {
+			t.Fatal(err)
+		}
+		if built := r.prefixMap.bh.length != 0; built != c.expected {
+			t.Fatalf("%s: expected prefix map %t, but found %t", c.name, c.expected, built)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, f := open("map", &comparer)
+	defer r.Close()
+	expected, _ := open("none", &comparer)
+	defer expected.Close()
+
+	// SeekPrefixGE returns the same results with and without the map, for
+	// present keys, absent keys within present prefixes and absent prefixes.
+	seekKeys := append([]string(nil), keys...)
+	for _, k := range keys {
+		seekKeys = append(seekKeys, k+"1")
+	}
+	seekKeys = append(seekKeys, "a/9999", "c/", "e/0399", "f/0000", "w/", "x/", "x/1", "z/")
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	expectedIter := expected.NewIter(nil /* lower */, nil /* upper */)
+	for _, k := range seekKeys {
+		key := []byte(k)
+		prefix := key[:comparer.Split(key)]
+		ikey, _ := iter.SeekPrefixGE(prefix, key)
+		expectedKey, _ := expectedIter.SeekPrefixGE(prefix, key)
+		if ikey == nil || expectedKey == nil {
+			if ikey != nil || expectedKey != nil {
+				t.Fatalf("%s: expected %v, but found %v", k, expectedKey, ikey)
+			}
+			continue
+		}
+		if !bytes.Equal(ikey.UserKey, expectedKey.UserKey) {
+			t.Fatalf("%s: expected %s, but found %s", k, expectedKey.UserKey, ikey.UserKey)
+		}
+		// The iterator can be advanced from the sought position.
+		ikey, _ = iter.Next()
+		expectedKey, _ = expectedIter.Next()
+		if (ikey == nil) != (expectedKey == nil) ||
+			(ikey != nil && !bytes.Equal(ikey.UserKey, expectedKey.UserKey)) {
+			t.Fatalf("%s: expected next %v, but found %v", k, expectedKey, ikey)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectedIter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// SeekPrefixLT returns the same results with and without the map, and the
+	// iterator can be moved backward within the prefix.
+	iter = r.NewIter(nil /* lower */, nil /* upper */)
+	expectedIter = expected.NewIter(nil /* lower */, nil /* upper */)
+	for _, k := range seekKeys {
+		key := []byte(k)
+		prefix := key[:comparer.Split(key)]
+		ikey, _ := iter.SeekPrefixLT(prefix, key)
+		expectedKey, _ := expectedIter.SeekPrefixLT(prefix, key)
+		if (ikey == nil) != (expectedKey == nil) ||
+			(ikey != nil && !bytes.Equal(ikey.UserKey, expectedKey.UserKey)) {
+			t.Fatalf("%s: expected %v, but found %v", k, expectedKey, ikey)
+		}
+		if ikey == nil {
+			continue
+		}
+		ikey, _ = iter.Prev()
+		expectedKey, _ = expectedIter.Prev()
+		if (ikey == nil) != (expectedKey == nil) ||
+			(ikey != nil && !bytes.Equal(ikey.UserKey, expectedKey.UserKey)) {
+			t.Fatalf("%s: expected prev %v, but found %v", k, expectedKey, ikey)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectedIter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The map is used in place of the filter, and an absent prefix is rejected
+	// without reading any blocks.
+	for _, off := range f.offsets {
+		if uint64(off) == r.filter.bh.offset {
+			t.Fatalf("unexpected read of the filter block")
+		}
+	}
+	iter = r.NewIter(nil /* lower */, nil /* upper */)
+	f.offsets = nil
+	for _, k := range []string{"f/0000", "w/", "z/0000"} {
+		key := []byte(k)
+		if ikey, _ := iter.SeekPrefixGE(key[:comparer.Split(key)], key); ikey != nil {
+			t.Fatalf("%s: unexpected key %s", k, ikey)
+		}
+		if ikey, _ := iter.SeekPrefixLT(key[:comparer.Split(key)], key); ikey != nil {
+			t.Fatalf("%s: unexpected key %s in reverse", k, ikey)
+		}
+	}
+	if len(f.offsets) != 0 {
+		t.Fatalf("expected no reads, but found %d", len(f.offsets))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
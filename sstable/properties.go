@@ -12,6 +12,8 @@ import (
 	"reflect"
 	"sort"
 	"unsafe"
+
+	"github.com/petermattis/pebble/vfs"
 )
 
 const propertiesBlockRestartInterval = math.MaxInt32
@@ -59,6 +61,10 @@ type Properties struct {
 	ColumnFamilyName string `prop:"rocksdb.column.family.name"`
 	// The name of the comparator used in this table.
 	ComparatorName string `prop:"rocksdb.comparator"`
+	// Whether the Writer stopped compressing blocks part way through the table
+	// because the first data blocks did not compress well (see
+	// TableOptions.MinCompressionRatio).
+	CompressionAbandoned bool `prop:"pebble.compression.abandoned"`
 	// The compression algorithm used to compress blocks.
 	CompressionName string `prop:"rocksdb.compression"`
 	// The compression options used to compress blocks.
@@ -70,6 +76,10 @@ type Properties struct {
 	DataSize uint64 `prop:"rocksdb.data.size"`
 	// Actual SST file creation time. 0 means unknown.
 	FileCreationTime uint64 `prop:"rocksdb.file.creation.time"`
+	// Whether the filter is embedded in the index block, preceding the index
+	// entries, rather than written as a separate meta block (see
+	// TableOptions.FilterEmbedThreshold).
+	FilterEmbedded bool `prop:"pebble.filter.embedded"`
 	// The name of the filter policy used in this table. Empty if no filter
 	// policy is used.
 	FilterPolicyName string `prop:"rocksdb.filter.policy"`
@@ -82,16 +92,31 @@ type Properties struct {
 	// The global sequence number to use for all entries in the table. Present if
 	// the table was created externally and ingested whole.
 	GlobalSeqNum uint64 `prop:"rocksdb.external_sst_file.global_seqno"`
+	// Whether the index entries are keyed by the first key of the data blocks
+	// they cover, rather than by a separator following the last key of those
+	// blocks (see TableOptions.IndexFirstKeys).
+	IndexFirstKeys bool `prop:"pebble.index.first.keys"`
 	// Whether the index key is user key or an internal key.
 	IndexKeyIsUserKey uint64 `prop:"rocksdb.index.key.is.user.key"`
 	// Total number of index partitions if kTwoLevelIndexSearch is used.
 	IndexPartitions uint64 `prop:"rocksdb.index.partitions"`
 	// The size of index block.
 	IndexSize uint64 `prop:"rocksdb.index.size"`
+	// The maximum number of data blocks covered by each index entry (see
+	// TableOptions.IndexSparsity). Only recorded for a sparse index. If 0, each
+	// index entry holds the handle of a single data block.
+	IndexSparsity uint64 `prop:"pebble.index.sparsity"`
 	// The index type. TODO(peter): add a more detailed description.
 	IndexType uint32 `prop:"rocksdb.block.based.table.index.type"`
 	// Whether delta encoding is used to encode the index values.
 	IndexValueIsDeltaEncoded uint64 `prop:"rocksdb.index.value.is.delta.encoded"`
+	// Whether the keys in the data blocks are compressed using the
+	// Comparer.CompressKey function of the comparer named by ComparatorName.
+	KeysCompressed bool `prop:"pebble.keys.compressed"`
+	// The length of the largest value of a point entry in this table. It can
+	// be used to size a buffer which holds any value read from the table. Only
+	// recorded if TableOptions.RecordLargestValueSize is set.
+	LargestValueSize uint64 `prop:"pebble.largest.value.size"`
 	// The name of the merge operator used in this table. Empty if no merge
 	// operator is used.
 	MergeOperatorName string `prop:"rocksdb.merge.operator"`
@@ -105,8 +130,19 @@ type Properties struct {
 	NumMergeOperands uint64 `prop:"rocksdb.merge.operands"`
 	// The number of range deletions in this table.
 	NumRangeDeletions uint64 `prop:"rocksdb.num.range-deletions"`
+	// The number of RANGEKEYDEL entries in this table.
+	NumRangeKeyDels uint64 `prop:"pebble.num.range-key-dels"`
+	// The number of RANGEKEYSET entries in this table.
+	NumRangeKeySets uint64 `prop:"pebble.num.range-key-sets"`
+	// The number of RANGEKEYUNSET entries in this table.
+	NumRangeKeyUnsets uint64 `prop:"pebble.num.range-key-unsets"`
 	// Timestamp of the earliest key. 0 if unknown.
 	OldestKeyTime uint64 `prop:"rocksdb.oldest.key.time"`
+	// An estimate of the number of bytes in the data blocks of this table which
+	// are covered by the range deletions in this table. The estimate is
+	// computed at block granularity, so a data block that overlaps a range
+	// deletion is counted in its entirety.
+	RangeDeletionsBytesEstimate uint64 `prop:"pebble.range-deletions-bytes-estimate"`
 	// The name of the prefix extractor used in this table. Empty if no prefix
 	// extractor is used.
 	PrefixExtractorName string `prop:"rocksdb.prefix.extractor.name"`
@@ -117,10 +153,15 @@ type Properties struct {
 	PropertyCollectorNames string `prop:"rocksdb.property.collectors"`
 	// Total raw key size.
 	RawKeySize uint64 `prop:"rocksdb.raw.key.size"`
+	// Total raw key size of point deletion tombstones.
+	RawPointTombstoneKeySize uint64 `prop:"pebble.raw.point-tombstone.key.size"`
 	// Total raw value size.
 	RawValueSize uint64 `prop:"rocksdb.raw.value.size"`
 	// Size of the top-level index if kTwoLevelIndexSearch is used.
 	TopLevelIndexSize uint64 `prop:"rocksdb.top-level.index.size"`
+	// The size of the user-key index block. 0 if the table does not contain a
+	// user-key index.
+	UserKeyIndexSize uint64 `prop:"pebble.user-key.index.size"`
 	// User collected properties.
 	UserProperties map[string]string
 	// ValueOffsets map from property name to byte offset of the property value
@@ -132,6 +173,18 @@ type Properties struct {
 	WholeKeyFiltering bool `prop:"rocksdb.block.based.table.whole.key.filtering"`
 }
 
+// ReadProperties reads the properties of the table in the open file f. Only
+// the footer, the metaindex and the properties block of the table are read
+// (see NewReaderMeta). The file is not closed.
+func ReadProperties(f vfs.File, o *Options) (*Properties, error) {
+	r := NewReaderMeta(f, o)
+	if r.err != nil {
+		return nil, r.err
+	}
+	props := r.Properties
+	return &props, nil
+}
+
 func (p *Properties) String() string {
 	var buf bytes.Buffer
 	v := reflect.ValueOf(*p)
@@ -257,6 +310,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.ComparatorName != "" {
 		p.saveString(m, unsafe.Offsetof(p.ComparatorName), p.ComparatorName)
 	}
+	if p.CompressionAbandoned {
+		p.saveBool(m, unsafe.Offsetof(p.CompressionAbandoned), p.CompressionAbandoned)
+	}
 	if p.CompressionName != "" {
 		p.saveString(m, unsafe.Offsetof(p.CompressionName), p.CompressionName)
 	}
@@ -268,6 +324,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.FileCreationTime > 0 {
 		p.saveUvarint(m, unsafe.Offsetof(p.FileCreationTime), p.FileCreationTime)
 	}
+	if p.FilterEmbedded {
+		p.saveBool(m, unsafe.Offsetof(p.FilterEmbedded), p.FilterEmbedded)
+	}
 	if p.FilterPolicyName != "" {
 		p.saveString(m, unsafe.Offsetof(p.FilterPolicyName), p.FilterPolicyName)
 	}
@@ -275,14 +334,26 @@ func (p *Properties) save(w *rawBlockWriter) {
 	p.saveUvarint(m, unsafe.Offsetof(p.FixedKeyLen), p.FixedKeyLen)
 	p.saveUvarint(m, unsafe.Offsetof(p.FormatVersion), p.FormatVersion)
 	p.saveUint64(m, unsafe.Offsetof(p.GlobalSeqNum), p.GlobalSeqNum)
+	if p.IndexFirstKeys {
+		p.saveBool(m, unsafe.Offsetof(p.IndexFirstKeys), p.IndexFirstKeys)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.IndexKeyIsUserKey), p.IndexKeyIsUserKey)
 	if p.IndexPartitions != 0 {
 		p.saveUvarint(m, unsafe.Offsetof(p.IndexPartitions), p.IndexPartitions)
 		p.saveUvarint(m, unsafe.Offsetof(p.TopLevelIndexSize), p.TopLevelIndexSize)
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.IndexSize), p.IndexSize)
+	if p.IndexSparsity > 1 {
+		p.saveUvarint(m, unsafe.Offsetof(p.IndexSparsity), p.IndexSparsity)
+	}
 	p.saveUint32(m, unsafe.Offsetof(p.IndexType), p.IndexType)
 	p.saveUvarint(m, unsafe.Offsetof(p.IndexValueIsDeltaEncoded), p.IndexValueIsDeltaEncoded)
+	if p.KeysCompressed {
+		p.saveBool(m, unsafe.Offsetof(p.KeysCompressed), p.KeysCompressed)
+	}
+	if p.LargestValueSize > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.LargestValueSize), p.LargestValueSize)
+	}
 	if p.MergeOperatorName != "" {
 		p.saveString(m, unsafe.Offsetof(p.MergeOperatorName), p.MergeOperatorName)
 	}
@@ -291,6 +362,15 @@ func (p *Properties) save(w *rawBlockWriter) {
 	p.saveUvarint(m, unsafe.Offsetof(p.NumDeletions), p.NumDeletions)
 	p.saveUvarint(m, unsafe.Offsetof(p.NumMergeOperands), p.NumMergeOperands)
 	p.saveUvarint(m, unsafe.Offsetof(p.NumRangeDeletions), p.NumRangeDeletions)
+	if p.NumRangeKeyDels > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumRangeKeyDels), p.NumRangeKeyDels)
+	}
+	if p.NumRangeKeySets > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumRangeKeySets), p.NumRangeKeySets)
+	}
+	if p.NumRangeKeyUnsets > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumRangeKeyUnsets), p.NumRangeKeyUnsets)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.OldestKeyTime), p.OldestKeyTime)
 	if p.PrefixExtractorName != "" {
 		p.saveString(m, unsafe.Offsetof(p.PrefixExtractorName), p.PrefixExtractorName)
@@ -299,8 +379,17 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.PropertyCollectorNames != "" {
 		p.saveString(m, unsafe.Offsetof(p.PropertyCollectorNames), p.PropertyCollectorNames)
 	}
+	if p.RangeDeletionsBytesEstimate > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.RangeDeletionsBytesEstimate), p.RangeDeletionsBytesEstimate)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.RawKeySize), p.RawKeySize)
+	if p.RawPointTombstoneKeySize > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.RawPointTombstoneKeySize), p.RawPointTombstoneKeySize)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.RawValueSize), p.RawValueSize)
+	if p.UserKeyIndexSize > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.UserKeyIndexSize), p.UserKeyIndexSize)
+	}
 	p.saveUint32(m, unsafe.Offsetof(p.Version), p.Version)
 	p.saveBool(m, unsafe.Offsetof(p.WholeKeyFiltering), p.WholeKeyFiltering)
 
@@ -5,6 +5,7 @@
 package sstable
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"os"
@@ -16,6 +17,7 @@ import (
 	"time"
 
 	"github.com/kr/pretty"
+	"github.com/petermattis/pebble/cache"
 )
 
 func TestPropertiesLoad(t *testing.T) {
@@ -86,6 +88,46 @@ func TestPropertiesLoad(t *testing.T) {
 	}
 }
 
+func TestPropertiesLoadRocksDBRangeDeletions(t *testing.T) {
+	// The pre-made table was created by RocksDB from h.txt with the range
+	// deletions [c,d) and [p,q). RocksDB includes range deletions in the entry
+	// and deletion counts.
+	f, err := os.Open(filepath.FromSlash("testdata/h.range-del.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	props := r.Properties
+	if props.NumRangeDeletions != 2 {
+		t.Fatalf("expected 2 range deletions, but found %d", props.NumRangeDeletions)
+	}
+	if props.NumDeletions != 2 {
+		t.Fatalf("expected 2 deletions, but found %d", props.NumDeletions)
+	}
+	if props.NumEntries != 1712 {
+		t.Fatalf("expected 1712 entries, but found %d", props.NumEntries)
+	}
+	if _, ok := props.UserProperties["rocksdb.num.range-deletions"]; ok {
+		t.Fatalf("expected the range deletion count not to be a user property")
+	}
+
+	var tombstones []string
+	iter := r.NewRangeDelIter()
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		tombstones = append(tombstones, fmt.Sprintf("%s-%s", key.UserKey, value))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"c-d", "p-q"}; !reflect.DeepEqual(expected, tombstones) {
+		t.Fatalf("expected %v, but found %v", expected, tombstones)
+	}
+}
+
 func TestPropertiesSave(t *testing.T) {
 	expected := &Properties{
 		ColumnFamilyID:           1,
@@ -153,3 +195,59 @@ func TestPropertiesSave(t *testing.T) {
 		check1(&props)
 	}
 }
+
+func TestReadProperties(t *testing.T) {
+	// The Options share a cache between the tables, which must not return
+	// the blocks of one table for another.
+	o := &Options{Cache: cache.New(1 << 20)}
+	testCases := []struct {
+		filename string
+		check    func(p *Properties) bool
+	}{
+		{"h.sst", func(p *Properties) bool {
+			return p.NumEntries == 1710 && p.CompressionName == "Snappy" &&
+				p.UserProperties["test.key-count"] == "1710"
+		}},
+		{"h.no-compression.sst", func(p *Properties) bool {
+			return p.NumEntries == 1710 && p.CompressionName == "NoCompression" &&
+				p.FilterPolicyName == ""
+		}},
+		{"h.table-bloom.no-compression.sst", func(p *Properties) bool {
+			return p.NumEntries == 1710 && p.FilterPolicyName == "rocksdb.BuiltinBloomFilter" &&
+				p.WholeKeyFiltering && !p.PrefixFiltering
+		}},
+		{"h.table-bloom.no-compression.prefix_extractor.no_whole_key_filter.sst", func(p *Properties) bool {
+			return p.NumEntries == 1710 && p.PrefixFiltering && !p.WholeKeyFiltering &&
+				p.PrefixExtractorName == "leveldb.BytewiseComparator"
+		}},
+		// The LevelDB format table was written by RocksDB, which includes a
+		// properties block.
+		{"h.ldb", func(p *Properties) bool {
+			return p.NumEntries == 1710 && p.ComparatorName == "leveldb.BytewiseComparator"
+		}},
+	}
+	for _, c := range testCases {
+		t.Run(c.filename, func(t *testing.T) {
+			f, err := os.Open(filepath.FromSlash("testdata/" + c.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			p, err := ReadProperties(f, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.check(p) {
+				t.Fatalf("unexpected properties:\n%s", p)
+			}
+			// The file remains open.
+			if _, err := f.ReadAt(make([]byte, 1), 0); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if _, err := ReadProperties(nil, nil); err == nil {
+		t.Fatalf("expected error reading properties of a nil file")
+	}
+}
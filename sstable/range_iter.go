@@ -0,0 +1,69 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+// NewRangeIter returns an iterator over the point entries of the table whose
+// user keys lie within [lower, upper). A nil bound leaves that side of the
+// range unbounded. The iterator has the same contract as the iterator returned
+// by NewIter, but its index holds only the index entries whose data blocks
+// may contain keys within the range, so the cost of positioning the iterator
+// and the memory it retains scale with the size of the range rather than the
+// size of the table. As with NewIter, the data blocks are read as the iterator
+// reaches them.
+//
+// The index block of the table is read in full when the iterator is created,
+// or retrieved from the block cache, as the table has a single index block.
+// Only the overlapping entries are retained by the iterator.
+//
+// SetBounds may narrow the bounds of the iterator, but bounds beyond the range
+// are clamped to the range.
+func (r *Reader) NewRangeIter(lower, upper []byte) *Iterator {
+	i := iterPool.Get().(*Iterator)
+	if err := i.Init(r, lower, upper); err != nil {
+		return i
+	}
+	i.rangeIndex = true
+	i.rangeLower, i.rangeUpper = i.lower, i.upper
+	var index blockIter
+	index, i.index = i.index, index
+	i.err = i.initRangeIndex(&index)
+	if err := index.Close(); i.err == nil {
+		i.err = err
+	}
+	return i
+}
+
+// initRangeIndex initializes the index of the iterator to hold the entries of
+// the table index whose data blocks may contain keys within the bounds of the
+// iterator. The entries are copied to a new block which does not refer to the
+// table index.
+func (i *Iterator) initRangeIndex(index *blockIter) error {
+	var ikey *InternalKey
+	var val []byte
+	if i.lower != nil {
+		ikey, val = i.reader.seekIndexGE(index, i.lower)
+	} else {
+		ikey, val = index.First()
+	}
+	w := blockWriter{restartInterval: 1}
+	for ; ikey != nil; ikey, val = index.Next() {
+		if i.upper != nil && i.reader.Properties.IndexFirstKeys &&
+			i.cmp(ikey.UserKey, i.upper) >= 0 {
+			// The blocks of the entry begin at or after the upper bound.
+			break
+		}
+		w.add(*ikey, val)
+		if i.upper != nil && !i.reader.Properties.IndexFirstKeys &&
+			i.cmp(ikey.UserKey, i.upper) >= 0 {
+			// The separator is at or after the upper bound, so the blocks of the
+			// following entries only contain keys after the upper bound.
+			break
+		}
+	}
+	if index.err != nil {
+		return index.err
+	}
+	return i.index.init(i.cmp, w.finish(), i.reader.Properties.GlobalSeqNum)
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/internal/base"
+)
+
+func TestRangeIter(t *testing.T) {
+	kv := func(key string, seqNum uint64) internalKV {
+		return internalKV{
+			Key:   base.MakeInternalKey([]byte(key), seqNum, InternalKeyKindSet),
+			Value: []byte(key),
+		}
+	}
+	blocks := [][]internalKV{
+		{kv("a", 1), kv("b", 2)},
+		{kv("c", 3), kv("d", 4)},
+		{kv("f", 6), kv("g", 7)},
+		{kv("h", 8)},
+		{kv("j", 10), kv("k", 11)},
+	}
+	str := func(key *InternalKey) string {
+		if key == nil {
+			return "."
+		}
+		return string(key.UserKey)
+	}
+
+	for _, c := range []struct {
+		name string
+		lo   TableOptions
+	}{
+		{"default", TableOptions{}},
+		{"index-first-keys", TableOptions{IndexFirstKeys: true}},
+		{"sparse-index", TableOptions{IndexSparsity: 2}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := newReaderFromBlocks(t, blocks, c.lo)
+			defer r.Close()
+
+			for _, rc := range []struct {
+				lower, upper string
+				// The keys within the range, scanned forward from SeekGE(lower) and
+				// backward from SeekLT(upper).
+				expected string
+				// The maximum number of index entries retained by the iterator.
+				maxEntries int32
+			}{
+				// The bounds lie exactly on block boundaries.
+				{"c", "f", "cd", 2},
+				{"a", "c", "ab", 2},
+				{"f", "h", "fg", 2},
+				{"h", "j", "h", 2},
+				{"c", "k", "cdfghj", 4},
+				{"j", "z", "jk", 1},
+				// The range lies entirely between the keys of two blocks.
+				{"d\x00", "e", "", 2},
+				{"e", "f", "", 2},
+				{"i", "j", "", 2},
+				// The range lies within a single block.
+				{"c\x00", "d\x00", "d", 2},
+				// The range lies before or after all of the keys.
+				{"0", "a", "", 1},
+				{"l", "z", "", 1},
+			} {
+				iter := r.NewRangeIter([]byte(rc.lower), []byte(rc.upper))
+				maxEntries := rc.maxEntries
+				if c.lo.IndexFirstKeys {
+					// The entry preceding the lower bound is retained, as its blocks
+					// may end with older versions of the lower bound.
+					maxEntries++
+				}
+				if n := iter.index.numRestarts; n > maxEntries {
+					t.Fatalf("[%s,%s): expected at most %d index entries, but found %d",
+						rc.lower, rc.upper, maxEntries, n)
+				}
+				var forward string
+				for key, _ := iter.SeekGE([]byte(rc.lower)); key != nil; key, _ = iter.Next() {
+					forward += str(key)
+				}
+				var backward string
+				for key, _ := iter.SeekLT([]byte(rc.upper)); key != nil; key, _ = iter.Prev() {
+					backward = str(key) + backward
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if forward != rc.expected || backward != rc.expected {
+					t.Fatalf("[%s,%s): expected %q, but found %q forward and %q backward",
+						rc.lower, rc.upper, rc.expected, forward, backward)
+				}
+			}
+
+			// SetBounds is confined to the range of the iterator.
+			iter := r.NewRangeIter([]byte("c"), []byte("h"))
+			iter.SetBounds(nil, nil)
+			var keys string
+			for key, _ := iter.SeekGE([]byte("c")); key != nil; key, _ = iter.Next() {
+				keys += str(key)
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if keys != "cdfg" {
+				t.Fatalf("expected cdfg, but found %s", keys)
+			}
+		})
+	}
+}
+
+// TestRangeIterRandomized checks that a range iterator returns the same keys
+// as an iterator over the full index with the same bounds.
+func TestRangeIterRandomized(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	var blocks [][]internalKV
+	for i := 0; i < 1000; {
+		var block []internalKV
+		for n := 1 + rng.Intn(8); n > 0; n-- {
+			block = append(block, internalKV{
+				Key:   base.MakeInternalKey(key(i), uint64(i), InternalKeyKindSet),
+				Value: key(i),
+			})
+			i += 1 + rng.Intn(3)
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, lo := range []TableOptions{
+		{},
+		{IndexFirstKeys: true},
+		{IndexSparsity: 3},
+	} {
+		r := newReaderFromBlocks(t, blocks, lo)
+		for k := 0; k < 200; k++ {
+			lowerIdx := rng.Intn(1100)
+			upperIdx := lowerIdx + rng.Intn(100)
+			lower, upper := key(lowerIdx), key(upperIdx)
+			riter := r.NewRangeIter(lower, upper)
+			iter := r.NewIter(lower, upper)
+			for j := 0; j < 20; j++ {
+				var rkey, ikey *InternalKey
+				switch op := rng.Intn(4); {
+				case op == 0 && upperIdx > lowerIdx:
+					seek := key(lowerIdx + rng.Intn(upperIdx-lowerIdx))
+					rkey, _ = riter.SeekGE(seek)
+					ikey, _ = iter.SeekGE(seek)
+				case op == 1:
+					seek := key(lowerIdx + rng.Intn(upperIdx-lowerIdx+1))
+					rkey, _ = riter.SeekLT(seek)
+					ikey, _ = iter.SeekLT(seek)
+				case op == 2 && iter.Valid():
+					rkey, _ = riter.Next()
+					ikey, _ = iter.Next()
+				case op == 3 && iter.Valid():
+					rkey, _ = riter.Prev()
+					ikey, _ = iter.Prev()
+				default:
+					continue
+				}
+				if (rkey == nil) != (ikey == nil) ||
+					(rkey != nil && base.InternalCompare(r.compare, *rkey, *ikey) != 0) {
+					t.Fatalf("[%s,%s): expected %v, but found %v", lower, upper, ikey, rkey)
+				}
+			}
+			if err := riter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Range keys are stored in the range-key block of a table, separately from
+// the point entries and range deletions. The encoding of the block matches
+// that of CockroachDB's Pebble.
+//
+// The range keys in the block are fragmented: two range keys either have
+// identical bounds or do not overlap. Each entry is keyed by the start key of
+// its span, with a trailer holding the sequence number and one of the kinds
+// RANGEKEYSET, RANGEKEYUNSET or RANGEKEYDEL. All of the suffixes of a kind
+// within a span at a sequence number are coalesced into a single entry. The
+// entry value depends on the kind:
+//
+//   RANGEKEYSET:   <end-len><end>(<suffix-len><suffix><value-len><value>)*
+//   RANGEKEYUNSET: <end-len><end>(<suffix-len><suffix>)*
+//   RANGEKEYDEL:   <end>
+//
+// where each length is a uvarint. The suffixes within an entry are sorted in
+// increasing order by the user key comparator.
+
+// SuffixValue is a suffix and value pair of a range key. The value is always
+// empty for RANGEKEYUNSET.
+type SuffixValue struct {
+	Suffix []byte
+	Value  []byte
+}
+
+// RangeKey is a decoded range key entry covering the user keys [Start,End).
+// SuffixValues is empty for a RANGEKEYDEL.
+type RangeKey struct {
+	Start        InternalKey
+	End          []byte
+	SuffixValues []SuffixValue
+}
+
+func (k RangeKey) String() string {
+	s := fmt.Sprintf("%s#%d,%s-%s", k.Start.UserKey, k.Start.SeqNum(), k.Start.Kind(), k.End)
+	for _, sv := range k.SuffixValues {
+		s += fmt.Sprintf(" %s", sv.Suffix)
+		if k.Start.Kind() == InternalKeyKindRangeKeySet {
+			s += fmt.Sprintf("=%s", sv.Value)
+		}
+	}
+	return s
+}
+
+func isRangeKey(kind InternalKeyKind) bool {
+	switch kind {
+	case InternalKeyKindRangeKeyDelete, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeySet:
+		return true
+	}
+	return false
+}
+
+// EncodeRangeKeyValue appends the encoding of the value of a range key entry
+// of the specified kind to dst. The suffix-value pairs must already be sorted
+// by suffix and are ignored for RANGEKEYDEL.
+func EncodeRangeKeyValue(
+	dst []byte, kind InternalKeyKind, end []byte, suffixValues []SuffixValue,
+) []byte {
+	if kind == InternalKeyKindRangeKeyDelete {
+		return append(dst, end...)
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	appendBytes := func(b []byte) {
+		n := binary.PutUvarint(tmp[:], uint64(len(b)))
+		dst = append(dst, tmp[:n]...)
+		dst = append(dst, b...)
+	}
+	appendBytes(end)
+	for _, sv := range suffixValues {
+		appendBytes(sv.Suffix)
+		if kind == InternalKeyKindRangeKeySet {
+			appendBytes(sv.Value)
+		}
+	}
+	return dst
+}
+
+var errCorruptRangeKey = errors.New("pebble/table: invalid table (corrupt range key)")
+
+// DecodeRangeKey decodes a range key entry from its key and encoded value.
+// The returned RangeKey aliases value.
+func DecodeRangeKey(key InternalKey, value []byte) (RangeKey, error) {
+	k := RangeKey{Start: key}
+	switch key.Kind() {
+	case InternalKeyKindRangeKeyDelete:
+		k.End = value
+		return k, nil
+	case InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeySet:
+	default:
+		return RangeKey{}, fmt.Errorf("pebble/table: invalid range key kind: %s", key.Kind())
+	}
+	decodeBytes := func() ([]byte, bool) {
+		n, m := binary.Uvarint(value)
+		if m <= 0 || uint64(len(value)-m) < n {
+			return nil, false
+		}
+		b := value[m : m+int(n)]
+		value = value[m+int(n):]
+		return b, true
+	}
+	var ok bool
+	if k.End, ok = decodeBytes(); !ok {
+		return RangeKey{}, errCorruptRangeKey
+	}
+	for len(value) > 0 {
+		var sv SuffixValue
+		if sv.Suffix, ok = decodeBytes(); !ok {
+			return RangeKey{}, errCorruptRangeKey
+		}
+		if key.Kind() == InternalKeyKindRangeKeySet {
+			if sv.Value, ok = decodeBytes(); !ok {
+				return RangeKey{}, errCorruptRangeKey
+			}
+		}
+		k.SuffixValues = append(k.SuffixValues, sv)
+	}
+	return k, nil
+}
+
+// rangeKeyFragmenter accumulates the range keys added to a Writer, which may
+// overlap and be added in any order, and fragments and coalesces them into
+// the entries of the range-key block when the table is finished.
+type rangeKeyFragmenter struct {
+	cmp  Compare
+	keys []RangeKey
+}
+
+func (f *rangeKeyFragmenter) add(k RangeKey) {
+	f.keys = append(f.keys, k)
+}
+
+// finish fragments the accumulated range keys, invoking emit for each entry
+// of the range-key block in order. Within a fragment, the suffixes of range
+// keys with the same sequence number and kind are coalesced into a single
+// entry. If a suffix is set more than once, the value added last is used.
+//
+// The fragments are visited in a single sweep over the range keys sorted by
+// start key, maintaining the set of range keys which cover the current
+// fragment.
+func (f *rangeKeyFragmenter) finish(emit func(key InternalKey, value []byte) error) error {
+	if len(f.keys) == 0 {
+		return nil
+	}
+	bounds := make([][]byte, 0, 2*len(f.keys))
+	for _, k := range f.keys {
+		bounds = append(bounds, k.Start.UserKey, k.End)
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return f.cmp(bounds[i], bounds[j]) < 0
+	})
+	// The range keys are referred to by their index in f.keys, which is the
+	// order in which they were added.
+	order := make([]int, len(f.keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return f.cmp(f.keys[order[i]].Start.UserKey, f.keys[order[j]].Start.UserKey) < 0
+	})
+
+	var buf []byte
+	var active, covering []int
+	var next int
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if f.cmp(start, end) == 0 {
+			continue
+		}
+		// Add the range keys starting at or before the fragment, and remove
+		// those ending at or before it. Every bound is the start or end of a
+		// fragment, so the remaining range keys cover the whole fragment.
+		for ; next < len(order) && f.cmp(f.keys[order[next]].Start.UserKey, start) <= 0; next++ {
+			active = append(active, order[next])
+		}
+		n := 0
+		for _, j := range active {
+			if f.cmp(f.keys[j].End, start) > 0 {
+				active[n] = j
+				n++
+			}
+		}
+		active = active[:n]
+
+		// Order the covering range keys by decreasing trailer, preserving the
+		// order in which they were added for identical trailers.
+		covering = append(covering[:0], active...)
+		sort.Slice(covering, func(i, j int) bool {
+			ti, tj := f.keys[covering[i]].Start.Trailer, f.keys[covering[j]].Start.Trailer
+			if ti != tj {
+				return ti > tj
+			}
+			return covering[i] < covering[j]
+		})
+		for j := 0; j < len(covering); {
+			trailer := f.keys[covering[j]].Start.Trailer
+			var suffixValues []SuffixValue
+			for ; j < len(covering) && f.keys[covering[j]].Start.Trailer == trailer; j++ {
+				for _, sv := range f.keys[covering[j]].SuffixValues {
+					suffixValues = f.addSuffixValue(suffixValues, sv)
+				}
+			}
+			key := InternalKey{UserKey: start, Trailer: trailer}
+			buf = EncodeRangeKeyValue(buf[:0], key.Kind(), end, suffixValues)
+			if err := emit(key, buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addSuffixValue inserts sv into the sorted suffixValues, replacing any
+// existing value with the same suffix.
+func (f *rangeKeyFragmenter) addSuffixValue(suffixValues []SuffixValue, sv SuffixValue) []SuffixValue {
+	i := sort.Search(len(suffixValues), func(i int) bool {
+		return f.cmp(suffixValues[i].Suffix, sv.Suffix) >= 0
+	})
+	if i < len(suffixValues) && f.cmp(suffixValues[i].Suffix, sv.Suffix) == 0 {
+		suffixValues[i] = sv
+		return suffixValues
+	}
+	suffixValues = append(suffixValues, SuffixValue{})
+	copy(suffixValues[i+1:], suffixValues[i:])
+	suffixValues[i] = sv
+	return suffixValues
+}
+
+// RangeKeyIterator iterates over the decoded range keys of a table, in the
+// order in which they are stored in the range-key block.
+type RangeKeyIterator struct {
+	iter blockIter
+	key  RangeKey
+	err  error
+}
+
+// NewRangeKeyIter returns an iterator over the range keys of the table, or nil
+// if the table does not contain any range keys.
+func (r *Reader) NewRangeKeyIter() *RangeKeyIterator {
+	if r.rangeKey.bh.length == 0 {
+		return nil
+	}
+	i := &RangeKeyIterator{}
+	b, err := r.readRangeKey()
+	if err == nil {
+		err = i.iter.init(r.compare, b, r.Properties.GlobalSeqNum)
+	}
+	i.err = err
+	return i
+}
+
+func (i *RangeKeyIterator) decode(key *InternalKey, value []byte) *RangeKey {
+	if key == nil {
+		return nil
+	}
+	k, err := DecodeRangeKey(*key, value)
+	if err != nil {
+		i.err = err
+		return nil
+	}
+	i.key = k
+	return &i.key
+}
+
+// First moves the iterator to the first range key, returning it, or nil if
+// there are no range keys. The returned RangeKey is only valid until the next
+// positioning call.
+func (i *RangeKeyIterator) First() *RangeKey {
+	if i.err != nil {
+		return nil
+	}
+	return i.decode(i.iter.First())
+}
+
+// SeekGE moves the iterator to the first range key whose start key is greater
+// than or equal to key, returning it, or nil if there is no such range key.
+func (i *RangeKeyIterator) SeekGE(key []byte) *RangeKey {
+	if i.err != nil {
+		return nil
+	}
+	// The range key kinds are not valid point key kinds, so internal keys of
+	// range keys do not order correctly against the search key of
+	// blockIter.SeekGE. The range keys are instead scanned and compared by user
+	// key.
+	k, v := i.iter.First()
+	for ; k != nil && i.iter.cmp(k.UserKey, key) < 0; k, v = i.iter.Next() {
+	}
+	return i.decode(k, v)
+}
+
+// Next moves the iterator to the next range key, returning it, or nil if the
+// iterator is exhausted.
+func (i *RangeKeyIterator) Next() *RangeKey {
+	if i.err != nil {
+		return nil
+	}
+	return i.decode(i.iter.Next())
+}
+
+// Error returns any accumulated error.
+func (i *RangeKeyIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+// Close closes the iterator, returning any accumulated error.
+func (i *RangeKeyIterator) Close() error {
+	err := i.iter.Close()
+	if i.err != nil {
+		err = i.err
+	}
+	*i = RangeKeyIterator{}
+	return err
+}
@@ -0,0 +1,323 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/vfs"
+	"golang.org/x/exp/rand"
+)
+
+// readRangeKeyEntries returns the encoded keys and values of the entries of
+// the range-key block of r.
+func readRangeKeyEntries(t *testing.T, r *Reader) [][2]string {
+	b, err := r.readRangeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var iter blockIter
+	if err := iter.init(r.compare, b, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	var entries [][2]string
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		buf := make([]byte, key.Size())
+		key.Encode(buf)
+		entries = append(entries, [2]string{hex.EncodeToString(buf), hex.EncodeToString(value)})
+	}
+	return entries
+}
+
+func TestRangeKeyEncoding(t *testing.T) {
+	add := func(w *Writer) error {
+		if err := w.Set([]byte("b"), []byte("point")); err != nil {
+			return err
+		}
+		if err := w.RangeKeySet([]byte("a"), []byte("c"), []byte("@5"), []byte("v5")); err != nil {
+			return err
+		}
+		if err := w.RangeKeySet([]byte("a"), []byte("c"), []byte("@3"), []byte("v3")); err != nil {
+			return err
+		}
+		if err := w.RangeKeyUnset([]byte("a"), []byte("c"), []byte("@1")); err != nil {
+			return err
+		}
+		if err := w.RangeKeyDelete([]byte("a"), []byte("c")); err != nil {
+			return err
+		}
+		if err := w.RangeKeySet([]byte("b"), []byte("e"), []byte("@2"), []byte("v2")); err != nil {
+			return err
+		}
+		return w.RangeKeyUnset([]byte("d"), []byte("f"), []byte("@4"))
+	}
+	r := newTestReader(t, nil, TableOptions{}, add)
+	defer r.Close()
+
+	if !r.Features().HasRangeKeys {
+		t.Fatalf("expected table to have range keys")
+	}
+	if r.Properties.NumRangeKeySets != 4 || r.Properties.NumRangeKeyUnsets != 4 ||
+		r.Properties.NumRangeKeyDels != 2 {
+		t.Fatalf("unexpected range key properties: sets=%d unsets=%d dels=%d",
+			r.Properties.NumRangeKeySets, r.Properties.NumRangeKeyUnsets,
+			r.Properties.NumRangeKeyDels)
+	}
+
+	// The pre-made table was written by CockroachDB's Pebble v1.1.5 using
+	// TableFormatPebblev2, adding the same point key and range keys. The blocks
+	// of the table are laid out as in the RocksDB format, but the footer holds
+	// Pebble's magic number and format version, which are replaced by those of
+	// the RocksDB format in order to open the table.
+	data, err := ioutil.ReadFile(filepath.FromSlash("testdata/rangekey.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magic := data[len(data)-len(rocksDBMagic):]; string(magic) != "\xf0\x9f\xaa\xb3\xf0\x9f\xaa\xb3" {
+		t.Fatalf("unexpected magic number %x", magic)
+	}
+	binary.LittleEndian.PutUint32(data[len(data)-rocksDBFooterLen+rocksDBVersionOffset:], rocksDBFormatVersion2)
+	copy(data[len(data)-len(rocksDBMagic):], rocksDBMagic)
+	mem := vfs.NewMem()
+	f, err := mem.Create("fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = mem.Open("fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := NewReader(f, 0, nil)
+	defer fixture.Close()
+	if fixture.err != nil {
+		t.Fatal(fixture.err)
+	}
+	if fixture.Properties.NumRangeKeySets != r.Properties.NumRangeKeySets ||
+		fixture.Properties.NumRangeKeyUnsets != r.Properties.NumRangeKeyUnsets ||
+		fixture.Properties.NumRangeKeyDels != r.Properties.NumRangeKeyDels {
+		t.Fatalf("unexpected range key properties of the pre-made table: sets=%d unsets=%d dels=%d",
+			fixture.Properties.NumRangeKeySets, fixture.Properties.NumRangeKeyUnsets,
+			fixture.Properties.NumRangeKeyDels)
+	}
+
+	// The encoded key and value of each entry in the range-key block match
+	// those of the pre-made table.
+	expected := readRangeKeyEntries(t, fixture)
+	if len(expected) != 10 {
+		t.Fatalf("expected 10 entries in the pre-made table, but found %d", len(expected))
+	}
+	if actual := readRangeKeyEntries(t, r); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected\n%v\nbut found\n%v", expected, actual)
+	}
+}
+
+func TestRangeKeyRoundTrip(t *testing.T) {
+	r := newTestReader(t, nil, TableOptions{}, func(w *Writer) error {
+		// Point entries are written independently of the range keys.
+		if err := w.Set([]byte("b"), []byte("point")); err != nil {
+			return err
+		}
+		if err := w.RangeKeySet([]byte("c"), []byte("g"), []byte("@2"), []byte("x")); err != nil {
+			return err
+		}
+		if err := w.RangeKeySet([]byte("a"), []byte("e"), []byte("@1"), []byte("y")); err != nil {
+			return err
+		}
+		if err := w.RangeKeyUnset([]byte("d"), []byte("f"), []byte("@3")); err != nil {
+			return err
+		}
+		// A later value for the same suffix replaces the earlier value.
+		if err := w.RangeKeySet([]byte("a"), []byte("b"), []byte("@1"), []byte("z")); err != nil {
+			return err
+		}
+		var buf []byte
+		buf = EncodeRangeKeyValue(buf, InternalKeyKindRangeKeySet, []byte("j"),
+			[]SuffixValue{{Suffix: []byte("@4"), Value: []byte("w")}})
+		if err := w.Add(base.MakeInternalKey([]byte("h"), 7, InternalKeyKindRangeKeySet), buf); err != nil {
+			return err
+		}
+		return w.RangeKeyDelete([]byte("i"), []byte("k"))
+	})
+	defer r.Close()
+
+	expected := []string{
+		"a#0,RANGEKEYSET-b @1=z",
+		"b#0,RANGEKEYSET-c @1=y",
+		"c#0,RANGEKEYSET-d @1=y @2=x",
+		"d#0,RANGEKEYSET-e @1=y @2=x",
+		"d#0,RANGEKEYUNSET-e @3",
+		"e#0,RANGEKEYSET-f @2=x",
+		"e#0,RANGEKEYUNSET-f @3",
+		"f#0,RANGEKEYSET-g @2=x",
+		"h#7,RANGEKEYSET-i @4=w",
+		"i#7,RANGEKEYSET-j @4=w",
+		"i#0,RANGEKEYDEL-j",
+		"j#0,RANGEKEYDEL-k",
+	}
+
+	iter := r.NewRangeKeyIter()
+	var results []string
+	for k := iter.First(); k != nil; k = iter.Next() {
+		results = append(results, k.String())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e, s := strings.Join(expected, "\n"), strings.Join(results, "\n"); e != s {
+		t.Fatalf("expected\n%s\nbut found\n%s", e, s)
+	}
+
+	iter = r.NewRangeKeyIter()
+	if k := iter.SeekGE([]byte("e")); k == nil || k.String() != expected[5] {
+		t.Fatalf("expected %s, but found %v", expected[5], k)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Range keys do not appear in the point iterator.
+	points := r.NewIter(nil /* lower */, nil /* upper */)
+	var n int
+	for key, _ := points.First(); key != nil; key, _ = points.Next() {
+		n++
+	}
+	if err := points.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 point entry, but found %d", n)
+	}
+}
+
+func TestWriterRangeKeyInvalid(t *testing.T) {
+	mem := vfs.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, TableOptions{})
+	if err := w.RangeKeySet([]byte("b"), []byte("a"), nil, nil); err == nil {
+		t.Fatalf("expected error for empty span")
+	}
+	w = NewWriter(f, nil, TableOptions{})
+	key := base.MakeInternalKey([]byte("a"), 0, InternalKeyKindRangeKeySet)
+	if err := w.AddRangeKey(key, []byte{0x05, 'b'}); err == nil {
+		t.Fatalf("expected error for corrupt value")
+	}
+}
+
+// TestRangeKeyFragmenterRandomized checks the fragments produced by the sweep
+// of rangeKeyFragmenter.finish against those found by checking every range
+// key against every fragment.
+func TestRangeKeyFragmenterRandomized(t *testing.T) {
+	seed := uint64(time.Now().UnixNano())
+	rng := rand.New(rand.NewSource(seed))
+	cmp := base.DefaultComparer.Compare
+
+	naive := func(keys []RangeKey) []string {
+		var bounds [][]byte
+		for _, k := range keys {
+			bounds = append(bounds, k.Start.UserKey, k.End)
+		}
+		sort.Slice(bounds, func(i, j int) bool { return cmp(bounds[i], bounds[j]) < 0 })
+		var results []string
+		for i := 0; i+1 < len(bounds); i++ {
+			start, end := bounds[i], bounds[i+1]
+			if cmp(start, end) == 0 {
+				continue
+			}
+			var covering []RangeKey
+			for _, k := range keys {
+				if cmp(k.Start.UserKey, start) <= 0 && cmp(end, k.End) <= 0 {
+					covering = append(covering, k)
+				}
+			}
+			sort.SliceStable(covering, func(i, j int) bool {
+				return covering[i].Start.Trailer > covering[j].Start.Trailer
+			})
+			for j := 0; j < len(covering); {
+				trailer := covering[j].Start.Trailer
+				values := map[string]string{}
+				for ; j < len(covering) && covering[j].Start.Trailer == trailer; j++ {
+					for _, sv := range covering[j].SuffixValues {
+						values[string(sv.Suffix)] = string(sv.Value)
+					}
+				}
+				var suffixValues []SuffixValue
+				for suffix, value := range values {
+					suffixValues = append(suffixValues, SuffixValue{[]byte(suffix), []byte(value)})
+				}
+				sort.Slice(suffixValues, func(i, j int) bool {
+					return cmp(suffixValues[i].Suffix, suffixValues[j].Suffix) < 0
+				})
+				key := InternalKey{UserKey: start, Trailer: trailer}
+				results = append(results, RangeKey{Start: key, End: end, SuffixValues: suffixValues}.String())
+			}
+		}
+		return results
+	}
+
+	kinds := []InternalKeyKind{
+		InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete,
+	}
+	for iter := 0; iter < 100; iter++ {
+		f := rangeKeyFragmenter{cmp: cmp}
+		var keys []RangeKey
+		for n := rng.Intn(30); n >= 0; n-- {
+			a, b := rng.Intn(20), rng.Intn(20)
+			if a == b {
+				continue
+			}
+			if a > b {
+				a, b = b, a
+			}
+			kind := kinds[rng.Intn(len(kinds))]
+			k := RangeKey{
+				Start: base.MakeInternalKey([]byte{'a' + byte(a)}, uint64(rng.Intn(3)), kind),
+				End:   []byte{'a' + byte(b)},
+			}
+			if kind != InternalKeyKindRangeKeyDelete {
+				sv := SuffixValue{Suffix: []byte{'@', '0' + byte(rng.Intn(4))}}
+				if kind == InternalKeyKindRangeKeySet {
+					sv.Value = []byte{'v', '0' + byte(rng.Intn(10))}
+				}
+				k.SuffixValues = []SuffixValue{sv}
+			}
+			keys = append(keys, k)
+			f.add(k)
+		}
+
+		var results []string
+		if err := f.finish(func(key InternalKey, value []byte) error {
+			k, err := DecodeRangeKey(key, value)
+			if err != nil {
+				return err
+			}
+			results = append(results, k.String())
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if e, s := strings.Join(naive(keys), "\n"), strings.Join(results, "\n"); e != s {
+			t.Fatalf("seed %d: expected\n%s\nbut found\n%s", seed, e, s)
+		}
+	}
+}
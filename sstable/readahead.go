@@ -0,0 +1,118 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"io"
+)
+
+// ReadaheadStats holds the readahead counters of an Iterator.
+type ReadaheadStats struct {
+	// The number of readahead reads issued to the file.
+	Reads int64
+	// The number of data blocks served from a readahead buffer.
+	Hits int64
+}
+
+// readaheadState tracks the data blocks loaded by an Iterator in order to
+// detect sequential access. Once Options.ReadaheadThreshold data blocks have
+// been loaded consecutively in sequential order, data blocks which are not
+// present in the block cache are read from the file Options.ReadaheadSize bytes
+// at a time, and subsequent blocks are served from the readahead buffer.
+// Positioning the iterator with a seek resets the state, disabling readahead.
+type readaheadState struct {
+	// The number of consecutive data blocks loaded in sequential order.
+	numSequential int
+	// The offset immediately following the previously loaded data block. Only
+	// valid if hasPrev is true.
+	prevEnd uint64
+	hasPrev bool
+	// The readahead buffer and the file offset of its first byte.
+	buf       []byte
+	bufOffset uint64
+	stats     ReadaheadStats
+	// prefetchSize, if non-zero, forces readahead of prefetchSize bytes
+	// regardless of the access pattern. It is used by Reader.PrefetchRange to
+	// read a run of adjacent blocks with a single read.
+	prefetchSize int
+}
+
+func (ra *readaheadState) reset() {
+	ra.numSequential = 0
+	ra.hasPrev = false
+	ra.buf = ra.buf[:0]
+}
+
+// resetForReuse returns a zero readaheadState which retains the readahead
+// buffer of ra.
+func (ra *readaheadState) resetForReuse() readaheadState {
+	return readaheadState{buf: ra.buf[:0]}
+}
+
+// observe records the load of the data block with the specified handle.
+func (ra *readaheadState) observe(bh blockHandle) {
+	if ra.hasPrev && bh.offset == ra.prevEnd {
+		ra.numSequential++
+	} else {
+		ra.numSequential = 0
+	}
+	ra.prevEnd = bh.offset + bh.length + blockTrailerLen
+	ra.hasPrev = true
+}
+
+func (ra *readaheadState) active(o *Options) bool {
+	if ra.prefetchSize > 0 {
+		return true
+	}
+	return o.ReadaheadThreshold > 0 && ra.numSequential >= o.ReadaheadThreshold
+}
+
+// size returns the number of bytes to read when refilling the readahead
+// buffer.
+func (ra *readaheadState) size(o *Options) int {
+	if ra.prefetchSize > 0 {
+		return ra.prefetchSize
+	}
+	return o.ReadaheadSize
+}
+
+// read fills b with the contents of f starting at offset, serving the read
+// from the readahead buffer if possible and otherwise refilling the buffer
+// with a read of at least size bytes.
+func (ra *readaheadState) read(f io.ReaderAt, b []byte, offset uint64, size int) error {
+	if offset >= ra.bufOffset && offset+uint64(len(b)) <= ra.bufOffset+uint64(len(ra.buf)) {
+		copy(b, ra.buf[offset-ra.bufOffset:])
+		ra.stats.Hits++
+		return nil
+	}
+
+	if size < len(b) {
+		size = len(b)
+	}
+	if cap(ra.buf) < size {
+		ra.buf = make([]byte, size)
+	}
+	ra.buf = ra.buf[:size]
+	n, err := f.ReadAt(ra.buf, int64(offset))
+	if n < len(b) {
+		// A short read is only an error if it did not cover the block. The
+		// readahead may extend past the end of the file.
+		ra.buf = ra.buf[:0]
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	ra.buf = ra.buf[:n]
+	ra.bufOffset = offset
+	ra.stats.Reads++
+	copy(b, ra.buf)
+	return nil
+}
+
+// ReadaheadStats returns the readahead counters of the iterator.
+func (i *Iterator) ReadaheadStats() ReadaheadStats {
+	return i.readahead.stats
+}
@@ -6,16 +6,25 @@ package sstable
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/internal/bytealloc"
 	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/internal/rangedel"
+	"github.com/petermattis/pebble/internal/xxhash"
 	"github.com/petermattis/pebble/vfs"
 )
 
@@ -42,6 +51,52 @@ func encodeBlockHandle(dst []byte, b blockHandle) int {
 	return n + m
 }
 
+// An index entry holds the block handle of a data block. In a sparse index
+// (see TableOptions.IndexSparsity), an index entry instead covers a group of
+// consecutive data blocks and holds the block handle of the first block in the
+// group followed by the uvarint encoded lengths of the remaining blocks. The
+// blocks in a group are contiguous, so the offset of each block following the
+// first is the end of the block before it. An index entry for a single block
+// is identical under both encodings.
+
+// appendIndexEntry appends the index entry for the group of blocks to dst.
+func appendIndexEntry(dst []byte, group []blockHandle) []byte {
+	var tmp [blockHandleMaxLen]byte
+	n := encodeBlockHandle(tmp[:], group[0])
+	dst = append(dst, tmp[:n]...)
+	for _, bh := range group[1:] {
+		n = binary.PutUvarint(tmp[:], bh.length)
+		dst = append(dst, tmp[:n]...)
+	}
+	return dst
+}
+
+// decodeIndexEntry decodes the block handles of the group of blocks covered by
+// the index entry src, appending them to dst. An index entry holding more
+// block handles than the sparsity of the table's index is corrupt.
+func (r *Reader) decodeIndexEntry(dst []blockHandle, src []byte) ([]blockHandle, error) {
+	bh, n := decodeBlockHandle(src)
+	if n == 0 {
+		return dst, errCorruptIndexEntry
+	}
+	dst = append(dst, bh)
+	blocks := uint64(1)
+	for src = src[n:]; len(src) > 0; src = src[n:] {
+		if blocks++; blocks > r.Properties.IndexSparsity {
+			return dst, errCorruptIndexEntry
+		}
+		var length uint64
+		if length, n = binary.Uvarint(src); n <= 0 {
+			return dst, errCorruptIndexEntry
+		}
+		bh = blockHandle{offset: bh.offset + bh.length + blockTrailerLen, length: length}
+		dst = append(dst, bh)
+	}
+	return dst, nil
+}
+
+var errCorruptIndexEntry = errors.New("pebble/table: corrupt index entry")
+
 // block is a []byte that holds a sequence of key/value pairs plus an index
 // over those pairs.
 type block []byte
@@ -62,8 +117,74 @@ type Iterator struct {
 	index      blockIter
 	data       blockIter
 	dataBH     blockHandle
-	err        error
-	closeHook  func(i *Iterator) error
+	// group holds the handles of the data blocks covered by the current index
+	// entry, and dataBH is group[groupIdx]. The group holds a single block
+	// unless the table has a sparse index.
+	group     []blockHandle
+	groupIdx  int
+	err       error
+	closeHook func(i *Iterator) error
+	readahead readaheadState
+	stats     IteratorStats
+	// resetStats accumulates the stats of the iterator prior to the last call
+	// to ResetStats.
+	resetStats IteratorStats
+	// skipCorrupt, if non-nil, records the data blocks which could not be
+	// loaded and were skipped. See SkipCorruptBlocks.
+	skipCorrupt *SkipCorruptBlocks
+	// rangeIndex is true if the iterator was created by NewRangeIter, in which
+	// case the index only holds the entries overlapping [rangeLower,
+	// rangeUpper), and the bounds of the iterator are confined to that range.
+	rangeIndex             bool
+	rangeLower, rangeUpper []byte
+	// sampler, if non-nil, samples the keys returned by the iterator into a
+	// histogram. See SampleKeys.
+	sampler *keySampler
+}
+
+// IteratorStats holds the time an Iterator has spent loading data blocks
+// which were not present in the block cache, split into the two phases of
+// loading a block. Time spent reading the block from the file is I/O time, while
+// time spent verifying, decrypting and decompressing the block is CPU time. A
+// large read duration indicates a slow disk or an undersized block cache,
+// while a large decode duration indicates that the iterator is CPU bound.
+type IteratorStats struct {
+	// The number of data blocks read from the file.
+	BlockReads int64
+	// The time spent reading data blocks from the file.
+	BlockReadDuration time.Duration
+	// The time spent decoding the data blocks read from the file.
+	BlockDecodeDuration time.Duration
+}
+
+// add adds the counters of o to s.
+func (s *IteratorStats) add(o IteratorStats) {
+	s.BlockReads += o.BlockReads
+	s.BlockReadDuration += o.BlockReadDuration
+	s.BlockDecodeDuration += o.BlockDecodeDuration
+}
+
+// Stats returns the block loading statistics of the iterator since it was
+// created or since the last call to ResetStats.
+func (i *Iterator) Stats() IteratorStats {
+	return i.stats
+}
+
+// ResetStats zeroes the statistics returned by Stats. An iterator which is
+// reused for several queries, such as by SetBounds, can reset its statistics
+// before each query in order to attribute the block loads to the query. The
+// statistics returned by CumulativeStats are not affected.
+func (i *Iterator) ResetStats() {
+	i.resetStats.add(i.stats)
+	i.stats = IteratorStats{}
+}
+
+// CumulativeStats returns the block loading statistics of the iterator since
+// it was created, regardless of calls to ResetStats.
+func (i *Iterator) CumulativeStats() IteratorStats {
+	stats := i.resetStats
+	stats.add(i.stats)
+	return stats
 }
 
 var iterPool = sync.Pool{
@@ -76,11 +197,16 @@ var iterPool = sync.Pool{
 // with Reader.NewIter, but allows for reusing of the Iterator between
 // different Readers.
 func (i *Iterator) Init(r *Reader, lower, upper []byte) error {
+	lower, upper = r.intersectBounds(lower, upper)
 	*i = Iterator{
-		lower:  lower,
-		upper:  upper,
-		reader: r,
-		err:    r.err,
+		lower:     lower,
+		upper:     upper,
+		reader:    r,
+		err:       r.err,
+		index:     i.index.resetForReuse(),
+		data:      i.data.resetForReuse(),
+		group:     i.group[:0],
+		readahead: i.readahead.resetForReuse(),
 	}
 	if i.err == nil {
 		var index block
@@ -112,7 +238,8 @@ func (i *Iterator) initBounds() {
 		}
 	}
 	i.blockUpper = i.upper
-	if i.blockUpper != nil && i.cmp(i.blockUpper, i.index.Key().UserKey) > 0 {
+	if i.blockUpper != nil && !i.reader.Properties.IndexFirstKeys &&
+		i.cmp(i.blockUpper, i.index.Key().UserKey) > 0 {
 		// The upper-bound is greater than the index key which itself is greater
 		// than or equal to every key in the block. No need to check the
 		// upper-bound again for this block.
@@ -120,10 +247,28 @@ func (i *Iterator) initBounds() {
 	}
 }
 
-// loadBlock loads the block at the current index position and leaves i.data
-// unpositioned. If unsuccessful, it sets i.err to any error encountered, which
-// may be nil if we have simply exhausted the entire table.
+// loadBlock loads the first block of the group at the current index position
+// and leaves i.data unpositioned. If unsuccessful, it sets i.err to any error
+// encountered, which may be nil if we have simply exhausted the entire table.
 func (i *Iterator) loadBlock() bool {
+	if !i.loadGroup() {
+		return false
+	}
+	return i.loadGroupBlock(0)
+}
+
+// loadLastBlock is like loadBlock, but loads the last block of the group at
+// the current index position.
+func (i *Iterator) loadLastBlock() bool {
+	if !i.loadGroup() {
+		return false
+	}
+	return i.loadGroupBlock(len(i.group) - 1)
+}
+
+// loadGroup decodes the handles of the blocks covered by the index entry at
+// the current index position.
+func (i *Iterator) loadGroup() bool {
 	if !i.index.Valid() {
 		i.err = i.index.err
 		// TODO(peter): Need to test that seeking to a key outside of the sstable
@@ -132,58 +277,82 @@ func (i *Iterator) loadBlock() bool {
 		i.data.restarts = 0
 		return false
 	}
-	// Load the next block.
-	v := i.index.Value()
-	var n int
-	i.dataBH, n = decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
-		return false
-	}
-	block, err := i.reader.readBlock(i.dataBH, nil /* transform */)
-	if err != nil {
-		i.err = err
-		return false
-	}
-	i.data.setCacheHandle(block)
-	i.err = i.data.init(i.cmp, block.Get(), i.reader.Properties.GlobalSeqNum)
-	if i.err != nil {
+	i.group, i.err = i.reader.decodeIndexEntry(i.group[:0], i.index.Value())
+	return i.err == nil
+}
+
+// loadGroupBlock loads the j'th block of the current group and leaves i.data
+// unpositioned.
+func (i *Iterator) loadGroupBlock(j int) bool {
+	i.groupIdx = j
+	i.dataBH = i.group[j]
+	i.readahead.observe(i.dataBH)
+	block, err := i.reader.readBlock(i.dataBH, nil /* transform */, &i.readahead, &i.stats)
+	if err == nil {
+		i.data.setCacheHandle(block)
+		err = i.data.init(i.cmp, block.Get(), i.reader.Properties.GlobalSeqNum)
+	}
+	if err != nil && i.skipCorrupt != nil {
+		// The block is replaced by an empty block, which is skipped in the same
+		// way as a block without any entries in the kind mask.
+		i.skipCorrupt.add(i.dataBH, err)
+		i.data.setCacheHandle(cache.Handle{})
+		err = i.data.init(i.cmp, emptyDataBlock, i.reader.Properties.GlobalSeqNum)
+	}
+	if i.err = err; i.err != nil {
 		return false
 	}
 	i.initBounds()
 	return true
 }
 
-// seekBlock loads the block at the current index position and positions i.data
-// at the first key in that block which is >= the given key. If unsuccessful,
-// it sets i.err to any error encountered, which may be nil if we have simply
-// exhausted the entire table.
-func (i *Iterator) seekBlock(key []byte) bool {
-	if !i.index.Valid() {
-		i.err = i.index.err
-		return false
+// mayHaveEmptyBlocks returns true if a data block loaded by the iterator may
+// present no entries, in which case the block must be skipped. This happens if
+// the iterator has a kind mask, or if it replaces corrupt blocks with empty
+// blocks.
+func (i *Iterator) mayHaveEmptyBlocks() bool {
+	return i.data.kindMask != 0 || i.skipCorrupt != nil
+}
+
+// seekGEInGroup positions i.data at the first key in the current block which
+// is >= the given key. If the block contains no such key, the remaining blocks
+// of the group are scanned in turn.
+func (i *Iterator) seekGEInGroup(key []byte) (*InternalKey, []byte) {
+	ikey, val := i.data.SeekGE(key)
+	for ikey == nil && i.data.err == nil && i.groupIdx+1 < len(i.group) {
+		if !i.loadGroupBlock(i.groupIdx + 1) {
+			return nil, nil
+		}
+		ikey, val = i.data.SeekGE(key)
 	}
-	// Load the next block.
-	v := i.index.Value()
-	h, n := decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
-		return false
+	return ikey, val
+}
+
+// seekGEFromIndex positions the iterator at the first entry which is >= the
+// given key, starting from the group at the current index position. If
+// skipped is non-nil, it is set to the number of entries the seek scanned past
+// within the target data block. If unsuccessful, it sets i.err to any error
+// encountered, which may be nil if we have simply exhausted the entire table.
+func (i *Iterator) seekGEFromIndex(key []byte, skipped *int) (*InternalKey, []byte) {
+	if !i.loadBlock() {
+		return nil, nil
 	}
-	block, err := i.reader.readBlock(h, nil /* transform */)
-	if err != nil {
-		i.err = err
-		return false
+	ikey, val := i.seekGEInGroup(key)
+	if skipped != nil {
+		*skipped = i.data.seekSkipped()
 	}
-	i.data.setCacheHandle(block)
-	i.err = i.data.init(i.cmp, block.Get(), i.reader.Properties.GlobalSeqNum)
-	if i.err != nil {
-		return false
+	if ikey == nil {
+		// The sought key may be greater than every key in the block if it is
+		// equal to a shortened separator in the index, or if the index is keyed
+		// by first keys, or the remainder of the block may contain only entries
+		// which are excluded by the kind mask.
+		return i.skipForward()
 	}
-	// Look for the key inside that block.
-	i.initBounds()
-	i.data.SeekGE(key)
-	return true
+	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
+		i.data.invalidateUpper() // force i.data.Valid() to return false
+		return nil, nil
+	}
+	return i.sample(ikey, val)
 }
 
 // SeekGE implements internalIterator.SeekGE, as documented in the pebble
@@ -193,22 +362,35 @@ func (i *Iterator) SeekGE(key []byte) (*InternalKey, []byte) {
 	if i.err != nil {
 		return nil, nil
 	}
+	i.readahead.reset()
+	i.startScan()
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
-		return nil, nil
-	}
-	if !i.loadBlock() {
+	key = i.reader.clampSeekGE(key)
+	if ikey, _ := i.reader.seekIndexGE(&i.index, key); ikey == nil {
 		return nil, nil
 	}
-	ikey, val := i.data.SeekGE(key)
-	if ikey == nil {
-		return nil, nil
+	return i.seekGEFromIndex(key, nil /* skipped */)
+}
+
+// SeekGEWithSkipped is like SeekGE, but additionally returns the number of
+// entries within the target data block that the seek scanned past, starting
+// from the restart point at which the scan began, before finding the returned
+// entry. The count is a measure of the density of the block around the sought
+// key and can be used to tune the block restart interval.
+func (i *Iterator) SeekGEWithSkipped(key []byte) (*InternalKey, []byte, int) {
+	if i.err != nil {
+		return nil, nil, 0
 	}
-	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
-		i.data.invalidateUpper() // force i.data.Valid() to return false
-		return nil, nil
+	i.readahead.reset()
+	i.startScan()
+
+	key = i.reader.clampSeekGE(key)
+	if ikey, _ := i.reader.seekIndexGE(&i.index, key); ikey == nil {
+		return nil, nil, 0
 	}
-	return ikey, val
+	var skipped int
+	ikey, val := i.seekGEFromIndex(key, &skipped)
+	return ikey, val, skipped
 }
 
 // SeekPrefixGE implements internalIterator.SeekPrefixGE, as documented in the
@@ -218,34 +400,78 @@ func (i *Iterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
 	if i.err != nil {
 		return nil, nil
 	}
+	i.readahead.reset()
+	i.startScan()
+
+	key = i.reader.clampSeekGE(key)
+	entry, ok := i.checkPrefix(prefix)
+	if !ok {
+		i.data.invalidateUpper() // force i.data.Valid() to return false
+		return nil, nil
+	}
+	if entry >= 0 {
+		// The keys with the prefix lie within a single index entry, so the
+		// index is positioned at that entry directly.
+		i.index.seekRestart(int32(entry))
+	} else if ikey, _ := i.reader.seekIndexGE(&i.index, key); ikey == nil {
+		return nil, nil
+	}
+	return i.seekGEFromIndex(key, nil /* skipped */)
+}
 
-	// Check prefix bloom filter.
-	if i.reader.tableFilter != nil {
+// checkPrefix consults the prefix map or the prefix filter of the table, if
+// any, returning false if the table contains no keys with the specified
+// prefix. The prefix map is exact, making the filter redundant. If the prefix
+// map places the keys with the prefix within a single index entry, entry is the
+// position of that entry in the index, and is -1 otherwise.
+func (i *Iterator) checkPrefix(prefix []byte) (entry int, ok bool) {
+	if i.reader.prefixMap.bh.length != 0 {
+		first, last, ok, err := i.reader.lookupPrefixMap(prefix)
+		if err != nil {
+			i.err = err
+			return -1, false
+		}
+		if !ok {
+			return -1, false
+		}
+		// The positions in the prefix map are those of the full index, rather
+		// than those of the partial index of a range iterator.
+		if first == last && !i.rangeIndex && int32(first) < i.index.numRestarts {
+			return int(first), true
+		}
+	} else if i.reader.tableFilter != nil && i.reader.tableFilter.prefix {
+		// Check prefix bloom filter. A filter containing only whole keys cannot
+		// be used to check for the existence of a prefix.
 		data, err := i.reader.readFilter()
 		if err != nil {
-			return nil, nil
+			return -1, false
 		}
 		if !i.reader.tableFilter.mayContain(data, prefix) {
-			i.data.invalidateUpper() // force i.data.Valid() to return false
-			return nil, nil
+			return -1, false
 		}
 	}
+	return -1, true
+}
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
-		return nil, nil
-	}
-	if !i.loadBlock() {
-		return nil, nil
-	}
-	ikey, val := i.data.SeekGE(key)
-	if ikey == nil {
+// SeekPrefixLT moves the iterator to the last entry whose key is less than
+// the given key, which is expected to have the specified prefix. If the table
+// is known not to contain any keys with the prefix, as determined by the
+// prefix map or the prefix filter, the iterator is exhausted without reading
+// any data blocks. Otherwise SeekPrefixLT is equivalent to SeekLT, and the
+// iterator may be moved backward from the entry using Prev. As with
+// SeekPrefixGE, the entry is not guaranteed to have the prefix, which the
+// caller is expected to check. Note that SeekPrefixLT only checks the lower
+// bound. It is up to the caller to ensure that key is less than the upper
+// bound.
+func (i *Iterator) SeekPrefixLT(prefix, key []byte) (*InternalKey, []byte) {
+	if i.err != nil {
 		return nil, nil
 	}
-	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
-		i.data.invalidateUpper() // force i.data.Valid() to return false
+	if _, ok := i.checkPrefix(prefix); !ok {
+		i.data.invalidateLower() // force i.data.Valid() to return false
 		return nil, nil
 	}
-	return ikey, val
+	return i.SeekLT(key)
 }
 
 // SeekLT implements internalIterator.SeekLT, as documented in the pebble
@@ -255,14 +481,36 @@ func (i *Iterator) SeekLT(key []byte) (*InternalKey, []byte) {
 	if i.err != nil {
 		return nil, nil
 	}
+	i.readahead.reset()
+	i.endScan()
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
-		i.index.Last()
-	}
+	key = i.reader.clampSeekLT(key)
+	i.reader.seekIndexLT(&i.index, key)
 	if !i.loadBlock() {
 		return nil, nil
 	}
+	// In a sparse index, the group may cover several blocks. Find the last
+	// block in the group whose first key is less than the given key.
+	for i.groupIdx+1 < len(i.group) {
+		if !i.loadGroupBlock(i.groupIdx + 1) {
+			return nil, nil
+		}
+		// NB: The first entry is examined regardless of its kind, since
+		// entries excluded by the kind mask still determine the span of the
+		// block.
+		if ikey, _ := i.data.first(); ikey != nil && i.cmp(ikey.UserKey, key) >= 0 {
+			if !i.loadGroupBlock(i.groupIdx - 1) {
+				return nil, nil
+			}
+			break
+		}
+	}
 	ikey, val := i.data.SeekLT(key)
+	if ikey == nil && i.mayHaveEmptyBlocks() {
+		// The remainder of the block may contain only entries which are
+		// excluded by the kind mask.
+		return i.skipBackward()
+	}
 	if ikey == nil {
 		// The index contains separator keys which may lie between
 		// user-keys. Consider the user-keys:
@@ -278,7 +526,7 @@ func (i *Iterator) SeekLT(key []byte) (*InternalKey, []byte) {
 		if ikey, val = i.index.Prev(); ikey == nil {
 			return nil, nil
 		}
-		if !i.loadBlock() {
+		if !i.loadLastBlock() {
 			return nil, nil
 		}
 		if ikey, val = i.data.Last(); ikey == nil {
@@ -300,6 +548,12 @@ func (i *Iterator) First() (*InternalKey, []byte) {
 	if i.err != nil {
 		return nil, nil
 	}
+	if i.reader.lower != nil {
+		// The keys of a view begin at its lower bound.
+		return i.SeekGE(i.reader.lower)
+	}
+	i.readahead.reset()
+	i.startScan()
 
 	if ikey, _ := i.index.First(); ikey == nil {
 		return nil, nil
@@ -309,13 +563,16 @@ func (i *Iterator) First() (*InternalKey, []byte) {
 	}
 	ikey, val := i.data.First()
 	if ikey == nil {
+		if i.mayHaveEmptyBlocks() {
+			return i.skipForward()
+		}
 		return nil, nil
 	}
 	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
 		i.data.invalidateUpper() // force i.data.Valid() to return false
 		return nil, nil
 	}
-	return ikey, val
+	return i.sample(ikey, val)
 }
 
 // Last implements internalIterator.Last, as documented in the pebble
@@ -326,14 +583,23 @@ func (i *Iterator) Last() (*InternalKey, []byte) {
 	if i.err != nil {
 		return nil, nil
 	}
+	if i.reader.upper != nil {
+		// The keys of a view end before its upper bound.
+		return i.SeekLT(i.reader.upper)
+	}
+	i.readahead.reset()
+	i.endScan()
 
 	if ikey, _ := i.index.Last(); ikey == nil {
 		return nil, nil
 	}
-	if !i.loadBlock() {
+	if !i.loadLastBlock() {
 		return nil, nil
 	}
 	if ikey, _ := i.data.Last(); ikey == nil {
+		if i.mayHaveEmptyBlocks() {
+			return i.skipBackward()
+		}
 		return nil, nil
 	}
 	if i.blockLower != nil && i.cmp(i.data.ikey.UserKey, i.blockLower) < 0 {
@@ -356,26 +622,46 @@ func (i *Iterator) Next() (*InternalKey, []byte) {
 			i.data.invalidateUpper()
 			return nil, nil
 		}
-		return key, val
+		return i.sample(key, val)
 	}
+	return i.skipForward()
+}
+
+// skipForward positions the iterator at the first entry of the blocks
+// following the current block, once the current block has been exhausted. If
+// the iterator has a kind mask, blocks without any entries whose kind is in
+// the mask are skipped.
+func (i *Iterator) skipForward() (*InternalKey, []byte) {
 	for {
 		if i.data.err != nil {
 			i.err = i.data.err
 			break
 		}
-		if key, _ := i.index.Next(); key == nil {
+		var loaded bool
+		if i.groupIdx+1 < len(i.group) {
+			loaded = i.loadGroupBlock(i.groupIdx + 1)
+		} else if key, _ := i.index.Next(); key == nil {
+			break
+		} else {
+			loaded = i.loadBlock()
+		}
+		if i.err != nil {
+			// A block could not be loaded.
 			break
 		}
-		if i.loadBlock() {
+		if loaded {
 			key, val := i.data.First()
 			if key == nil {
+				if i.mayHaveEmptyBlocks() {
+					continue
+				}
 				return nil, nil
 			}
 			if i.blockUpper != nil && i.cmp(key.UserKey, i.blockUpper) >= 0 {
 				i.data.invalidateUpper()
 				return nil, nil
 			}
-			return key, val
+			return i.sample(key, val)
 		}
 	}
 	return nil, nil
@@ -387,6 +673,7 @@ func (i *Iterator) Prev() (*InternalKey, []byte) {
 	if i.err != nil {
 		return nil, nil
 	}
+	i.endScan()
 	if key, val := i.data.Prev(); key != nil {
 		if i.blockLower != nil && i.cmp(key.UserKey, i.blockLower) < 0 {
 			i.data.invalidateLower()
@@ -394,17 +681,37 @@ func (i *Iterator) Prev() (*InternalKey, []byte) {
 		}
 		return key, val
 	}
+	return i.skipBackward()
+}
+
+// skipBackward positions the iterator at the last entry of the blocks
+// preceding the current block, once the current block has been exhausted. If
+// the iterator has a kind mask, blocks without any entries whose kind is in
+// the mask are skipped.
+func (i *Iterator) skipBackward() (*InternalKey, []byte) {
 	for {
 		if i.data.err != nil {
 			i.err = i.data.err
 			break
 		}
-		if key, _ := i.index.Prev(); key == nil {
+		var loaded bool
+		if i.groupIdx > 0 {
+			loaded = i.loadGroupBlock(i.groupIdx - 1)
+		} else if key, _ := i.index.Prev(); key == nil {
+			break
+		} else {
+			loaded = i.loadLastBlock()
+		}
+		if i.err != nil {
+			// A block could not be loaded.
 			break
 		}
-		if i.loadBlock() {
+		if loaded {
 			key, val := i.data.Last()
 			if key == nil {
+				if i.mayHaveEmptyBlocks() {
+					continue
+				}
 				return nil, nil
 			}
 			if i.blockLower != nil && i.cmp(key.UserKey, i.blockLower) < 0 {
@@ -422,6 +729,21 @@ func (i *Iterator) Key() *InternalKey {
 	return i.data.Key()
 }
 
+// KeyParsed returns the components of the internal key at the current
+// position: the user key, and the sequence number and kind decoded from the
+// key's trailer, which saves the caller from decoding the trailer of the key
+// returned by Key. The user key is only valid until the next positioning
+// call. If the iterator is not
+// positioned at an entry, KeyParsed returns a nil user key and
+// InternalKeyKindInvalid.
+func (i *Iterator) KeyParsed() (userKey []byte, seqNum uint64, kind InternalKeyKind) {
+	if !i.data.Valid() {
+		return nil, 0, InternalKeyKindInvalid
+	}
+	key := i.data.Key()
+	return key.UserKey, key.SeqNum(), key.Kind()
+}
+
 // Value implements internalIterator.Value, as documented in the pebble
 // package.
 func (i *Iterator) Value() []byte {
@@ -461,7 +783,15 @@ func (i *Iterator) Close() error {
 		return err
 	}
 	err := i.err
-	*i = Iterator{}
+	// Clear all references before returning the iterator to the pool so that
+	// a pooled iterator does not keep a Reader or cached blocks alive. The
+	// scratch buffers are retained to avoid reallocating them on reuse.
+	*i = Iterator{
+		index:     i.index.resetForReuse(),
+		data:      i.data.resetForReuse(),
+		group:     i.group[:0],
+		readahead: i.readahead.resetForReuse(),
+	}
 	iterPool.Put(i)
 	return err
 }
@@ -469,8 +799,10 @@ func (i *Iterator) Close() error {
 // SetBounds implements internalIterator.SetBounds, as documented in the pebble
 // package.
 func (i *Iterator) SetBounds(lower, upper []byte) {
-	i.lower = lower
-	i.upper = upper
+	i.lower, i.upper = i.reader.intersectBounds(lower, upper)
+	if i.rangeIndex {
+		i.lower, i.upper = intersectBounds(i.cmp, i.lower, i.upper, i.rangeLower, i.rangeUpper)
+	}
 }
 
 // compactionIterator is similar to Iterator but it increments the number of
@@ -479,6 +811,26 @@ type compactionIterator struct {
 	*Iterator
 	bytesIterated *uint64
 	prevOffset    uint64
+	// Sets, Deletions and Merges are the number of entries of each kind the
+	// iterator has returned so far. They are updated by First and Next, and
+	// allow the caller to determine, for example, whether a table consists
+	// mostly of deletion tombstones.
+	Sets      uint64
+	Deletions uint64
+	Merges    uint64
+}
+
+// countKind adds the entry with the given key to the count of entries of its
+// kind.
+func (i *compactionIterator) countKind(key *InternalKey) {
+	switch key.Kind() {
+	case InternalKeyKindSet:
+		i.Sets++
+	case InternalKeyKindDelete:
+		i.Deletions++
+	case InternalKeyKindMerge:
+		i.Merges++
+	}
 }
 
 func (i *compactionIterator) SeekGE(key []byte) (*InternalKey, []byte) {
@@ -515,6 +867,7 @@ func (i *compactionIterator) First() (*InternalKey, []byte) {
 		i.prevOffset = (uint64(i.data.nextOffset) * i.dataBH.length) / uint64(len(i.data.data))
 	}
 	*i.bytesIterated += i.prevOffset
+	i.countKind(key)
 	return key, val
 }
 
@@ -535,10 +888,15 @@ func (i *compactionIterator) Next() (*InternalKey, []byte) {
 				i.err = i.data.err
 				return nil, nil
 			}
-			if key, _ := i.index.Next(); key == nil {
+			var loaded bool
+			if i.groupIdx+1 < len(i.group) {
+				loaded = i.loadGroupBlock(i.groupIdx + 1)
+			} else if key, _ := i.index.Next(); key == nil {
 				return nil, nil
+			} else {
+				loaded = i.loadBlock()
 			}
-			if i.loadBlock() {
+			if loaded {
 				key, val = i.data.First()
 				if key == nil {
 					return nil, nil
@@ -560,6 +918,7 @@ func (i *compactionIterator) Next() (*InternalKey, []byte) {
 	}
 	*i.bytesIterated += uint64(curOffset - i.prevOffset)
 	i.prevOffset = curOffset
+	i.countKind(key)
 	return key, val
 }
 
@@ -567,81 +926,640 @@ func (i *compactionIterator) Prev() (*InternalKey, []byte) {
 	panic("pebble: Prev unimplemented")
 }
 
+// stableKeyIterator is similar to Iterator, but the user keys it returns
+// remain valid until the iterator is closed rather than only until the next
+// positioning call. The user keys are copied into an arena owned by the
+// iterator, so they share a small number of allocations. The returned
+// InternalKey itself, and the returned values, are only valid until the next
+// positioning call, as with Iterator.
+type stableKeyIterator struct {
+	*Iterator
+	alloc bytealloc.A
+	key   InternalKey
+}
+
+func (i *stableKeyIterator) stabilize(key *InternalKey, val []byte) (*InternalKey, []byte) {
+	if key == nil {
+		return nil, nil
+	}
+	i.key.Trailer = key.Trailer
+	i.alloc, i.key.UserKey = i.alloc.Copy(key.UserKey)
+	return &i.key, val
+}
+
+func (i *stableKeyIterator) SeekGE(key []byte) (*InternalKey, []byte) {
+	return i.stabilize(i.Iterator.SeekGE(key))
+}
+
+func (i *stableKeyIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
+	return i.stabilize(i.Iterator.SeekPrefixGE(prefix, key))
+}
+
+func (i *stableKeyIterator) SeekLT(key []byte) (*InternalKey, []byte) {
+	return i.stabilize(i.Iterator.SeekLT(key))
+}
+
+func (i *stableKeyIterator) First() (*InternalKey, []byte) {
+	return i.stabilize(i.Iterator.First())
+}
+
+func (i *stableKeyIterator) Last() (*InternalKey, []byte) {
+	return i.stabilize(i.Iterator.Last())
+}
+
+func (i *stableKeyIterator) Next() (*InternalKey, []byte) {
+	return i.stabilize(i.Iterator.Next())
+}
+
+func (i *stableKeyIterator) Prev() (*InternalKey, []byte) {
+	return i.stabilize(i.Iterator.Prev())
+}
+
+func (i *stableKeyIterator) Key() *InternalKey {
+	if !i.Iterator.Valid() {
+		return nil
+	}
+	return &i.key
+}
+
+func (i *stableKeyIterator) Close() error {
+	// The arena is not reused: the keys returned by the iterator may still be
+	// referenced by the caller.
+	i.alloc = nil
+	return i.Iterator.Close()
+}
+
 type weakCachedBlock struct {
 	bh     blockHandle
 	mu     sync.RWMutex
 	handle cache.WeakHandle
 }
 
+// residentBlock is a block held in memory for the lifetime of a Reader, such as
+// the index block of a Reader returned by Writer.Finish. It is stored in the
+// handle of a weakCachedBlock, from which it is never evicted.
+type residentBlock []byte
+
+func (b residentBlock) Get() []byte {
+	return b
+}
+
 type blockTransform func([]byte) ([]byte, error)
 
+// pinnedBlocks holds strong references to the blocks read by an immutable
+// Reader, keyed by block offset.
+type pinnedBlocks struct {
+	sync.Mutex
+	m map[uint64]cache.Handle
+}
+
+// ReaderOption provides an interface to configure a Reader while it is being
+// opened.
+type ReaderOption interface {
+	readerApply(*Reader)
+}
+
+// Immutable is a ReaderOption which specifies whether the table is known to be
+// immutable, which is the common case. An immutable Reader holds a reference
+// to every block it reads for the lifetime of the Reader: the index and filter
+// blocks are held forever and data blocks are read from disk and decompressed
+// at most once, regardless of evictions from the block cache. This trades
+// memory, bounded by the size of the table, for latency. The default is false.
+type Immutable bool
+
+func (i Immutable) readerApply(r *Reader) {
+	if i {
+		r.pinned = &pinnedBlocks{m: make(map[uint64]cache.Handle)}
+	} else {
+		r.pinned = nil
+	}
+}
+
+// BlockCaching is a ReaderOption which specifies the kinds of blocks of the
+// table which are stored in the block cache. Meta blocks, such as the index,
+// filter and range deletion blocks, are small and consulted by every lookup,
+// while data blocks make up the bulk of the table. Caching only the meta blocks
+// keeps them hot while preventing large scans from evicting the working set of
+// the cache. Blocks which are not cached are read from disk on every access.
+// The default is CacheAllBlocks.
+type BlockCaching uint8
+
+const (
+	// CacheMetaBlocks caches the index, filter and other meta blocks.
+	CacheMetaBlocks BlockCaching = 1 << iota
+	// CacheDataBlocks caches the data blocks.
+	CacheDataBlocks
+	// CacheAllBlocks caches both the meta blocks and the data blocks.
+	CacheAllBlocks = CacheMetaBlocks | CacheDataBlocks
+)
+
+func (c BlockCaching) readerApply(r *Reader) {
+	r.caching = c
+}
+
+// PartialBlockReads is a ReaderOption which specifies whether a point lookup
+// which misses the block cache reads only the portion of an uncompressed data
+// block needed to find the key, rather than the whole block. The restart
+// points of the block are used to locate and bound the read. The checksum of a
+// partially read block cannot be verified, and the block is not added to the
+// cache. This benefits point lookups on tables with large uncompressed blocks
+// which are unlikely to be read again. The default is false.
+type PartialBlockReads bool
+
+func (p PartialBlockReads) readerApply(r *Reader) {
+	r.partialReads = bool(p)
+}
+
+// VerifyBlockHandles is a ReaderOption which specifies whether NewReader walks
+// the index of the table and verifies that the handles of the data blocks
+// are in increasing order of offset and do not overlap one another or the
+// meta blocks. A corrupt index which violates this may otherwise lead to
+// subtle misreads. Verifying the handles reads the index block when the
+// Reader is created. The default is false.
+type VerifyBlockHandles bool
+
+func (v VerifyBlockHandles) readerApply(r *Reader) {
+	r.verifyHandles = bool(v)
+}
+
+// ReadLimiter limits the rate at which a Reader reads blocks from its file.
+// The rate.Limiter in golang.org/x/time/rate can be adapted to a ReadLimiter.
+type ReadLimiter interface {
+	// WaitN blocks until n more bytes may be read.
+	WaitN(n int)
+}
+
+// ThrottleReads is a ReaderOption which specifies a ReadLimiter which the
+// Reader consults before reading each block from the file, including the
+// trailer of the block. Blocks found in the block cache are not throttled. A
+// table read by a background scan, such as a compaction, can be throttled
+// to prevent the scan from saturating the disk bandwidth needed by foreground
+// reads. A nil limiter, the default, does not limit reads.
+type ThrottleReads struct {
+	Limiter ReadLimiter
+}
+
+func (t ThrottleReads) readerApply(r *Reader) {
+	r.limiter = t.Limiter
+}
+
+// metaOnlyOption is the ReaderOption used by NewReaderMeta to only read the
+// metadata of the table.
+type metaOnlyOption struct{}
+
+func (metaOnlyOption) readerApply(r *Reader) {
+	r.metaOnly = true
+}
+
+// IterOption provides an interface to configure an Iterator while it is being
+// created.
+type IterOption interface {
+	iterApply(*Iterator)
+}
+
+// SkipCorruptBlocks is an IterOption which configures an Iterator for
+// best-effort reads of a partially corrupt table, such as when salvaging its
+// intact data. A data block which cannot be loaded, for example due to a
+// checksum mismatch, is skipped rather than failing the iteration, and is
+// recorded in Skipped. The index block of the table must be intact. The
+// SkipCorruptBlocks must not be shared by concurrently used iterators.
+type SkipCorruptBlocks struct {
+	// Skipped holds the data blocks which were skipped, in the order in which
+	// they were first encountered. A block is recorded once, regardless of how
+	// often the iterator encounters it.
+	Skipped []SkippedBlock
+}
+
+// SkippedBlock describes a data block skipped by an Iterator configured with
+// SkipCorruptBlocks.
+type SkippedBlock struct {
+	// Offset and Length locate the block within the file. The length excludes
+	// the block trailer.
+	Offset uint64
+	Length uint64
+	// Err is the error encountered when loading the block.
+	Err error
+}
+
+func (s *SkipCorruptBlocks) iterApply(i *Iterator) {
+	i.skipCorrupt = s
+}
+
+func (s *SkipCorruptBlocks) add(bh blockHandle, err error) {
+	for j := range s.Skipped {
+		if s.Skipped[j].Offset == bh.offset {
+			return
+		}
+	}
+	s.Skipped = append(s.Skipped, SkippedBlock{Offset: bh.offset, Length: bh.length, Err: err})
+}
+
+// emptyDataBlock is a data block without any entries. It is the same as the
+// data block written for an empty table, with a single restart point.
+var emptyDataBlock = []byte{0, 0, 0, 0, 1, 0, 0, 0}
+
+// KindMask is a set of InternalKeyKinds, in which kind k is represented by bit
+// k. As an IterOption, it restricts an Iterator to the entries whose kind is
+// in the set. Entries of other kinds are skipped by the data block iterators,
+// without being returned to the caller. The zero KindMask contains every kind.
+type KindMask uint64
+
+// MakeKindMask returns the KindMask containing the specified kinds.
+func MakeKindMask(kinds ...InternalKeyKind) KindMask {
+	var m KindMask
+	for _, kind := range kinds {
+		m |= 1 << kind
+	}
+	return m
+}
+
+// Contains returns true if the kind is in the mask.
+func (m KindMask) Contains(kind InternalKeyKind) bool {
+	return m == 0 || m&(1<<kind) != 0
+}
+
+func (m KindMask) iterApply(i *Iterator) {
+	i.data.kindMask = m
+}
+
 // Reader is a table reader.
+//
+// A Reader is safe for concurrent use by multiple goroutines, each using its
+// own iterators. The lazily loaded index, filter and range deletion blocks are
+// guarded by mutexes, the block cache is safe for concurrent use, and the
+// mutable state of a scan, such as readahead and statistics, is held by the
+// Iterator. Iterators are not safe for concurrent use.
 type Reader struct {
-	file              vfs.File
+	// stats is accessed atomically, and is the first field of the Reader to
+	// ensure the 64-bit alignment of its counters.
+	stats             ReaderStats
+	file              io.ReaderAt
+	size              int64
 	fileNum           uint64
 	err               error
 	index             weakCachedBlock
 	filter            weakCachedBlock
 	rangeDel          weakCachedBlock
+	userKeyIndex      weakCachedBlock
+	rangeKey          weakCachedBlock
+	prefixMap         weakCachedBlock
+	cfRanges          weakCachedBlock
+	blockKeyRanges    weakCachedBlock
 	rangeDelTransform blockTransform
 	opts              *Options
 	cache             *cache.Cache
 	compare           Compare
 	split             Split
 	tableFilter       *tableFilterReader
-	Properties        Properties
+	// The checksum type of the blocks of the table.
+	checksumType uint8
+	// The format of the table, which determines the encoding of zlib
+	// compressed blocks.
+	format TableFormat
+	// The dictionary against which the data blocks of the table are
+	// compressed, if any, and the decoder of the zstd blocks compressed against
+	// it.
+	compressionDict []byte
+	zstdDict        *zstdDictDecoder
+	// The handle of the metaindex block.
+	metaindexBH blockHandle
+	// cipher, if non-nil, decrypts the blocks of an encrypted table.
+	cipher TableCipher
+	// The user key bounds of a Reader created by View. A nil bound is
+	// unbounded. The lower bound is inclusive and the upper bound exclusive.
+	lower []byte
+	upper []byte
+	// view is true if the Reader was created by View, in which case the file is
+	// owned by the parent Reader.
+	view bool
+	// tableProps, if non-nil, holds the properties of the full table for a
+	// Reader created by View, whose Properties are scoped to the view. See
+	// tableProperties.
+	tableProps *Properties
+	// caching specifies the kinds of blocks which are stored in the cache.
+	caching BlockCaching
+	// pinned holds the blocks read by an immutable Reader. Nil if the Reader is
+	// not immutable. Shared with any views of the Reader.
+	pinned *pinnedBlocks
+	// partialReads is true if point lookups may read part of a data block. See
+	// PartialBlockReads.
+	partialReads bool
+	// verifyHandles is true if the handles in the index are verified by
+	// NewReader. See VerifyBlockHandles.
+	verifyHandles bool
+	// limiter, if non-nil, limits the rate of block reads. See ThrottleReads.
+	limiter ReadLimiter
+	// decompressKey, if non-nil, decompresses the keys of the data blocks,
+	// which were compressed using Comparer.CompressKey.
+	decompressKey DecompressKey
+	// metaOnly is true if the Reader was created by NewReaderMeta, in which
+	// case no blocks other than the metaindex and properties may be read.
+	metaOnly   bool
+	features   TableFeatures
+	Properties Properties
 }
 
-// Close implements DB.Close, as documented in the pebble package.
-func (r *Reader) Close() error {
-	if r.err != nil {
-		if r.file != nil {
-			r.file.Close()
-			r.file = nil
-		}
-		return r.err
-	}
-	if r.file != nil {
-		r.err = r.file.Close()
-		r.file = nil
-		if r.err != nil {
-			return r.err
-		}
-	}
-	// Make any future calls to Get, NewIter or Close return an error.
-	r.err = errors.New("pebble/table: reader is closed")
-	return nil
+// View returns a Reader that is logically restricted to the user keys in the
+// range [lower,upper). A nil bound is unbounded. The view shares the file and
+// the block cache with r and is cheap to create. Iterators created from the
+// view have their bounds intersected with the view range, get returns
+// ErrNotFound for keys outside of the range, and EstimateDiskUsage only
+// considers the data blocks within the range. The range deletions and range
+// keys of the view are truncated to the range. The size and count Properties of
+// the view are scoped to the range: the range deletions and range keys are
+// counted, and the point entry properties are estimated from the fraction of
+// the data blocks of the table lying within the range.
+//
+// Closing the view does not close the underlying file. The view must not be
+// used after r has been closed.
+func (r *Reader) View(lower, upper []byte) *Reader {
+	lower, upper = r.intersectBounds(lower, upper)
+	v := &Reader{
+		file:              r.file,
+		size:              r.size,
+		fileNum:           r.fileNum,
+		err:               r.err,
+		rangeDelTransform: r.rangeDelTransform,
+		opts:              r.opts,
+		cache:             r.cache,
+		compare:           r.compare,
+		split:             r.split,
+		tableFilter:       r.tableFilter,
+		checksumType:      r.checksumType,
+		format:            r.format,
+		compressionDict:   r.compressionDict,
+		zstdDict:          r.zstdDict,
+		metaindexBH:       r.metaindexBH,
+		cipher:            r.cipher,
+		lower:             lower,
+		upper:             upper,
+		view:              true,
+		caching:           r.caching,
+		pinned:            r.pinned,
+		partialReads:      r.partialReads,
+		limiter:           r.limiter,
+		decompressKey:     r.decompressKey,
+		metaOnly:          r.metaOnly,
+		features:          r.features,
+		Properties:        r.Properties,
+	}
+	v.index.bh = r.index.bh
+	v.filter.bh = r.filter.bh
+	v.rangeDel.bh = r.rangeDel.bh
+	v.userKeyIndex.bh = r.userKeyIndex.bh
+	v.rangeKey.bh = r.rangeKey.bh
+	v.prefixMap.bh = r.prefixMap.bh
+	v.cfRanges.bh = r.cfRanges.bh
+	v.blockKeyRanges.bh = r.blockKeyRanges.bh
+	v.tableProps = r.tableProperties()
+	if v.err == nil {
+		v.err = v.scopeProperties()
+	}
+	return v
 }
 
-// get is a testing helper that simulates a read and helps verify bloom filters
-// until they are available through iterators.
-func (r *Reader) get(key []byte) (value []byte, err error) {
-	if r.err != nil {
-		return nil, r.err
+// tableProperties returns the properties of the full table, which differ from
+// the Properties of a Reader created by View.
+func (r *Reader) tableProperties() *Properties {
+	if r.tableProps != nil {
+		return r.tableProps
 	}
+	return &r.Properties
+}
 
-	if r.tableFilter != nil {
-		data, err := r.readFilter()
+// scopeProperties scopes the size and count Properties of a Reader created by
+// View to the bounds of the view.
+func (r *Reader) scopeProperties() error {
+	props := r.tableProperties()
+	usage, err := r.estimateDiskUsage(r.lower, r.upper, true /* endExclusive */)
+	if err != nil {
+		return err
+	}
+	scale := func(n uint64) uint64 {
+		if props.DataSize == 0 {
+			return n
+		}
+		return uint64(float64(n) * float64(usage) / float64(props.DataSize))
+	}
+	p := &r.Properties
+	p.DataSize = usage
+	p.NumDataBlocks = scale(props.NumDataBlocks)
+	p.NumEntries = scale(props.NumEntries)
+	p.NumDeletions = scale(props.NumDeletions)
+	p.NumMergeOperands = scale(props.NumMergeOperands)
+	p.RawKeySize = scale(props.RawKeySize)
+	p.RawValueSize = scale(props.RawValueSize)
+	p.RawPointTombstoneKeySize = scale(props.RawPointTombstoneKeySize)
+
+	p.NumRangeDeletions, p.RangeDeletionsBytesEstimate = 0, 0
+	if r.rangeDel.bh.length != 0 {
+		b, err := r.readRangeDel()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		var lookupKey []byte
-		if r.split != nil {
-			lookupKey = key[:r.split(key)]
-		} else {
-			lookupKey = key
+		if err := countBlockEntries(r, b, func(*InternalKey, []byte) {
+			p.NumRangeDeletions++
+		}); err != nil {
+			return err
 		}
-		if !r.tableFilter.mayContain(data, lookupKey) {
-			return nil, base.ErrNotFound
+		if props.NumRangeDeletions != 0 {
+			p.RangeDeletionsBytesEstimate = props.RangeDeletionsBytesEstimate *
+				p.NumRangeDeletions / props.NumRangeDeletions
 		}
 	}
-
-	i := iterPool.Get().(*Iterator)
-	if err := i.Init(r, nil, nil); err == nil {
-		i.index.SeekGE(key)
-		i.seekBlock(key)
+	p.NumRangeKeySets, p.NumRangeKeyUnsets, p.NumRangeKeyDels = 0, 0, 0
+	if r.rangeKey.bh.length != 0 {
+		b, err := r.readRangeKey()
+		if err != nil {
+			return err
+		}
+		if err := countBlockEntries(r, b, func(key *InternalKey, _ []byte) {
+			switch key.Kind() {
+			case InternalKeyKindRangeKeyDelete:
+				p.NumRangeKeyDels++
+			case InternalKeyKindRangeKeyUnset:
+				p.NumRangeKeyUnsets++
+			case InternalKeyKindRangeKeySet:
+				p.NumRangeKeySets++
+			}
+		}); err != nil {
+			return err
+		}
 	}
-
+	return nil
+}
+
+// verifyBlockHandles verifies that the data block handles in the index are in
+// increasing order of offset, and that each block, including its trailer, ends
+// at or before the start of the following block and of the metaindex.
+func (r *Reader) verifyBlockHandles() error {
+	indexBlock, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+	var index blockIter
+	if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+		return err
+	}
+	var group []blockHandle
+	var prev blockHandle
+	var havePrev bool
+	for key, value := index.First(); key != nil; key, value = index.Next() {
+		if group, err = r.decodeIndexEntry(group[:0], value); err != nil {
+			index.Close()
+			return err
+		}
+		for _, bh := range group {
+			if havePrev && bh.offset < prev.offset+prev.length+blockTrailerLen {
+				index.Close()
+				return fmt.Errorf("pebble/table: invalid table (block handle %d/%d overlaps or "+
+					"precedes block handle %d/%d)", bh.offset, bh.length, prev.offset, prev.length)
+			}
+			if bh.offset+bh.length+blockTrailerLen > r.metaindexBH.offset {
+				index.Close()
+				return fmt.Errorf("pebble/table: invalid table (block handle %d/%d overlaps "+
+					"metaindex at offset %d)", bh.offset, bh.length, r.metaindexBH.offset)
+			}
+			prev, havePrev = bh, true
+		}
+	}
+	return index.Close()
+}
+
+// intersectBounds returns the intersection of the specified bounds with the
+// bounds of the Reader.
+func (r *Reader) intersectBounds(lower, upper []byte) ([]byte, []byte) {
+	return intersectBounds(r.compare, lower, upper, r.lower, r.upper)
+}
+
+// intersectBounds returns the intersection of the bounds [lower, upper) with
+// the bounds [boundLower, boundUpper). A nil bound is unbounded.
+func intersectBounds(cmp Compare, lower, upper, boundLower, boundUpper []byte) ([]byte, []byte) {
+	if boundLower != nil && (lower == nil || cmp(lower, boundLower) < 0) {
+		lower = boundLower
+	}
+	if boundUpper != nil && (upper == nil || cmp(upper, boundUpper) > 0) {
+		upper = boundUpper
+	}
+	return lower, upper
+}
+
+// contains returns true if the user key lies within the bounds of the Reader.
+func (r *Reader) contains(key []byte) bool {
+	if r.lower != nil && r.compare(key, r.lower) < 0 {
+		return false
+	}
+	if r.upper != nil && r.compare(key, r.upper) >= 0 {
+		return false
+	}
+	return true
+}
+
+// clampSeekGE returns the key at which a forward seek for the specified key
+// begins, which for a Reader created by View is no less than the lower bound of
+// the view.
+func (r *Reader) clampSeekGE(key []byte) []byte {
+	if r.lower != nil && r.compare(key, r.lower) < 0 {
+		return r.lower
+	}
+	return key
+}
+
+// clampSeekLT returns the key at which a backward seek for the specified key
+// begins, which for a Reader created by View is no greater than the upper
+// bound of the view.
+func (r *Reader) clampSeekLT(key []byte) []byte {
+	if r.upper != nil && r.compare(key, r.upper) > 0 {
+		return r.upper
+	}
+	return key
+}
+
+// Close implements DB.Close, as documented in the pebble package.
+func (r *Reader) Close() error {
+	if r.view {
+		// The file and pinned blocks are owned by the parent Reader.
+		r.file = nil
+		r.pinned = nil
+	}
+	if r.pinned != nil {
+		r.pinned.Lock()
+		for _, h := range r.pinned.m {
+			h.Release()
+		}
+		r.pinned.m = nil
+		r.pinned.Unlock()
+		r.pinned = nil
+	}
+	if r.err != nil {
+		if c, ok := r.file.(io.Closer); ok {
+			c.Close()
+		}
+		r.file = nil
+		return r.err
+	}
+	file := r.file
+	r.file = nil
+	if c, ok := file.(io.Closer); ok {
+		if r.err = c.Close(); r.err != nil {
+			return r.err
+		}
+	}
+	// Make any future calls to Get, NewIter or Close return an error.
+	r.err = errors.New("pebble/table: reader is closed")
+	return nil
+}
+
+// get is a testing helper that simulates a read and helps verify bloom filters
+// until they are available through iterators.
+func (r *Reader) get(key []byte) (value []byte, err error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !r.contains(key) {
+		return nil, base.ErrNotFound
+	}
+
+	if r.tableFilter != nil {
+		if lookupKey, ok := r.tableFilter.lookupKey(key, r.split); ok {
+			data, err := r.readFilter()
+			if err != nil {
+				return nil, err
+			}
+			if !r.tableFilter.mayContain(data, lookupKey) {
+				return nil, base.ErrNotFound
+			}
+		}
+	}
+	return r.getUnfiltered(key)
+}
+
+// getUnfiltered is get without the checks of the key against the bounds and
+// filter of the table, for callers which have already performed them. The
+// returned value is a copy owned by the caller.
+func (r *Reader) getUnfiltered(key []byte) (value []byte, err error) {
+	if r.userKeyIndex.bh.length != 0 {
+		return r.getWithUserKeyIndex(key)
+	}
+
+	i := iterPool.Get().(*Iterator)
+	if err := i.Init(r, nil, nil); err == nil {
+		ikey, indexValue := r.seekIndexGE(&i.index, key)
+		if ikey != nil && r.partialReads && r.decompressKey == nil && !r.Properties.IndexFirstKeys {
+			value, found, ok, err := r.getPartial(indexValue, key)
+			if ok || err != nil {
+				if closeErr := i.Close(); err == nil {
+					err = closeErr
+				}
+				if err == nil && !found {
+					err = base.ErrNotFound
+				}
+				return value, err
+			}
+		}
+		i.seekGEFromIndex(key, nil /* skipped */)
+	}
+
 	if !i.Valid() || r.compare(key, i.Key().UserKey) != 0 {
 		err := i.Close()
 		if err == nil {
@@ -649,16 +1567,103 @@ func (r *Reader) get(key []byte) (value []byte, err error) {
 		}
 		return nil, err
 	}
-	return i.Value(), i.Close()
+	// Closing the iterator releases the data block, whose memory may then be
+	// reused, so the value is copied first.
+	value = append(make([]byte, 0, len(i.Value())), i.Value()...)
+	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	return value, nil
 }
 
-// NewIter returns an internal iterator for the contents of the table.
-func (r *Reader) NewIter(lower, upper []byte) *Iterator {
+// getWithUserKeyIndex is the implementation of get for tables containing a
+// user-key index. The user-key index is keyed by the first user key of each
+// data block. Multiple versions of a user key may span data blocks, so the
+// newest version of key may reside at the end of the data block preceding the
+// first block whose first key is >= key. The search starts at that preceding
+// block and moves forward to the next block if key is not found there.
+func (r *Reader) getWithUserKeyIndex(key []byte) ([]byte, error) {
+	index, err := r.readUserKeyIndex()
+	if err != nil {
+		return nil, err
+	}
+	numEntries := int(binary.LittleEndian.Uint32(index[len(index)-4:]))
+	restarts := len(index) - 4*(1+numEntries)
+	if restarts == 0 {
+		// The table does not contain any data blocks with entries.
+		return nil, base.ErrNotFound
+	}
+	// Every entry in the user-key index is a restart point.
+	entry := func(j int) (key, value []byte) {
+		offset := int(binary.LittleEndian.Uint32(index[restarts+4*j:]))
+		// The first byte is the shared key length which is always 0.
+		unshared, n := binary.Uvarint(index[offset+1:])
+		offset += 1 + n
+		valueLen, n := binary.Uvarint(index[offset:])
+		offset += n
+		key = index[offset : offset+int(unshared)]
+		offset += int(unshared)
+		return key, index[offset : offset+int(valueLen)]
+	}
+
+	j := sort.Search(numEntries, func(j int) bool {
+		k, _ := entry(j)
+		return r.compare(k, key) >= 0
+	})
+	if j > 0 {
+		j--
+	}
+
+	// NB: the data block iterator is taken from an Iterator in iterPool in
+	// order to avoid allocating a blockIter on every call.
+	i := iterPool.Get().(*Iterator)
+	*i = Iterator{reader: r, cmp: r.compare, data: i.data.resetForReuse()}
+	for ; j < numEntries; j++ {
+		_, v := entry(j)
+		var n int
+		i.dataBH, n = decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.Close()
+			return nil, errors.New("pebble/table: corrupt index entry")
+		}
+		h, err := r.readBlock(i.dataBH, nil /* transform */, nil /* readahead */, nil /* stats */)
+		if err != nil {
+			i.Close()
+			return nil, err
+		}
+		i.data.setCacheHandle(h)
+		if err := i.data.init(r.compare, h.Get(), r.Properties.GlobalSeqNum); err != nil {
+			i.Close()
+			return nil, err
+		}
+		if ikey, value := i.data.SeekGE(key); ikey != nil {
+			if r.compare(key, ikey.UserKey) != 0 {
+				break
+			}
+			value = append(make([]byte, 0, len(value)), value...)
+			if err := i.Close(); err != nil {
+				return nil, err
+			}
+			return value, nil
+		}
+	}
+	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	return nil, base.ErrNotFound
+}
+
+// NewIter returns an internal iterator for the contents of the table. The
+// iterator may be configured using IterOptions, such as a KindMask.
+func (r *Reader) NewIter(lower, upper []byte, opts ...IterOption) *Iterator {
 	// NB: pebble.tableCache wraps the returned iterator with one which performs
 	// reference counting on the Reader, preventing the Reader from being closed
 	// until the final iterator closes.
 	i := iterPool.Get().(*Iterator)
 	_ = i.Init(r, lower, upper)
+	for _, opt := range opts {
+		opt.iterApply(i)
+	}
 	return i
 }
 
@@ -673,6 +1678,17 @@ func (r *Reader) NewCompactionIter(bytesIterated *uint64) *compactionIterator {
 	}
 }
 
+// NewStableKeyIter returns an internal iterator similar to NewIter, but the
+// user keys returned by the iterator remain valid until the iterator is
+// closed, allowing them to be retained or handed to other goroutines without
+// copying each key. The memory used by the keys is retained until the iterator
+// is closed, so the iterator is best suited to bounded scans.
+func (r *Reader) NewStableKeyIter(lower, upper []byte) *stableKeyIterator {
+	i := iterPool.Get().(*Iterator)
+	_ = i.Init(r, lower, upper)
+	return &stableKeyIterator{Iterator: i}
+}
+
 // NewRangeDelIter returns an internal iterator for the contents of the
 // range-del block for the table. Returns nil if the table does not contain any
 // range deletions.
@@ -693,16 +1709,516 @@ func (r *Reader) NewRangeDelIter() *blockIter {
 	return i
 }
 
+// EstimateDiskUsage returns the total size of the data blocks overlapping the
+// user key range [start,end]. A data block which only partially overlaps the
+// range is included in its entirety. For a Reader created by View, the range is
+// first intersected with the bounds of the view.
+func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	start = r.clampSeekGE(start)
+	endExclusive := false
+	if r.upper != nil && r.compare(end, r.upper) >= 0 {
+		// The upper bound of a view is exclusive.
+		end, endExclusive = r.upper, true
+	}
+	return r.estimateDiskUsage(start, end, endExclusive)
+}
+
+// estimateDiskUsage returns the total size of the data blocks overlapping the
+// user key range from start to end, which includes end unless endExclusive is
+// true. A nil start or end is unbounded.
+func (r *Reader) estimateDiskUsage(start, end []byte, endExclusive bool) (uint64, error) {
+	if start != nil && end != nil {
+		if c := r.compare(start, end); c > 0 || (c == 0 && endExclusive) {
+			return 0, nil
+		}
+	}
+
+	index, err := r.readIndex()
+	if err != nil {
+		return 0, err
+	}
+	iter := &blockIter{}
+	if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+		return 0, err
+	}
+	var key *InternalKey
+	var val []byte
+	if start != nil {
+		key, val = r.seekIndexGE(iter, start)
+	} else {
+		key, val = iter.First()
+	}
+	if key == nil {
+		// The range starts after the last data block.
+		return 0, iter.Close()
+	}
+	// For a sparse index, the entire group of blocks covered by the index
+	// entries containing start and end is included.
+	group, err := r.decodeIndexEntry(nil, val)
+	if err != nil {
+		return 0, err
+	}
+	startBH := group[0]
+	dataSize := r.tableProperties().DataSize
+	if end == nil {
+		return dataSize - startBH.offset, iter.Close()
+	}
+	key, val = iter.SeekGE(end)
+	if r.Properties.IndexFirstKeys {
+		// The range ends in the blocks of the last entry whose first key is <=
+		// end, or < end if end is exclusive.
+		if key == nil {
+			key, val = iter.Last()
+		} else if c := r.compare(key.UserKey, end); c > 0 || (c == 0 && endExclusive) {
+			if key, val = iter.Prev(); key == nil {
+				// The range ends before the first data block.
+				return 0, iter.Close()
+			}
+		}
+	} else if key == nil {
+		// The range extends past the last data block.
+		return dataSize - startBH.offset, iter.Close()
+	} else if endExclusive {
+		// The blocks of the entry lie beyond the range if they begin with end.
+		if group, err = r.decodeIndexEntry(group[:0], val); err != nil {
+			return 0, err
+		}
+		first, err := r.firstBlockKey(group[0])
+		if err != nil {
+			return 0, err
+		}
+		if first != nil && r.compare(first.UserKey, end) >= 0 {
+			if key, val = iter.Prev(); key == nil {
+				// The range ends before the first data block.
+				return 0, iter.Close()
+			}
+		}
+	}
+	if group, err = r.decodeIndexEntry(group[:0], val); err != nil {
+		return 0, err
+	}
+	endBH := group[len(group)-1]
+	if endBH.offset < startBH.offset {
+		// The range lies between two data blocks.
+		return 0, iter.Close()
+	}
+	return endBH.offset + endBH.length + blockTrailerLen - startBH.offset, iter.Close()
+}
+
+// firstBlockKey returns the first key of the data block bh, or nil if the
+// block is empty.
+func (r *Reader) firstBlockKey(bh blockHandle) (*InternalKey, error) {
+	h, err := r.readBlock(bh, nil /* transform */, nil /* readahead */, nil /* stats */)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Release()
+	var data blockIter
+	if err := data.init(r.compare, h.Get(), r.Properties.GlobalSeqNum); err != nil {
+		return nil, err
+	}
+	key, _ := data.first()
+	if key != nil {
+		k := key.Clone()
+		key = &k
+	}
+	return key, data.Close()
+}
+
+// SampleKeys returns an approximately evenly spaced sample of the keys in the
+// table containing roughly every stride'th key. Rather than scanning the
+// table, the position of each sampled key is estimated from the offsets of the
+// data blocks, and the sampled key is the key at the restart point of the data
+// block nearest to the estimated position. Only the data blocks containing
+// sampled keys are read and only the keys at restart points are decoded, which
+// makes sampling much cheaper than a full scan for a large stride. The estimate
+// is most accurate when the entries are of similar size. If the stride is
+// smaller than the restart interval, at most one key is sampled per restart
+// point. For a Reader created by View, keys outside of the view are omitted.
+func (r *Reader) SampleKeys(stride int) ([]InternalKey, error) {
+	if stride <= 0 {
+		return nil, fmt.Errorf("pebble/table: invalid sample stride %d", stride)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	props := r.tableProperties()
+	numEntries, dataSize := props.NumEntries, props.DataSize
+	if numEntries == 0 || dataSize == 0 {
+		return nil, nil
+	}
+	bytesPerEntry := float64(dataSize) / float64(numEntries)
+
+	index, err := r.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	iter := &blockIter{}
+	if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+		return nil, err
+	}
+	var data blockIter
+	var samples []InternalKey
+	// The estimated ordinal of the next key to sample.
+	var next uint64
+	var group []blockHandle
+	for key, val := iter.First(); key != nil && next < numEntries; key, val = iter.Next() {
+		if group, err = r.decodeIndexEntry(group[:0], val); err != nil {
+			return nil, err
+		}
+		for _, bh := range group {
+			// The estimated ordinals of the first key in the block and of the first
+			// key in the following block.
+			first := uint64(float64(bh.offset) / bytesPerEntry)
+			limit := uint64(float64(bh.offset+bh.length+blockTrailerLen) / bytesPerEntry)
+			if next >= limit {
+				continue
+			}
+			h, err := r.readBlock(bh, nil /* transform */, nil /* readahead */, nil /* stats */)
+			if err != nil {
+				return nil, err
+			}
+			if err := data.init(r.compare, h.Get(), r.Properties.GlobalSeqNum); err != nil {
+				h.Release()
+				return nil, err
+			}
+			prev := int32(-1)
+			for ; next < limit; next += uint64(stride) {
+				var j int32
+				if next > first {
+					j = int32(float64(next-first) / float64(limit-first) * float64(data.numRestarts))
+				}
+				if j == prev {
+					continue
+				}
+				prev = j
+				if key, _ := data.seekRestart(j); r.contains(key.UserKey) {
+					samples = append(samples, key.Clone())
+				}
+			}
+			h.Release()
+		}
+	}
+	return samples, iter.Close()
+}
+
+// LoadBlocks reads the blocks of the table at the specified offsets into the
+// block cache. Offsets which do not correspond to a block of the table are
+// ignored. LoadBlocks implements cache.BlockLoader, allowing a Reader to be
+// used to warm the cache from a warm set saved by cache.SaveWarmSet.
+func (r *Reader) LoadBlocks(offsets []uint64) error {
+	if r.err != nil {
+		return r.err
+	}
+	want := make(map[uint64]bool, len(offsets))
+	for _, offset := range offsets {
+		want[offset] = true
+	}
+
+	for _, m := range []struct {
+		bh        blockHandle
+		transform blockTransform
+	}{
+		{r.index.bh, nil},
+		{r.filter.bh, nil},
+		{r.rangeDel.bh, r.rangeDelTransform},
+		{r.userKeyIndex.bh, nil},
+		{r.rangeKey.bh, nil},
+	} {
+		if m.bh.length == 0 || !want[m.bh.offset] {
+			continue
+		}
+		h, err := r.readMetaBlock(m.bh, m.transform)
+		if err != nil {
+			return err
+		}
+		h.Release()
+		delete(want, m.bh.offset)
+	}
+	if len(want) == 0 {
+		return nil
+	}
+
+	index, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+	iter := &blockIter{}
+	if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+		return err
+	}
+	var group []blockHandle
+	for key, val := iter.First(); key != nil; key, val = iter.Next() {
+		if group, err = r.decodeIndexEntry(group[:0], val); err != nil {
+			return err
+		}
+		for _, bh := range group {
+			if !want[bh.offset] {
+				continue
+			}
+			h, err := r.readBlock(bh, nil /* transform */, nil /* readahead */, nil /* stats */)
+			if err != nil {
+				return err
+			}
+			h.Release()
+		}
+	}
+	return iter.Close()
+}
+
+// prefetchMaxReadSize is the maximum size of the reads issued by
+// PrefetchRange.
+const prefetchMaxReadSize = 4 << 20
+
+// PrefetchRange loads the data blocks of the table which may contain keys in
+// the range [lower, upper) into the block cache, so that a subsequent scan of
+// the range does not read from the file. A nil bound is unbounded. Runs of
+// adjacent blocks which are not already cached are loaded using a single read
+// of up to 4MB, rather than a read per block. PrefetchRange does nothing if
+// data blocks are neither cached nor pinned by the Reader.
+func (r *Reader) PrefetchRange(lower, upper []byte) error {
+	if r.err != nil {
+		return r.err
+	}
+	c := r.blockCache(CacheDataBlocks)
+	if c == nil && r.pinned == nil {
+		return nil
+	}
+	lower, upper = r.intersectBounds(lower, upper)
+
+	index, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+	iter := &blockIter{}
+	if err := iter.init(r.compare, index, r.Properties.GlobalSeqNum); err != nil {
+		return err
+	}
+	var key *InternalKey
+	var val []byte
+	if lower != nil {
+		key, val = r.seekIndexGE(iter, lower)
+	} else {
+		key, val = iter.First()
+	}
+	var handles, group []blockHandle
+	for ; key != nil; key, val = iter.Next() {
+		// With a first-key index, the index key is the first key in the blocks
+		// covered by the entry, so these blocks lie beyond the range.
+		if r.Properties.IndexFirstKeys && upper != nil && r.compare(key.UserKey, upper) >= 0 {
+			break
+		}
+		if group, err = r.decodeIndexEntry(group[:0], val); err != nil {
+			iter.Close()
+			return err
+		}
+		for _, bh := range group {
+			if h := c.Get(r.fileNum, bh.offset); h.Get() != nil {
+				h.Release()
+				continue
+			}
+			handles = append(handles, bh)
+		}
+		// The index key is greater than or equal to every key in the blocks
+		// covered by the entry, so the following blocks lie beyond the range.
+		if !r.Properties.IndexFirstKeys && upper != nil && r.compare(key.UserKey, upper) >= 0 {
+			break
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	var ra readaheadState
+	for j := 0; j < len(handles); {
+		start := handles[j].offset
+		end := start + handles[j].length + blockTrailerLen
+		k := j + 1
+		for ; k < len(handles) && handles[k].offset == end; k++ {
+			next := handles[k].offset + handles[k].length + blockTrailerLen
+			if next-start > prefetchMaxReadSize {
+				break
+			}
+			end = next
+		}
+		ra = readaheadState{buf: ra.buf[:0], prefetchSize: int(end - start)}
+		for _, bh := range handles[j:k] {
+			h, err := r.readBlock(bh, nil /* transform */, &ra, nil /* stats */)
+			if err != nil {
+				return err
+			}
+			h.Release()
+		}
+		j = k
+	}
+	return nil
+}
+
+// seekIndexGE positions the index iterator at the first entry whose blocks may
+// contain keys greater than or equal to the given key. If the index is keyed by
+// separators, this is the first entry whose key is >= key. If it is keyed by
+// first keys, this is the entry preceding the first entry whose key is >= key,
+// as the blocks of the preceding entry may end with such keys, including older
+// versions of key itself.
+func (r *Reader) seekIndexGE(index *blockIter, key []byte) (*InternalKey, []byte) {
+	ikey, val := index.SeekGE(key)
+	if !r.Properties.IndexFirstKeys {
+		return ikey, val
+	}
+	if ikey == nil {
+		return index.Last()
+	}
+	if ikey, val := index.Prev(); ikey != nil {
+		return ikey, val
+	}
+	return index.First()
+}
+
+// seekIndexLT positions the index iterator at the last entry whose blocks may
+// contain keys less than the given key. If the index is keyed by first keys,
+// this is the last entry whose key is < key, and the index is exhausted if
+// there is no such entry.
+func (r *Reader) seekIndexLT(index *blockIter, key []byte) (*InternalKey, []byte) {
+	ikey, val := index.SeekGE(key)
+	if ikey == nil {
+		return index.Last()
+	}
+	if r.Properties.IndexFirstKeys {
+		return index.Prev()
+	}
+	return ikey, val
+}
+
+// readIndex reads the index block. If the filter is embedded in the index
+// block, the filter is stripped from the returned block.
 func (r *Reader) readIndex() (block, error) {
-	return r.readWeakCachedBlock(&r.index, nil /* transform */)
+	atomic.AddInt64(&r.stats.IndexBlockReads, 1)
+	b, err := r.readWeakCachedBlock(&r.index, nil /* transform */)
+	if err != nil {
+		return nil, err
+	}
+	return r.trimEmbeddedFilter(b)
+}
+
+// trimEmbeddedFilter strips the filter which precedes the index entries in the
+// index block of a table with an embedded filter.
+func (r *Reader) trimEmbeddedFilter(b block) (block, error) {
+	if !r.Properties.FilterEmbedded {
+		return b, nil
+	}
+	if uint64(len(b)) < r.Properties.FilterSize {
+		return nil, errors.New("pebble/table: invalid table (bad embedded filter size)")
+	}
+	return b[r.Properties.FilterSize:], nil
 }
 
+// readFilter reads the filter block. An embedded filter is read along with the
+// index block which holds it, so that a single block read serves both.
 func (r *Reader) readFilter() (block, error) {
-	return r.readWeakCachedBlock(&r.filter, nil /* transform */)
+	atomic.AddInt64(&r.stats.FilterBlockReads, 1)
+	if !r.Properties.FilterEmbedded {
+		return r.readWeakCachedBlock(&r.filter, nil /* transform */)
+	}
+	b, err := r.readWeakCachedBlock(&r.index, nil /* transform */)
+	if err != nil {
+		return nil, err
+	}
+	n := r.Properties.FilterSize
+	if uint64(len(b)) < n {
+		return nil, errors.New("pebble/table: invalid table (bad embedded filter size)")
+	}
+	return b[:n:n], nil
+}
+
+func (r *Reader) readUserKeyIndex() (block, error) {
+	return r.readWeakCachedBlock(&r.userKeyIndex, nil /* transform */)
 }
 
 func (r *Reader) readRangeDel() (block, error) {
-	return r.readWeakCachedBlock(&r.rangeDel, r.rangeDelTransform)
+	b, err := r.readWeakCachedBlock(&r.rangeDel, r.rangeDelTransform)
+	if err != nil || (r.lower == nil && r.upper == nil) {
+		return b, err
+	}
+	return r.truncateSpans(b, func(key InternalKey, value []byte) ([]byte, error) {
+		return value, nil
+	}, func(dst []byte, key InternalKey, value, end []byte) ([]byte, error) {
+		return append(dst, end...), nil
+	})
+}
+
+func (r *Reader) readRangeKey() (block, error) {
+	b, err := r.readWeakCachedBlock(&r.rangeKey, nil /* transform */)
+	if err != nil || (r.lower == nil && r.upper == nil) {
+		return b, err
+	}
+	return r.truncateSpans(b, func(key InternalKey, value []byte) ([]byte, error) {
+		k, err := DecodeRangeKey(key, value)
+		return k.End, err
+	}, func(dst []byte, key InternalKey, value, end []byte) ([]byte, error) {
+		k, err := DecodeRangeKey(key, value)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeRangeKeyValue(dst, key.Kind(), end, k.SuffixValues), nil
+	})
+}
+
+// truncateSpans returns a block holding the entries of the block b, each of
+// which is a span such as a range tombstone, truncated to the bounds of a
+// Reader created by View. Spans lying outside of the bounds are omitted. end
+// returns the end key of the span held by an entry, and setEnd appends to dst
+// the value of an entry with its end key replaced.
+func (r *Reader) truncateSpans(
+	b block,
+	end func(key InternalKey, value []byte) ([]byte, error),
+	setEnd func(dst []byte, key InternalKey, value, end []byte) ([]byte, error),
+) (block, error) {
+	type span struct {
+		key   InternalKey
+		value []byte
+	}
+	var spans []span
+	iter := &blockIter{}
+	if err := iter.init(r.compare, b, r.Properties.GlobalSeqNum); err != nil {
+		return nil, err
+	}
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		spanEnd, err := end(*key, value)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		start := r.clampSeekGE(key.UserKey)
+		spanEnd = r.clampSeekLT(spanEnd)
+		if r.compare(start, spanEnd) >= 0 {
+			continue
+		}
+		v, err := setEnd(nil, *key, value, spanEnd)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		spans = append(spans, span{
+			key:   InternalKey{UserKey: append([]byte(nil), start...), Trailer: key.Trailer},
+			value: v,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	// The start keys of the spans preceding the view are raised to its lower
+	// bound, which may reorder spans which were not fragmented.
+	sort.SliceStable(spans, func(i, j int) bool {
+		return base.InternalCompare(r.compare, spans[i].key, spans[j].key) < 0
+	})
+	w := blockWriter{restartInterval: 1}
+	for _, s := range spans {
+		w.add(s.key, s.value)
+	}
+	return w.finish(), nil
 }
 
 func (r *Reader) readWeakCachedBlock(
@@ -716,12 +2232,13 @@ func (r *Reader) readWeakCachedBlock(
 	}
 	w.mu.RUnlock()
 	if b != nil {
+		atomic.AddInt64(&r.stats.CacheHits, 1)
 		return b, nil
 	}
 
 	// Slow-path: read the index block from disk. This checks the cache again,
 	// but that is ok because somebody else might have inserted it for us.
-	h, err := r.readBlock(w.bh, transform)
+	h, err := r.readMetaBlock(w.bh, transform)
 	if err != nil {
 		return nil, err
 	}
@@ -734,28 +2251,152 @@ func (r *Reader) readWeakCachedBlock(
 	return b, err
 }
 
-// readBlock reads and decompresses a block from disk into memory.
+// readBlock reads and decompresses a data block from disk into memory. An
+// immutable Reader retains a reference to the block and serves subsequent
+// reads of the block from memory. If the keys of the table are compressed, the
+// keys of the block are decompressed as well.
 func (r *Reader) readBlock(
-	bh blockHandle, transform blockTransform,
+	bh blockHandle, transform blockTransform, ra *readaheadState, stats *IteratorStats,
+) (cache.Handle, error) {
+	atomic.AddInt64(&r.stats.DataBlockReads, 1)
+	if transform == nil && r.decompressKey != nil {
+		transform = r.transformCompressedKeys
+	}
+	return r.readBlockWithCache(r.blockCache(CacheDataBlocks), bh, transform, ra, stats)
+}
+
+// readMetaBlock is like readBlock, but for reading a meta block.
+func (r *Reader) readMetaBlock(bh blockHandle, transform blockTransform) (cache.Handle, error) {
+	return r.readBlockWithCache(r.blockCache(CacheMetaBlocks), bh, transform,
+		nil /* readahead */, nil /* stats */)
+}
+
+// blockCache returns the cache in which blocks of the specified kind are
+// stored, or nil if they are not cached.
+func (r *Reader) blockCache(kind BlockCaching) *cache.Cache {
+	if r.caching&kind == 0 {
+		return nil
+	}
+	return r.cache
+}
+
+func (r *Reader) readBlockWithCache(
+	c *cache.Cache,
+	bh blockHandle,
+	transform blockTransform,
+	ra *readaheadState,
+	stats *IteratorStats,
 ) (cache.Handle, error) {
-	if h := r.cache.Get(r.fileNum, bh.offset); h.Get() != nil {
+	if r.metaOnly {
+		return cache.Handle{}, errMetaOnly
+	}
+	if r.pinned == nil {
+		return r.readBlockInternal(c, bh, transform, ra, stats)
+	}
+
+	r.pinned.Lock()
+	if h, ok := r.pinned.m[bh.offset]; ok {
+		h = h.Acquire()
+		r.pinned.Unlock()
+		atomic.AddInt64(&r.stats.CacheHits, 1)
+		return h, nil
+	}
+	r.pinned.Unlock()
+
+	h, err := r.readBlockInternal(c, bh, transform, ra, stats)
+	if err != nil {
+		return h, err
+	}
+
+	r.pinned.Lock()
+	defer r.pinned.Unlock()
+	if r.pinned.m == nil {
+		// The Reader has been closed.
+		return h, nil
+	}
+	if existing, ok := r.pinned.m[bh.offset]; ok {
+		// Another goroutine read the block concurrently.
+		h.Release()
+		return existing.Acquire(), nil
+	}
+	r.pinned.m[bh.offset] = h.Acquire()
+	return h, nil
+}
+
+// verifyChecksum returns true if checksum is the checksum of b, a block
+// followed by its block type, using the checksum type of the table.
+func (r *Reader) verifyChecksum(b, checksum []byte) bool {
+	if r.checksumType == checksumXXHash64 {
+		return binary.LittleEndian.Uint32(checksum) == uint32(xxhash.Sum64(b))
+	}
+	return binary.LittleEndian.Uint32(checksum) == crc.New(b).Value()
+}
+
+// readBlockInternal reads a block, storing it in c. The block is not cached if
+// c is nil.
+func (r *Reader) readBlockInternal(
+	c *cache.Cache,
+	bh blockHandle,
+	transform blockTransform,
+	ra *readaheadState,
+	stats *IteratorStats,
+) (cache.Handle, error) {
+	if h := c.Get(r.fileNum, bh.offset); h.Get() != nil {
+		atomic.AddInt64(&r.stats.CacheHits, 1)
 		return h, nil
 	}
+	atomic.AddInt64(&r.stats.CacheMisses, 1)
 
-	b := r.cache.Alloc(int(bh.length + blockTrailerLen))
-	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+	if err := r.checkBlockSize(bh.length + blockTrailerLen); err != nil {
 		return cache.Handle{}, err
 	}
+	if r.limiter != nil {
+		r.limiter.WaitN(int(bh.length + blockTrailerLen))
+	}
+	var start time.Time
+	if stats != nil {
+		start = time.Now()
+	}
+	b := r.alloc(int(bh.length + blockTrailerLen))
+	if ra != nil && ra.active(r.opts) {
+		if err := ra.read(r.file, b, bh.offset, ra.size(r.opts)); err != nil {
+			return cache.Handle{}, err
+		}
+	} else if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+		return cache.Handle{}, err
+	}
+	if stats != nil {
+		// The remainder of the block load verifies, decrypts and decompresses
+		// the block, which is accounted as decode time.
+		now := time.Now()
+		stats.BlockReads++
+		stats.BlockReadDuration += now.Sub(start)
+		start = now
+		defer func() {
+			stats.BlockDecodeDuration += time.Since(start)
+		}()
+	}
 
-	checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
-	checksum1 := crc.New(b[:bh.length+1]).Value()
-	if checksum0 != checksum1 {
+	if !r.verifyChecksum(b[:bh.length+1], b[bh.length+1:]) {
 		return cache.Handle{}, errors.New("pebble/table: invalid table (checksum mismatch)")
 	}
 
 	typ := b[bh.length]
 	b = b[:bh.length]
 
+	if cipher := r.cipher; cipher != nil {
+		n := len(b) - cipher.Overhead()
+		if n < 0 {
+			return cache.Handle{}, errors.New("pebble/table: invalid table (encrypted block too short)")
+		}
+		opened, err := cipher.Open(r.alloc(n)[:0], b, bh.offset)
+		if err != nil {
+			return cache.Handle{}, fmt.Errorf("pebble/table: invalid table (block decryption failed): %v", err)
+		}
+		r.free(b)
+		b = opened
+	}
+
 	switch typ {
 	case noCompressionBlockType:
 		break
@@ -764,12 +2405,30 @@ func (r *Reader) readBlock(
 		if err != nil {
 			return cache.Handle{}, err
 		}
-		decoded := r.cache.Alloc(decodedLen)
+		if err := r.checkBlockSize(uint64(decodedLen)); err != nil {
+			r.free(b)
+			return cache.Handle{}, err
+		}
+		decoded := r.alloc(decodedLen)
 		decoded, err = snappy.Decode(decoded, b)
 		if err != nil {
 			return cache.Handle{}, err
 		}
-		r.cache.Free(b)
+		r.free(b)
+		b = decoded
+	case zlibCompressionBlockType:
+		decoded, err := r.decodeZlib(b, r.blockDict(bh))
+		if err != nil {
+			return cache.Handle{}, err
+		}
+		r.free(b)
+		b = decoded
+	case zstdCompressionBlockType:
+		decoded, err := r.decodeZstd(b, r.blockDict(bh))
+		if err != nil {
+			return cache.Handle{}, err
+		}
+		r.free(b)
 		b = decoded
 	default:
 		return cache.Handle{}, fmt.Errorf("pebble/table: unknown block compression: %d", typ)
@@ -784,10 +2443,94 @@ func (r *Reader) readBlock(
 		}
 	}
 
-	h := r.cache.Set(r.fileNum, bh.offset, b)
+	h := c.Set(r.fileNum, bh.offset, b)
 	return h, nil
 }
 
+// alloc allocates a buffer for reading or decoding a block from the
+// BufferPool, if there is one, or from the cache otherwise. A buffer allocated
+// from either may be stored in the cache, or freed to either. Decoded blocks
+// are not freed by the Reader: they are freed to the cache's allocator when
+// evicted, and left to the garbage collector if the Reader has no cache.
+func (r *Reader) alloc(n int) []byte {
+	if p := r.opts.BufferPool; p != nil {
+		return p.Alloc(n)
+	}
+	return r.cache.Alloc(n)
+}
+
+// free frees a buffer allocated by alloc.
+func (r *Reader) free(b []byte) {
+	if p := r.opts.BufferPool; p != nil {
+		p.Free(b)
+		return
+	}
+	r.cache.Free(b)
+}
+
+// checkBlockSize returns an error if a buffer of the specified size exceeds
+// the Options.MaxBlockSize limit.
+func (r *Reader) checkBlockSize(size uint64) error {
+	if max := r.opts.MaxBlockSize; max > 0 && size > uint64(max) {
+		return fmt.Errorf("pebble/table: invalid table (block size %d exceeds maximum %d)", size, max)
+	}
+	return nil
+}
+
+// blockDict returns the dictionary against which the block bh was compressed,
+// or nil if the block was compressed without a dictionary. Only the data
+// blocks, which precede all of the other blocks of the table, are compressed
+// against the dictionary.
+func (r *Reader) blockDict(bh blockHandle) []byte {
+	if bh.offset < r.tableProperties().DataSize {
+		return r.compressionDict
+	}
+	return nil
+}
+
+// decodeZlib decompresses a block compressed using zlib. The block holds a raw
+// deflate stream, which in RocksDB tables is preceded by the uvarint encoded
+// length of the decompressed block. LevelDB derived tables do not record the
+// length. A non-nil dict is the preset dictionary of the stream.
+func (r *Reader) decodeZlib(b, dict []byte) ([]byte, error) {
+	if r.format == TableFormatLevelDB {
+		max := r.opts.MaxBlockSize
+		if max <= 0 {
+			max = math.MaxInt32
+		}
+		zr := flate.NewReaderDict(bytes.NewReader(b), dict)
+		decoded, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+		if err != nil {
+			return nil, fmt.Errorf("pebble/table: invalid table (bad zlib block): %v", err)
+		}
+		if err := r.checkBlockSize(uint64(len(decoded))); err != nil {
+			return nil, err
+		}
+		return decoded, zr.Close()
+	}
+
+	decodedLen, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.New("pebble/table: invalid table (bad zlib block length)")
+	}
+	if err := r.checkBlockSize(decodedLen); err != nil {
+		return nil, err
+	}
+	zr := flate.NewReaderDict(bytes.NewReader(b[n:]), dict)
+	var decoded []byte
+	var err error
+	if r.streamDecompression(decodedLen) {
+		decoded, err = r.decompressChunked(zr, decodedLen)
+	} else {
+		decoded = r.alloc(int(decodedLen))
+		_, err = io.ReadFull(zr, decoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pebble/table: invalid table (bad zlib block): %v", err)
+	}
+	return decoded, zr.Close()
+}
+
 func (r *Reader) transformRangeDelV1(b []byte) ([]byte, error) {
 	// Convert v1 (RocksDB format) range-del blocks to v2 blocks on the fly. The
 	// v1 format range-del blocks have unfragmented and unsorted range
@@ -830,41 +2573,177 @@ func (r *Reader) transformRangeDelV1(b []byte) ([]byte, error) {
 	return rangeDelBlock.finish(), nil
 }
 
-func (r *Reader) readMetaindex(metaindexBH blockHandle, o *Options) error {
-	b, err := r.readBlock(metaindexBH, nil /* transform */)
+// transformCompressedKeys rewrites a data block whose keys were compressed
+// using Comparer.CompressKey into an equivalent block of decompressed keys,
+// which can be searched using the comparer. The restart interval of the
+// rewritten block need not match that of the original.
+func (r *Reader) transformCompressedKeys(b []byte) ([]byte, error) {
+	iter := &blockIter{}
+	if err := iter.init(r.compare, b, 0 /* globalSeqNum */); err != nil {
+		return nil, err
+	}
+	w := blockWriter{
+		restartInterval: 16,
+	}
+	var buf []byte
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		var err error
+		buf, err = r.decompressKey(buf[:0], key.UserKey)
+		if err != nil {
+			return nil, fmt.Errorf("pebble/table: invalid table (bad compressed key): %v", err)
+		}
+		w.add(InternalKey{UserKey: buf, Trailer: key.Trailer}, value)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return w.finish(), nil
+}
+
+// readMetaindexHandles reads the metaindex block, returning the handles of the
+// meta blocks keyed by name.
+func (r *Reader) readMetaindexHandles() (map[string]blockHandle, error) {
+	b, err := r.readBlockInternal(r.blockCache(CacheMetaBlocks), r.metaindexBH,
+		nil /* transform */, nil /* readahead */, nil /* stats */)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	i, err := newRawBlockIter(bytes.Compare, b.Get())
+	meta, err := decodeMetaindex(b.Get())
 	b.Release()
+	return meta, err
+}
+
+// decodeMetaindex decodes the contents of a metaindex block, returning the
+// handles of the meta blocks keyed by name.
+func decodeMetaindex(b block) (map[string]blockHandle, error) {
+	i, err := newRawBlockIter(bytes.Compare, b)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	meta := map[string]blockHandle{}
 	for valid := i.First(); valid; valid = i.Next() {
 		bh, n := decodeBlockHandle(i.Value())
 		if n == 0 {
-			return errors.New("pebble/table: invalid table (bad filter block handle)")
+			return nil, errors.New("pebble/table: invalid table (bad filter block handle)")
 		}
 		meta[string(i.Key().UserKey)] = bh
 	}
 	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// RawMetaBlock returns the contents of the meta block with the specified name
+// in the metaindex, such as "rocksdb.properties" or a block added by
+// Writer.AddMetaBlock, without interpreting them.
+// The checksum of the block is verified and the block is decompressed. The
+// metaindex block itself is returned for an empty name. An error is returned
+// if the table does not have a meta block with the name. A Reader created by
+// NewReaderMeta may only return the metaindex and properties blocks.
+func (r *Reader) RawMetaBlock(name string) ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	bh := r.metaindexBH
+	if name != "" {
+		meta, err := r.readMetaindexHandles()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if bh, ok = meta[name]; !ok {
+			return nil, fmt.Errorf("pebble/table: meta block %q not found", name)
+		}
+		if r.metaOnly && name != metaPropertiesName {
+			return nil, errMetaOnly
+		}
+	}
+	h, err := r.readBlockInternal(r.blockCache(CacheMetaBlocks), bh,
+		nil /* transform */, nil /* readahead */, nil /* stats */)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), h.Get()...)
+	h.Release()
+	return b, nil
+}
+
+// NewSectionReader returns a reader over the raw bytes of the table's file,
+// read through the Reader's file. This allows the file to be streamed, such
+// as to replicate the table, while the Reader continues to serve reads,
+// without opening the file a second time. The bytes are not verified or
+// decoded. The returned reader is safe for concurrent use, but must not be
+// used after the Reader is closed. The section reader of a view covers the
+// whole file.
+func (r *Reader) NewSectionReader() (*io.SectionReader, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return io.NewSectionReader(r.file, 0, r.size), nil
+}
+
+func (r *Reader) readMetaindex(footer footer, o *Options) error {
+	r.metaindexBH = footer.metaindexBH
+	meta, err := r.readMetaindexHandles()
+	if err != nil {
 		return err
 	}
 
 	if bh, ok := meta[metaPropertiesName]; ok {
-		b, err = r.readBlock(bh, nil /* transform */)
+		// The properties are read even by a Reader created by NewReaderMeta, so
+		// they bypass readBlockWithCache. They are only needed while loading.
+		b, err := r.readBlockInternal(r.blockCache(CacheMetaBlocks), bh,
+			nil /* transform */, nil /* readahead */, nil /* stats */)
 		if err != nil {
 			return err
 		}
 		data := b.Get()
-		err := r.Properties.load(data, bh.offset)
+		err = r.Properties.load(data, bh.offset)
 		b.Release()
 		if err != nil {
 			return err
 		}
 	}
+	return r.initMeta(footer, meta, o)
+}
+
+// initMeta initializes the Reader from the handles of the meta blocks of the
+// table and its properties, which have already been loaded.
+func (r *Reader) initMeta(footer footer, meta map[string]blockHandle, o *Options) error {
+	r.features.init(footer.format, meta, &r.Properties)
+	if r.metaOnly {
+		// The remaining meta blocks, and the comparer which decompresses the
+		// keys, are only needed to read the contents of the table.
+		return nil
+	}
+
+	// The compression dictionary is needed to decompress the data blocks, so
+	// it is loaded eagerly.
+	if bh, ok := meta[metaCompressionDictName]; ok {
+		b, err := r.readMetaBlock(bh, nil /* transform */)
+		if err != nil {
+			return err
+		}
+		r.compressionDict = append([]byte(nil), b.Get()...)
+		r.zstdDict = &zstdDictDecoder{dict: r.compressionDict}
+		b.Release()
+	}
+
+	// The keys of the data blocks can only be decompressed by the comparer
+	// which compressed them.
+	if r.Properties.KeysCompressed {
+		if o.Comparer.DecompressKey == nil || r.Properties.ComparatorName != o.Comparer.Name {
+			return fmt.Errorf("pebble/table: keys compressed by comparer %q cannot be decompressed by comparer %q",
+				r.Properties.ComparatorName, o.Comparer.Name)
+		}
+		r.decompressKey = o.Comparer.DecompressKey
+	}
+
+	if bh, ok := meta[metaUserKeyIndexName]; ok {
+		r.userKeyIndex.bh = bh
+	}
 
 	if bh, ok := meta[metaRangeDelV2Name]; ok {
 		r.rangeDel.bh = bh
@@ -873,11 +2752,39 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *Options) error {
 		r.rangeDelTransform = r.transformRangeDelV1
 	}
 
+	if bh, ok := meta[metaRangeKeyName]; ok {
+		r.rangeKey.bh = bh
+	}
+
+	// The prefix map can only be used if the prefixes passed to SeekPrefixGE
+	// are extracted in the same way as when the table was written.
+	if bh, ok := meta[metaPrefixMapName]; ok &&
+		r.split != nil && r.Properties.ComparatorName == o.Comparer.Name {
+		r.prefixMap.bh = bh
+	}
+
+	if bh, ok := meta[metaCFRangesName]; ok {
+		r.cfRanges.bh = bh
+	}
+
+	if bh, ok := meta[metaBlockKeyRangesName]; ok {
+		r.blockKeyRanges.bh = bh
+	}
+
 	for level := range r.opts.Levels {
 		fp := r.opts.Levels[level].FilterPolicy
 		if fp == nil {
 			continue
 		}
+		if r.Properties.FilterEmbedded {
+			// An embedded filter does not have a metaindex entry.
+			if fp.Name() != r.Properties.FilterPolicyName {
+				continue
+			}
+			r.tableFilter = newTableFilterReader(fp)
+			r.tableFilter.initMode(&r.Properties, o.Comparer)
+			break
+		}
 		types := []struct {
 			ftype  FilterType
 			prefix string
@@ -892,6 +2799,7 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *Options) error {
 				switch t.ftype {
 				case TableFilter:
 					r.tableFilter = newTableFilterReader(fp)
+					r.tableFilter.initMode(&r.Properties, o.Comparer)
 				default:
 					return fmt.Errorf("unknown filter type: %v", t.ftype)
 				}
@@ -909,31 +2817,59 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *Options) error {
 
 // NewReader returns a new table reader for the file. Closing the reader will
 // close the file.
-func NewReader(f vfs.File, fileNum uint64, o *Options) *Reader {
-	o = o.EnsureDefaults()
-	r := &Reader{
-		file:    f,
-		fileNum: fileNum,
-		opts:    o,
-		cache:   o.Cache,
-		compare: o.Comparer.Compare,
-		split:   o.Comparer.Split,
+func NewReader(f vfs.File, fileNum uint64, o *Options, extraOpts ...ReaderOption) *Reader {
+	if f == nil {
+		return NewReaderSize(nil /* f */, 0 /* size */, fileNum, o, extraOpts...)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		r := newReader(f, fileNum, o, extraOpts)
+		r.err = fmt.Errorf("pebble/table: invalid table (could not stat file): %v", err)
+		return r
 	}
+	return NewReaderSize(f, stat.Size(), fileNum, o, extraOpts...)
+}
+
+// NewReaderSize returns a new table reader for a table of the specified size
+// which is read through f, such as a table stored in an object store rather
+// than on a filesystem. The footer is read from the end of the table as
+// located by the size, and the Reader otherwise behaves identically to one
+// returned by NewReader. Closing the reader will close f if it implements
+// io.Closer.
+func NewReaderSize(
+	f io.ReaderAt, size int64, fileNum uint64, o *Options, extraOpts ...ReaderOption,
+) *Reader {
+	r := newReader(f, fileNum, o, extraOpts)
 	if f == nil {
 		r.err = errors.New("pebble/table: nil file")
 		return r
 	}
-	footer, err := readFooter(f)
+	r.size = size
+	footer, err := readFooterAt(f, size)
 	if err != nil {
 		r.err = err
 		return r
 	}
+	if c := r.opts.BlockCipher; c != nil {
+		if r.cipher, err = readTableCipher(f, size, c); err != nil {
+			r.err = err
+			return r
+		}
+	}
+	r.checksumType = footer.checksum
+	r.format = footer.format
 	// Read the metaindex.
-	if err := r.readMetaindex(footer.metaindexBH, o); err != nil {
+	if err := r.readMetaindex(footer, r.opts); err != nil {
 		r.err = err
 		return r
 	}
 	r.index.bh = footer.indexBH
+	if r.verifyHandles {
+		if err := r.verifyBlockHandles(); err != nil {
+			r.err = err
+			return r
+		}
+	}
 
 	// index, r.err = r.readIndex()
 	// iter, _ := newBlockIter(r.compare, index)
@@ -942,3 +2878,42 @@ func NewReader(f vfs.File, fileNum uint64, o *Options) *Reader {
 	// }
 	return r
 }
+
+func newReader(f io.ReaderAt, fileNum uint64, o *Options, extraOpts []ReaderOption) *Reader {
+	o = o.EnsureDefaults()
+	r := &Reader{
+		file:    f,
+		fileNum: fileNum,
+		opts:    o,
+		cache:   o.Cache,
+		compare: o.Comparer.Compare,
+		split:   o.Comparer.Split,
+		caching: CacheAllBlocks,
+	}
+	for _, opt := range extraOpts {
+		opt.readerApply(r)
+	}
+	return r
+}
+
+// errMetaOnly is returned when reading the contents of a table using a Reader
+// created by NewReaderMeta.
+var errMetaOnly = errors.New("pebble/table: reader only loaded the table metadata")
+
+// NewReaderMeta returns a Reader for the file which only reads the footer,
+// the metaindex and the properties of the table. The index, filter and data
+// blocks are never read, which makes NewReaderMeta suitable for scanning the
+// metadata of many tables. The Properties and Features of the returned Reader
+// are populated, while iterators, point lookups and any other methods which
+// read the contents of the table return an error. Closing the reader will
+// close the file.
+func NewReaderMeta(f vfs.File, o *Options) *Reader {
+	// The blocks are read without the cache, as a Reader created without a
+	// file number would share the cache keys of every other such Reader.
+	if o != nil && o.Cache != nil {
+		oc := *o
+		oc.Cache = nil
+		o = &oc
+	}
+	return NewReader(f, 0 /* fileNum */, o, metaOnlyOption{})
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/petermattis/pebble/internal/base"
+)
+
+// internalKV is an internal key and its value.
+type internalKV struct {
+	Key   InternalKey
+	Value []byte
+}
+
+// newReaderFromBlocks returns a Reader over a table whose data blocks hold
+// exactly the specified groups of entries: each group is written to its own
+// data block, in order. This gives tests precise control over the block
+// boundaries of a table, which the block size only controls approximately.
+// The groups must be non-empty and the entries must be in increasing order
+// across all of the groups. The BlockSize and MaxKeysPerBlock of lo are
+// ignored.
+func newReaderFromBlocks(t testing.TB, blocks [][]internalKV, lo TableOptions) *Reader {
+	lo.BlockSize = math.MaxInt32
+	lo.MaxKeysPerBlock = 0
+	r := newTestReader(t, nil, lo, func(w *Writer) error {
+		for i, block := range blocks {
+			if len(block) == 0 {
+				t.Fatalf("block %d is empty", i)
+			}
+			for j, kv := range block {
+				// The block is only flushed before the first entry of a group, when it
+				// holds the maximum number of keys.
+				w.maxKeysPerBlock = math.MaxInt32
+				if j == 0 && w.block.nEntries > 0 {
+					w.maxKeysPerBlock = w.block.nEntries
+				}
+				if err := w.Add(kv.Key, kv.Value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return r
+}
+
+// readDataBlocks returns the entries of each of the data blocks of the table,
+// in order.
+func readDataBlocks(t testing.TB, r *Reader) [][]internalKV {
+	indexBlock, err := r.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index blockIter
+	if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+		t.Fatal(err)
+	}
+	var blocks [][]internalKV
+	var group []blockHandle
+	for key, value := index.First(); key != nil; key, value = index.Next() {
+		if group, err = r.decodeIndexEntry(group[:0], value); err != nil {
+			t.Fatal(err)
+		}
+		for _, bh := range group {
+			h, err := r.readBlock(bh, nil /* transform */, nil /* readahead */, nil /* stats */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kvs []internalKV
+			err = countBlockEntries(r, h.Get(), func(key *InternalKey, value []byte) {
+				kvs = append(kvs, internalKV{Key: key.Clone(), Value: append([]byte(nil), value...)})
+			})
+			h.Release()
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, kvs)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+func TestNewReaderFromBlocks(t *testing.T) {
+	kv := func(key string, seqNum uint64, value string) internalKV {
+		return internalKV{
+			Key:   base.MakeInternalKey([]byte(key), seqNum, InternalKeyKindSet),
+			Value: []byte(value),
+		}
+	}
+	blocks := [][]internalKV{
+		{kv("a", 1, "a1")},
+		{kv("b", 2, "b2"), kv("c", 3, "c3"), kv("d", 4, "d4")},
+		// The versions of a key may be split across blocks.
+		{kv("e", 6, "e6")},
+		{kv("e", 5, "e5"), kv("f", 7, "f7")},
+		{kv("g", 8, "g8"), kv("h", 9, "h9")},
+	}
+
+	for _, c := range []struct {
+		name string
+		lo   TableOptions
+	}{
+		{"default", TableOptions{}},
+		{"snappy", TableOptions{Compression: SnappyCompression}},
+		{"sparse-index", TableOptions{IndexSparsity: 2}},
+		{"index-first-keys", TableOptions{IndexFirstKeys: true}},
+		{"restart-interval=1", TableOptions{BlockRestartInterval: 1}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := newReaderFromBlocks(t, blocks, c.lo)
+			defer r.Close()
+
+			// Each group of entries lands in its own data block.
+			if v := r.Properties.NumDataBlocks; v != uint64(len(blocks)) {
+				t.Fatalf("expected %d data blocks, but found %d", len(blocks), v)
+			}
+			if actual := readDataBlocks(t, r); !reflect.DeepEqual(blocks, actual) {
+				t.Fatalf("expected blocks\n%v\nbut found\n%v", blocks, actual)
+			}
+
+			// Seeks exactly at and around the block boundaries find the expected
+			// entries.
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			defer iter.Close()
+			for _, c := range []struct {
+				seekGE, expectedGE string
+				seekLT, expectedLT string
+			}{
+				{"a", "a", "b", "a"},
+				{"a\x00", "b", "d", "c"},
+				{"b", "b", "e", "d"},
+				{"d", "d", "e\x00", "e"},
+				{"d\x00", "e", "f", "e"},
+				{"e", "e", "g", "f"},
+				{"f\x00", "g", "h\x00", "h"},
+			} {
+				if key, _ := iter.SeekGE([]byte(c.seekGE)); key == nil || string(key.UserKey) != c.expectedGE {
+					t.Fatalf("SeekGE(%q): expected %q, but found %v", c.seekGE, c.expectedGE, key)
+				}
+				if key, _ := iter.SeekLT([]byte(c.seekLT)); key == nil || string(key.UserKey) != c.expectedLT {
+					t.Fatalf("SeekLT(%q): expected %q, but found %v", c.seekLT, c.expectedLT, key)
+				}
+			}
+			// The newest version of a key split across blocks is found first.
+			if key, value := iter.SeekGE([]byte("e")); key.SeqNum() != 6 || string(value) != "e6" {
+				t.Fatalf("SeekGE(e): expected e#6, but found %s:%s", key, value)
+			}
+			if key, _ := iter.Next(); key == nil || key.SeqNum() != 5 {
+				t.Fatalf("expected e#5 to follow e#6, but found %v", key)
+			}
+		})
+	}
+}
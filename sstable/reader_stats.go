@@ -0,0 +1,41 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "sync/atomic"
+
+// ReaderStats holds the block read counters of a Reader, accumulated over the
+// lifetime of the Reader by all of its iterators and point lookups. A view of a
+// Reader has its own counters.
+type ReaderStats struct {
+	// The number of data blocks read, whether from the block cache or from the
+	// file.
+	DataBlockReads int64
+	// The number of times the index block was read.
+	IndexBlockReads int64
+	// The number of times the filter block was read. A filter embedded in the
+	// index block is counted as a filter block read rather than an index block
+	// read.
+	FilterBlockReads int64
+	// The number of block reads, of any kind, served from memory: the block
+	// cache, or the blocks held by an immutable Reader.
+	CacheHits int64
+	// The number of block reads, of any kind, which read the block from the
+	// file.
+	CacheMisses int64
+}
+
+// Stats returns the block read counters of the Reader. Stats is safe to call
+// concurrently with the use of the Reader.
+func (r *Reader) Stats() ReaderStats {
+	s := &r.stats
+	return ReaderStats{
+		DataBlockReads:   atomic.LoadInt64(&s.DataBlockReads),
+		IndexBlockReads:  atomic.LoadInt64(&s.IndexBlockReads),
+		FilterBlockReads: atomic.LoadInt64(&s.FilterBlockReads),
+		CacheHits:        atomic.LoadInt64(&s.CacheHits),
+		CacheMisses:      atomic.LoadInt64(&s.CacheMisses),
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
+)
+
+func TestReaderStats(t *testing.T) {
+	fp := bloom.FilterPolicy(10)
+	r := newTestReader(t, &Options{
+		Cache:  cache.New(1 << 20),
+		Levels: []TableOptions{{FilterPolicy: fp}},
+	}, TableOptions{BlockSize: 128, FilterPolicy: fp}, func(w *Writer) error {
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	numDataBlocks := int64(r.Properties.NumDataBlocks)
+	if numDataBlocks < 10 {
+		t.Fatalf("expected at least 10 data blocks, but found %d", numDataBlocks)
+	}
+	// Opening the Reader reads the metaindex and properties blocks.
+	initial := r.Stats()
+
+	scan := func() {
+		iter := r.NewIter(nil /* lower */, nil /* upper */)
+		var n int
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != 500 {
+			t.Fatalf("expected 500 keys, but found %d", n)
+		}
+	}
+	sub := func(a, b ReaderStats) ReaderStats {
+		return ReaderStats{
+			DataBlockReads:   a.DataBlockReads - b.DataBlockReads,
+			IndexBlockReads:  a.IndexBlockReads - b.IndexBlockReads,
+			FilterBlockReads: a.FilterBlockReads - b.FilterBlockReads,
+			CacheHits:        a.CacheHits - b.CacheHits,
+			CacheMisses:      a.CacheMisses - b.CacheMisses,
+		}
+	}
+
+	// The first scan of the cold Reader reads the index and every data block
+	// from the file.
+	scan()
+	cold := r.Stats()
+	expected := ReaderStats{
+		DataBlockReads:  numDataBlocks,
+		IndexBlockReads: 1,
+		CacheMisses:     numDataBlocks + 1,
+	}
+	if s := sub(cold, initial); s != expected {
+		t.Fatalf("expected %+v, but found %+v", expected, s)
+	}
+
+	// The second scan is served from the block cache.
+	scan()
+	expected = ReaderStats{
+		DataBlockReads:  numDataBlocks,
+		IndexBlockReads: 1,
+		CacheHits:       numDataBlocks + 1,
+	}
+	if s := sub(r.Stats(), cold); s != expected {
+		t.Fatalf("expected %+v, but found %+v", expected, s)
+	}
+
+	// A point lookup reads the filter.
+	before := r.Stats()
+	if _, err := r.get([]byte("0100")); err != nil {
+		t.Fatal(err)
+	}
+	if s := sub(r.Stats(), before); s.FilterBlockReads != 1 || s.CacheMisses != 1 {
+		t.Fatalf("expected a filter block read from the file, but found %+v", s)
+	}
+
+	// The counters may be read concurrently with iteration.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+				_ = r.Stats()
+			}
+			iter.Close()
+		}()
+	}
+	wg.Wait()
+	if s := sub(r.Stats(), before); s.DataBlockReads < 4*numDataBlocks {
+		t.Fatalf("expected at least %d data block reads, but found %d",
+			4*numDataBlocks, s.DataBlockReads)
+	}
+}
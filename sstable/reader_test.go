@@ -8,75 +8,29 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/internal/datadriven"
 	"github.com/petermattis/pebble/vfs"
 	"golang.org/x/exp/rand"
 )
 
-// iterAdapter adapts the new Iterator API which returns the key and value from
-// positioning methods (Seek*, First, Last, Next, Prev) to the old API which
-// returned a boolean corresponding to Valid. Only used by test code.
-type iterAdapter struct {
-	*Iterator
-}
-
-func (i *iterAdapter) verify(key *InternalKey, val []byte) bool {
-	valid := key != nil
-	if valid != i.Valid() {
-		panic(fmt.Sprintf("inconsistent valid: %t != %t", valid, i.Valid()))
-	}
-	if valid {
-		if base.InternalCompare(bytes.Compare, *key, i.Key()) != 0 {
-			panic(fmt.Sprintf("inconsistent key: %s != %s", *key, i.Key()))
-		}
-		if !bytes.Equal(val, i.Value()) {
-			panic(fmt.Sprintf("inconsistent value: [% x] != [% x]", val, i.Value()))
-		}
-	}
-	return valid
-}
-
-func (i *iterAdapter) SeekGE(key []byte) bool {
-	return i.verify(i.Iterator.SeekGE(key))
-}
-
-func (i *iterAdapter) SeekPrefixGE(prefix, key []byte) bool {
-	return i.verify(i.Iterator.SeekPrefixGE(prefix, key))
-}
-
-func (i *iterAdapter) SeekLT(key []byte) bool {
-	return i.verify(i.Iterator.SeekLT(key))
-}
-
-func (i *iterAdapter) First() bool {
-	return i.verify(i.Iterator.First())
-}
-
-func (i *iterAdapter) Last() bool {
-	return i.verify(i.Iterator.Last())
-}
-
-func (i *iterAdapter) Next() bool {
-	return i.verify(i.Iterator.Next())
-}
-
-func (i *iterAdapter) Prev() bool {
-	return i.verify(i.Iterator.Prev())
-}
-
-func (i *iterAdapter) Key() InternalKey {
-	return *i.Iterator.Key()
-}
-
 func TestReader(t *testing.T) {
 	tableOpts := map[string]TableOptions{
 		// No bloom filters.
@@ -96,6 +50,12 @@ func TestReader(t *testing.T) {
 			FilterPolicy: bloom.FilterPolicy(100),
 			FilterType:   base.TableFilter,
 		},
+		"indexFirstKeys": TableOptions{
+			// An index keyed by the first key of each single-entry block, so
+			// that every key lies at a block boundary.
+			IndexFirstKeys:  true,
+			MaxKeysPerBlock: 1,
+		},
 	}
 
 	opts := map[string]*Options{
@@ -182,7 +142,7 @@ func runTestReader(t *testing.T, o Options, dir string) {
 					}
 				}
 
-				iter := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+				iter := NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
 				if err := iter.Error(); err != nil {
 					t.Fatal(err)
 				}
@@ -258,17 +218,20 @@ func checkValidPrefix(prefix, key []byte) bool {
 }
 
 func TestBytesIteratedCompressed(t *testing.T) {
-	for _, blockSize := range []int{10, 100, 1000, 4096} {
-		for _, numEntries := range []uint64{0, 1, 1e5} {
-			r := buildTestTable(t, numEntries, blockSize, SnappyCompression)
-			var bytesIterated uint64
-			citer := r.NewCompactionIter(&bytesIterated)
-			for citer.First(); citer.Valid(); citer.Next() {}
+	for _, compression := range []Compression{SnappyCompression, ZstdCompression} {
+		for _, blockSize := range []int{10, 100, 1000, 4096} {
+			for _, numEntries := range []uint64{0, 1, 1e5} {
+				r := buildTestTable(t, numEntries, blockSize, compression)
+				var bytesIterated uint64
+				citer := r.NewCompactionIter(&bytesIterated)
+				for citer.First(); citer.Valid(); citer.Next() {
+				}
 
-			expected := r.Properties.DataSize
-			// There is some inaccuracy due to compression estimation.
-			if bytesIterated < expected * 99/100 || bytesIterated > expected * 101/100 {
-				t.Fatalf("bytesIterated: got %d, want %d", bytesIterated, expected)
+				expected := r.Properties.DataSize
+				// There is some inaccuracy due to compression estimation.
+				if bytesIterated < expected*99/100 || bytesIterated > expected*101/100 {
+					t.Fatalf("%s: bytesIterated: got %d, want %d", compression, bytesIterated, expected)
+				}
 			}
 		}
 	}
@@ -290,6 +253,56 @@ func TestBytesIteratedUncompressed(t *testing.T) {
 	}
 }
 
+func TestCompactionIterKindCounts(t *testing.T) {
+	kinds := []InternalKeyKind{
+		InternalKeyKindSet, InternalKeyKindDelete, InternalKeyKindMerge, InternalKeyKindDelete,
+	}
+	var expected [3]uint64
+	r := newTestReader(t, nil, TableOptions{BlockSize: 64}, func(w *Writer) error {
+		for i := 0; i < 300; i++ {
+			kind := kinds[(i*i)%len(kinds)]
+			key := base.MakeInternalKey([]byte(fmt.Sprintf("%04d", i)), uint64(i), kind)
+			var value []byte
+			if kind != InternalKeyKindDelete {
+				value = []byte(fmt.Sprintf("value-%d", i))
+			}
+			if err := w.Add(key, value); err != nil {
+				return err
+			}
+			expected[kind]++
+		}
+		// Range deletions are not entries of the data blocks, and are not counted.
+		return w.DeleteRange([]byte("0010"), []byte("0020"))
+	})
+	defer r.Close()
+	if r.Properties.NumDataBlocks < 2 {
+		t.Fatalf("expected several data blocks, but found %d", r.Properties.NumDataBlocks)
+	}
+
+	var bytesIterated uint64
+	citer := r.NewCompactionIter(&bytesIterated)
+	var counts [3]uint64
+	for key, _ := citer.First(); key != nil; key, _ = citer.Next() {
+		counts[key.Kind()]++
+		if citer.Sets != counts[InternalKeyKindSet] ||
+			citer.Deletions != counts[InternalKeyKindDelete] ||
+			citer.Merges != counts[InternalKeyKindMerge] {
+			t.Fatalf("%s: expected %d sets, %d deletions and %d merges, but found %d, %d and %d",
+				key, counts[InternalKeyKindSet], counts[InternalKeyKindDelete], counts[InternalKeyKindMerge],
+				citer.Sets, citer.Deletions, citer.Merges)
+		}
+	}
+	if err := citer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if counts != expected {
+		t.Fatalf("expected counts %v, but found %v", expected, counts)
+	}
+	if citer.Deletions != r.Properties.NumDeletions {
+		t.Fatalf("expected %d deletions, but found %d", r.Properties.NumDeletions, citer.Deletions)
+	}
+}
+
 func buildTestTable(t *testing.T, numEntries uint64, blockSize int, compression Compression) *Reader {
 	mem := vfs.NewMem()
 	f0, err := mem.Create("test")
@@ -327,6 +340,46 @@ func buildTestTable(t *testing.T, numEntries uint64, blockSize int, compression
 	})
 }
 
+// writeTestTable creates the named table in fs, calls add to populate it, and
+// returns the closed Writer.
+func writeTestTable(
+	t testing.TB, fs vfs.FS, name string, o *Options, lo TableOptions, add func(w *Writer) error,
+) *Writer {
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, o, lo)
+	if err := add(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// openTestTable opens the named table in fs for reading.
+func openTestTable(
+	t testing.TB, fs vfs.FS, name string, o *Options, extraOpts ...ReaderOption,
+) *Reader {
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewReader(f, 0, o, extraOpts...)
+}
+
+// newTestReader writes a table populated by add to a new in-memory filesystem
+// and opens it for reading. The Options are used for both writing and reading.
+func newTestReader(
+	t testing.TB, o *Options, lo TableOptions, add func(w *Writer) error, extraOpts ...ReaderOption,
+) *Reader {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", o, lo, add)
+	return openTestTable(t, mem, "test", o, extraOpts...)
+}
+
 func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader, [][]byte) {
 	mem := vfs.NewMem()
 	f0, err := mem.Create("bench")
@@ -452,3 +505,3208 @@ func BenchmarkTableIterPrev(b *testing.B) {
 			})
 	}
 }
+
+func TestReaderView(t *testing.T) {
+	r := buildTestTable(t, 1000, 256, NoCompression)
+	defer r.Close()
+
+	key := func(i uint64) []byte {
+		k := make([]byte, 8+i%3)
+		binary.BigEndian.PutUint64(k, i)
+		return k
+	}
+	lower, upper := key(100), key(600)
+	v := r.View(lower, upper)
+
+	// Iterating over the view is equivalent to a bounded iteration over the full
+	// table.
+	scan := func(iter *Iterator) []string {
+		var keys []string
+		for k, _ := iter.SeekGE(lower); k != nil; k, _ = iter.Next() {
+			keys = append(keys, k.String())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	expected := scan(r.NewIter(lower, upper))
+	if len(expected) != 500 {
+		t.Fatalf("expected 500 keys, but found %d", len(expected))
+	}
+	if got := scan(v.NewIter(nil /* lower */, nil /* upper */)); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %d keys, but found %d", len(expected), len(got))
+	}
+	if got := scan(v.NewIter(nil /* lower */, key(900))); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %d keys, but found %d", len(expected), len(got))
+	}
+
+	// Positioning an iterator over the view never leaves the view.
+	iter := v.NewIter(nil /* lower */, nil /* upper */)
+	for _, c := range []struct {
+		name     string
+		pos      func() (*InternalKey, []byte)
+		expected uint64
+	}{
+		{"first", iter.First, 100},
+		{"last", iter.Last, 599},
+		{"seek-ge", func() (*InternalKey, []byte) { return iter.SeekGE(key(0)) }, 100},
+		{"seek-lt", func() (*InternalKey, []byte) { return iter.SeekLT(key(999)) }, 599},
+		{"seek-prefix-ge", func() (*InternalKey, []byte) {
+			return iter.SeekPrefixGE(key(0), key(0))
+		}, 100},
+	} {
+		if k, _ := c.pos(); k == nil || !bytes.Equal(k.UserKey, key(c.expected)) {
+			t.Fatalf("%s: expected %x, but found %v", c.name, key(c.expected), k)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys outside of the view are not found.
+	for _, i := range []uint64{0, 99, 600, 999} {
+		if _, err := v.get(key(i)); err != base.ErrNotFound {
+			t.Fatalf("%d: expected not found, but found %v", i, err)
+		}
+		if _, err := r.get(key(i)); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	for _, i := range []uint64{100, 350, 599} {
+		if _, err := v.get(key(i)); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+
+	// The disk usage estimate is restricted to the view.
+	full, err := r.EstimateDiskUsage(key(0), key(999))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full != r.Properties.DataSize {
+		t.Fatalf("expected %d, but found %d", r.Properties.DataSize, full)
+	}
+	// The upper bound of the view is exclusive, so the view ends with the last
+	// key preceding the bound.
+	expectedUsage, err := r.EstimateDiskUsage(lower, key(599))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := v.EstimateDiskUsage(key(0), key(999))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != expectedUsage || usage >= full {
+		t.Fatalf("expected %d (< %d), but found %d", expectedUsage, full, usage)
+	}
+
+	// The size and count properties are scoped to the view.
+	if v.Properties.DataSize != usage {
+		t.Fatalf("expected data size %d, but found %d", usage, v.Properties.DataSize)
+	}
+	if n := v.Properties.NumEntries; n < 450 || n > 550 {
+		t.Fatalf("expected roughly 500 entries, but found %d", n)
+	}
+	if r.Properties.NumEntries != 1000 {
+		t.Fatalf("expected 1000 entries, but found %d", r.Properties.NumEntries)
+	}
+
+	// Closing the view leaves the underlying Reader usable.
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.get(key(0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderViewRangeDeletions(t *testing.T) {
+	r := newTestReader(t, nil, TableOptions{}, func(w *Writer) error {
+		for _, k := range []string{"a", "d", "h", "n", "r"} {
+			if err := w.Set([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		for _, span := range [][2]string{{"a", "b"}, {"b", "e"}, {"g", "i"}, {"m", "z"}} {
+			if err := w.DeleteRange([]byte(span[0]), []byte(span[1])); err != nil {
+				return err
+			}
+		}
+		for _, span := range [][2]string{{"a", "e"}, {"k", "z"}} {
+			if err := w.RangeKeySet([]byte(span[0]), []byte(span[1]), nil, []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	// The spans of the view are truncated to its bounds, and the spans lying
+	// outside of the bounds are omitted.
+	v := r.View([]byte("c"), []byte("p"))
+	var tombstones []string
+	iter := v.NewRangeDelIter()
+	for k, end := iter.First(); k != nil; k, end = iter.Next() {
+		tombstones = append(tombstones, fmt.Sprintf("%s-%s", k.UserKey, end))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"c-e", "g-i", "m-p"}
+	if !reflect.DeepEqual(expected, tombstones) {
+		t.Fatalf("expected %s, but found %s", expected, tombstones)
+	}
+	if v.Properties.NumRangeDeletions != uint64(len(expected)) {
+		t.Fatalf("expected %d range deletions, but found %d",
+			len(expected), v.Properties.NumRangeDeletions)
+	}
+
+	var rangeKeys []string
+	rangeKeyIter := v.NewRangeKeyIter()
+	for k := rangeKeyIter.First(); k != nil; k = rangeKeyIter.Next() {
+		rangeKeys = append(rangeKeys, fmt.Sprintf("%s-%s", k.Start.UserKey, k.End))
+	}
+	if err := rangeKeyIter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"c-e", "k-p"}
+	if !reflect.DeepEqual(expected, rangeKeys) {
+		t.Fatalf("expected %s, but found %s", expected, rangeKeys)
+	}
+	if v.Properties.NumRangeKeySets != uint64(len(expected)) {
+		t.Fatalf("expected %d range key sets, but found %d",
+			len(expected), v.Properties.NumRangeKeySets)
+	}
+
+	// The point entries of the view are unaffected by the truncation.
+	pointIter := v.NewIter(nil /* lower */, nil /* upper */)
+	var keys []string
+	for k, _ := pointIter.First(); k != nil; k, _ = pointIter.Next() {
+		keys = append(keys, string(k.UserKey))
+	}
+	if err := pointIter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"d", "h", "n"}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatalf("expected %s, but found %s", expected, keys)
+	}
+}
+
+func TestReaderUserKeyIndex(t *testing.T) {
+	build := func(userKeyIndex bool) *Reader {
+		return newTestReader(t, nil, TableOptions{
+			BlockSize:    64,
+			Compression:  NoCompression,
+			UserKeyIndex: userKeyIndex,
+		}, func(w *Writer) error {
+			// Write several versions of each key so that the versions of a key
+			// frequently span data blocks.
+			for i := 0; i < 200; i += 2 {
+				key := []byte(fmt.Sprintf("%04d", i))
+				for seqNum := uint64(i%5 + 1); seqNum > 0; seqNum-- {
+					value := []byte(fmt.Sprintf("%04d.%d", i, seqNum))
+					if err := w.Add(base.MakeInternalKey(key, seqNum, InternalKeyKindSet), value); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	r := build(false)
+	defer r.Close()
+	u := build(true)
+	defer u.Close()
+	if r.Properties.UserKeyIndexSize != 0 {
+		t.Fatalf("expected no user-key index, but found size %d", r.Properties.UserKeyIndexSize)
+	}
+	if u.Properties.UserKeyIndexSize == 0 {
+		t.Fatalf("expected user-key index")
+	}
+
+	// Collect the first and last user key of each data block so that lookups
+	// of keys exactly on the block boundaries are exercised.
+	var keys [][]byte
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	var prevBH blockHandle
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		if iter.dataBH != prevBH {
+			keys = append(keys, append([]byte(nil), key.UserKey...))
+			prevBH = iter.dataBH
+		}
+	}
+	for key, _ := iter.Last(); key != nil; key, _ = iter.Prev() {
+		if iter.dataBH != prevBH {
+			keys = append(keys, append([]byte(nil), key.UserKey...))
+			prevBH = iter.dataBH
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) < 20 {
+		t.Fatalf("expected many data blocks, but found %d block boundaries", len(keys))
+	}
+	for i := 0; i <= 200; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%04d", i)))
+	}
+	keys = append(keys, []byte(""), []byte("0000\x00"), []byte("9999"))
+
+	for _, key := range keys {
+		expected, expectedErr := r.get(key)
+		value, err := u.get(key)
+		if expectedErr != err || !bytes.Equal(expected, value) {
+			t.Fatalf("%q: expected %q (%v), but found %q (%v)", key, expected, expectedErr, value, err)
+		}
+		if expectedErr == nil {
+			// The newest version of a key is always returned.
+			if v := fmt.Sprintf("%s.%d", key, mustAtoi(t, string(key))%5+1); v != string(value) {
+				t.Fatalf("%q: expected %q, but found %q", key, v, value)
+			}
+		}
+	}
+}
+
+func TestLegacyIterAdapter(t *testing.T) {
+	r := buildTestTable(t, 1000, 256, SnappyCompression)
+	defer r.Close()
+
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	defer iter.Close()
+	legacy := NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
+	defer legacy.Close()
+
+	// verify checks that the legacy adapter is positioned at the same entry as
+	// the new style iterator.
+	verify := func(op string, key *InternalKey, val []byte, valid bool) {
+		if (key != nil) != valid {
+			t.Fatalf("%s: inconsistent valid: %t != %t", op, key != nil, valid)
+		}
+		if valid != legacy.Valid() {
+			t.Fatalf("%s: inconsistent valid: %t != %t", op, valid, legacy.Valid())
+		}
+		if valid {
+			if base.InternalCompare(bytes.Compare, *key, legacy.Key()) != 0 {
+				t.Fatalf("%s: inconsistent key: %s != %s", op, *key, legacy.Key())
+			}
+			if !bytes.Equal(val, legacy.Value()) {
+				t.Fatalf("%s: inconsistent value: [% x] != [% x]", op, val, legacy.Value())
+			}
+		}
+	}
+
+	rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	seekKey := func() []byte {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(rng.Intn(1100)))
+		return buf[:]
+	}
+	for i := 0; i < 1000; i++ {
+		switch rng.Intn(7) {
+		case 0:
+			key, val := iter.First()
+			verify("first", key, val, legacy.First())
+		case 1:
+			key, val := iter.Last()
+			verify("last", key, val, legacy.Last())
+		case 2:
+			k := seekKey()
+			key, val := iter.SeekGE(k)
+			verify(fmt.Sprintf("seek-ge %x", k), key, val, legacy.SeekGE(k))
+		case 3:
+			k := seekKey()
+			key, val := iter.SeekLT(k)
+			verify(fmt.Sprintf("seek-lt %x", k), key, val, legacy.SeekLT(k))
+		case 4:
+			k := seekKey()
+			key, val := iter.SeekPrefixGE(k, k)
+			verify(fmt.Sprintf("seek-prefix-ge %x", k), key, val, legacy.SeekPrefixGE(k, k))
+		case 5:
+			if iter.Valid() {
+				key, val := iter.Next()
+				verify("next", key, val, legacy.Next())
+			}
+		case 6:
+			if iter.Valid() {
+				key, val := iter.Prev()
+				verify("prev", key, val, legacy.Prev())
+			}
+		}
+	}
+	if err := legacy.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIteratorSeekGEWithSkipped(t *testing.T) {
+	const restartInterval = 16
+	const numKeys = 100
+	// The block size is chosen so that all of the keys fit in a single block.
+	r := newTestReader(t, nil, TableOptions{
+		BlockRestartInterval: restartInterval,
+		BlockSize:            1 << 20,
+		Compression:          NoCompression,
+	}, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%04d", 2*i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	defer iter.Close()
+	for i := 0; i <= 2*numKeys; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		ikey, _, skipped := iter.SeekGEWithSkipped(key)
+
+		// The entry found is the (i+1)/2'th entry. The seek begins at the
+		// restart point preceding the last entry which is less than the key.
+		found := (i + 1) / 2
+		var expected int
+		if found > 0 {
+			expected = found - ((found-1)/restartInterval)*restartInterval
+		}
+		if found == numKeys {
+			if ikey != nil {
+				t.Fatalf("%s: expected exhausted iterator, but found %s", key, ikey)
+			}
+		} else if v := fmt.Sprintf("%04d", 2*found); ikey == nil || v != string(ikey.UserKey) {
+			t.Fatalf("%s: expected %s, but found %v", key, v, ikey)
+		}
+		if expected != skipped {
+			t.Fatalf("%s: expected %d skipped, but found %d", key, expected, skipped)
+		}
+	}
+}
+
+func TestIteratorSeekSeparator(t *testing.T) {
+	// Each key is written to its own block, so the index entry of the first
+	// block is a separator between the two keys.
+	r := newTestReader(t, nil, TableOptions{BlockSize: 1}, func(w *Writer) error {
+		for _, key := range []string{"ab1", "ac5"} {
+			if err := w.Set([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	// A seek key equal to the separator positions the index at the first
+	// block, which contains no key >= the seek key.
+	seeks := []struct {
+		name string
+		seek func(i *Iterator, key []byte) *InternalKey
+	}{
+		{"seek-ge", func(i *Iterator, key []byte) *InternalKey {
+			ikey, _ := i.SeekGE(key)
+			return ikey
+		}},
+		{"seek-ge-with-skipped", func(i *Iterator, key []byte) *InternalKey {
+			ikey, _, _ := i.SeekGEWithSkipped(key)
+			return ikey
+		}},
+		{"seek-prefix-ge", func(i *Iterator, key []byte) *InternalKey {
+			ikey, _ := i.SeekPrefixGE(key, key)
+			return ikey
+		}},
+	}
+	for _, c := range seeks {
+		t.Run(c.name, func(t *testing.T) {
+			for _, key := range []string{"ab2", "ac", "ac5"} {
+				iter := r.NewIter(nil /* lower */, nil /* upper */)
+				ikey := c.seek(iter, []byte(key))
+				if ikey == nil || string(ikey.UserKey) != "ac5" {
+					t.Fatalf("%s: expected ac5, but found %v", key, ikey)
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderLoadBlocks(t *testing.T) {
+	r := buildTestTable(t, 1000, 256, SnappyCompression)
+	defer r.Close()
+
+	var offsets []uint64
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		if n := len(offsets); n == 0 || offsets[n-1] != iter.dataBH.offset {
+			offsets = append(offsets, iter.dataBH.offset)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	offsets = append(offsets, r.index.bh.offset)
+
+	// Save the warm set, then evict the table from the cache.
+	var buf bytes.Buffer
+	if err := r.cache.SaveWarmSet(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r.cache.EvictFile(r.fileNum)
+	for _, offset := range offsets {
+		if h := r.cache.Get(r.fileNum, offset); h.Get() != nil {
+			t.Fatalf("%d: expected block to be evicted", offset)
+		}
+	}
+
+	err := r.cache.LoadWarmSet(&buf, func(fileNum uint64) cache.BlockLoader {
+		if fileNum == r.fileNum {
+			return r
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range offsets {
+		h := r.cache.Get(r.fileNum, offset)
+		if h.Get() == nil {
+			t.Fatalf("%d: expected block to be loaded", offset)
+		}
+		h.Release()
+	}
+}
+
+func TestReaderFeatures(t *testing.T) {
+	testCases := []struct {
+		name      string
+		opts      *Options
+		tableOpts TableOptions
+		rangeDel  bool
+		expected  TableFeatures
+	}{
+		{
+			name: "default",
+			expected: TableFeatures{
+				Format:      TableFormatRocksDBv2,
+				Compression: "Snappy",
+			},
+		},
+		{
+			name:      "no-compression",
+			tableOpts: TableOptions{Compression: NoCompression},
+			expected: TableFeatures{
+				Format:      TableFormatRocksDBv2,
+				Compression: "NoCompression",
+			},
+		},
+		{
+			name:      "bloom",
+			tableOpts: TableOptions{FilterPolicy: bloom.FilterPolicy(10)},
+			expected: TableFeatures{
+				Format:       TableFormatRocksDBv2,
+				Compression:  "Snappy",
+				FilterPolicy: "rocksdb.BuiltinBloomFilter",
+				FilterType:   TableFilter,
+			},
+		},
+		{
+			name:     "range-del",
+			rangeDel: true,
+			expected: TableFeatures{
+				Format:            TableFormatRocksDBv2,
+				Compression:       "Snappy",
+				HasRangeDeletions: true,
+			},
+		},
+		{
+			name:      "user-key-index",
+			tableOpts: TableOptions{UserKeyIndex: true},
+			expected: TableFeatures{
+				Format:          TableFormatRocksDBv2,
+				Compression:     "Snappy",
+				HasUserKeyIndex: true,
+			},
+		},
+		{
+			name: "leveldb",
+			opts: &Options{TableFormat: TableFormatLevelDB},
+			expected: TableFeatures{
+				Format:      TableFormatLevelDB,
+				Compression: "Snappy",
+			},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			mem := vfs.NewMem()
+			writeTestTable(t, mem, "test", c.opts, c.tableOpts, func(w *Writer) error {
+				if err := w.Set([]byte("a"), []byte("a")); err != nil {
+					return err
+				}
+				if c.rangeDel {
+					if err := w.DeleteRange([]byte("b"), []byte("c")); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			// NB: the filter policy is not configured in the Reader options. The
+			// filter is still reported in the table features.
+			r := openTestTable(t, mem, "test", nil)
+			defer r.Close()
+			if v := r.Features(); c.expected != v {
+				t.Fatalf("expected %+v, but found %+v", c.expected, v)
+			}
+		})
+	}
+}
+
+func TestIteratorReadahead(t *testing.T) {
+	mem := vfs.NewMem()
+	const numKeys = 5000
+	writeTestTable(t, mem, "test", nil, TableOptions{
+		BlockSize:   256,
+		Compression: NoCompression,
+	}, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%06d", i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	open := func() (*Reader, *readCountingFile) {
+		f1, err := mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &readCountingFile{File: f1}
+		// No block cache is configured, so every data block load which is not
+		// served by readahead requires a read.
+		return NewReader(f, 0, &Options{ReadaheadSize: 4 << 10}), f
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		r, f := open()
+		defer r.Close()
+		iter := r.NewIter(nil /* lower */, nil /* upper */)
+		defer iter.Close()
+		before := f.reads
+		var n int
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			n++
+		}
+		if n != numKeys {
+			t.Fatalf("expected %d keys, but found %d", numKeys, n)
+		}
+		stats := iter.ReadaheadStats()
+		if stats.Reads == 0 || stats.Hits == 0 {
+			t.Fatalf("expected readahead, but found %+v", stats)
+		}
+		// The data blocks loaded before readahead engages and the readahead
+		// reads are the only reads of the file.
+		numBlocks := int64(r.Properties.NumDataBlocks)
+		if reads := int64(f.reads - before); reads >= numBlocks/2 {
+			t.Fatalf("expected fewer than %d reads, but found %d", numBlocks/2, reads)
+		}
+		if v := stats.Reads + stats.Hits; v > numBlocks {
+			t.Fatalf("expected at most %d readahead blocks, but found %d", numBlocks, v)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		r, _ := open()
+		defer r.Close()
+		iter := r.NewIter(nil /* lower */, nil /* upper */)
+		defer iter.Close()
+		rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%06d", rng.Intn(numKeys)))
+			if ikey, _ := iter.SeekGE(key); ikey == nil || !bytes.Equal(key, ikey.UserKey) {
+				t.Fatalf("expected %s, but found %v", key, ikey)
+			}
+			// A short scan within a block does not engage readahead.
+			iter.Next()
+		}
+		if stats := iter.ReadaheadStats(); stats != (ReadaheadStats{}) {
+			t.Fatalf("expected no readahead, but found %+v", stats)
+		}
+	})
+}
+
+func TestReaderSampleKeys(t *testing.T) {
+	const restartInterval = 16
+	const numKeys = 20000
+	r := newTestReader(t, nil, TableOptions{
+		BlockRestartInterval: restartInterval,
+		BlockSize:            4096,
+		Compression:          NoCompression,
+	}, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%06d", i))
+			if err := w.Set(key, bytes.Repeat(key, 2)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	// Compute the ground truth ordinal of every key with a full scan.
+	ordinals := make(map[string]int)
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		ordinals[string(key.UserKey)] = len(ordinals)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stride := range []int{100, 1000, 7777} {
+		t.Run(fmt.Sprintf("stride=%d", stride), func(t *testing.T) {
+			samples, err := r.SampleKeys(stride)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := (numKeys + stride - 1) / stride
+			if len(samples) < expected-1 || len(samples) > expected+1 {
+				t.Fatalf("expected %d samples, but found %d", expected, len(samples))
+			}
+			for i, key := range samples {
+				ordinal, ok := ordinals[string(key.UserKey)]
+				if !ok {
+					t.Fatalf("sampled unknown key %s", key)
+				}
+				// Each sampled key is expected to be within a couple of restart
+				// intervals of the ground truth sample.
+				if d := ordinal - i*stride; d < -2*restartInterval || d > 2*restartInterval {
+					t.Fatalf("sample %d: expected ordinal near %d, but found %d", i, i*stride, ordinal)
+				}
+			}
+		})
+	}
+
+	if _, err := r.SampleKeys(0); err == nil {
+		t.Fatalf("expected error for zero stride")
+	}
+}
+
+// readCountingFile counts the number of reads performed on a file, and the
+// number of bytes read.
+type readCountingFile struct {
+	vfs.File
+	reads int
+	bytes int64
+}
+
+func (f *readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+	f.bytes += int64(len(p))
+	return f.File.ReadAt(p, off)
+}
+
+func TestReaderGetPrefixFilter(t *testing.T) {
+	fp := bloom.FilterPolicy(100)
+	f, err := build(NoCompression, fp, TableFilter, fixtureComparer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &readCountingFile{File: f}
+	r := NewReader(counting, 0, &Options{
+		Cache:    cache.New(1 << 20),
+		Comparer: fixtureComparer,
+		Levels:   []TableOptions{{FilterPolicy: fp}},
+	})
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.Properties.PrefixFiltering || r.Properties.WholeKeyFiltering {
+		t.Fatalf("expected a prefix filter")
+	}
+
+	// Absent prefixes are rejected by the filter, which is read once, without
+	// reading the index or any data blocks.
+	counting.reads = 0
+	for _, word := range nonsenseWords {
+		if _, err := r.get([]byte(word)); err != base.ErrNotFound {
+			t.Fatalf("%s: expected not found, but found %v", word, err)
+		}
+	}
+	if counting.reads != 1 {
+		t.Fatalf("expected 1 read of the filter, but found %d", counting.reads)
+	}
+
+	// Present keys pass the filter and are read from the data blocks.
+	for word, count := range wordCount {
+		value, err := r.get([]byte(word))
+		if err != nil {
+			t.Fatalf("%s: %v", word, err)
+		}
+		if string(value) != count {
+			t.Fatalf("%s: expected %s, but found %s", word, count, value)
+		}
+	}
+	if counting.reads <= 1 {
+		t.Fatalf("expected reads of the index and data blocks")
+	}
+}
+
+func TestReaderImmutable(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{
+		BlockSize:   64,
+		Compression: SnappyCompression,
+	}, func(w *Writer) error {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	for _, immutable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("immutable=%t", immutable), func(t *testing.T) {
+			f1, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &readCountingFile{File: f1}
+			// No block cache is configured, so every block read which is not
+			// served by the Reader itself requires a read and a decompression.
+			r := NewReader(f, 0, nil, Immutable(immutable))
+			defer r.Close()
+
+			const n = 10
+			before := f.reads
+			for i := 0; i < n; i++ {
+				value, err := r.get([]byte("0050"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(value) != "0050" {
+					t.Fatalf("expected 0050, but found %s", value)
+				}
+			}
+
+			// Each get reads the index block and the data block. An immutable
+			// Reader reads and decompresses each of them exactly once.
+			expected := 2 * n
+			if immutable {
+				expected = 2
+			}
+			if reads := f.reads - before; expected != reads {
+				t.Fatalf("expected %d reads, but found %d", expected, reads)
+			}
+		})
+	}
+}
+
+func TestReaderBlockCaching(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{
+		BlockSize:    64,
+		FilterPolicy: bloom.FilterPolicy(10),
+	}, func(w *Writer) error {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	for _, caching := range []BlockCaching{CacheAllBlocks, CacheMetaBlocks, CacheDataBlocks} {
+		t.Run(fmt.Sprintf("caching=%d", caching), func(t *testing.T) {
+			c := cache.New(1 << 20)
+			r := openTestTable(t, mem, "test", &Options{
+				Cache:  c,
+				Levels: []TableOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+			}, caching)
+			defer r.Close()
+
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("%04d", i))
+				if value, err := r.get(key); err != nil || !bytes.Equal(key, value) {
+					t.Fatalf("%s: unexpected value %q, %v", key, value, err)
+				}
+			}
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			var n int
+			for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+				n++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n != 100 {
+				t.Fatalf("expected 100 keys, but found %d", n)
+			}
+
+			cached := func(bh blockHandle) bool {
+				h := c.Get(0, bh.offset)
+				defer h.Release()
+				return h.Get() != nil
+			}
+			for _, bh := range []blockHandle{r.index.bh, r.filter.bh} {
+				if expected := caching&CacheMetaBlocks != 0; cached(bh) != expected {
+					t.Fatalf("expected meta block at offset %d cached=%t", bh.offset, expected)
+				}
+			}
+			index, err := r.readIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			indexIter := &blockIter{}
+			if err := indexIter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+				t.Fatal(err)
+			}
+			var blocks int
+			for _, val := indexIter.First(); val != nil; _, val = indexIter.Next() {
+				bh, _ := decodeBlockHandle(val)
+				if expected := caching&CacheDataBlocks != 0; cached(bh) != expected {
+					t.Fatalf("expected data block at offset %d cached=%t", bh.offset, expected)
+				}
+				blocks++
+			}
+			if err := indexIter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if blocks < 10 {
+				t.Fatalf("expected many data blocks, but found %d", blocks)
+			}
+		})
+	}
+}
+
+func TestIteratorPoolReuse(t *testing.T) {
+	var readers []*Reader
+	for _, prefix := range []string{"a", "b"} {
+		r := newTestReader(t, &Options{Cache: cache.New(1 << 20)}, TableOptions{BlockSize: 64}, func(w *Writer) error {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("%s%04d", prefix, i))
+				if err := w.Set(key, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		defer r.Close()
+		readers = append(readers, r)
+	}
+
+	// A closed iterator must not retain references to the Reader or to any
+	// cached blocks.
+	i := readers[0].NewIter(nil /* lower */, nil /* upper */)
+	for key, _ := i.First(); key != nil; key, _ = i.Next() {
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if i.reader != nil || i.cmp != nil {
+		t.Fatalf("expected closed iterator to clear its reader")
+	}
+	if i.index.data != nil || i.data.data != nil || i.data.key != nil {
+		t.Fatalf("expected closed iterator to clear its block references")
+	}
+	if i.index.cacheHandle.Get() != nil || i.data.cacheHandle.Get() != nil {
+		t.Fatalf("expected closed iterator to release its cache handles")
+	}
+
+	// Concurrently draw iterators from the pool over different Readers and
+	// verify that no state leaks from a previous use of the struct.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(uint64(g)))
+			for n := 0; n < 200; n++ {
+				j := rng.Intn(len(readers))
+				prefix := string('a' + byte(j))
+				i := readers[j].NewIter(nil /* lower */, nil /* upper */)
+				seek := []byte(fmt.Sprintf("%s%04d", prefix, rng.Intn(100)))
+				var count int
+				for key, value := i.SeekGE(seek); key != nil && count < 5; key, value = i.Next() {
+					if !bytes.HasPrefix(key.UserKey, []byte(prefix)) || !bytes.Equal(key.UserKey, value) {
+						t.Errorf("expected key with prefix %s, but found %s=%s", prefix, key.UserKey, value)
+					}
+					count++
+				}
+				if count == 0 {
+					t.Errorf("expected to find %s", seek)
+				}
+				if err := i.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func BenchmarkTableGet(b *testing.B) {
+	const blockSize = 32 << 10
+
+	for _, userKeyIndex := range []bool{false, true} {
+		b.Run(fmt.Sprintf("user-key-index=%t", userKeyIndex),
+			func(b *testing.B) {
+				var keys [][]byte
+				r := newTestReader(b, &Options{
+					Cache: cache.New(128 << 20),
+				}, TableOptions{
+					BlockSize:    blockSize,
+					UserKeyIndex: userKeyIndex,
+				}, func(w *Writer) error {
+					var ikey InternalKey
+					for i := uint64(0); i < 1e6; i++ {
+						key := make([]byte, 8)
+						binary.BigEndian.PutUint64(key, i)
+						keys = append(keys, key)
+						ikey.UserKey = key
+						if err := w.Add(ikey, nil); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				defer r.Close()
+				rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := r.get(keys[rng.Intn(len(keys))]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+	}
+}
+
+func BenchmarkTableNewIter(b *testing.B) {
+	const blockSize = 32 << 10
+
+	r, keys := buildBenchmarkTable(b, blockSize, 16)
+	rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := r.NewIter(nil /* lower */, nil /* upper */)
+		it.SeekGE(keys[rng.Intn(len(keys))])
+		it.Next()
+		if err := it.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReaderCombinedIter(t *testing.T) {
+	r := newTestReader(t, nil, TableOptions{}, func(w *Writer) error {
+		for _, k := range []string{"a#5,1", "b#4,1", "c#3,0", "d#2,2", "g#1,1"} {
+			parts := strings.Split(k, "#")
+			var seqNum uint64
+			var kind int
+			fmt.Sscanf(parts[1], "%d,%d", &seqNum, &kind)
+			key := base.MakeInternalKey([]byte(parts[0]), seqNum, InternalKeyKind(kind))
+			if err := w.Add(key, []byte(parts[0])); err != nil {
+				return err
+			}
+		}
+		for _, ts := range [][2]string{{"b", "d"}, {"e", "f"}} {
+			if err := w.DeleteRange([]byte(ts[0]), []byte(ts[1])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	format := func(key *InternalKey, value []byte) string {
+		s := fmt.Sprintf("%s#%d,%s", key.UserKey, key.SeqNum(), key.Kind())
+		if key.Kind() == InternalKeyKindRangeDelete {
+			s += "-" + string(value)
+		}
+		return s
+	}
+
+	testCases := []struct {
+		seek     string
+		expected string
+	}{
+		{"", "a#5,SET b#4,SET b#0,RANGEDEL-d c#3,DEL d#2,MERGE e#0,RANGEDEL-f g#1,SET"},
+		{"c", "c#3,DEL d#2,MERGE e#0,RANGEDEL-f g#1,SET"},
+		{"e", "e#0,RANGEDEL-f g#1,SET"},
+		{"h", ""},
+	}
+	for _, c := range testCases {
+		t.Run(c.seek, func(t *testing.T) {
+			iter := r.NewCombinedIter()
+			var key *InternalKey
+			var value []byte
+			if c.seek == "" {
+				key, value = iter.First()
+			} else {
+				key, value = iter.SeekGE([]byte(c.seek))
+			}
+			var results []string
+			for ; key != nil; key, value = iter.Next() {
+				if !iter.Valid() || iter.Key() != key {
+					t.Fatalf("inconsistent iterator position at %s", format(key, value))
+				}
+				results = append(results, format(key, value))
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if s := strings.Join(results, " "); c.expected != s {
+				t.Fatalf("expected\n%s\nbut found\n%s", c.expected, s)
+			}
+		})
+	}
+}
+
+func TestStableKeyIter(t *testing.T) {
+	const numEntries = 5000
+	r := buildTestTable(t, numEntries, 256, SnappyCompression)
+	defer r.Close()
+
+	check := func(i uint64, key []byte) error {
+		if len(key) != int(8+i%3) {
+			return fmt.Errorf("%d: expected key length %d, but found %d", i, 8+i%3, len(key))
+		}
+		if v := binary.BigEndian.Uint64(key); v != i {
+			return fmt.Errorf("%d: expected key %d, but found %d", i, i, v)
+		}
+		return nil
+	}
+
+	// Hand each key to another goroutine while iteration continues. The keys
+	// must not be mutated by subsequent positioning calls.
+	type item struct {
+		i   uint64
+		key []byte
+	}
+	ch := make(chan item, 100)
+	errCh := make(chan error, 1)
+	go func() {
+		var err error
+		for it := range ch {
+			if err == nil {
+				err = check(it.i, it.key)
+			}
+		}
+		errCh <- err
+	}()
+
+	iter := r.NewStableKeyIter(nil /* lower */, nil /* upper */)
+	var keys [][]byte
+	var i uint64
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		keys = append(keys, key.UserKey)
+		ch <- item{i, key.UserKey}
+		i++
+	}
+	close(ch)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != numEntries {
+		t.Fatalf("expected %d keys, but found %d", numEntries, len(keys))
+	}
+
+	// Repositioning the iterator does not invalidate the retained keys.
+	for key, _ := iter.Last(); key != nil; key, _ = iter.Prev() {
+	}
+	iter.SeekGE(keys[numEntries/2])
+	for i, key := range keys {
+		if err := check(uint64(i), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderSparseIndex(t *testing.T) {
+	// The index separators are the last user key of each data block, so that
+	// every key sought lies within the span of a data block. The tables with a
+	// sparse index are checked against a table with a dense index.
+	comparer := *base.DefaultComparer
+	comparer.Separator = func(dst, a, b []byte) []byte {
+		return append(dst, a...)
+	}
+	o := &Options{Comparer: &comparer}
+
+	build := func(sparsity int) *Reader {
+		return newTestReader(t, o, TableOptions{
+			BlockSize:     64,
+			Compression:   NoCompression,
+			IndexSparsity: sparsity,
+		}, func(w *Writer) error {
+			// Write several versions of each key so that the versions of a key
+			// frequently span data blocks.
+			for i := 0; i < 400; i += 2 {
+				key := []byte(fmt.Sprintf("%04d", i))
+				for seqNum := uint64(i%3 + 1); seqNum > 0; seqNum-- {
+					value := []byte(fmt.Sprintf("%04d.%d", i, seqNum))
+					if err := w.Add(base.MakeInternalKey(key, seqNum, InternalKeyKindSet), value); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	format := func(key *InternalKey, value []byte) string {
+		if key == nil {
+			return "."
+		}
+		return fmt.Sprintf("%s#%d:%s", key.UserKey, key.SeqNum(), value)
+	}
+	// describe positions the iterator using seek and then steps it forward
+	// and backward, describing each position.
+	describe := func(r *Reader, lower, upper []byte, seek func(i *Iterator) (*InternalKey, []byte)) string {
+		i := r.NewIter(lower, upper)
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%s", format(seek(i)))
+		for j := 0; j < 8 && i.Valid(); j++ {
+			fmt.Fprintf(&buf, " %s", format(i.Next()))
+		}
+		for j := 0; j < 16 && i.Valid(); j++ {
+			fmt.Fprintf(&buf, " %s", format(i.Prev()))
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	dense := build(1)
+	defer dense.Close()
+
+	var keys [][]byte
+	for i := 0; i <= 401; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%04d", i)))
+	}
+	keys = append(keys, []byte(""), []byte("0000\x00"), []byte("9999"))
+
+	for _, sparsity := range []int{2, 3, 8, 1000} {
+		t.Run(fmt.Sprintf("sparsity=%d", sparsity), func(t *testing.T) {
+			r := build(sparsity)
+			defer r.Close()
+
+			if r.Properties.DataSize != dense.Properties.DataSize ||
+				r.Properties.NumDataBlocks != dense.Properties.NumDataBlocks {
+				t.Fatalf("expected %d data blocks of %d bytes, but found %d blocks of %d bytes",
+					dense.Properties.NumDataBlocks, dense.Properties.DataSize,
+					r.Properties.NumDataBlocks, r.Properties.DataSize)
+			}
+			// The sparse index holds a separator key for every sparsity'th block
+			// rather than for every block.
+			if r.Properties.IndexSize >= dense.Properties.IndexSize {
+				t.Fatalf("expected sparse index to be smaller than %d bytes, but found %d",
+					dense.Properties.IndexSize, r.Properties.IndexSize)
+			}
+			t.Logf("index size: dense=%d sparse=%d", dense.Properties.IndexSize, r.Properties.IndexSize)
+
+			check := func(desc string, seek func(i *Iterator) (*InternalKey, []byte)) {
+				for _, bounds := range [][2][]byte{
+					{nil, nil},
+					{[]byte("0101"), []byte("0301")},
+				} {
+					expected := describe(dense, bounds[0], bounds[1], seek)
+					if result := describe(r, bounds[0], bounds[1], seek); expected != result {
+						t.Fatalf("%s [%q,%q): expected\n%s\nbut found\n%s",
+							desc, bounds[0], bounds[1], expected, result)
+					}
+				}
+			}
+			check("first", func(i *Iterator) (*InternalKey, []byte) { return i.First() })
+			check("last", func(i *Iterator) (*InternalKey, []byte) { return i.Last() })
+			for _, key := range keys {
+				check(fmt.Sprintf("seek-ge(%q)", key), func(i *Iterator) (*InternalKey, []byte) {
+					return i.SeekGE(key)
+				})
+				check(fmt.Sprintf("seek-prefix-ge(%q)", key), func(i *Iterator) (*InternalKey, []byte) {
+					return i.SeekPrefixGE(key, key)
+				})
+				check(fmt.Sprintf("seek-lt(%q)", key), func(i *Iterator) (*InternalKey, []byte) {
+					return i.SeekLT(key)
+				})
+
+				expected, expectedErr := dense.get(key)
+				value, err := r.get(key)
+				if expectedErr != err || !bytes.Equal(expected, value) {
+					t.Fatalf("get(%q): expected %q (%v), but found %q (%v)",
+						key, expected, expectedErr, value, err)
+				}
+			}
+
+			// A full scan in either direction visits every entry.
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			var n int
+			for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+				n++
+			}
+			for key, _ := iter.Last(); key != nil; key, _ = iter.Prev() {
+				n++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if expected := 2 * int(r.Properties.NumEntries); n != expected {
+				t.Fatalf("expected %d entries, but found %d", expected, n)
+			}
+
+			samples, err := r.SampleKeys(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedSamples, err := dense.SampleKeys(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expectedSamples, samples) {
+				t.Fatalf("expected samples %v, but found %v", expectedSamples, samples)
+			}
+		})
+	}
+}
+
+func TestDecodeIndexEntry(t *testing.T) {
+	group := []blockHandle{{0, 10}, {10 + blockTrailerLen, 20}, {30 + 2*blockTrailerLen, 30}}
+	testCases := []struct {
+		sparsity uint64
+		entry    []byte
+		expected []blockHandle
+	}{
+		// An entry of a dense index holds a single handle, and trailing bytes
+		// are corruption.
+		{0, appendIndexEntry(nil, group[:1]), group[:1]},
+		{0, appendIndexEntry(nil, group[:2]), nil},
+		{0, append(appendIndexEntry(nil, group[:1]), 0x01), nil},
+		// An entry of a sparse index holds at most sparsity handles.
+		{2, appendIndexEntry(nil, group[:1]), group[:1]},
+		{2, appendIndexEntry(nil, group[:2]), group[:2]},
+		{2, appendIndexEntry(nil, group), nil},
+		{3, appendIndexEntry(nil, group), group},
+		{3, append(appendIndexEntry(nil, group[:2]), 0x80), nil},
+	}
+	for _, c := range testCases {
+		r := &Reader{}
+		r.Properties.IndexSparsity = c.sparsity
+		handles, err := r.decodeIndexEntry(nil, c.entry)
+		if c.expected == nil {
+			if err != errCorruptIndexEntry {
+				t.Fatalf("%d/% x: expected %v, but found %v", c.sparsity, c.entry, errCorruptIndexEntry, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d/% x: %v", c.sparsity, c.entry, err)
+		}
+		if !reflect.DeepEqual(handles, c.expected) {
+			t.Fatalf("%d/% x: expected %v, but found %v", c.sparsity, c.entry, c.expected, handles)
+		}
+	}
+}
+
+// latencyFile injects a fixed latency into each read of a file.
+type latencyFile struct {
+	vfs.File
+	latency time.Duration
+	reads   int64
+}
+
+func (f *latencyFile) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&f.reads, 1)
+	time.Sleep(f.latency)
+	return f.File.ReadAt(p, off)
+}
+
+func TestIteratorStats(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 256}, func(w *Writer) error {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, bytes.Repeat(key, 4)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const latency = 2 * time.Millisecond
+	f := &latencyFile{File: f1}
+	r := NewReader(f, 0, &Options{Cache: cache.New(1 << 20)})
+	defer r.Close()
+	f.latency = latency
+
+	scan := func() IteratorStats {
+		iter := r.NewIter(nil /* lower */, nil /* upper */)
+		// Only count the reads of data blocks, not the read of the index block.
+		f.reads = 0
+		var n int
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			n++
+		}
+		stats := iter.Stats()
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != 200 {
+			t.Fatalf("expected 200 entries, but found %d", n)
+		}
+		return stats
+	}
+
+	// Each data block is read from the file, and the read time includes the
+	// injected latency of each read of the file. Readahead may serve several
+	// blocks with a single read.
+	stats := scan()
+	if numBlocks := int64(r.Properties.NumDataBlocks); numBlocks < 10 || stats.BlockReads != numBlocks {
+		t.Fatalf("expected %d block reads, but found %d", numBlocks, stats.BlockReads)
+	}
+	if min := time.Duration(f.reads) * latency; f.reads == 0 || stats.BlockReadDuration < min {
+		t.Fatalf("expected read duration of at least %s, but found %s", min, stats.BlockReadDuration)
+	}
+	if stats.BlockDecodeDuration <= 0 || stats.BlockDecodeDuration >= stats.BlockReadDuration {
+		t.Fatalf("expected decode duration less than the read duration %s, but found %s",
+			stats.BlockReadDuration, stats.BlockDecodeDuration)
+	}
+
+	// The data blocks are now in the block cache, so no time is spent loading
+	// them.
+	if stats := scan(); stats != (IteratorStats{}) {
+		t.Fatalf("expected no block loads, but found %+v", stats)
+	}
+}
+
+func TestIteratorResetStats(t *testing.T) {
+	// No block cache is configured, so every query loads its data blocks.
+	r := newTestReader(t, nil, TableOptions{BlockSize: 256}, func(w *Writer) error {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, bytes.Repeat(key, 4)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	defer iter.Close()
+	query := func(lower, upper string) IteratorStats {
+		iter.SetBounds([]byte(lower), []byte(upper))
+		iter.ResetStats()
+		var n int
+		for key, _ := iter.SeekGE([]byte(lower)); key != nil; key, _ = iter.Next() {
+			n++
+		}
+		if n != 100 {
+			t.Fatalf("expected 100 entries, but found %d", n)
+		}
+		return iter.Stats()
+	}
+
+	// Each query only accounts for its own block loads, while the cumulative
+	// stats account for both queries.
+	first := query("0000", "0100")
+	second := query("0100", "0200")
+	if first.BlockReads == 0 || second.BlockReads == 0 {
+		t.Fatalf("expected block reads in both queries, but found %+v and %+v", first, second)
+	}
+	expected := first
+	expected.add(second)
+	if cumulative := iter.CumulativeStats(); cumulative != expected {
+		t.Fatalf("expected cumulative stats %+v, but found %+v", expected, cumulative)
+	}
+
+	// Resetting the stats does not affect the cumulative stats.
+	iter.ResetStats()
+	if stats := iter.Stats(); stats != (IteratorStats{}) {
+		t.Fatalf("expected no block loads, but found %+v", stats)
+	}
+	if cumulative := iter.CumulativeStats(); cumulative != expected {
+		t.Fatalf("expected cumulative stats %+v, but found %+v", expected, cumulative)
+	}
+}
+
+func TestIteratorKindMask(t *testing.T) {
+	// The table contains a run of deletions spanning several data blocks,
+	// surrounded by sets interspersed with deletions.
+	var keys []InternalKey
+	for i := 0; i < 400; i++ {
+		var kind InternalKeyKind = InternalKeyKindSet
+		if (i >= 100 && i < 200) || i%7 == 0 {
+			kind = InternalKeyKindDelete
+		}
+		keys = append(keys, base.MakeInternalKey([]byte(fmt.Sprintf("%04d", i)), 1, kind))
+	}
+
+	for _, sparsity := range []int{1, 4} {
+		r := newTestReader(t, nil, TableOptions{BlockSize: 64, IndexSparsity: sparsity}, func(w *Writer) error {
+			for _, key := range keys {
+				if err := w.Add(key, key.UserKey); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		for _, mask := range []KindMask{
+			MakeKindMask(InternalKeyKindSet),
+			MakeKindMask(InternalKeyKindDelete),
+			MakeKindMask(InternalKeyKindSet, InternalKeyKindDelete),
+			MakeKindMask(InternalKeyKindMerge),
+		} {
+			var expected []string
+			for _, key := range keys {
+				if mask.Contains(key.Kind()) {
+					expected = append(expected, key.String())
+				}
+			}
+
+			iter := r.NewIter(nil /* lower */, nil /* upper */, mask)
+			var forward []string
+			for key, value := iter.First(); key != nil; key, value = iter.Next() {
+				if !bytes.Equal(key.UserKey, value) {
+					t.Fatalf("%s: unexpected value %q", key, value)
+				}
+				forward = append(forward, key.String())
+			}
+			var backward []string
+			for key, _ := iter.Last(); key != nil; key, _ = iter.Prev() {
+				backward = append([]string{key.String()}, backward...)
+			}
+			if !reflect.DeepEqual(expected, forward) {
+				t.Fatalf("sparsity=%d mask=%x: expected forward scan\n%v\nbut found\n%v",
+					sparsity, mask, expected, forward)
+			}
+			if !reflect.DeepEqual(expected, backward) {
+				t.Fatalf("sparsity=%d mask=%x: expected backward scan\n%v\nbut found\n%v",
+					sparsity, mask, expected, backward)
+			}
+
+			// Seeking lands on the nearest entry whose kind is in the mask.
+			for j, key := range keys {
+				var ge, lt string
+				for _, k := range keys[j:] {
+					if mask.Contains(k.Kind()) {
+						ge = k.String()
+						break
+					}
+				}
+				for l := j - 1; l >= 0; l-- {
+					if mask.Contains(keys[l].Kind()) {
+						lt = keys[l].String()
+						break
+					}
+				}
+				var got string
+				if k, _ := iter.SeekGE(key.UserKey); k != nil {
+					got = k.String()
+				}
+				if ge != got {
+					t.Fatalf("sparsity=%d mask=%x: SeekGE(%s): expected %q, but found %q",
+						sparsity, mask, key.UserKey, ge, got)
+				}
+				got = ""
+				if k, _ := iter.SeekLT(key.UserKey); k != nil {
+					got = k.String()
+				}
+				if lt != got {
+					t.Fatalf("sparsity=%d mask=%x: SeekLT(%s): expected %q, but found %q",
+						sparsity, mask, key.UserKey, lt, got)
+				}
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReaderBufferPool(b *testing.B) {
+	mem := vfs.NewMem()
+	writeTestTable(b, mem, "bench", nil, TableOptions{
+		BlockSize:   8 << 10,
+		Compression: SnappyCompression,
+	}, func(w *Writer) error {
+		rng := rand.New(rand.NewSource(1))
+		value := make([]byte, 64)
+		for i := 0; i < 1e5; i++ {
+			// Half of each value is random, so that the compressed blocks are
+			// large enough to be pooled.
+			rng.Read(value[:32])
+			if err := w.Set([]byte(fmt.Sprintf("%08d", i)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	const numReaders = 8
+	for _, shared := range []bool{false, true} {
+		b.Run(fmt.Sprintf("shared=%t", shared), func(b *testing.B) {
+			o := &Options{}
+			if shared {
+				o.BufferPool = cache.NewBufferPool()
+			}
+			var readers []*Reader
+			for i := 0; i < numReaders; i++ {
+				f, err := mem.Open("bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				readers = append(readers, NewReader(f, uint64(i), o))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := readers[i%numReaders]
+				iter := r.NewIter(nil /* lower */, nil /* upper */)
+				for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+				}
+				if err := iter.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			for _, r := range readers {
+				if err := r.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// offsetRecordingFile records the offset of each read of the file.
+type offsetRecordingFile struct {
+	vfs.File
+	offsets []int64
+}
+
+func (f *offsetRecordingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.offsets = append(f.offsets, off)
+	return f.File.ReadAt(p, off)
+}
+
+func TestReaderMeta(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{
+		BlockSize:    256,
+		FilterPolicy: bloom.FilterPolicy(10),
+	}, func(w *Writer) error {
+		for i := 0; i < 1000; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%04d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return w.DeleteRange([]byte("0100"), []byte("0200"))
+	})
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &offsetRecordingFile{File: f1}
+	o := &Options{Levels: []TableOptions{{FilterPolicy: bloom.FilterPolicy(10)}}}
+	r := NewReaderMeta(f, o)
+
+	// Only the footer, the metaindex and the properties are read.
+	if len(f.offsets) != 3 {
+		t.Fatalf("expected 3 reads, but found %d", len(f.offsets))
+	}
+	if r.Properties.NumEntries != 1000 || r.Properties.NumRangeDeletions != 1 ||
+		r.Properties.FilterPolicyName != "rocksdb.BuiltinBloomFilter" {
+		t.Fatalf("unexpected properties:\n%s", &r.Properties)
+	}
+	if features := r.Features(); !features.HasRangeDeletions || features.FilterPolicy == "" {
+		t.Fatalf("unexpected features: %+v", features)
+	}
+
+	// Every method which reads the contents of the table fails without
+	// reading the file.
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	if key, _ := iter.First(); key != nil {
+		t.Fatalf("expected no entries, but found %s", key)
+	}
+	if err := iter.Close(); err != errMetaOnly {
+		t.Fatalf("expected %v, but found %v", errMetaOnly, err)
+	}
+	if _, err := r.get([]byte("0500")); err != errMetaOnly {
+		t.Fatalf("expected %v, but found %v", errMetaOnly, err)
+	}
+	if _, err := r.EstimateDiskUsage([]byte("0000"), []byte("0999")); err != errMetaOnly {
+		t.Fatalf("expected %v, but found %v", errMetaOnly, err)
+	}
+	if _, err := r.SampleKeys(10); err != errMetaOnly {
+		t.Fatalf("expected %v, but found %v", errMetaOnly, err)
+	}
+	if len(f.offsets) != 3 {
+		t.Fatalf("expected no further reads, but found %d reads", len(f.offsets)-3)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata of a table whose keys were compressed can be read without
+	// the comparer which compressed them.
+	comparer := *base.DefaultComparer
+	comparer.Name = "pebble.test.compressed-keys"
+	comparer.CompressKey = func(dst, key []byte) []byte {
+		return append(dst, key...)
+	}
+	comparer.DecompressKey = func(dst, key []byte) ([]byte, error) {
+		return append(dst, key...), nil
+	}
+	writeTestTable(t, mem, "compressed", &Options{Comparer: &comparer}, TableOptions{},
+		func(w *Writer) error {
+			return w.Set([]byte("a"), []byte("value"))
+		})
+	f1, err = mem.Open("compressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReaderMeta(f1, nil)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.Properties.KeysCompressed || r.Properties.NumEntries != 1 {
+		t.Fatalf("unexpected properties:\n%s", &r.Properties)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compression dictionary is not read.
+	data, err := ioutil.ReadFile(filepath.FromSlash("testdata/h.zstd-dict.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := mem.Create("dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f2.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f2, err = mem.Open("dict"); err != nil {
+		t.Fatal(err)
+	}
+	f = &offsetRecordingFile{File: f2}
+	r = NewReaderMeta(f, nil)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.Features().HasCompressionDict || r.compressionDict != nil || len(f.offsets) != 3 {
+		t.Fatalf("expected 3 reads and no compression dictionary, but found %d reads", len(f.offsets))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderMetaSharedCache(t *testing.T) {
+	// Readers created by NewReaderMeta have no file number. Sharing a cache
+	// between them must not return the blocks of one table for another. The
+	// tables have the same layout, and differ only in the kind of their entry.
+	mem := vfs.NewMem()
+	for i, name := range []string{"a", "b"} {
+		writeTestTable(t, mem, name, nil, TableOptions{}, func(w *Writer) error {
+			if i == 0 {
+				return w.Set([]byte("k"), nil)
+			}
+			return w.Delete([]byte("k"))
+		})
+	}
+
+	o := &Options{Cache: cache.New(1 << 20)}
+	for i, name := range []string{"a", "b"} {
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReaderMeta(f, o)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if n := r.Properties.NumDeletions; n != uint64(i) {
+			t.Fatalf("%s: expected %d deletions, but found %d", name, i, n)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndexBlockRestartInterval(t *testing.T) {
+	build := func(interval int) *Reader {
+		return newTestReader(t, nil, TableOptions{
+			BlockSize:                 64,
+			IndexBlockRestartInterval: interval,
+		}, func(w *Writer) error {
+			for i := 0; i < 2000; i += 2 {
+				if err := w.Set([]byte(fmt.Sprintf("%05d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	format := func(key *InternalKey) string {
+		if key == nil {
+			return "."
+		}
+		return key.String()
+	}
+
+	expected := build(1)
+	defer expected.Close()
+	for _, interval := range []int{2, 16, 1000} {
+		t.Run(fmt.Sprintf("interval=%d", interval), func(t *testing.T) {
+			r := build(interval)
+			defer r.Close()
+			if r.Properties.NumDataBlocks < 100 {
+				t.Fatalf("expected at least 100 data blocks, but found %d", r.Properties.NumDataBlocks)
+			}
+			// Delta encoding shrinks the index block.
+			if r.Properties.IndexSize >= expected.Properties.IndexSize {
+				t.Fatalf("expected index size smaller than %d, but found %d",
+					expected.Properties.IndexSize, r.Properties.IndexSize)
+			}
+
+			eIter := expected.NewIter(nil /* lower */, nil /* upper */)
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			for i := 0; i <= 2000; i++ {
+				key := []byte(fmt.Sprintf("%05d", i))
+				e, _ := eIter.SeekGE(key)
+				k, _ := iter.SeekGE(key)
+				if format(e) != format(k) {
+					t.Fatalf("SeekGE(%s): expected %s, but found %s", key, format(e), format(k))
+				}
+				e, _ = eIter.Prev()
+				k, _ = iter.Prev()
+				if format(e) != format(k) {
+					t.Fatalf("SeekGE(%s).Prev(): expected %s, but found %s", key, format(e), format(k))
+				}
+				e, _ = eIter.SeekLT(key)
+				k, _ = iter.SeekLT(key)
+				if format(e) != format(k) {
+					t.Fatalf("SeekLT(%s): expected %s, but found %s", key, format(e), format(k))
+				}
+				e, _ = eIter.Next()
+				k, _ = iter.Next()
+				if format(e) != format(k) {
+					t.Fatalf("SeekLT(%s).Next(): expected %s, but found %s", key, format(e), format(k))
+				}
+			}
+			var n int
+			for k, _ := iter.Last(); k != nil; k, _ = iter.Prev() {
+				n++
+			}
+			if n != 1000 {
+				t.Fatalf("expected 1000 entries, but found %d", n)
+			}
+			if err := eIter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexBlockSeekGE(b *testing.B) {
+	for _, interval := range []int{1, 16} {
+		b.Run(fmt.Sprintf("restart=%d", interval), func(b *testing.B) {
+			var keys [][]byte
+			r := newTestReader(b, nil, TableOptions{
+				BlockSize:                 256,
+				IndexBlockRestartInterval: interval,
+			}, func(w *Writer) error {
+				for i := uint64(0); i < 1e5; i++ {
+					key := make([]byte, 8)
+					binary.BigEndian.PutUint64(key, i)
+					keys = append(keys, key)
+					if err := w.Set(key, nil); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			defer r.Close()
+			it := r.NewIter(nil /* lower */, nil /* upper */)
+			defer it.Close()
+			rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				it.index.SeekGE(keys[rng.Intn(len(keys))])
+			}
+		})
+	}
+}
+
+func TestReaderConcurrentUse(t *testing.T) {
+	// A Reader is shared by many goroutines, each using its own iterators. The
+	// cache is small so that blocks are concurrently evicted and reloaded. Run
+	// with -race to detect unsynchronized access to the Reader's state.
+	const numKeys = 5000
+	r := newTestReader(t, &Options{
+		Cache:  cache.New(32 << 10),
+		Levels: []TableOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+	}, TableOptions{
+		BlockSize:    512,
+		FilterPolicy: bloom.FilterPolicy(10),
+	}, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%05d", i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return w.DeleteRange([]byte("01000"), []byte("02000"))
+	})
+	defer r.Close()
+
+	const numGoroutines = 16
+	errCh := make(chan error, numGoroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(uint64(g)))
+			for n := 0; n < 200; n++ {
+				i := rng.Intn(numKeys)
+				key := []byte(fmt.Sprintf("%05d", i))
+				switch rng.Intn(5) {
+				case 0:
+					v, err := r.get(key)
+					if err != nil || !bytes.Equal(v, key) {
+						errCh <- fmt.Errorf("get(%s): got (%q, %v)", key, v, err)
+						return
+					}
+				case 1:
+					iter := r.NewIter(nil /* lower */, nil /* upper */)
+					k, _ := iter.SeekGE(key)
+					if k == nil || !bytes.Equal(k.UserKey, key) {
+						errCh <- fmt.Errorf("SeekGE(%s): got %v", key, k)
+						return
+					}
+					for j := 0; j < 100 && k != nil; j++ {
+						k, _ = iter.Next()
+					}
+					if err := iter.Close(); err != nil {
+						errCh <- err
+						return
+					}
+				case 2:
+					iter := r.NewIter(key, nil /* upper */)
+					var count int
+					for k, _ := iter.Last(); k != nil; k, _ = iter.Prev() {
+						count++
+					}
+					if err := iter.Close(); err != nil {
+						errCh <- err
+						return
+					}
+					if count != numKeys-i {
+						errCh <- fmt.Errorf("reverse scan from %s: expected %d keys, but found %d",
+							key, numKeys-i, count)
+						return
+					}
+				case 3:
+					iter := r.NewRangeDelIter()
+					if k, _ := iter.First(); k == nil || string(k.UserKey) != "01000" {
+						errCh <- fmt.Errorf("unexpected range deletion %v", k)
+						return
+					}
+					if err := iter.Close(); err != nil {
+						errCh <- err
+						return
+					}
+				case 4:
+					if _, err := r.EstimateDiskUsage(key, []byte("99999")); err != nil {
+						errCh <- err
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderRawMetaBlock(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", &Options{
+		TablePropertyCollectors: []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+		},
+	}, TableOptions{
+		BlockSize:    256,
+		FilterPolicy: bloom.FilterPolicy(10),
+	}, func(w *Writer) error {
+		for i := 0; i < 100; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%04d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// decode returns the key/value pairs of a raw block.
+	decode := func(b []byte) map[string]string {
+		iter, err := newRawBlockIter(bytes.Compare, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]string)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			m[string(iter.Key().UserKey)] = string(iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	for _, meta := range []bool{false, true} {
+		t.Run(fmt.Sprintf("meta=%t", meta), func(t *testing.T) {
+			f, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r *Reader
+			if meta {
+				r = NewReaderMeta(f, nil)
+			} else {
+				r = NewReader(f, 0, nil)
+			}
+			defer r.Close()
+
+			// The properties block holds the same key/value pairs as the
+			// properties loaded by the Reader.
+			raw, err := r.RawMetaBlock(metaPropertiesName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected rawBlockWriter
+			expected.restartInterval = propertiesBlockRestartInterval
+			r.Properties.save(&expected)
+			if got, want := decode(raw), decode(expected.finish()); !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected properties\n%v\nbut found\n%v", want, got)
+			}
+			if got := decode(raw)["test.key-count"]; got != "100" {
+				t.Fatalf("expected test.key-count 100, but found %q", got)
+			}
+
+			// The metaindex block maps the names of the meta blocks to their
+			// handles.
+			raw, err = r.RawMetaBlock("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			metaindex := decode(raw)
+			if _, ok := metaindex[metaPropertiesName]; !ok {
+				t.Fatalf("expected %s in metaindex: %v", metaPropertiesName, metaindex)
+			}
+			filterName := "fullfilter." + bloom.FilterPolicy(10).Name()
+			if _, ok := metaindex[filterName]; !ok {
+				t.Fatalf("expected %s in metaindex: %v", filterName, metaindex)
+			}
+
+			_, err = r.RawMetaBlock(filterName)
+			if meta {
+				if err != errMetaOnly {
+					t.Fatalf("expected %v, but found %v", errMetaOnly, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.RawMetaBlock("missing"); err == nil {
+				t.Fatalf("expected error for missing meta block")
+			}
+		})
+	}
+}
+
+func TestReaderPartialBlockReads(t *testing.T) {
+	mem := vfs.NewMem()
+	build := func(name string, compression Compression) {
+		// The table consists of a few large data blocks.
+		writeTestTable(t, mem, name, nil, TableOptions{
+			BlockSize:   64 << 10,
+			Compression: compression,
+		}, func(w *Writer) error {
+			for i := 0; i < 5000; i++ {
+				key := []byte(fmt.Sprintf("%05d", 2*i))
+				if err := w.Set(key, bytes.Repeat(key, i%4)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	open := func(name string, opts ...ReaderOption) (*Reader, *readCountingFile) {
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf := &readCountingFile{File: f}
+		// No block cache is configured, so every lookup reads from the file.
+		return NewReader(rf, 0, nil, opts...), rf
+	}
+	build("uncompressed", NoCompression)
+	build("snappy", SnappyCompression)
+
+	for _, name := range []string{"uncompressed", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			r, f := open(name, PartialBlockReads(true))
+			defer r.Close()
+			expected, expectedF := open(name)
+			defer expected.Close()
+
+			// Lookups return the same results with and without partial reads, for
+			// both present and absent keys.
+			for i := 0; i < 10001; i++ {
+				key := []byte(fmt.Sprintf("%05d", i))
+				v, err := r.get(key)
+				expectedV, expectedErr := expected.get(key)
+				if err != expectedErr || !bytes.Equal(v, expectedV) {
+					t.Fatalf("%s: expected %q, %v, but found %q, %v", key, expectedV, expectedErr, v, err)
+				}
+			}
+
+			// A lookup of a key early in a block reads fewer bytes than the block.
+			f.bytes, expectedF.bytes = 0, 0
+			for _, k := range []string{"00000", "00002", "00003"} {
+				if _, err := r.get([]byte(k)); err != nil && err != base.ErrNotFound {
+					t.Fatal(err)
+				}
+				if _, err := expected.get([]byte(k)); err != nil && err != base.ErrNotFound {
+					t.Fatal(err)
+				}
+			}
+			if name == "uncompressed" {
+				if f.bytes*10 > expectedF.bytes {
+					t.Fatalf("expected partial reads to read far fewer than %d bytes, but read %d",
+						expectedF.bytes, f.bytes)
+				}
+			} else if f.bytes < expectedF.bytes {
+				// Compressed blocks are read in full.
+				t.Fatalf("expected at least %d bytes to be read, but read %d",
+					expectedF.bytes, f.bytes)
+			}
+		})
+	}
+}
+
+func TestReaderPartialBlockReadsCorrupt(t *testing.T) {
+	// The table consists of a single uncompressed data block with 7 restart
+	// points.
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{Compression: NoCompression},
+		func(w *Writer) error {
+			for i := 0; i < 100; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("%03d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	f, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	blockLen := r.Properties.DataSize - blockTrailerLen
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	numRestarts := binary.LittleEndian.Uint32(data[blockLen-4:])
+	if numRestarts != 7 {
+		t.Fatalf("expected 7 restart points, but found %d", numRestarts)
+	}
+	restartsOffset := blockLen - 4*uint64(numRestarts+1)
+
+	// The partial reads do not verify the checksum of the block, so restart
+	// points which lie beyond the entries or go backward are detected rather
+	// than read.
+	testCases := []struct {
+		name    string
+		corrupt func(restarts []uint32)
+		keys    []string
+	}{
+		{"beyond-entries", func(restarts []uint32) {
+			for j := range restarts {
+				restarts[j] = uint32(restartsOffset) + uint32(j)
+			}
+		}, []string{"000", "042", "099"}},
+		{"max", func(restarts []uint32) {
+			for j := range restarts {
+				restarts[j] = math.MaxUint32
+			}
+		}, []string{"000", "042", "099"}},
+		// The restart points at keys 048 and 064 are swapped, so the entries
+		// preceding key 064 appear to go backward.
+		{"backward", func(restarts []uint32) {
+			restarts[3], restarts[4] = restarts[4], restarts[3]
+		}, []string{"050"}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			corrupt := append([]byte(nil), data...)
+			restarts := make([]uint32, numRestarts)
+			for j := range restarts {
+				restarts[j] = binary.LittleEndian.Uint32(corrupt[restartsOffset+4*uint64(j):])
+			}
+			c.corrupt(restarts)
+			for j := range restarts {
+				binary.LittleEndian.PutUint32(corrupt[restartsOffset+4*uint64(j):], restarts[j])
+			}
+			name := "corrupt-" + c.name
+			f, err := mem.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(corrupt); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r := openTestTable(t, mem, name, nil, PartialBlockReads(true))
+			defer r.Close()
+			for _, key := range c.keys {
+				if _, err := r.get([]byte(key)); err != errCorruptPartialBlock {
+					t.Fatalf("%s: expected %v, but found %v", key, errCorruptPartialBlock, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderVerifyBlockHandles(t *testing.T) {
+	// The fixtures have valid block handles.
+	for _, name := range []string{"h.sst", "h.ldb", "h.no-compression.sst", "h.xxhash64.no-compression.sst"} {
+		f, err := os.Open(filepath.FromSlash("testdata/" + name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, nil, VerifyBlockHandles(true))
+		if err := r.Close(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 256, Compression: NoCompression}, func(w *Writer) error {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, bytes.Repeat(key, 4)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil, VerifyBlockHandles(true))
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	// Craft an index in which the handles of the second and third data blocks
+	// are swapped, so that the offsets of the handles go backward. The handles
+	// have the same encoded length, so the index block has the same length.
+	indexBlock, err := r.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []InternalKey
+	var values [][]byte
+	iter, err := newBlockIter(r.compare, indexBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		keys = append(keys, key.Clone())
+		values = append(values, append([]byte(nil), value...))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	indexBH := r.index.bh
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) < 4 || len(values[1]) != len(values[2]) {
+		t.Fatalf("unexpected index entries %q", values)
+	}
+	values[1], values[2] = values[2], values[1]
+	bw := blockWriter{restartInterval: 1}
+	for i := range keys {
+		bw.add(keys[i], values[i])
+	}
+	b := bw.finish()
+	if uint64(len(b)) != indexBH.length {
+		t.Fatalf("expected index block of length %d, but found %d", indexBH.length, len(b))
+	}
+	copy(data[indexBH.offset:], b)
+	trailer := data[indexBH.offset+indexBH.length:]
+	binary.LittleEndian.PutUint32(trailer[1:], crc.New(b).Update(trailer[:1]).Value())
+
+	f2, err := mem.Create("corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f2.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	open := func(opts ...ReaderOption) *Reader {
+		f, err := mem.Open("corrupt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f, 0, nil, opts...)
+	}
+
+	// The corrupt index is only detected when requested.
+	r = open()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r = open(VerifyBlockHandles(true))
+	prev, _ := decodeBlockHandle(values[1])
+	bh, _ := decodeBlockHandle(values[2])
+	expected := fmt.Sprintf("block handle %d/%d overlaps or precedes block handle %d/%d",
+		bh.offset, bh.length, prev.offset, prev.length)
+	if err := r.Close(); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected error containing %q, but found %v", expected, err)
+	}
+}
+
+func TestReaderPrefetchRange(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 256}, func(w *Writer) error {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, bytes.Repeat(key, 4)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &readCountingFile{File: f1}
+	c := cache.New(1 << 20)
+	r := NewReader(f, 0, &Options{Cache: c})
+	defer r.Close()
+
+	// Find the data blocks intersecting the range [0400, 0600).
+	lower, upper := []byte("0400"), []byte("0600")
+	var inRange, outOfRange []blockHandle
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		bh := iter.dataBH
+		var handles *[]blockHandle
+		if r.compare(key.UserKey, lower) >= 0 && r.compare(key.UserKey, upper) < 0 {
+			handles = &inRange
+		} else {
+			handles = &outOfRange
+		}
+		if n := len(*handles); n == 0 || (*handles)[n-1] != bh {
+			*handles = append(*handles, bh)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(inRange) < 10 {
+		t.Fatalf("expected many data blocks in range, but found %d", len(inRange))
+	}
+	c.EvictFile(0)
+	// Read the index block so that only the reads of data blocks are counted.
+	if _, err := r.readIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The data blocks intersecting the range are adjacent, and are loaded with
+	// a single read.
+	f.reads = 0
+	if err := r.PrefetchRange(lower, upper); err != nil {
+		t.Fatal(err)
+	}
+	if f.reads != 1 {
+		t.Fatalf("expected 1 read, but found %d", f.reads)
+	}
+	for _, bh := range inRange {
+		h := c.Get(0, bh.offset)
+		if h.Get() == nil {
+			t.Fatalf("expected block at offset %d to be cached", bh.offset)
+		}
+		h.Release()
+	}
+	var cached int
+	for _, bh := range outOfRange {
+		h := c.Get(0, bh.offset)
+		if h.Get() != nil {
+			cached++
+		}
+		h.Release()
+	}
+	// Only the blocks straddling the bounds of the range may be cached.
+	if cached > 2 {
+		t.Fatalf("expected at most 2 blocks outside the range to be cached, but found %d", cached)
+	}
+
+	// A scan of the range loads no blocks.
+	iter = r.NewIter(lower, upper)
+	var n int
+	for key, _ := iter.SeekGE(lower); key != nil; key, _ = iter.Next() {
+		n++
+	}
+	if n != 200 {
+		t.Fatalf("expected 200 entries, but found %d", n)
+	}
+	if stats := iter.Stats(); stats.BlockReads != 0 {
+		t.Fatalf("expected no block reads, but found %d", stats.BlockReads)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prefetching cached blocks does not read from the file.
+	f.reads = 0
+	if err := r.PrefetchRange(lower, upper); err != nil {
+		t.Fatal(err)
+	}
+	if f.reads != 0 {
+		t.Fatalf("expected no reads, but found %d", f.reads)
+	}
+}
+
+func TestReaderNewSectionReader(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.FromSlash("testdata/h.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.FromSlash("testdata/h.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+
+	s, err := r.NewSectionReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != int64(len(data)) {
+		t.Fatalf("expected size %d, but found %d", len(data), s.Size())
+	}
+	// Streaming the section reader returns the bytes of the file, while the
+	// Reader continues to serve reads.
+	buf := make([]byte, 1000)
+	var streamed []byte
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	key, _ := iter.First()
+	for {
+		n, err := s.Read(buf)
+		streamed = append(streamed, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if key != nil {
+			key, _ = iter.Next()
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, streamed) {
+		t.Fatalf("streamed bytes differ from the file")
+	}
+	// Random access reads return the bytes at the offset.
+	if _, err := s.ReadAt(buf[:100], 5000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[5000:5100], buf[:100]) {
+		t.Fatalf("read bytes differ from the file")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.NewSectionReader(); err == nil {
+		t.Fatalf("expected error from closed reader")
+	}
+}
+
+func TestNewReaderSize(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.FromSlash("testdata/h.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.FromSlash("testdata/h.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r0 := NewReader(f, 0, nil)
+	defer r0.Close()
+
+	scan := func(r *Reader) string {
+		var buf bytes.Buffer
+		iter := r.NewIter(nil /* lower */, nil /* upper */)
+		for key, val := iter.First(); key != nil; key, val = iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s\n", key, val)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	expected := scan(r0)
+
+	// The table is read from the middle of a larger object, through a reader
+	// which does not implement io.Closer.
+	object := append(append([]byte("prefix"), data...), "suffix"...)
+	section := io.NewSectionReader(bytes.NewReader(object), int64(len("prefix")), int64(len(data)))
+	r1 := NewReaderSize(section, int64(len(data)), 0, nil)
+	if r1.err != nil {
+		t.Fatal(r1.err)
+	}
+	if !reflect.DeepEqual(r0.Properties, r1.Properties) {
+		t.Fatalf("expected properties\n%s\nbut found\n%s", r0.Properties.String(), r1.Properties.String())
+	}
+	if s := scan(r1); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+	s, err := r1.NewSectionReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != int64(len(data)) {
+		t.Fatalf("expected size %d, but found %d", len(data), s.Size())
+	}
+	if err := r1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The footer is located by the size, so an incorrect size is detected.
+	r2 := NewReaderSize(bytes.NewReader(object), int64(len(object)), 0, nil)
+	if err := r2.Close(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if r := NewReaderSize(nil /* f */, 0 /* size */, 0, nil); r.err == nil {
+		t.Fatalf("expected error for nil reader")
+	}
+}
+
+func TestReaderCompressedKeys(t *testing.T) {
+	// The keys are 8 digit decimal numbers, which are compressed to 4 byte
+	// big-endian integers. The encoding preserves the order of the keys.
+	comparer := *base.DefaultComparer
+	comparer.Name = "pebble.test.compressed-keys"
+	comparer.CompressKey = func(dst, key []byte) []byte {
+		n, err := strconv.ParseUint(string(key), 10, 32)
+		if err != nil || len(key) != 8 {
+			panic(fmt.Sprintf("invalid key %q", key))
+		}
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], uint32(n))
+		return append(dst, buf[:]...)
+	}
+	comparer.DecompressKey = func(dst, key []byte) ([]byte, error) {
+		if len(key) != 4 {
+			return nil, fmt.Errorf("invalid compressed key %q", key)
+		}
+		return append(dst, fmt.Sprintf("%08d", binary.BigEndian.Uint32(key))...), nil
+	}
+
+	const numKeys = 5000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%08d", 3*i))
+	}
+	mem := vfs.NewMem()
+	build := func(name string, comparer *Comparer) *Reader {
+		o := &Options{Comparer: comparer}
+		writeTestTable(t, mem, name, o, TableOptions{BlockSize: 256}, func(w *Writer) error {
+			for i := 0; i < numKeys; i++ {
+				if err := w.Set(key(i), []byte(fmt.Sprint(i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		r := openTestTable(t, mem, name, o)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	}
+	r := build("compressed", &comparer)
+	defer r.Close()
+	plain := build("plain", base.DefaultComparer)
+	defer plain.Close()
+
+	if !r.Properties.KeysCompressed || plain.Properties.KeysCompressed {
+		t.Fatalf("unexpected keys compressed properties: %t, %t",
+			r.Properties.KeysCompressed, plain.Properties.KeysCompressed)
+	}
+	if r.Properties.DataSize >= plain.Properties.DataSize {
+		t.Fatalf("expected compressed data size %d to be smaller than %d",
+			r.Properties.DataSize, plain.Properties.DataSize)
+	}
+
+	// The keys are returned decompressed and in order, in both directions.
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	i := 0
+	for k, v := iter.First(); k != nil; k, v = iter.Next() {
+		if !bytes.Equal(k.UserKey, key(i)) || string(v) != fmt.Sprint(i) {
+			t.Fatalf("expected %s=%d, but found %s=%s", key(i), i, k.UserKey, v)
+		}
+		i++
+	}
+	if i != numKeys {
+		t.Fatalf("expected %d keys, but found %d", numKeys, i)
+	}
+	for k, _ := iter.Last(); k != nil; k, _ = iter.Prev() {
+		i--
+		if !bytes.Equal(k.UserKey, key(i)) {
+			t.Fatalf("expected %s, but found %s", key(i), k.UserKey)
+		}
+	}
+	if i != 0 {
+		t.Fatalf("expected %d keys in reverse, but found %d", numKeys, numKeys-i)
+	}
+
+	// Seeks for present and absent keys are positioned by the comparer on the
+	// decompressed keys, as in the uncompressed table.
+	expectedIter := plain.NewIter(nil /* lower */, nil /* upper */)
+	for i := -1; i <= 3*numKeys+1; i += 7 {
+		k := []byte(fmt.Sprintf("%08d", i))
+		if i < 0 {
+			k = []byte("0000000")
+		}
+		got, _ := iter.SeekGE(k)
+		expected, _ := expectedIter.SeekGE(k)
+		if (got == nil) != (expected == nil) ||
+			(got != nil && !bytes.Equal(got.UserKey, expected.UserKey)) {
+			t.Fatalf("SeekGE(%s): expected %v, but found %v", k, expected, got)
+		}
+		got, _ = iter.SeekLT(k)
+		expected, _ = expectedIter.SeekLT(k)
+		if (got == nil) != (expected == nil) ||
+			(got != nil && !bytes.Equal(got.UserKey, expected.UserKey)) {
+			t.Fatalf("SeekLT(%s): expected %v, but found %v", k, expected, got)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectedIter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numKeys; i += 11 {
+		if v, err := r.get(key(i)); err != nil || string(v) != fmt.Sprint(i) {
+			t.Fatalf("%s: expected %d, but found %q (%v)", key(i), i, v, err)
+		}
+	}
+
+	// A table with compressed keys cannot be read without the comparer which
+	// compressed them.
+	f, err := mem.Open("compressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewReader(f, 0, nil)
+	if other.err == nil || !strings.Contains(other.err.Error(), "cannot be decompressed") {
+		t.Fatalf("expected decompression error, but found %v", other.err)
+	}
+	other.Close()
+}
+
+func TestIteratorSkipCorruptBlocks(t *testing.T) {
+	mem := vfs.NewMem()
+	const numKeys = 1000
+	writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 256, Compression: NoCompression}, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%05d", i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	open := func(name string) *Reader {
+		r := openTestTable(t, mem, name, nil)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	}
+
+	// Find the block in the middle of the table and the keys it holds.
+	r := open("test")
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	if key, _ := iter.SeekGE([]byte(fmt.Sprintf("%05d", numKeys/2))); key == nil {
+		t.Fatalf("expected key")
+	}
+	corrupt := iter.dataBH
+	lost := make(map[string]bool)
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		if iter.dataBH == corrupt {
+			lost[string(key.UserKey)] = true
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt a byte in the middle of the block.
+	f, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data[corrupt.offset+corrupt.length/2] ^= 0xff
+	f, err = mem.Create("corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r = open("corrupt")
+	defer r.Close()
+
+	// By default, a scan stops at the corrupt block.
+	iter = r.NewIter(nil /* lower */, nil /* upper */)
+	n := 0
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		n++
+	}
+	if err := iter.Close(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch error, but found %v", err)
+	}
+	if n >= numKeys-len(lost) {
+		t.Fatalf("expected the scan to stop at the corrupt block, but found %d keys", n)
+	}
+
+	// With SkipCorruptBlocks, the keys of the surrounding blocks are returned
+	// in both directions, and the corrupt block is reported once.
+	skip := &SkipCorruptBlocks{}
+	iter = r.NewIter(nil /* lower */, nil /* upper */, skip)
+	var forward, backward []string
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		forward = append(forward, string(key.UserKey))
+	}
+	for key, _ := iter.Last(); key != nil; key, _ = iter.Prev() {
+		backward = append(backward, string(key.UserKey))
+	}
+	if key, _ := iter.SeekGE([]byte(fmt.Sprintf("%05d", numKeys/2))); key == nil || lost[string(key.UserKey)] {
+		t.Fatalf("expected SeekGE to skip the corrupt block, but found %v", key)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i := 0; i < numKeys; i++ {
+		if key := fmt.Sprintf("%05d", i); !lost[key] {
+			expected = append(expected, key)
+		}
+	}
+	if !reflect.DeepEqual(expected, forward) {
+		t.Fatalf("expected %d keys, but found %d", len(expected), len(forward))
+	}
+	for i, j := 0, len(backward)-1; i < j; i, j = i+1, j-1 {
+		backward[i], backward[j] = backward[j], backward[i]
+	}
+	if !reflect.DeepEqual(expected, backward) {
+		t.Fatalf("expected %d keys in reverse, but found %d", len(expected), len(backward))
+	}
+	if len(skip.Skipped) != 1 {
+		t.Fatalf("expected 1 skipped block, but found %+v", skip.Skipped)
+	}
+	if s := skip.Skipped[0]; s.Offset != corrupt.offset || s.Length != corrupt.length ||
+		s.Err == nil || !strings.Contains(s.Err.Error(), "checksum mismatch") {
+		t.Fatalf("unexpected skipped block %+v, expected %d/%d", s, corrupt.offset, corrupt.length)
+	}
+}
+
+// tokenBucketLimiter is a ReadLimiter which allows rate bytes per second, with
+// bursts of up to burst bytes.
+type tokenBucketLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	total  int
+}
+
+func (l *tokenBucketLimiter) WaitN(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	l.total += n
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+}
+
+func TestReaderThrottleReads(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 4096, Compression: NoCompression}, func(w *Writer) error {
+		value := bytes.Repeat([]byte("v"), 1000)
+		for i := 0; i < 200; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%05d", i)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	open := func(opts ...ReaderOption) *Reader {
+		f, err := mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The blocks are not cached, so every block is read from the file.
+		opts = append(opts, BlockCaching(CacheMetaBlocks))
+		r := NewReader(f, 0, nil, opts...)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	}
+	scan := func(r *Reader) int {
+		var bytesIterated uint64
+		iter := r.NewCompactionIter(&bytesIterated)
+		n := 0
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// A nil limiter does not limit reads.
+	r := open(ThrottleReads{})
+	if n := scan(r); n != 200 {
+		t.Fatalf("expected 200 keys, but found %d", n)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scan reads the data blocks, about 200KB, at no more than 1MB/s.
+	const rate = 1 << 20
+	const burst = 16 << 10
+	limiter := &tokenBucketLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+	r = open(ThrottleReads{Limiter: limiter})
+	defer r.Close()
+	limiter.total = 0
+	start := time.Now()
+	if n := scan(r); n != 200 {
+		t.Fatalf("expected 200 keys, but found %d", n)
+	}
+	elapsed := time.Since(start)
+	// The index block is read along with the data blocks.
+	if uint64(limiter.total) < r.Properties.DataSize {
+		t.Fatalf("expected at least %d bytes read, but found %d", r.Properties.DataSize, limiter.total)
+	}
+	if readRate := float64(limiter.total-burst) / elapsed.Seconds(); readRate > rate {
+		t.Fatalf("read %d bytes in %s, exceeding %d bytes/s", limiter.total, elapsed, rate)
+	}
+}
+
+func TestReaderIndexFirstKeys(t *testing.T) {
+	// Every other key has several versions, which span data blocks of two
+	// entries each.
+	type kv struct {
+		key   InternalKey
+		value []byte
+	}
+	var kvs []kv
+	for c := byte('b'); c <= 'x'; c += 2 {
+		versions := 1 + int(c-'b')%3
+		for v := versions; v > 0; v-- {
+			kvs = append(kvs, kv{
+				key:   base.MakeInternalKey([]byte{c}, uint64(v), InternalKeyKindSet),
+				value: []byte(fmt.Sprintf("%c%d", c, v)),
+			})
+		}
+	}
+	// The probes include keys at and between the block boundaries.
+	var probes [][]byte
+	for c := byte('a'); c <= 'y'; c++ {
+		probes = append(probes, []byte{c}, []byte{c, 0})
+	}
+
+	build := func(lo TableOptions) *Reader {
+		r := newTestReader(t, nil, lo, func(w *Writer) error {
+			for _, e := range kvs {
+				if err := w.Add(e.key, e.value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	}
+	format := func(key *InternalKey, value []byte) string {
+		if key == nil {
+			return "."
+		}
+		return fmt.Sprintf("%s:%s", key, value)
+	}
+	expected := func(j int) string {
+		if j < 0 || j >= len(kvs) {
+			return "."
+		}
+		return format(&kvs[j].key, kvs[j].value)
+	}
+
+	for _, firstKeys := range []bool{false, true} {
+		for _, sparsity := range []int{1, 3} {
+			t.Run(fmt.Sprintf("firstKeys=%t,sparsity=%d", firstKeys, sparsity), func(t *testing.T) {
+				r := build(TableOptions{
+					IndexFirstKeys:  firstKeys,
+					IndexSparsity:   sparsity,
+					MaxKeysPerBlock: 2,
+				})
+				defer r.Close()
+				if r.Properties.IndexFirstKeys != firstKeys || r.Features().IndexFirstKeys != firstKeys {
+					t.Fatalf("expected the index first keys property to be %t", firstKeys)
+				}
+
+				iter := r.NewIter(nil /* lower */, nil /* upper */)
+				defer iter.Close()
+				for _, probe := range probes {
+					ge := sort.Search(len(kvs), func(j int) bool {
+						return bytes.Compare(kvs[j].key.UserKey, probe) >= 0
+					})
+					if got, want := format(iter.SeekGE(probe)), expected(ge); got != want {
+						t.Fatalf("SeekGE(%q): expected %s, but found %s", probe, want, got)
+					}
+					// The iterator is only stepped if it is positioned.
+					if got, want := format(iter.Next()), expected(ge+1); ge < len(kvs) && got != want {
+						t.Fatalf("SeekGE(%q).Next(): expected %s, but found %s", probe, want, got)
+					}
+					// A prefix seek need only find keys with the prefix.
+					exists := ge < len(kvs) && bytes.Equal(kvs[ge].key.UserKey, probe)
+					if got, want := format(iter.SeekPrefixGE(probe, probe)), expected(ge); exists && got != want {
+						t.Fatalf("SeekPrefixGE(%q): expected %s, but found %s", probe, want, got)
+					}
+					if got, want := format(iter.SeekLT(probe)), expected(ge-1); got != want {
+						t.Fatalf("SeekLT(%q): expected %s, but found %s", probe, want, got)
+					}
+					if got, want := format(iter.Prev()), expected(ge-2); ge > 0 && got != want {
+						t.Fatalf("SeekLT(%q).Prev(): expected %s, but found %s", probe, want, got)
+					}
+
+					value, err := r.get(probe)
+					if exists {
+						if err != nil || !bytes.Equal(value, kvs[ge].value) {
+							t.Fatalf("get(%q): expected %s, but found %s, %v", probe, kvs[ge].value, value, err)
+						}
+					} else if err != base.ErrNotFound {
+						t.Fatalf("get(%q): expected not found, but found %s, %v", probe, value, err)
+					}
+
+					if size, err := r.EstimateDiskUsage(probe, probe); err != nil {
+						t.Fatal(err)
+					} else if exists && size == 0 {
+						t.Fatalf("EstimateDiskUsage(%q): expected a non-zero size", probe)
+					}
+				}
+			})
+		}
+	}
+
+	// A first-key index interpreted as a separator index seeks one block too
+	// far: the seek for a key at the end of a block lands on the following
+	// block, whose first key is the first index key >= the sought key.
+	r := build(TableOptions{IndexFirstKeys: true, MaxKeysPerBlock: 2})
+	defer r.Close()
+	r.Properties.IndexFirstKeys = false
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	defer iter.Close()
+	var misplaced int
+	for _, probe := range probes {
+		ge := sort.Search(len(kvs), func(j int) bool {
+			return bytes.Compare(kvs[j].key.UserKey, probe) >= 0
+		})
+		if format(iter.SeekGE(probe)) != expected(ge) {
+			misplaced++
+		}
+	}
+	if misplaced == 0 {
+		t.Fatalf("expected misinterpreted seeks to be misplaced")
+	}
+}
+
+func TestIteratorKeyParsed(t *testing.T) {
+	kinds := []InternalKeyKind{InternalKeyKindSet, InternalKeyKindDelete, InternalKeyKindMerge}
+	// Each user key has several versions of different kinds, spread across
+	// small data blocks.
+	r := newTestReader(t, nil, TableOptions{BlockSize: 64}, func(w *Writer) error {
+		for i := 0; i < 100; i++ {
+			for j := 0; j < 3; j++ {
+				seqNum := uint64(1000*i + 10 - j)
+				key := base.MakeInternalKey([]byte(fmt.Sprintf("%03d", i)), seqNum, kinds[(i+j)%len(kinds)])
+				if err := w.Add(key, []byte("value")); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+
+	check := func(iter *Iterator, key *InternalKey, globalSeqNum uint64) {
+		t.Helper()
+		userKey, seqNum, kind := iter.KeyParsed()
+		if key == nil {
+			if userKey != nil || kind != InternalKeyKindInvalid {
+				t.Fatalf("expected an invalid key, but found %q #%d,%s", userKey, seqNum, kind)
+			}
+			return
+		}
+		// Decode the trailer of the encoded key manually.
+		buf := make([]byte, key.Size())
+		key.Encode(buf)
+		trailer := binary.LittleEndian.Uint64(buf[len(buf)-8:])
+		expectedSeqNum, expectedKind := trailer>>8, InternalKeyKind(trailer&0xff)
+		if globalSeqNum != 0 && expectedSeqNum != globalSeqNum {
+			t.Fatalf("expected global seqnum %d, but found %d", globalSeqNum, expectedSeqNum)
+		}
+		if !bytes.Equal(userKey, key.UserKey) || seqNum != expectedSeqNum || kind != expectedKind {
+			t.Fatalf("expected %s, but found %q #%d,%s", key, userKey, seqNum, kind)
+		}
+	}
+
+	for _, globalSeqNum := range []uint64{0, 12345} {
+		r.Properties.GlobalSeqNum = globalSeqNum
+		iter := r.NewIter(nil /* lower */, nil /* upper */)
+		check(iter, nil, globalSeqNum)
+		var n int
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			check(iter, key, globalSeqNum)
+			n++
+		}
+		if n != 300 {
+			t.Fatalf("expected 300 entries, but found %d", n)
+		}
+		check(iter, nil, globalSeqNum)
+		for key, _ := iter.Last(); key != nil; key, _ = iter.Prev() {
+			check(iter, key, globalSeqNum)
+		}
+		key, _ := iter.SeekGE([]byte("050"))
+		check(iter, key, globalSeqNum)
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReaderEmbeddedFilter(t *testing.T) {
+	mem := vfs.NewMem()
+	build := func(name string, threshold int) {
+		writeTestTable(t, mem, name, nil, TableOptions{
+			BlockSize:            64,
+			FilterEmbedThreshold: threshold,
+			FilterPolicy:         bloom.FilterPolicy(10),
+		}, func(w *Writer) error {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("%04d", i))
+				if err := w.Set(key, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	build("separate", 0)
+	build("embedded", 4096)
+	// A threshold smaller than the filter and the index together does not
+	// embed the filter.
+	build("too-small", 64)
+
+	testCases := []struct {
+		name     string
+		embedded bool
+		// The reads performed by a get of a key in the table, which reads the
+		// filter, the index and a data block.
+		reads int
+	}{
+		{"separate", false, 3},
+		{"embedded", true, 2},
+		{"too-small", false, 3},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			f0, err := mem.Open(c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &readCountingFile{File: f0}
+			r := NewReader(f, 0, &Options{
+				Cache:  cache.New(1 << 20),
+				Levels: []TableOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+			})
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.Properties.FilterEmbedded != c.embedded || r.Features().FilterEmbedded != c.embedded {
+				t.Fatalf("expected filter embedded %t, but found %t and %t",
+					c.embedded, r.Properties.FilterEmbedded, r.Features().FilterEmbedded)
+			}
+			if r.tableFilter == nil {
+				t.Fatalf("expected the filter to be used")
+			}
+			if f := r.Features().FilterPolicy; f != "rocksdb.BuiltinBloomFilter" {
+				t.Fatalf("unexpected filter policy %q", f)
+			}
+
+			before := f.reads
+			if value, err := r.get([]byte("0050")); err != nil || string(value) != "0050" {
+				t.Fatalf("unexpected value %q, %v", value, err)
+			}
+			if reads := f.reads - before; reads != c.reads {
+				t.Fatalf("expected %d reads, but found %d", c.reads, reads)
+			}
+
+			// The filter excludes the keys which are not in the table.
+			var excluded int
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("%04d.missing", i))
+				if _, err := r.get(key); err != base.ErrNotFound {
+					t.Fatalf("%s: expected not found, but found %v", key, err)
+				}
+				data, err := r.readFilter()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !r.tableFilter.mayContain(data, key) {
+					excluded++
+				}
+			}
+			if excluded < 90 {
+				t.Fatalf("expected the filter to exclude most missing keys, but excluded %d", excluded)
+			}
+
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			var n int
+			for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+				n++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n != 100 {
+				t.Fatalf("expected 100 keys, but found %d", n)
+			}
+		})
+	}
+
+	// A Reader which does not use the filter still reads the index.
+	f, err := mem.Open("embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+	if r.tableFilter != nil {
+		t.Fatalf("expected the filter to be unused")
+	}
+	if value, err := r.get([]byte("0099")); err != nil || string(value) != "0099" {
+		t.Fatalf("unexpected value %q, %v", value, err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RebuildFilter writes a copy of the table read by r to f, replacing the
+// table's filter with one built using the specified policy. A nil policy
+// removes the filter. The data blocks are copied verbatim, so rebuilding the
+// filter is much cheaper than rewriting the table. Only the filter, the index
+// and the meta blocks are rewritten. The keys are read once in order to
+// derive the new filter. The file is closed when RebuildFilter returns.
+//
+// The data blocks are written at the same offsets as in the original table,
+// which keeps the user-key index valid. The data blocks of an encrypted table
+// are re-encrypted with the key of the new table, which is derived from a new
+// salt.
+func RebuildFilter(r *Reader, f writeCloseSyncer, policy FilterPolicy) (err error) {
+	lo := TableOptions{
+		FilterPolicy: policy,
+		FilterType:   TableFilter,
+		UserKeyIndex: r.userKeyIndex.bh.length != 0,
+	}
+	w := NewWriter(f, r.opts, lo)
+	// The data blocks are copied along with their trailers, so the rebuilt
+	// table uses the checksum type of the original table.
+	w.checksumType = r.checksumType
+	defer func() {
+		if err != nil && w.syncer != nil {
+			// Close the file, ignoring the error from the aborted Writer.
+			w.err = err
+			_ = w.Close()
+		}
+	}()
+	if w.err != nil {
+		return w.err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.view {
+		return errors.New("pebble: cannot rebuild the filter of a view")
+	}
+
+	// The properties of the table are retained, other than those which are
+	// recomputed by the Writer.
+	props := r.Properties
+	props.FilterPolicyName = ""
+	props.FilterSize = 0
+	props.NumRangeDeletions = 0
+	props.NumRangeKeyDels = 0
+	props.NumRangeKeySets = 0
+	props.NumRangeKeyUnsets = 0
+	props.PrefixExtractorName = w.props.PrefixExtractorName
+	props.PrefixFiltering = w.props.PrefixFiltering
+	props.WholeKeyFiltering = w.props.WholeKeyFiltering
+	props.ValueOffsets = nil
+	w.props = props
+
+	indexBlock, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+	var index blockIter
+	if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+		return err
+	}
+	var group []blockHandle
+	for key, value := index.First(); key != nil; key, value = index.Next() {
+		if group, err = r.decodeIndexEntry(group[:0], value); err != nil {
+			return err
+		}
+		for _, bh := range group {
+			if err := rebuildFilterCopyBlock(r, w, bh); err != nil {
+				return err
+			}
+		}
+		// The blocks are copied to the same offsets, so the index entry is
+		// unchanged.
+		w.indexBlock.add(*key, value)
+		w.numDataBlocks += len(group)
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+
+	if r.rangeDel.bh.length != 0 {
+		b, err := r.readRangeDel()
+		if err != nil {
+			return err
+		}
+		var iter blockIter
+		if err := iter.init(r.compare, b, 0 /* globalSeqNum */); err != nil {
+			return err
+		}
+		for key, value := iter.First(); key != nil; key, value = iter.Next() {
+			if err := w.addTombstone(*key, value); err != nil {
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	if r.rangeKey.bh.length != 0 {
+		b, err := r.readRangeKey()
+		if err != nil {
+			return err
+		}
+		var iter blockIter
+		if err := iter.init(r.compare, b, 0 /* globalSeqNum */); err != nil {
+			return err
+		}
+		for key, value := iter.First(); key != nil; key, value = iter.Next() {
+			if err := w.AddRangeKey(*key, value); err != nil {
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// rebuildFilterCopyBlock copies the data block bh from r to w, adding the keys
+// in the block to the filter of w.
+func rebuildFilterCopyBlock(r *Reader, w *Writer, bh blockHandle) error {
+	if bh.offset != w.meta.Size {
+		return fmt.Errorf("pebble/table: unexpected data block offset %d, expected %d",
+			bh.offset, w.meta.Size)
+	}
+
+	h, err := r.readBlock(bh, nil /* transform */, nil /* readahead */, nil /* stats */)
+	if err != nil {
+		return err
+	}
+	var iter blockIter
+	if err := iter.init(r.compare, h.Get(), 0 /* globalSeqNum */); err != nil {
+		h.Release()
+		return err
+	}
+	var first, last []byte
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		if first == nil {
+			first = append([]byte(nil), key.UserKey...)
+			if w.meta.SmallestPoint.UserKey == nil {
+				w.meta.SmallestPoint = key.Clone()
+			}
+		}
+		last = append(last[:0], key.UserKey...)
+		w.meta.updateSeqNum(key.SeqNum())
+		w.meta.updateLargestPoint(*key)
+		w.maybeAddToFilter(key.UserKey)
+	}
+	err = iter.Close()
+	h.Release()
+	if err != nil {
+		return err
+	}
+
+	raw := make([]byte, bh.length+blockTrailerLen)
+	if _, err := r.file.ReadAt(raw, int64(bh.offset)); err != nil {
+		return err
+	}
+	if r.cipher != nil {
+		// The block is re-encrypted with the key of the new table. The block
+		// compression is unchanged, so the block keeps its length.
+		typ := raw[bh.length]
+		opened, err := r.cipher.Open(nil, raw[:bh.length], bh.offset)
+		if err != nil {
+			return fmt.Errorf("pebble/table: invalid table (block decryption failed): %v", err)
+		}
+		newBH, err := w.writeCompressedBlock(opened, typ)
+		if err != nil {
+			return err
+		}
+		if newBH != bh {
+			return fmt.Errorf("pebble/table: unexpected data block handle %d/%d, expected %d/%d",
+				newBH.offset, newBH.length, bh.offset, bh.length)
+		}
+	} else {
+		// Copy the block, including its trailer, verbatim.
+		n, err := w.writer.Write(raw)
+		w.meta.Size += uint64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	if first != nil {
+		w.dataBlocks = append(w.dataBlocks, dataBlockSummary{
+			bh:       bh,
+			smallest: first,
+			largest:  last,
+			size:     bh.length + blockTrailerLen,
+		})
+		w.blockFirstKey = first
+		w.maybeAddToUserKeyIndex(bh)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestRebuildFilter(t *testing.T) {
+	mem := vfs.NewMem()
+	build := func(name string, policy FilterPolicy) {
+		writeTestTable(t, mem, name, nil, TableOptions{
+			BlockSize:    256,
+			FilterPolicy: policy,
+			UserKeyIndex: true,
+		}, func(w *Writer) error {
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("%05d", i))
+				if err := w.Set(key, bytes.Repeat(key, i%5)); err != nil {
+					return err
+				}
+			}
+			return w.DeleteRange([]byte("00100"), []byte("00200"))
+		})
+	}
+	open := func(name string, policy FilterPolicy) *Reader {
+		return openTestTable(t, mem, name, &Options{
+			Levels: []TableOptions{{FilterPolicy: policy}},
+		})
+	}
+	readAll := func(name string) []byte {
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	oldPolicy := bloom.FilterPolicy(10)
+	newPolicy := bloom.FilterPolicy(20)
+	build("old", oldPolicy)
+	build("fresh", newPolicy)
+
+	r := open("old", oldPolicy)
+	defer r.Close()
+	f, err := mem.Create("rebuilt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildFilter(r, f, newPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := open("fresh", newPolicy)
+	defer fresh.Close()
+	rebuilt := open("rebuilt", newPolicy)
+	defer rebuilt.Close()
+
+	// The rebuilt filter is identical to the filter of a freshly built table.
+	if rebuilt.Properties.FilterPolicyName != newPolicy.Name() {
+		t.Fatalf("expected filter policy %s, but found %s",
+			newPolicy.Name(), rebuilt.Properties.FilterPolicyName)
+	}
+	if rebuilt.tableFilter == nil {
+		t.Fatalf("expected rebuilt table to use the new filter")
+	}
+	freshFilter, err := fresh.readFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuiltFilter, err := rebuilt.readFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(freshFilter, rebuiltFilter) {
+		t.Fatalf("rebuilt filter differs from freshly built filter")
+	}
+
+	// The data blocks are copied verbatim.
+	dataSize := r.Properties.DataSize
+	if rebuilt.Properties.DataSize != dataSize {
+		t.Fatalf("expected data size %d, but found %d", dataSize, rebuilt.Properties.DataSize)
+	}
+	if !bytes.Equal(readAll("old")[:dataSize], readAll("rebuilt")[:dataSize]) {
+		t.Fatalf("data blocks differ")
+	}
+
+	// The contents of the table are unchanged, and can be read using the
+	// user-key index and the new filter.
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		v, err := rebuilt.get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, bytes.Repeat(key, i%5)) {
+			t.Fatalf("%s: unexpected value %q", key, v)
+		}
+	}
+	if rebuilt.Properties.NumEntries != r.Properties.NumEntries ||
+		rebuilt.Properties.NumRangeDeletions != r.Properties.NumRangeDeletions {
+		t.Fatalf("unexpected properties:\n%s", &rebuilt.Properties)
+	}
+	iter := rebuilt.NewRangeDelIter()
+	if key, end := iter.First(); key == nil || string(key.UserKey) != "00100" || string(end) != "00200" {
+		t.Fatalf("unexpected range deletion %s-%s", key, end)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/internal/rangedel"
+)
+
+// SnapshotIterator iterates over the point entries of a table as of a sequence
+// number. Entries newer than the sequence number are hidden, as are entries
+// deleted by a range tombstone in the table whose sequence number is less
+// than or equal to the sequence number. Multiple versions of a user key which
+// are visible as of the sequence number are all returned, newest first.
+type SnapshotIterator struct {
+	cmp       Compare
+	iter      *Iterator
+	rangeDels *blockIter
+	seqNum    uint64
+	key       *InternalKey
+	value     []byte
+	err       error
+}
+
+// ReadAt returns an iterator presenting the point entries of the table as of
+// the specified sequence number. See SnapshotIterator.
+func (r *Reader) ReadAt(seqNum uint64) *SnapshotIterator {
+	i := &SnapshotIterator{
+		cmp:    r.compare,
+		iter:   r.NewIter(nil /* lower */, nil /* upper */),
+		seqNum: seqNum,
+	}
+	if r.rangeDel.bh.length != 0 {
+		b, err := r.readRangeDel()
+		if err != nil {
+			i.err = err
+			return i
+		}
+		i.rangeDels = &blockIter{}
+		i.err = i.rangeDels.init(r.compare, b, r.Properties.GlobalSeqNum)
+	}
+	return i
+}
+
+// NewVisibleIter returns an iterator presenting the point entries of the table
+// which are not deleted by a range tombstone in the same table. A range
+// tombstone only hides the entries it covers with lower sequence numbers. It
+// is equivalent to reading the table as of the maximum sequence number.
+func (r *Reader) NewVisibleIter() *SnapshotIterator {
+	return r.ReadAt(InternalKeySeqNumMax)
+}
+
+// GetAt returns the value of the newest version of key whose sequence number
+// is less than or equal to seqNum, ignoring any newer versions. It is the point
+// read analog of ReadAt: base.ErrNotFound is returned if no version of the key
+// is visible as of seqNum, or if the newest visible version is a deletion or
+// is deleted by a visible range tombstone in the table. If the newest visible
+// version is a merge operand, the operand is returned as is. The returned value
+// is a copy which is owned by the caller.
+func (r *Reader) GetAt(key []byte, seqNum uint64) ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !r.contains(key) {
+		return nil, base.ErrNotFound
+	}
+	i := r.ReadAt(seqNum)
+	ikey, value := i.SeekGE(key)
+	if ikey == nil || r.compare(key, ikey.UserKey) != 0 || ikey.Kind() == InternalKeyKindDelete {
+		err := i.Close()
+		if err == nil {
+			err = base.ErrNotFound
+		}
+		return nil, err
+	}
+	value = append([]byte(nil), value...)
+	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// visible returns true if the entry is visible as of the sequence number.
+func (i *SnapshotIterator) visible(key *InternalKey) bool {
+	if key.SeqNum() > i.seqNum {
+		return false
+	}
+	if i.rangeDels == nil {
+		return true
+	}
+	// Only tombstones with sequence numbers less than the snapshot passed to
+	// rangedel.Get are visible, so the snapshot is one past the sequence number.
+	t := rangedel.Get(i.cmp, i.rangeDels, key.UserKey, i.seqNum+1)
+	return !t.Deletes(key.SeqNum())
+}
+
+func (i *SnapshotIterator) skipForward(key *InternalKey, value []byte) (*InternalKey, []byte) {
+	for key != nil && !i.visible(key) {
+		key, value = i.iter.Next()
+	}
+	i.key, i.value = key, value
+	return key, value
+}
+
+func (i *SnapshotIterator) skipBackward(key *InternalKey, value []byte) (*InternalKey, []byte) {
+	for key != nil && !i.visible(key) {
+		key, value = i.iter.Prev()
+	}
+	i.key, i.value = key, value
+	return key, value
+}
+
+// SeekGE moves the iterator to the first visible entry whose key is greater
+// than or equal to the given key.
+func (i *SnapshotIterator) SeekGE(key []byte) (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	return i.skipForward(i.iter.SeekGE(key))
+}
+
+// SeekLT moves the iterator to the last visible entry whose key is less than
+// the given key.
+func (i *SnapshotIterator) SeekLT(key []byte) (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	return i.skipBackward(i.iter.SeekLT(key))
+}
+
+// First moves the iterator to the first visible entry.
+func (i *SnapshotIterator) First() (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	return i.skipForward(i.iter.First())
+}
+
+// Last moves the iterator to the last visible entry.
+func (i *SnapshotIterator) Last() (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	return i.skipBackward(i.iter.Last())
+}
+
+// Next moves the iterator to the next visible entry.
+func (i *SnapshotIterator) Next() (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	return i.skipForward(i.iter.Next())
+}
+
+// Prev moves the iterator to the previous visible entry.
+func (i *SnapshotIterator) Prev() (*InternalKey, []byte) {
+	if i.err != nil {
+		return nil, nil
+	}
+	return i.skipBackward(i.iter.Prev())
+}
+
+// Key returns the key of the current entry, or nil if the iterator is not
+// positioned at an entry.
+func (i *SnapshotIterator) Key() *InternalKey {
+	return i.key
+}
+
+// Value returns the value of the current entry.
+func (i *SnapshotIterator) Value() []byte {
+	return i.value
+}
+
+// Valid returns true if the iterator is positioned at a valid entry.
+func (i *SnapshotIterator) Valid() bool {
+	return i.key != nil && i.err == nil
+}
+
+// Error returns any accumulated error.
+func (i *SnapshotIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	if err := i.iter.Error(); err != nil {
+		return err
+	}
+	if i.rangeDels != nil {
+		return i.rangeDels.Error()
+	}
+	return nil
+}
+
+// Close closes the iterator, returning any accumulated error.
+func (i *SnapshotIterator) Close() error {
+	err := i.iter.Close()
+	if i.rangeDels != nil {
+		if err2 := i.rangeDels.Close(); err == nil {
+			err = err2
+		}
+	}
+	if i.err != nil {
+		err = i.err
+	}
+	*i = SnapshotIterator{}
+	return err
+}
@@ -67,6 +67,7 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/vfs"
 )
 
@@ -90,7 +91,9 @@ The table file format looks like:
 Each block consists of some data and a 5 byte trailer: a 1 byte block type and
 a 4 byte checksum of the compressed data. The block type gives the per-block
 compression used; each block is compressed independently. The checksum
-algorithm is described in the pebble/crc package.
+algorithm is described in the pebble/crc package. Tables whose footer specifies
+the xxHash64 checksum type instead store the lower 32 bits of the xxHash64
+checksum of the compressed data and block type, as RocksDB does.
 
 The decompressed block data consists of a sequence of key/value entries
 followed by a trailer. Each key is encoded as a shared prefix length and a
@@ -139,12 +142,18 @@ const (
 	minFooterLen = levelDBFooterLen
 	maxFooterLen = rocksDBFooterLen
 
+	footerChecksumLen = 4
+
 	levelDBFormatVersion  = 0
 	rocksDBFormatVersion2 = 2
+	// The footer version of a RocksDB table whose footer holds a checksum of
+	// the block handles has this bit set in addition to the format version.
+	footerVersionHandleChecksum = 1 << 31
 
-	noChecksum     = 0
-	checksumCRC32c = 1
-	checksumXXHash = 2
+	noChecksum       = 0
+	checksumCRC32c   = 1
+	checksumXXHash   = 2
+	checksumXXHash64 = 3
 
 	// The block type gives the per-block compression format.
 	// These constants are part of the file format and should not be changed.
@@ -153,10 +162,43 @@ const (
 	// use the default compression (which is snappy).
 	noCompressionBlockType     byte = 0
 	snappyCompressionBlockType byte = 1
+	// Blocks compressed using zlib are only written by LevelDB and RocksDB
+	// derived implementations, and are read but never written by Pebble.
+	zlibCompressionBlockType byte = 2
+	// The zstd block type matches that of RocksDB.
+	zstdCompressionBlockType byte = 7
 
 	metaPropertiesName = "rocksdb.properties"
-	metaRangeDelName   = "rocksdb.range_del"
-	metaRangeDelV2Name = "rocksdb.range_del2"
+	// The compression dictionary is written by RocksDB when dictionary
+	// compression is enabled (max_dict_bytes > 0). The data blocks, but not the
+	// index or meta blocks, are compressed against the dictionary. The block
+	// itself is stored uncompressed.
+	metaCompressionDictName = "rocksdb.compression_dict"
+	metaRangeDelName        = "rocksdb.range_del"
+	metaRangeDelV2Name      = "rocksdb.range_del2"
+
+	// The user-key index is an optional meta block which maps the first user
+	// key of each data block to the block handle of that data block. The keys
+	// are stored without an internal key trailer which allows point lookups to
+	// binary search the index using user key comparisons alone.
+	metaUserKeyIndexName = "pebble.index.user-key"
+
+	// The range-key block holds the fragmented range keys of the table. The
+	// name and encoding match CockroachDB's Pebble.
+	metaRangeKeyName = "pebble.range_key"
+
+	// The prefix map is an optional meta block which maps each distinct key
+	// prefix of a table with few prefixes to the range of index entries
+	// containing the keys with that prefix. See prefix_map.go.
+	metaPrefixMapName = "pebble.prefix.block-map"
+
+	// The column family ranges block maps the ID of each column family in a
+	// table to the range of its keys. See column_family.go.
+	metaCFRangesName = "pebble.cf.ranges"
+
+	// The block key ranges block records the exact smallest and largest user
+	// keys of each data block. See block_key_ranges.go.
+	metaBlockKeyRangesName = "pebble.block.key-ranges"
 
 	// RocksDB always includes this in the properties block. Since Pebble
 	// doesn't use zstd compression, the string will always be the same.
@@ -178,25 +220,41 @@ const (
 //    <padding> to make the total size 2 * BlockHandle::kMaxEncodedLength + 1
 //    footer version (4 bytes)
 //    table_magic_number (8 bytes)
+//
+// In the RocksDB format, the last 4 bytes of the padding may optionally hold a
+// checksum of the preceding footer bytes, which include the metaindex and
+// index handles (see TableOptions.FooterChecksum). The checksum allows a
+// Reader to detect a corrupted handle before reading the block it points to:
+//    footer checksum (4 bytes, CRC32c of the footer bytes preceding the padding)
+// The presence of the checksum is recorded by setting the
+// footerVersionHandleChecksum bit of the footer version. The checksum is only
+// written if the handles leave room for it in the padding.
 type footer struct {
 	format      TableFormat
 	checksum    uint8
 	metaindexBH blockHandle
 	indexBH     blockHandle
+	// handleChecksum is true if the footer holds a checksum of the handles.
+	handleChecksum bool
 }
 
 func readFooter(f vfs.File) (footer, error) {
-	var footer footer
 	stat, err := f.Stat()
 	if err != nil {
-		return footer, fmt.Errorf("pebble/table: invalid table (could not stat file): %v", err)
+		return footer{}, fmt.Errorf("pebble/table: invalid table (could not stat file): %v", err)
 	}
-	if stat.Size() < minFooterLen {
+	return readFooterAt(f, stat.Size())
+}
+
+// readFooterAt reads the footer of a table file of the specified size.
+func readFooterAt(f io.ReaderAt, size int64) (footer, error) {
+	var footer footer
+	if size < minFooterLen {
 		return footer, errors.New("pebble/table: invalid table (file size is too small)")
 	}
 
 	buf := make([]byte, maxFooterLen)
-	off := stat.Size() - maxFooterLen
+	off := size - maxFooterLen
 	if off < 0 {
 		off = 0
 	}
@@ -206,12 +264,16 @@ func readFooter(f vfs.File) (footer, error) {
 	}
 	buf = buf[:n]
 
+	// full is the complete encoded footer while buf is advanced past the
+	// decoded fields.
+	var full []byte
 	switch string(buf[len(buf)-len(rocksDBMagic):]) {
 	case levelDBMagic:
 		if len(buf) < levelDBFooterLen {
 			return footer, fmt.Errorf("pebble/table: invalid table (footer too short): %d", len(buf))
 		}
 		buf = buf[len(buf)-levelDBFooterLen:]
+		full = buf
 		footer.format = TableFormatLevelDB
 		footer.checksum = checksumCRC32c
 
@@ -220,13 +282,20 @@ func readFooter(f vfs.File) (footer, error) {
 			return footer, fmt.Errorf("pebble/table: invalid table (footer too short): %d", len(buf))
 		}
 		buf = buf[len(buf)-rocksDBFooterLen:]
+		full = buf
 		version := binary.LittleEndian.Uint32(buf[rocksDBVersionOffset:rocksDBMagicOffset])
+		if version&footerVersionHandleChecksum != 0 {
+			footer.handleChecksum = true
+			version &^= footerVersionHandleChecksum
+		}
 		if version != rocksDBFormatVersion2 {
 			return footer, fmt.Errorf("pebble/table: unsupported format version %d", version)
 		}
 		footer.format = TableFormatRocksDBv2
 		footer.checksum = uint8(buf[0])
-		if footer.checksum != checksumCRC32c {
+		switch footer.checksum {
+		case checksumCRC32c, checksumXXHash64:
+		default:
 			return footer, fmt.Errorf("pebble/table: unsupported checksum type %d", footer.checksum)
 		}
 		buf = buf[1:]
@@ -247,11 +316,80 @@ func readFooter(f vfs.File) (footer, error) {
 		if n == 0 {
 			return footer, errors.New("pebble/table: invalid table (bad index block handle)")
 		}
+		buf = buf[n:]
+	}
+
+	// Verify the footer checksum, if present. The checksum covers the footer
+	// bytes preceding the remaining buf.
+	if footer.handleChecksum {
+		checksumOffset := footer.checksumOffset()
+		handlesEnd := len(full) - len(buf)
+		if handlesEnd > checksumOffset {
+			return footer, errors.New("pebble/table: invalid table (footer block handles overlap checksum)")
+		}
+		checksum0 := binary.LittleEndian.Uint32(full[checksumOffset:])
+		checksum1 := crc.New(full[:handlesEnd]).Value()
+		if checksum0 != checksum1 {
+			return footer, errors.New("pebble/table: invalid table (footer block handle checksum mismatch)")
+		}
 	}
 
 	return footer, nil
 }
 
+// Footer is the decoded footer of a table, which locates the metaindex and
+// index blocks.
+type Footer struct {
+	// Format is the format of the table.
+	Format TableFormat
+	// MetaindexOffset and MetaindexLength locate the metaindex block. The
+	// length does not include the block trailer.
+	MetaindexOffset, MetaindexLength uint64
+	// IndexOffset and IndexLength locate the index block. The length does not
+	// include the block trailer.
+	IndexOffset, IndexLength uint64
+	// HandleChecksum is true if the footer contains a checksum of the block
+	// handles (see TableOptions.FooterChecksum).
+	HandleChecksum bool
+}
+
+// FooterSize returns the size in bytes of the footer of a table with the
+// specified format, or 0 if the format is unknown. The footer is stored at the
+// very end of the table file.
+func FooterSize(format TableFormat) int64 {
+	switch format {
+	case TableFormatLevelDB:
+		return levelDBFooterLen
+	case TableFormatRocksDBv2:
+		return rocksDBFooterLen
+	}
+	return 0
+}
+
+// ReadFooter reads and decodes the footer of the table file f, which has the
+// specified size. Only the end of the file is read, allowing the metadata of a
+// table to be located without opening a Reader.
+func ReadFooter(f vfs.File, size int64) (Footer, error) {
+	ftr, err := readFooterAt(f, size)
+	if err != nil {
+		return Footer{}, err
+	}
+	return Footer{
+		Format:          ftr.format,
+		MetaindexOffset: ftr.metaindexBH.offset,
+		MetaindexLength: ftr.metaindexBH.length,
+		IndexOffset:     ftr.indexBH.offset,
+		IndexLength:     ftr.indexBH.length,
+		HandleChecksum:  ftr.handleChecksum,
+	}, nil
+}
+
+// checksumOffset returns the offset within the encoded footer of the optional
+// footer checksum.
+func (f footer) checksumOffset() int {
+	return rocksDBVersionOffset - footerChecksumLen
+}
+
 func (f footer) encode(buf []byte) []byte {
 	switch f.format {
 	case TableFormatLevelDB:
@@ -260,7 +398,7 @@ func (f footer) encode(buf []byte) []byte {
 			buf[i] = 0
 		}
 		n := encodeBlockHandle(buf[0:], f.metaindexBH)
-		n += encodeBlockHandle(buf[n:], f.indexBH)
+		encodeBlockHandle(buf[n:], f.indexBH)
 		copy(buf[len(buf)-len(levelDBMagic):], levelDBMagic)
 
 	case TableFormatRocksDBv2:
@@ -272,9 +410,28 @@ func (f footer) encode(buf []byte) []byte {
 		n := 1
 		n += encodeBlockHandle(buf[n:], f.metaindexBH)
 		n += encodeBlockHandle(buf[n:], f.indexBH)
-		binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], rocksDBFormatVersion2)
+		version := uint32(rocksDBFormatVersion2)
+		if f.encodeChecksum(buf, n) {
+			version |= footerVersionHandleChecksum
+		}
+		binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], version)
 		copy(buf[len(buf)-len(rocksDBMagic):], rocksDBMagic)
 	}
 
 	return buf
 }
+
+// encodeChecksum writes the footer checksum of the first n bytes of the
+// encoded footer, if enabled and if the handles leave room for it, returning
+// whether the checksum was written.
+func (f footer) encodeChecksum(buf []byte, n int) bool {
+	if !f.handleChecksum {
+		return false
+	}
+	offset := f.checksumOffset()
+	if n > offset {
+		return false
+	}
+	binary.LittleEndian.PutUint32(buf[offset:], crc.New(buf[:n]).Value())
+	return true
+}
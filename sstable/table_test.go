@@ -10,6 +10,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -20,6 +21,8 @@ import (
 	"github.com/kr/pretty"
 	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/internal/base"
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/internal/xxhash"
 	"github.com/petermattis/pebble/vfs"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/rand"
@@ -133,7 +136,7 @@ func check(f vfs.File, comparer *Comparer, fp FilterPolicy) error {
 		}
 
 		// Check using SeekGE.
-		i := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+		i := NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
 		if !i.SeekGE([]byte(k)) || string(i.Key().UserKey) != k {
 			return fmt.Errorf("Find %q: key was not in the table", k)
 		}
@@ -179,7 +182,7 @@ func check(f vfs.File, comparer *Comparer, fp FilterPolicy) error {
 		}
 
 		// Check using Find.
-		i := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+		i := NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
 		if i.SeekGE([]byte(s)) && s == string(i.Key().UserKey) {
 			return fmt.Errorf("Find %q: unexpectedly found key in the table", s)
 		}
@@ -205,7 +208,7 @@ func check(f vfs.File, comparer *Comparer, fp FilterPolicy) error {
 		{0, "~"},
 	}
 	for _, ct := range countTests {
-		n, i := 0, iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+		n, i := 0, NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
 		for valid := i.SeekGE([]byte(ct.start)); valid; valid = i.Next() {
 			n++
 		}
@@ -254,7 +257,7 @@ func check(f vfs.File, comparer *Comparer, fp FilterPolicy) error {
 			upper = []byte(words[upperIdx])
 		}
 
-		i := iterAdapter{r.NewIter(lower, upper)}
+		i := NewLegacyIterAdapter(r.NewIter(lower, upper))
 
 		{
 			// NB: the semantics of First are that it starts iteration from the
@@ -319,6 +322,19 @@ func build(
 	ftype FilterType,
 	comparer *Comparer,
 	propCollector func() TablePropertyCollector,
+) (vfs.File, error) {
+	return buildWithChecksum(compression, fp, ftype, comparer, propCollector, CRC32cChecksum)
+}
+
+// buildWithChecksum is like build, but writes the blocks of the table using
+// the specified checksum type.
+func buildWithChecksum(
+	compression Compression,
+	fp FilterPolicy,
+	ftype FilterType,
+	comparer *Comparer,
+	propCollector func() TablePropertyCollector,
+	checksumType ChecksumType,
 ) (vfs.File, error) {
 	// Create a sorted list of wordCount's keys.
 	keys := make([]string, len(wordCount))
@@ -352,6 +368,7 @@ func build(
 		Compression:  compression,
 		FilterPolicy: fp,
 		FilterType:   ftype,
+		ChecksumType: checksumType,
 	}
 
 	w := NewWriter(f0, opts, tableOpts)
@@ -391,6 +408,297 @@ func testReader(t *testing.T, filename string, comparer *Comparer, fp FilterPoli
 func TestReaderLevelDB(t *testing.T)            { testReader(t, "h.ldb", nil, nil) }
 func TestReaderDefaultCompression(t *testing.T) { testReader(t, "h.sst", nil, nil) }
 func TestReaderNoCompression(t *testing.T)      { testReader(t, "h.no-compression.sst", nil, nil) }
+func TestReaderXXHash64Checksum(t *testing.T) {
+	testReader(t, "h.xxhash64.no-compression.sst", nil, nil)
+}
+
+// TestReaderZlibCompression checks that tables whose data blocks are compressed
+// using zlib can be read. The pre-made tables were created by Pebble, using a
+// Writer modified to compress blocks in the manner of LevelDB and RocksDB.
+func TestReaderZlibCompression(t *testing.T) {
+	for _, c := range []struct {
+		filename string
+		format   TableFormat
+	}{
+		{"h.zlib.ldb", TableFormatLevelDB},
+		{"h.zlib.sst", TableFormatRocksDBv2},
+	} {
+		t.Run(c.filename, func(t *testing.T) {
+			testReader(t, c.filename, nil, nil)
+
+			data, err := ioutil.ReadFile(filepath.FromSlash("testdata/" + c.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(filepath.FromSlash("testdata/" + c.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if r.format != c.format {
+				t.Fatalf("expected format %d, but found %d", c.format, r.format)
+			}
+			index, err := r.readIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter := &blockIter{}
+			if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			for _, val := iter.First(); val != nil; _, val = iter.Next() {
+				bh, _ := decodeBlockHandle(val)
+				if typ := data[bh.offset+bh.length]; typ != zlibCompressionBlockType {
+					t.Fatalf("unexpected block type %d", typ)
+				}
+				n++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				t.Fatalf("expected data blocks")
+			}
+		})
+	}
+}
+
+// TestReaderDictCompression checks that tables whose data blocks are
+// compressed against a dictionary stored in a meta block can be read. The
+// pre-made tables were created by RocksDB with max_dict_bytes set.
+func TestReaderDictCompression(t *testing.T) {
+	for _, c := range []struct {
+		filename  string
+		blockType byte
+		decode    func(r *Reader, b, dict []byte) ([]byte, error)
+	}{
+		{"h.zlib-dict.sst", zlibCompressionBlockType, (*Reader).decodeZlib},
+		{"h.zstd-dict.sst", zstdCompressionBlockType, (*Reader).decodeZstd},
+	} {
+		t.Run(c.filename, func(t *testing.T) {
+			testReader(t, c.filename, nil, nil)
+
+			data, err := ioutil.ReadFile(filepath.FromSlash("testdata/" + c.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(filepath.FromSlash("testdata/" + c.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if !r.Features().HasCompressionDict || len(r.compressionDict) == 0 {
+				t.Fatalf("expected a compression dictionary")
+			}
+			index, err := r.readIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter := &blockIter{}
+			if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+				t.Fatal(err)
+			}
+			// A Reader decompressing the blocks as a stream uses the dictionary.
+			streaming := &Reader{
+				opts:     &Options{StreamingDecompressionThreshold: 1},
+				format:   r.format,
+				zstdDict: r.zstdDict,
+			}
+			// The data blocks cannot be decompressed without the dictionary.
+			var n, undecodable int
+			for _, val := iter.First(); val != nil; _, val = iter.Next() {
+				bh, _ := decodeBlockHandle(val)
+				if typ := data[bh.offset+bh.length]; typ != c.blockType {
+					t.Fatalf("unexpected block type %d", typ)
+				}
+				raw := data[bh.offset : bh.offset+bh.length]
+				expected, err := c.decode(r, raw, r.compressionDict)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decoded, err := c.decode(streaming, raw, r.compressionDict); err != nil {
+					t.Fatal(err)
+				} else if !bytes.Equal(expected, decoded) {
+					t.Fatalf("streaming decompression differs")
+				}
+				if decoded, err := c.decode(r, raw, nil); err != nil || !bytes.Equal(expected, decoded) {
+					undecodable++
+				}
+				n++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 || undecodable == 0 {
+				t.Fatalf("expected data blocks compressed against the dictionary, found %d of %d", undecodable, n)
+			}
+		})
+	}
+}
+
+// TestWriterZstdCompression checks that tables written using zstd compression
+// can be read, and that their data blocks are stored using the zstd block type.
+func TestWriterZstdCompression(t *testing.T) {
+	f, err := build(ZstdCompression, nil, TableFilter, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := check(f, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = build(ZstdCompression, nil, TableFilter, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if v := r.Properties.CompressionName; v != "ZSTD" {
+		t.Fatalf("expected compression name ZSTD, but found %s", v)
+	}
+	index, err := r.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := &blockIter{}
+	if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	var typ [1]byte
+	for _, val := iter.First(); val != nil; _, val = iter.Next() {
+		bh, _ := decodeBlockHandle(val)
+		if _, err := r.file.ReadAt(typ[:], int64(bh.offset+bh.length)); err != nil {
+			t.Fatal(err)
+		}
+		if typ[0] != zstdCompressionBlockType {
+			t.Fatalf("unexpected block type %d", typ[0])
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatalf("expected data blocks")
+	}
+}
+
+func TestWriterChecksumType(t *testing.T) {
+	for _, c := range []struct {
+		checksumType ChecksumType
+		checksum     uint8
+	}{
+		{DefaultChecksum, checksumCRC32c},
+		{CRC32cChecksum, checksumCRC32c},
+		{XXHash64Checksum, checksumXXHash64},
+	} {
+		t.Run(c.checksumType.String(), func(t *testing.T) {
+			f, err := buildWithChecksum(SnappyCompression, nil, TableFilter, nil, nil, c.checksumType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = buildWithChecksum(SnappyCompression, nil, TableFilter, nil, nil, c.checksumType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.checksumType != c.checksum {
+				t.Fatalf("expected checksum type %d, but found %d", c.checksum, r.checksumType)
+			}
+
+			// A corrupted block fails checksum verification.
+			index, err := r.readIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter := &blockIter{}
+			if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+				t.Fatal(err)
+			}
+			_, val := iter.First()
+			bh, _ := decodeBlockHandle(val)
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			raw := make([]byte, bh.length+blockTrailerLen)
+			if _, err := r.file.ReadAt(raw, int64(bh.offset)); err != nil {
+				t.Fatal(err)
+			}
+			if !r.verifyChecksum(raw[:bh.length+1], raw[bh.length+1:]) {
+				t.Fatalf("expected the checksum to verify")
+			}
+			raw[0] ^= 0xff
+			if r.verifyChecksum(raw[:bh.length+1], raw[bh.length+1:]) {
+				t.Fatalf("expected the checksum of the corrupted block to fail verification")
+			}
+		})
+	}
+
+	// The LevelDB table format cannot record xxHash64 checksums.
+	mem := vfs.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, &Options{TableFormat: TableFormatLevelDB}, TableOptions{ChecksumType: XXHash64Checksum})
+	if err := w.Set([]byte("a"), nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// BenchmarkVerifyChecksum compares the cost of verifying the checksum of a
+// 32KB block using each checksum type.
+func BenchmarkVerifyChecksum(b *testing.B) {
+	rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	block := make([]byte, 32<<10+1)
+	for i := range block {
+		block[i] = byte(rng.Uint32())
+	}
+	for _, checksumType := range []ChecksumType{CRC32cChecksum, XXHash64Checksum} {
+		b.Run(checksumType.String(), func(b *testing.B) {
+			mem := vfs.NewMem()
+			f, err := mem.Create("test")
+			if err != nil {
+				b.Fatal(err)
+			}
+			w := NewWriter(f, nil, TableOptions{ChecksumType: checksumType})
+			r := &Reader{checksumType: w.checksumType}
+			// Compute the checksum of the block, followed by its block type, in
+			// the same way as the Writer.
+			checksum := make([]byte, blockTrailerLen-1)
+			if w.checksumType == checksumXXHash64 {
+				binary.LittleEndian.PutUint32(checksum, uint32(xxhash.Sum64(block)))
+			} else {
+				binary.LittleEndian.PutUint32(checksum, crc.New(block).Value())
+			}
+			if !r.verifyChecksum(block, checksum) {
+				b.Fatalf("expected the checksum to verify")
+			}
+
+			b.SetBytes(int64(len(block)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.verifyChecksum(block, checksum)
+			}
+		})
+	}
+}
+
 func TestReaderBlockBloomIgnored(t *testing.T) {
 	testReader(t, "h.block-bloom.no-compression.sst", nil, nil)
 }
@@ -536,6 +844,132 @@ func (c *countingFilterPolicy) MayContain(ftype FilterType, filter, key []byte)
 	return got
 }
 
+func TestReaderFilterMode(t *testing.T) {
+	// prefixComparer extracts a two byte prefix, so that the prefix of a key
+	// generally differs from the key.
+	prefixComparer := func(name string) *Comparer {
+		c := *base.DefaultComparer
+		c.Name = name
+		c.Split = func(a []byte) int {
+			if len(a) < 2 {
+				return len(a)
+			}
+			return 2
+		}
+		return &c
+	}
+	const fixtureName = "leveldb.BytewiseComparator"
+
+	open := func(name string) (vfs.File, error) {
+		if strings.HasPrefix(name, "testdata/") {
+			return os.Open(filepath.FromSlash(name))
+		}
+		switch name {
+		case "pebble.whole-key":
+			return build(NoCompression, bloom.FilterPolicy(10), TableFilter, nil, nil)
+		case "pebble.prefix":
+			return build(NoCompression, bloom.FilterPolicy(10), TableFilter, prefixComparer(fixtureName), nil)
+		}
+		return nil, fmt.Errorf("unknown table %s", name)
+	}
+
+	testCases := []struct {
+		table    string
+		comparer *Comparer
+		// getFilter and seekFilter are whether the filter is used by get and
+		// SeekPrefixGE respectively.
+		getFilter, seekFilter bool
+	}{
+		// Tables whose filter contains whole keys.
+		{"testdata/h.table-bloom.no-compression.sst", nil, true, false},
+		{"testdata/h.table-bloom.no-compression.sst", prefixComparer(fixtureName), true, false},
+		{"pebble.whole-key", nil, true, false},
+		{"pebble.whole-key", prefixComparer(fixtureName), true, false},
+		// Tables whose filter contains prefixes. The filter is only used if the
+		// Reader has a Split function with the name of the prefix extractor.
+		{"testdata/h.table-bloom.no-compression.prefix_extractor.no_whole_key_filter.sst",
+			fixtureComparer, true, true},
+		{"testdata/h.table-bloom.no-compression.prefix_extractor.no_whole_key_filter.sst",
+			nil, false, false},
+		{"pebble.prefix", prefixComparer(fixtureName), true, true},
+		{"pebble.prefix", nil, false, false},
+		{"pebble.prefix", prefixComparer("other"), false, false},
+	}
+	for _, c := range testCases {
+		name := fmt.Sprintf("%s/split=%t", c.table, c.comparer != nil)
+		if c.comparer != nil {
+			name += "," + c.comparer.Name
+		}
+		t.Run(name, func(t *testing.T) {
+			f, err := open(c.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp := &countingFilterPolicy{FilterPolicy: bloom.FilterPolicy(10)}
+			r := NewReader(f, 0, &Options{
+				Comparer: c.comparer,
+				Levels:   []TableOptions{{FilterPolicy: fp}},
+			})
+			defer r.Close()
+			calls := func() int {
+				n := fp.truePositives + fp.falsePositives + fp.falseNegatives + fp.trueNegatives
+				*fp = countingFilterPolicy{FilterPolicy: fp.FilterPolicy}
+				return n
+			}
+
+			// Every key is found, regardless of whether the filter is used.
+			for k, v := range wordCount {
+				if v1, err := r.get([]byte(k)); err != nil || string(v1) != v {
+					t.Fatalf("get %q: got (%q, %v), want (%q, nil)", k, v1, err, v)
+				}
+			}
+			if n := calls(); (n > 0) != c.getFilter {
+				t.Fatalf("expected filter use by get to be %t, but found %d filter checks", c.getFilter, n)
+			}
+
+			if c.comparer != nil {
+				iter := r.NewIter(nil /* lower */, nil /* upper */)
+				for k := range wordCount {
+					key := []byte(k)
+					prefix := key[:c.comparer.Split(key)]
+					if ikey, _ := iter.SeekPrefixGE(prefix, key); ikey == nil || string(ikey.UserKey) != k {
+						t.Fatalf("SeekPrefixGE(%q, %q): got %v", prefix, key, ikey)
+					}
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if n := calls(); (n > 0) != c.seekFilter {
+					t.Fatalf("expected filter use by SeekPrefixGE to be %t, but found %d filter checks",
+						c.seekFilter, n)
+				}
+
+				// SeekPrefixLT finds every key in reverse, and uses the filter in the
+				// same way as SeekPrefixGE.
+				iter = r.NewIter(nil /* lower */, nil /* upper */)
+				for k := range wordCount {
+					// The successor of k has the same prefix as k.
+					key := []byte(k + "\x00")
+					prefix := key[:c.comparer.Split([]byte(k))]
+					if ikey, _ := iter.SeekPrefixLT(prefix, key); ikey == nil || string(ikey.UserKey) != k {
+						t.Fatalf("SeekPrefixLT(%q, %q): got %v", prefix, key, ikey)
+					}
+					if ikey, _ := iter.Prev(); ikey != nil && string(ikey.UserKey) >= k {
+						t.Fatalf("SeekPrefixLT(%q, %q): Prev got %v", prefix, key, ikey)
+					}
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if n := calls(); (n > 0) != c.seekFilter {
+					t.Fatalf("expected filter use by SeekPrefixLT to be %t, but found %d filter checks",
+						c.seekFilter, n)
+				}
+			}
+		})
+	}
+}
+
 func TestWriterRoundTrip(t *testing.T) {
 	for name, fp := range map[string]FilterPolicy{
 		"none":       nil,
@@ -592,7 +1026,7 @@ func TestFinalBlockIsWritten(t *testing.T) {
 				continue
 			}
 			r := NewReader(rf, 0, nil)
-			i := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+			i := NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
 			for valid := i.First(); valid; valid = i.Next() {
 				got++
 			}
@@ -624,7 +1058,7 @@ func TestReaderGlobalSeqNum(t *testing.T) {
 	const globalSeqNum = 42
 	r.Properties.GlobalSeqNum = globalSeqNum
 
-	i := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+	i := NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
 	for valid := i.First(); valid; valid = i.Next() {
 		if globalSeqNum != i.Key().SeqNum() {
 			t.Fatalf("expected %d, but found %d", globalSeqNum, i.Key().SeqNum())
@@ -639,50 +1073,165 @@ func TestFooterRoundTrip(t *testing.T) {
 		TableFormatLevelDB,
 	} {
 		t.Run(fmt.Sprintf("format=%d", format), func(t *testing.T) {
-			for _, checksum := range []uint8{checksumCRC32c} {
-				t.Run(fmt.Sprintf("checksum=%d", checksum), func(t *testing.T) {
-					footer := footer{
-						format:      format,
-						checksum:    checksum,
-						metaindexBH: blockHandle{offset: 1, length: 2},
-						indexBH:     blockHandle{offset: 3, length: 4},
-					}
-					for offset := range []int64{0, 1, 100} {
-						t.Run(fmt.Sprintf("offset=%d", offset), func(t *testing.T) {
-							mem := vfs.NewMem()
-							f, err := mem.Create("test")
-							if err != nil {
-								t.Fatal(err)
-							}
-							if _, err := f.Write(buf[:offset]); err != nil {
-								t.Fatal(err)
-							}
-							if _, err := f.Write(footer.encode(buf[100:])); err != nil {
-								t.Fatal(err)
-							}
-							if err := f.Close(); err != nil {
-								t.Fatal(err)
-							}
-
-							f, err = mem.Open("test")
-							if err != nil {
-								t.Fatal(err)
-							}
-							result, err := readFooter(f)
-							if err != nil {
-								t.Fatal(err)
-							}
-							if err := f.Close(); err != nil {
-								t.Fatal(err)
-							}
-
-							if diff := pretty.Diff(footer, result); diff != nil {
-								t.Fatalf("expected %+v, but found %+v\n%s",
-									footer, result, strings.Join(diff, "\n"))
-							}
-						})
+			for _, checksum := range []uint8{checksumCRC32c, checksumXXHash64} {
+				if checksum != checksumCRC32c && format == TableFormatLevelDB {
+					// The LevelDB footer cannot record the checksum type.
+					continue
+				}
+				for _, handleChecksum := range []bool{false, true} {
+					if handleChecksum && format == TableFormatLevelDB {
+						// The LevelDB footer cannot record a checksum.
+						continue
 					}
-				})
+					t.Run(fmt.Sprintf("checksum=%d,handleChecksum=%t", checksum, handleChecksum), func(t *testing.T) {
+						footer := footer{
+							format:         format,
+							checksum:       checksum,
+							metaindexBH:    blockHandle{offset: 1, length: 2},
+							indexBH:        blockHandle{offset: 3, length: 4},
+							handleChecksum: handleChecksum,
+						}
+						for offset := range []int64{0, 1, 100} {
+							t.Run(fmt.Sprintf("offset=%d", offset), func(t *testing.T) {
+								mem := vfs.NewMem()
+								f, err := mem.Create("test")
+								if err != nil {
+									t.Fatal(err)
+								}
+								if _, err := f.Write(buf[:offset]); err != nil {
+									t.Fatal(err)
+								}
+								if _, err := f.Write(footer.encode(buf[100:])); err != nil {
+									t.Fatal(err)
+								}
+								if err := f.Close(); err != nil {
+									t.Fatal(err)
+								}
+
+								f, err = mem.Open("test")
+								if err != nil {
+									t.Fatal(err)
+								}
+								result, err := readFooter(f)
+								if err != nil {
+									t.Fatal(err)
+								}
+								if err := f.Close(); err != nil {
+									t.Fatal(err)
+								}
+
+								if diff := pretty.Diff(footer, result); diff != nil {
+									t.Fatalf("expected %+v, but found %+v\n%s",
+										footer, result, strings.Join(diff, "\n"))
+								}
+							})
+						}
+					})
+				}
+			}
+		})
+	}
+}
+
+// TestRocksDBChecksumTypes decodes RocksDB tables using the CRC32c and the
+// xxHash64 checksum types, both of which use the 5 byte block trailer.
+func TestRocksDBChecksumTypes(t *testing.T) {
+	testCases := []struct {
+		filename string
+		checksum uint8
+	}{
+		{"h.no-compression.sst", checksumCRC32c},
+		{"h.xxhash64.no-compression.sst", checksumXXHash64},
+	}
+
+	var blocks [][]byte
+	for _, c := range testCases {
+		t.Run(c.filename, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.FromSlash("testdata/" + c.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mem := vfs.NewMem()
+			writeFile := func(name string, data []byte) vfs.File {
+				f, err := mem.Create(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+				f, err = mem.Open(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return f
+			}
+
+			f := writeFile("test", data)
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.checksumType != c.checksum {
+				t.Fatalf("expected checksum type %d, but found %d", c.checksum, r.checksumType)
+			}
+
+			// The data blocks are contiguous, each followed by its trailer. The
+			// contents of the data blocks do not depend on the checksum type.
+			index, err := r.readIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter := &blockIter{}
+			if err := iter.init(r.compare, index, 0 /* globalSeqNum */); err != nil {
+				t.Fatal(err)
+			}
+			var offset, firstEnd uint64
+			var i int
+			for _, val := iter.First(); val != nil; _, val = iter.Next() {
+				bh, _ := decodeBlockHandle(val)
+				if bh.offset != offset {
+					t.Fatalf("expected block %d at offset %d, but found %d", i, offset, bh.offset)
+				}
+				offset = bh.offset + bh.length + blockTrailerLen
+				if i == 0 {
+					firstEnd = offset
+				}
+				if typ := data[bh.offset+bh.length]; typ != noCompressionBlockType {
+					t.Fatalf("unexpected block type %d", typ)
+				}
+				block := data[bh.offset : bh.offset+bh.length]
+				if len(blocks) == i {
+					blocks = append(blocks, block)
+				} else if !bytes.Equal(blocks[i], block) {
+					t.Fatalf("block %d differs between the fixtures", i)
+				}
+				i++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if offset != r.Properties.DataSize || i != len(blocks) {
+				t.Fatalf("expected %d blocks of %d bytes, but found %d blocks of %d bytes",
+					len(blocks), r.Properties.DataSize, i, offset)
+			}
+
+			// Corrupting the last byte of the trailer of the first data block is
+			// detected, which requires the full trailer to be checksummed.
+			corrupt := append([]byte(nil), data...)
+			corrupt[firstEnd-1] ^= 0xff
+			cr := NewReader(writeFile("corrupt", corrupt), 0, nil)
+			defer cr.Close()
+			iter2 := cr.NewIter(nil /* lower */, nil /* upper */)
+			if key, _ := iter2.First(); key != nil {
+				t.Fatalf("expected checksum mismatch, but found %s", key)
+			}
+			if err := iter2.Close(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Fatalf("expected checksum mismatch, but found %v", err)
 			}
 		})
 	}
@@ -736,6 +1285,260 @@ func TestReadFooter(t *testing.T) {
 	}
 }
 
+func TestFooterChecksum(t *testing.T) {
+	mem := vfs.NewMem()
+	write := func(name string, checksum bool) []byte {
+		writeTestTable(t, mem, name, nil, TableOptions{FooterChecksum: checksum}, func(w *Writer) error {
+			for _, k := range []string{"a", "b", "c"} {
+				if err := w.Set([]byte(k), []byte(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, stat.Size())
+		if _, err := f.ReadAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	open := func(name string, data []byte) *Reader {
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f, 0, nil)
+	}
+
+	data := write("test", true)
+	footerBuf := data[len(data)-rocksDBFooterLen:]
+	version := binary.LittleEndian.Uint32(footerBuf[rocksDBVersionOffset:])
+	if expected := uint32(rocksDBFormatVersion2 | footerVersionHandleChecksum); version != expected {
+		t.Fatalf("expected footer version %#x, but found %#x", expected, version)
+	}
+	r := open("test", data)
+	if v, err := r.get([]byte("b")); err != nil || string(v) != "b" {
+		t.Fatalf("expected b, but found %q (%v)", v, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the offset of the index handle by flipping the low bit of its
+	// first varint byte.
+	_, n := decodeBlockHandle(footerBuf[1:])
+	footerBuf[1+n] ^= 1
+	r = open("corrupt", data)
+	const expected = "footer block handle checksum mismatch"
+	if r.err == nil || !strings.Contains(r.err.Error(), expected) {
+		t.Fatalf("expected %q, but found %v", expected, r.err)
+	}
+	if err := r.Close(); err == nil {
+		t.Fatalf("expected %q, but found success", expected)
+	}
+
+	// The padding of a footer without a checksum is not interpreted, whatever
+	// its contents.
+	data = write("unchecked", false)
+	footerBuf = data[len(data)-rocksDBFooterLen:]
+	_, n0 := decodeBlockHandle(footerBuf[1:])
+	_, n1 := decodeBlockHandle(footerBuf[1+n0:])
+	for i := 1 + n0 + n1; i < rocksDBVersionOffset; i++ {
+		footerBuf[i] = 0xfc
+	}
+	r = open("padded", data)
+	if v, err := r.get([]byte("b")); err != nil || string(v) != "b" {
+		t.Fatalf("expected b, but found %q (%v)", v, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The LevelDB footer cannot record the presence of a checksum.
+	f, err := mem.Create("leveldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, &Options{TableFormat: TableFormatLevelDB}, TableOptions{FooterChecksum: true})
+	const expectedErr = "footer checksums require the RocksDB table format"
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), expectedErr) {
+		t.Fatalf("expected %q, but found %v", expectedErr, err)
+	}
+}
+
+func TestReaderMaxBlockSize(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{}, func(w *Writer) error {
+		for _, k := range []string{"a", "b", "c"} {
+			if err := w.Set([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	f, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	ftr, err := readFooter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the footer with an index block handle claiming a 1 TB block.
+	ftr.indexBH.length = 1 << 40
+	copy(data[len(data)-rocksDBFooterLen:], ftr.encode(make([]byte, rocksDBFooterLen)))
+	f, err = mem.Create("corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"test", "corrupt"} {
+		t.Run(name, func(t *testing.T) {
+			f, err := mem.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, &Options{MaxBlockSize: 1 << 20})
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			var first string
+			if key, _ := iter.First(); key != nil {
+				first = string(key.UserKey)
+			}
+			err = iter.Close()
+			if name == "test" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if first != "a" {
+					t.Fatalf("expected a, but found %q", first)
+				}
+			} else {
+				const expected = "exceeds maximum"
+				if err == nil || !strings.Contains(err.Error(), expected) {
+					t.Fatalf("expected %q, but found %v", expected, err)
+				}
+			}
+			r.Close()
+		})
+	}
+}
+
+func TestFooterSize(t *testing.T) {
+	testCases := []struct {
+		format   TableFormat
+		expected int64
+	}{
+		{TableFormatLevelDB, 48},
+		{TableFormatRocksDBv2, 53},
+		{TableFormat(99), 0},
+	}
+	for _, c := range testCases {
+		if size := FooterSize(c.format); c.expected != size {
+			t.Fatalf("%d: expected %d, but found %d", c.format, c.expected, size)
+		}
+	}
+}
+
+func TestReadFooterExported(t *testing.T) {
+	for _, format := range []TableFormat{TableFormatLevelDB, TableFormatRocksDBv2} {
+		for _, checksum := range []bool{false, true} {
+			if checksum && format == TableFormatLevelDB {
+				continue
+			}
+			t.Run(fmt.Sprintf("format=%d,checksum=%t", format, checksum), func(t *testing.T) {
+				mem := vfs.NewMem()
+				o := &Options{TableFormat: format}
+				lo := TableOptions{FooterChecksum: checksum}
+				writeTestTable(t, mem, "test", o, lo, func(w *Writer) error {
+					for _, k := range []string{"a", "b", "c"} {
+						if err := w.Set([]byte(k), []byte(k)); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+
+				f, err := mem.Open("test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				stat, err := f.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ftr, err := ReadFooter(f, stat.Size())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ftr.Format != format {
+					t.Fatalf("expected format %d, but found %d", format, ftr.Format)
+				}
+				if ftr.HandleChecksum != checksum {
+					t.Fatalf("expected checksum %t, but found %t", checksum, ftr.HandleChecksum)
+				}
+				expected, err := readFooter(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ftr.MetaindexOffset != expected.metaindexBH.offset ||
+					ftr.MetaindexLength != expected.metaindexBH.length ||
+					ftr.IndexOffset != expected.indexBH.offset ||
+					ftr.IndexLength != expected.indexBH.length {
+					t.Fatalf("expected %+v, but found %+v", expected, ftr)
+				}
+				// The footer immediately follows the last block in the file.
+				end := ftr.IndexOffset + ftr.IndexLength + blockTrailerLen
+				if e := ftr.MetaindexOffset + ftr.MetaindexLength + blockTrailerLen; e > end {
+					end = e
+				}
+				if size := int64(end) + FooterSize(format); size != stat.Size() {
+					t.Fatalf("expected file size %d, but found %d", stat.Size(), size)
+				}
+			})
+		}
+	}
+}
+
 type errorPropCollector struct{}
 
 func (errorPropCollector) Add(key InternalKey, _ []byte) error {
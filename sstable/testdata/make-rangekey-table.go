@@ -0,0 +1,45 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build ignore
+
+// This program writes rangekey.sst using CockroachDB's Pebble, adding the same
+// point key and range keys as TestRangeKeyEncoding.
+//
+// To build and run, from a module requiring github.com/cockroachdb/pebble
+// v1.1.5:
+// go run make-rangekey-table.go rangekey.sst
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/cockroachdb/pebble/objstorage/objstorageprovider"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+func main() {
+	f, err := vfs.Default.Create(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := sstable.NewWriter(objstorageprovider.NewFileWritable(f), sstable.WriterOptions{
+		TableFormat: sstable.TableFormatPebblev2,
+	})
+	must := func(err error) {
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	must(w.Set([]byte("b"), []byte("point")))
+	must(w.RangeKeySet([]byte("a"), []byte("c"), []byte("@5"), []byte("v5")))
+	must(w.RangeKeySet([]byte("a"), []byte("c"), []byte("@3"), []byte("v3")))
+	must(w.RangeKeyUnset([]byte("a"), []byte("c"), []byte("@1")))
+	must(w.RangeKeyDelete([]byte("a"), []byte("c")))
+	must(w.RangeKeySet([]byte("b"), []byte("e"), []byte("@2"), []byte("v2")))
+	must(w.RangeKeyUnset([]byte("d"), []byte("f"), []byte("@4")))
+	must(w.Close())
+}
@@ -81,10 +81,11 @@ class KeyCountPropertyCollectorFactory : public rocksdb::TablePropertiesCollecto
 };
 
 int write() {
-  for (int i = 0; i < 9; ++i) {
+  for (int i = 0; i < 13; ++i) {
     rocksdb::Options options;
     rocksdb::BlockBasedTableOptions table_options;
     const char* outfile;
+    bool range_deletions = false;
 
     switch (i) {
       case 0:
@@ -168,6 +169,48 @@ int write() {
         table_options.whole_key_filtering = false;
         break;
 
+      // The following tables were written by RocksDB 6.29, whose shortened
+      // index separators have the kTypeDeletionWithTimestamp seek kind. That
+      // kind is larger than InternalKeyKindMax, so the separators are left
+      // unshortened.
+      case 9:
+        outfile = "h.xxhash64.no-compression.sst";
+        options.table_properties_collector_factories.emplace_back(
+            new KeyCountPropertyCollectorFactory);
+        options.compression = rocksdb::kNoCompression;
+        table_options.format_version = 2;
+        table_options.checksum = rocksdb::kxxHash64;
+        table_options.index_shortening = rocksdb::BlockBasedTableOptions::IndexShorteningMode::kNoShortening;
+        table_options.whole_key_filtering = false;
+        break;
+
+      case 10:
+        outfile = "h.zlib-dict.sst";
+        options.compression = rocksdb::kZlibCompression;
+        options.compression_opts.max_dict_bytes = 4096;
+        table_options.format_version = 2;
+        table_options.index_shortening = rocksdb::BlockBasedTableOptions::IndexShorteningMode::kNoShortening;
+        table_options.whole_key_filtering = false;
+        break;
+
+      case 11:
+        outfile = "h.zstd-dict.sst";
+        options.compression = rocksdb::kZSTD;
+        options.compression_opts.max_dict_bytes = 4096;
+        table_options.format_version = 2;
+        table_options.index_shortening = rocksdb::BlockBasedTableOptions::IndexShorteningMode::kNoShortening;
+        table_options.whole_key_filtering = false;
+        break;
+
+      case 12:
+        outfile = "h.range-del.sst";
+        options.compression = rocksdb::kNoCompression;
+        table_options.format_version = 2;
+        table_options.index_shortening = rocksdb::BlockBasedTableOptions::IndexShorteningMode::kNoShortening;
+        table_options.whole_key_filtering = false;
+        range_deletions = true;
+        break;
+
       default:
         continue;
     }
@@ -188,6 +231,10 @@ int write() {
       val = val.substr(1 + val.rfind(' '));
       tb->Put(key.c_str(), val.c_str());
     }
+    if (range_deletions) {
+      tb->DeleteRange("c", "d");
+      tb->DeleteRange("p", "q");
+    }
 
     rocksdb::ExternalSstFileInfo info;
     status = tb->Finish(&info);
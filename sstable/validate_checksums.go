@@ -0,0 +1,118 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ChecksumMismatchError is returned by Reader.ValidateChecksums if the checksum
+// in the trailer of a block does not match the contents of the block.
+type ChecksumMismatchError struct {
+	// Offset and Length locate the corrupted block in the table, excluding the
+	// block trailer.
+	Offset uint64
+	Length uint64
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("pebble/table: invalid table (checksum mismatch in block %d/%d)",
+		e.Offset, e.Length)
+}
+
+// ValidateChecksums reads every block of the table from the file and verifies
+// the checksum in its trailer, such as to detect bit rot in a table which is
+// rarely read. The metaindex and index blocks are verified first, as they
+// locate the remaining blocks. The data blocks and the meta blocks, including
+// the filter and properties blocks, are then verified in order of offset. A
+// *ChecksumMismatchError locating the first corrupted block found is returned.
+//
+// Unlike iteration, every block is read, including the blocks which no seek
+// would read, and the blocks are read from the file even if they are present
+// in the block cache. The blocks are neither decompressed nor cached. A Reader
+// created by NewReaderMeta may also validate the checksums of the table.
+func (r *Reader) ValidateChecksums() error {
+	if r.err != nil {
+		return r.err
+	}
+	var buf []byte
+	validate := func(bh blockHandle) error {
+		if err := r.checkBlockSize(bh.length + blockTrailerLen); err != nil {
+			return err
+		}
+		n := int(bh.length + blockTrailerLen)
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := r.file.ReadAt(buf, int64(bh.offset)); err != nil {
+			return err
+		}
+		if !r.verifyChecksum(buf[:bh.length+1], buf[bh.length+1:]) {
+			return &ChecksumMismatchError{Offset: bh.offset, Length: bh.length}
+		}
+		return nil
+	}
+
+	if err := validate(r.metaindexBH); err != nil {
+		return err
+	}
+	if err := validate(r.index.bh); err != nil {
+		return err
+	}
+
+	meta, err := r.readMetaindexHandles()
+	if err != nil {
+		return err
+	}
+	var handles []blockHandle
+	for _, bh := range meta {
+		handles = append(handles, bh)
+	}
+	var indexBlock block
+	if r.metaOnly {
+		// A Reader created by NewReaderMeta does not cache the index block, so
+		// it is read from the file and released once the handles are decoded.
+		h, err := r.readBlockInternal(nil /* cache */, r.index.bh,
+			nil /* transform */, nil /* readahead */, nil /* stats */)
+		if err != nil {
+			return err
+		}
+		defer h.Release()
+		if indexBlock, err = r.trimEmbeddedFilter(h.Get()); err != nil {
+			return err
+		}
+	} else if indexBlock, err = r.readIndex(); err != nil {
+		return err
+	}
+	var index blockIter
+	if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+		return err
+	}
+	for key, value := index.First(); key != nil; key, value = index.Next() {
+		if handles, err = r.decodeIndexEntry(handles, value); err != nil {
+			index.Close()
+			return err
+		}
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+
+	sort.Slice(handles, func(i, j int) bool {
+		return handles[i].offset < handles[j].offset
+	})
+	for i, bh := range handles {
+		// The v1 and v2 range-del metaindex entries share a block.
+		if i > 0 && bh == handles[i-1] {
+			continue
+		}
+		if err := validate(bh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestValidateChecksumsFixtures(t *testing.T) {
+	for _, name := range []string{
+		"h.sst",
+		"h.ldb",
+		"h.no-compression.sst",
+		"h.table-bloom.no-compression.sst",
+		"h.xxhash64.no-compression.sst",
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if err := r.ValidateChecksums(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestValidateChecksums(t *testing.T) {
+	fp := bloom.FilterPolicy(10)
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 128, FilterPolicy: fp}, func(w *Writer) error {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("%03d", i))
+			if err := w.Set(key, key); err != nil {
+				return err
+			}
+		}
+		return w.AddRangeDel([]byte("050"), []byte("100"), 0)
+	})
+	f, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Options{
+		Cache:  cache.New(1 << 20),
+		Levels: []TableOptions{{FilterPolicy: fp}},
+	}
+	r := NewReaderSize(bytes.NewReader(data), int64(len(data)), 0, o)
+	if err := r.ValidateChecksums(); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := r.readMetaindexHandles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexBlock, err := r.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index blockIter
+	if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+		t.Fatal(err)
+	}
+	var dataBlocks []blockHandle
+	for key, value := index.First(); key != nil; key, value = index.Next() {
+		bh, _ := decodeBlockHandle(value)
+		dataBlocks = append(dataBlocks, bh)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	metaReader := NewReaderMeta(f, o)
+	if err := metaReader.ValidateChecksums(); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaReader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(dataBlocks) < 3 {
+		t.Fatalf("expected at least 3 data blocks, but found %d", len(dataBlocks))
+	}
+
+	for _, c := range []struct {
+		name string
+		bh   blockHandle
+		// metaOnly is true if the corruption is found by ValidateChecksums
+		// on a Reader created by NewReaderMeta, rather than when the Reader
+		// reads the properties.
+		metaOnly bool
+	}{
+		{"first-data-block", dataBlocks[0], true},
+		{"data-block", dataBlocks[len(dataBlocks)/2], true},
+		{"filter", meta["fullfilter."+fp.Name()], true},
+		{"range-del", meta[metaRangeDelV2Name], true},
+		{"properties", meta[metaPropertiesName], false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			bh := c.bh
+			if bh.length == 0 {
+				t.Fatalf("block not found")
+			}
+
+			// Corrupt the last byte of the block, leaving the trailer intact.
+			corrupt := append([]byte(nil), data...)
+			corrupt[bh.offset+bh.length-1] ^= 0xff
+			// The block cache of the Reader holds the uncorrupted blocks, which
+			// do not hide the corruption.
+			r := NewReaderSize(bytes.NewReader(corrupt), int64(len(corrupt)), 0, o)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			err := r.ValidateChecksums()
+			var mismatch *ChecksumMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected checksum mismatch, but found %v", err)
+			}
+			if mismatch.Offset != bh.offset || mismatch.Length != bh.length {
+				t.Fatalf("expected mismatch in block %d/%d, but found %d/%d",
+					bh.offset, bh.length, mismatch.Offset, mismatch.Length)
+			}
+			if !c.metaOnly {
+				return
+			}
+
+			mf, err := mem.Create(c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := mf.Write(corrupt); err != nil {
+				t.Fatal(err)
+			}
+			if err := mf.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if mf, err = mem.Open(c.name); err != nil {
+				t.Fatal(err)
+			}
+			metaReader := NewReaderMeta(mf, o)
+			defer metaReader.Close()
+			if metaReader.err != nil {
+				t.Fatal(metaReader.err)
+			}
+			err = metaReader.ValidateChecksums()
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected checksum mismatch, but found %v", err)
+			}
+			if mismatch.Offset != bh.offset || mismatch.Length != bh.length {
+				t.Fatalf("expected mismatch in block %d/%d, but found %d/%d",
+					bh.offset, bh.length, mismatch.Offset, mismatch.Length)
+			}
+		})
+	}
+}
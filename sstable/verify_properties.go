@@ -0,0 +1,190 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// PropertyMismatch describes a table property whose recorded value differs
+// from the value derived from the contents of the table.
+type PropertyMismatch struct {
+	// Name is the name of the property, such as "rocksdb.num.entries".
+	Name     string
+	Recorded uint64
+	Actual   uint64
+}
+
+func (m PropertyMismatch) String() string {
+	return fmt.Sprintf("%s: recorded %d, actual %d", m.Name, m.Recorded, m.Actual)
+}
+
+// PropertiesMismatchError is returned by Reader.VerifyAgainstProperties if the
+// contents of a table do not match its recorded properties.
+type PropertiesMismatchError struct {
+	Mismatches []PropertyMismatch
+}
+
+func (e *PropertiesMismatchError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("pebble/table: table does not match its properties: ")
+	for i, m := range e.Mismatches {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(m.String())
+	}
+	return buf.String()
+}
+
+// VerifyAgainstProperties scans the table and verifies that its contents match
+// the counts and sizes recorded in its properties: the number of point
+// entries, point deletions and merge operands, the raw key and value sizes,
+// the number of range deletions and range keys, and the number and total size
+// of the data blocks. If any property does not match, a
+// *PropertiesMismatchError listing every mismatch is returned. A mismatch
+// indicates a bug in the writer of the table, or corruption which was not
+// detected by the block checksums. Every block of the table is read, so
+// VerifyAgainstProperties is as expensive as a full scan.
+//
+// The table does not record its smallest and largest keys or its range of
+// sequence numbers as properties, so these are not verified.
+func (r *Reader) VerifyAgainstProperties() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.view {
+		return errors.New("pebble/table: cannot verify the properties of a view")
+	}
+
+	var actual Properties
+	indexBlock, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+	var index blockIter
+	if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+		return err
+	}
+	var group []blockHandle
+	for key, value := index.First(); key != nil; key, value = index.Next() {
+		if group, err = r.decodeIndexEntry(group[:0], value); err != nil {
+			index.Close()
+			return err
+		}
+		for _, bh := range group {
+			if err := r.verifyDataBlock(bh, &actual); err != nil {
+				index.Close()
+				return err
+			}
+		}
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+
+	if r.rangeDel.bh.length != 0 {
+		// The tombstones are counted as they were written, before any
+		// fragmentation of a legacy range-del block by the Reader.
+		h, err := r.readMetaBlock(r.rangeDel.bh, nil /* transform */)
+		if err != nil {
+			return err
+		}
+		err = countBlockEntries(r, h.Get(), func(*InternalKey, []byte) {
+			actual.NumRangeDeletions++
+		})
+		h.Release()
+		if err != nil {
+			return err
+		}
+	}
+	if r.rangeKey.bh.length != 0 {
+		b, err := r.readRangeKey()
+		if err != nil {
+			return err
+		}
+		err = countBlockEntries(r, b, func(key *InternalKey, _ []byte) {
+			switch key.Kind() {
+			case InternalKeyKindRangeKeyDelete:
+				actual.NumRangeKeyDels++
+			case InternalKeyKindRangeKeyUnset:
+				actual.NumRangeKeyUnsets++
+			case InternalKeyKindRangeKeySet:
+				actual.NumRangeKeySets++
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	recorded := &r.Properties
+	var mismatches []PropertyMismatch
+	check := func(offset uintptr, recorded, actual uint64) {
+		if recorded != actual {
+			mismatches = append(mismatches, PropertyMismatch{
+				Name:     propOffsetTagMap[offset],
+				Recorded: recorded,
+				Actual:   actual,
+			})
+		}
+	}
+	check(unsafe.Offsetof(recorded.DataSize), recorded.DataSize, actual.DataSize)
+	check(unsafe.Offsetof(recorded.NumDataBlocks), recorded.NumDataBlocks, actual.NumDataBlocks)
+	check(unsafe.Offsetof(recorded.NumDeletions), recorded.NumDeletions, actual.NumDeletions)
+	check(unsafe.Offsetof(recorded.NumEntries), recorded.NumEntries, actual.NumEntries)
+	check(unsafe.Offsetof(recorded.NumMergeOperands), recorded.NumMergeOperands, actual.NumMergeOperands)
+	check(unsafe.Offsetof(recorded.NumRangeDeletions), recorded.NumRangeDeletions, actual.NumRangeDeletions)
+	check(unsafe.Offsetof(recorded.NumRangeKeyDels), recorded.NumRangeKeyDels, actual.NumRangeKeyDels)
+	check(unsafe.Offsetof(recorded.NumRangeKeySets), recorded.NumRangeKeySets, actual.NumRangeKeySets)
+	check(unsafe.Offsetof(recorded.NumRangeKeyUnsets), recorded.NumRangeKeyUnsets, actual.NumRangeKeyUnsets)
+	check(unsafe.Offsetof(recorded.RawKeySize), recorded.RawKeySize, actual.RawKeySize)
+	check(unsafe.Offsetof(recorded.RawValueSize), recorded.RawValueSize, actual.RawValueSize)
+	if len(mismatches) > 0 {
+		return &PropertiesMismatchError{Mismatches: mismatches}
+	}
+	return nil
+}
+
+// verifyDataBlock reads the data block bh, accumulating the properties derived
+// from its entries into props.
+func (r *Reader) verifyDataBlock(bh blockHandle, props *Properties) error {
+	h, err := r.readBlock(bh, nil /* transform */, nil /* readahead */, nil /* stats */)
+	if err != nil {
+		return err
+	}
+	defer h.Release()
+	props.NumDataBlocks++
+	// The data blocks are written contiguously from the start of the file.
+	if end := bh.offset + bh.length + blockTrailerLen; end > props.DataSize {
+		props.DataSize = end
+	}
+	return countBlockEntries(r, h.Get(), func(key *InternalKey, value []byte) {
+		props.NumEntries++
+		switch key.Kind() {
+		case InternalKeyKindDelete:
+			props.NumDeletions++
+		case InternalKeyKindMerge:
+			props.NumMergeOperands++
+		}
+		props.RawKeySize += uint64(key.Size())
+		props.RawValueSize += uint64(len(value))
+	})
+}
+
+// countBlockEntries calls fn for each entry of the block b.
+func countBlockEntries(r *Reader, b block, fn func(key *InternalKey, value []byte)) error {
+	var iter blockIter
+	if err := iter.init(r.compare, b, 0 /* globalSeqNum */); err != nil {
+		return err
+	}
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		fn(key, value)
+	}
+	return iter.Close()
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestVerifyAgainstPropertiesFixtures(t *testing.T) {
+	// The pre-made tables, including those written by RocksDB, match their
+	// properties.
+	for _, name := range []string{
+		"h.sst",
+		"h.ldb",
+		"h.no-compression.sst",
+		"h.table-bloom.no-compression.sst",
+		"h.xxhash64.no-compression.sst",
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if err := r.VerifyAgainstProperties(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestVerifyAgainstProperties(t *testing.T) {
+	mem := vfs.NewMem()
+	// build writes a table holding entries of each kind, applying tamper to the
+	// properties of the Writer before the table is finished.
+	build := func(tamper func(p *Properties)) *Reader {
+		writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 128}, func(w *Writer) error {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("%03d", i))
+				var err error
+				switch i % 3 {
+				case 0:
+					err = w.Set(key, []byte(fmt.Sprintf("value-%d", i)))
+				case 1:
+					err = w.Delete(key)
+				case 2:
+					err = w.Merge(key, []byte("operand"))
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if err := w.DeleteRange([]byte("010"), []byte("020")); err != nil {
+				return err
+			}
+			if err := w.RangeKeySet([]byte("a"), []byte("c"), nil, []byte("v")); err != nil {
+				return err
+			}
+			if err := w.RangeKeyDelete([]byte("b"), []byte("d")); err != nil {
+				return err
+			}
+			if tamper != nil {
+				tamper(&w.props)
+			}
+			return nil
+		})
+		r := openTestTable(t, mem, "test", nil)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	}
+
+	r := build(nil)
+	if err := r.VerifyAgainstProperties(); err != nil {
+		t.Fatal(err)
+	}
+	// A view cannot be verified, as its properties describe the whole table.
+	if err := r.View([]byte("010"), []byte("020")).VerifyAgainstProperties(); err == nil {
+		t.Fatalf("expected an error verifying a view")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A table whose properties are deliberately inconsistent with its
+	// contents reports every mismatch.
+	r = build(func(p *Properties) {
+		p.NumEntries++
+		p.NumDeletions--
+		p.RawValueSize += 10
+		p.NumRangeDeletions = 5
+	})
+	defer r.Close()
+	err := r.VerifyAgainstProperties()
+	mismatchErr, ok := err.(*PropertiesMismatchError)
+	if !ok {
+		t.Fatalf("expected a properties mismatch error, but found %v", err)
+	}
+	expected := []PropertyMismatch{
+		{Name: "rocksdb.deleted.keys", Recorded: 32, Actual: 33},
+		{Name: "rocksdb.num.entries", Recorded: 101, Actual: 100},
+		{Name: "rocksdb.num.range-deletions", Recorded: 5, Actual: 1},
+		{Name: "rocksdb.raw.value.size", Recorded: r.Properties.RawValueSize, Actual: r.Properties.RawValueSize - 10},
+	}
+	if !reflect.DeepEqual(expected, mismatchErr.Mismatches) {
+		t.Fatalf("expected mismatches\n%v\nbut found\n%v", expected, mismatchErr.Mismatches)
+	}
+}
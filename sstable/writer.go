@@ -12,11 +12,15 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
+	"strings"
 
 	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/internal/base"
 	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/internal/rangedel"
+	"github.com/petermattis/pebble/internal/xxhash"
+	"github.com/petermattis/pebble/vfs"
 )
 
 // WriterMetadata holds info about a finished sstable.
@@ -28,6 +32,8 @@ type WriterMetadata struct {
 	LargestRange   InternalKey
 	SmallestSeqNum uint64
 	LargestSeqNum  uint64
+	// LargestValueSize is the length of the largest value of a point entry.
+	LargestValueSize uint64
 }
 
 func (m *WriterMetadata) updateSeqNum(seqNum uint64) {
@@ -73,6 +79,15 @@ func (m *WriterMetadata) Largest(cmp Compare) InternalKey {
 	return m.LargestRange
 }
 
+// dataBlockSummary holds the smallest and largest user keys in a data block
+// along with the size of the block, including the block trailer.
+type dataBlockSummary struct {
+	bh       blockHandle
+	smallest []byte
+	largest  []byte
+	size     uint64
+}
+
 type flusher interface {
 	Flush() error
 }
@@ -83,6 +98,20 @@ type writeCloseSyncer interface {
 }
 
 // Writer is a table writer.
+//
+// The table produced by a Writer is a deterministic function of the keys and
+// values added and the options the Writer was created with: blocks are written
+// in key order and the properties block is serialized in sorted order of the
+// property names, including user properties. Building the same input twice,
+// whether serially or concurrently with other Writers, produces byte-identical
+// tables.
+//
+// The table is written sequentially: the Writer never seeks or rewrites an
+// earlier part of the file. The properties block, which holds counts that are
+// only known once all of the entries have been added, is written after the data,
+// filter and index blocks, and is located through the metaindex and footer
+// which follow it. The file may therefore be a sink which does not support
+// seeking, such as a network connection.
 type Writer struct {
 	writer    io.Writer
 	bufWriter *bufio.Writer
@@ -92,36 +121,112 @@ type Writer struct {
 	// The following fields are copied from Options.
 	blockSize          int
 	blockSizeThreshold int
+	maxKeysPerBlock    int
 	compare            Compare
 	split              Split
 	compression        Compression
 	separator          Separator
 	successor          Successor
 	tableFormat        TableFormat
+	footerChecksum     bool
+	disableSyncOnClose bool
+	recordLargestValue bool
+	// The size below which the filter and the index are written as a single
+	// block. See TableOptions.FilterEmbedThreshold.
+	filterEmbedThreshold int
+	// The minimum compression ratio of the first compressionSampleBlocks data
+	// blocks below which the remaining blocks are written uncompressed. The
+	// uncompressed and stored sizes of the sampled blocks are accumulated in
+	// sampledRawSize and sampledStoredSize.
+	minCompressionRatio float64
+	sampledBlocks       int
+	sampledRawSize      uint64
+	sampledStoredSize   uint64
 	// Internal flag to allow creation of range-del-v1 format blocks. Only used
 	// for testing. Note that v2 format blocks are backwards compatible with v1
 	// format blocks.
 	rangeDelV1Format bool
+	// The checksum type of the blocks (see TableOptions.ChecksumType).
+	checksumType uint8
 	// A table is a series of blocks and a block's index entry contains a
 	// separator key between one block and the next. Thus, a finished block
 	// cannot be written until the first key in the next block is seen.
 	// pendingBH is the blockHandle of a finished block that is waiting for
 	// the next call to Set. If the writer is not in this state, pendingBH
 	// is zero.
-	pendingBH      blockHandle
-	block          blockWriter
-	indexBlock     blockWriter
-	rangeDelBlock  blockWriter
+	pendingBH     blockHandle
+	block         blockWriter
+	indexBlock    blockWriter
+	rangeDelBlock blockWriter
+	// indexSparsity is the number of data blocks covered by each index entry.
+	// indexGroup holds the handles of the finished data blocks not yet added
+	// to the index, and indexEntryBuf is the re-used buffer for encoding the
+	// index entry for the group. numDataBlocks is the number of data blocks
+	// added to the index.
+	indexSparsity int
+	indexGroup    []blockHandle
+	indexEntryBuf []byte
+	numDataBlocks int
+	// indexFirstKeys is true if the index entries are keyed by the first key
+	// of the group of blocks they cover (see TableOptions.IndexFirstKeys),
+	// which is held in indexFirstKey until the entry is added.
+	indexFirstKeys bool
+	indexFirstKey  InternalKey
+	// rangeKeys accumulates the range keys, which are fragmented and written
+	// to the range-key block when the table is finished.
+	rangeKeys      rangeKeyFragmenter
 	props          Properties
 	propCollectors []TablePropertyCollector
-	// compressedBuf is the destination buffer for snappy compression. It is
+	// dataBlocks records the user key bounds and on-disk size of each finished
+	// data block. It is used to estimate the number of bytes covered by range
+	// tombstones when the table is finished. blockFirstKey is the first user
+	// key in the current data block.
+	dataBlocks    []dataBlockSummary
+	blockFirstKey []byte
+	// userKeyIndexBlock maps the first user key of each data block to the
+	// block's handle. Nil unless TableOptions.UserKeyIndex is set.
+	userKeyIndexBlock *rawBlockWriter
+	// blockKeyRanges is true if the key ranges of the data blocks are written
+	// to a meta block (see TableOptions.BlockKeyRanges).
+	blockKeyRanges bool
+	// prefixMap holds the range of index entries containing the keys of each
+	// distinct prefix seen so far, in order. prefixMapThreshold is the maximum
+	// number of prefixes, and is zero if the prefix map is disabled or has been
+	// abandoned because the threshold was exceeded.
+	prefixMap          []prefixMapEntry
+	prefixMapThreshold int
+	// cfRanges holds the range of keys of each column family added by AddCF,
+	// in order. cfKeyBuf is the re-used buffer for the prefixed keys.
+	cfRanges []cfRange
+	cfKeyBuf []byte
+	// metaBlocks holds the meta blocks added by AddMetaBlock, which are written
+	// when the table is finished.
+	metaBlocks []namedMetaBlock
+	// compressKey, if non-nil, compresses the user keys stored in the data
+	// blocks (see Comparer.CompressKey). The data block then holds compressed
+	// keys, so lastKey holds the encoded, uncompressed last key added to the
+	// block, and keyBuf is the re-used buffer for the compressed keys.
+	compressKey CompressKey
+	lastKey     []byte
+	keyBuf      []byte
+	// compressedBuf is the destination buffer for block compression. It is
 	// re-used over the lifetime of the writer, avoiding the allocation of a
 	// temporary buffer for each block.
 	compressedBuf []byte
+	// cipher, if non-nil, encrypts each block after compression. sealedBuf is
+	// the re-used destination buffer for the encrypted blocks.
+	cipher    TableCipher
+	sealedBuf []byte
 	// filter accumulates the filter block. If populated, the filter ingests
 	// either the output of w.split (i.e. a prefix extractor) if w.split is not
 	// nil, or the full keys otherwise.
 	filter filterWriter
+	// opts and filterPolicy are the options and the filter policy the Writer
+	// was created with, which configure the Reader returned by Finish.
+	// finished is populated once the table has been finished.
+	opts         *Options
+	filterPolicy FilterPolicy
+	finished     *finishedTable
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
 	// blockTrailerLen bytes, or (5 * binary.MaxVarintLen64) bytes.
 	tmp [rocksDBFooterLen]byte
@@ -164,6 +269,210 @@ func (w *Writer) DeleteRange(start, end []byte) error {
 	return w.addTombstone(base.MakeInternalKey(start, 0, InternalKeyKindRangeDelete), end)
 }
 
+// AddRangeDel adds a range tombstone deleting the keys in the range
+// [start,end) with sequence numbers less than seqNum. The tombstones are
+// written to the range-del block of the table, separately from the point
+// entries, and are returned by Reader.NewRangeDelIter. As with Add, the
+// tombstones must be fragmented and added in order, independently of the
+// point entries. If the table is ingested with a global sequence number, the
+// sequence numbers of the tombstones are replaced by it when read, in the same
+// way as those of the point entries.
+func (w *Writer) AddRangeDel(start, end []byte, seqNum uint64) error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.addTombstone(base.MakeInternalKey(start, seqNum, InternalKeyKindRangeDelete), end)
+}
+
+// RangeKeySet sets the range key for the span [start,end) at the specified
+// suffix to value. The sequence number is set to 0. Range keys may overlap and
+// may be added in any order, independently of the point entries and range
+// deletions. They are fragmented when the table is finished. Intended for use
+// to externally construct an sstable before ingestion into a DB.
+func (w *Writer) RangeKeySet(start, end, suffix, value []byte) error {
+	return w.addRangeKey(RangeKey{
+		Start:        base.MakeInternalKey(start, 0, InternalKeyKindRangeKeySet),
+		End:          end,
+		SuffixValues: []SuffixValue{{Suffix: suffix, Value: value}},
+	})
+}
+
+// RangeKeyUnset removes the range key for the span [start,end) at the
+// specified suffix. The sequence number is set to 0. See RangeKeySet.
+func (w *Writer) RangeKeyUnset(start, end, suffix []byte) error {
+	return w.addRangeKey(RangeKey{
+		Start:        base.MakeInternalKey(start, 0, InternalKeyKindRangeKeyUnset),
+		End:          end,
+		SuffixValues: []SuffixValue{{Suffix: suffix}},
+	})
+}
+
+// RangeKeyDelete deletes all of the range keys in the span [start,end). The
+// sequence number is set to 0. See RangeKeySet.
+func (w *Writer) RangeKeyDelete(start, end []byte) error {
+	return w.addRangeKey(RangeKey{
+		Start: base.MakeInternalKey(start, 0, InternalKeyKindRangeKeyDelete),
+		End:   end,
+	})
+}
+
+// AddRangeKey adds a range key entry, whose value is encoded as described by
+// EncodeRangeKeyValue. Unlike Add, range keys need not be added in order or be
+// fragmented.
+func (w *Writer) AddRangeKey(key InternalKey, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	k, err := DecodeRangeKey(key, value)
+	if err != nil {
+		w.err = err
+		return w.err
+	}
+	return w.addRangeKey(k)
+}
+
+func (w *Writer) addRangeKey(k RangeKey) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.compare(k.Start.UserKey, k.End) >= 0 {
+		w.err = fmt.Errorf("pebble: invalid range key span: %s", k)
+		return w.err
+	}
+	// The range keys are retained until the table is finished, so copy them.
+	k.Start = k.Start.Clone()
+	k.End = append([]byte(nil), k.End...)
+	suffixValues := make([]SuffixValue, len(k.SuffixValues))
+	for i, sv := range k.SuffixValues {
+		suffixValues[i] = SuffixValue{
+			Suffix: append([]byte(nil), sv.Suffix...),
+			Value:  append([]byte(nil), sv.Value...),
+		}
+	}
+	k.SuffixValues = suffixValues
+	w.meta.updateSeqNum(k.Start.SeqNum())
+	w.rangeKeys.add(k)
+	return nil
+}
+
+// AddTombstoneCoveringTable adds a single range deletion tombstone with the
+// specified sequence number which covers every key in the table read by r,
+// including the span of the range tombstones in r. The bounds of r are found
+// by positioning at the first and last keys of r and its range deletion block,
+// without enumerating the keys of r. This allows a compaction to record that an
+// input table is entirely shadowed by a range deletion without re-emitting its
+// contents. Nothing is added if r is empty.
+//
+// The end key of a tombstone is exclusive. If the largest key in r is a point
+// key, the end key of the tombstone is its immediate successor, formed by
+// appending a zero byte. This requires a comparer for which that is the
+// immediate successor, such as the default bytewise comparer.
+func (w *Writer) AddTombstoneCoveringTable(r *Reader, seqNum uint64) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	var start, end []byte
+	var found bool
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	if key, _ := iter.First(); key != nil {
+		found = true
+		start = append(start, key.UserKey...)
+		key, _ = iter.Last()
+		end = append(append(end, key.UserKey...), 0)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if rangeDelIter := r.NewRangeDelIter(); rangeDelIter != nil {
+		if key, _ := rangeDelIter.First(); key != nil {
+			if !found || w.compare(key.UserKey, start) < 0 {
+				start = append(start[:0], key.UserKey...)
+			}
+			// The tombstones are fragmented and sorted by start key, so the last
+			// tombstone has the largest end key.
+			_, value := rangeDelIter.Last()
+			if !found || w.compare(value, end) > 0 {
+				end = append(end[:0], value...)
+			}
+			found = true
+		}
+		if err := rangeDelIter.Close(); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return w.addTombstone(base.MakeInternalKey(start, seqNum, InternalKeyKindRangeDelete), end)
+}
+
+// InternalIterator is the subset of the internal iterator interface used by
+// BuildTable to iterate over the entries of a table.
+type InternalIterator interface {
+	First() (*InternalKey, []byte)
+	Next() (*InternalKey, []byte)
+	Error() error
+}
+
+// BuildTable adds all of the entries of iter to w. The entries must be in
+// strictly increasing internal key order, which is validated. Range deletion
+// tombstones in iter are fragmented before being added, so they may overlap
+// each other. Neither w nor iter is closed.
+func BuildTable(w *Writer, iter InternalIterator) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	var err error
+	frag := rangedel.Fragmenter{
+		Cmp: w.compare,
+		Emit: func(fragmented []rangedel.Tombstone) {
+			for _, t := range fragmented {
+				if err == nil {
+					err = w.Add(t.Start, t.End)
+				}
+			}
+		},
+	}
+
+	// NB: the previous key is saved as the memory backing a key returned by
+	// iter may change on the next call to Next.
+	var prevKey InternalKey
+	var prevKeyBuf []byte
+	var hasPrev bool
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		if hasPrev && base.InternalCompare(w.compare, prevKey, *key) >= 0 {
+			err = fmt.Errorf("pebble: keys must be added in order: %s, %s", prevKey, key)
+			break
+		}
+		prevKeyBuf = append(prevKeyBuf[:0], key.UserKey...)
+		prevKey = InternalKey{UserKey: prevKeyBuf, Trailer: key.Trailer}
+		hasPrev = true
+
+		if key.Kind() == InternalKeyKindRangeDelete {
+			// The fragmenter holds on to the tombstone until it is flushed, and
+			// may emit previously added tombstones, setting err.
+			frag.Add(key.Clone(), append([]byte(nil), value...))
+		} else {
+			err = w.Add(*key, value)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = iter.Error()
+	}
+	if err != nil {
+		return err
+	}
+	frag.Finish()
+	return err
+}
+
 // Merge adds an action to the DB that merges the value at key with the new
 // value. The details of the merge are dependent upon the configured merge
 // operator. The sequence number is set to 0. Intended for use to externally
@@ -183,6 +492,10 @@ func (w *Writer) Merge(key, value []byte) error {
 // added ordered by their start key, but they can be added out of order from
 // point entries. Additionally, range deletion tombstones must be fragmented
 // (i.e. by rangedel.Fragmenter).
+//
+// A nil value is written identically to a zero-length value, and both are read
+// back as an empty, non-nil value. The kind of the key, rather than the value,
+// distinguishes a SET of an empty value from a DELETE.
 func (w *Writer) Add(key InternalKey, value []byte) error {
 	if w.err != nil {
 		return w.err
@@ -191,6 +504,9 @@ func (w *Writer) Add(key InternalKey, value []byte) error {
 	if key.Kind() == InternalKeyKindRangeDelete {
 		return w.addTombstone(key, value)
 	}
+	if isRangeKey(key.Kind()) {
+		return w.AddRangeKey(key, value)
+	}
 	return w.addPoint(key, value)
 }
 
@@ -203,6 +519,12 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 	if err := w.maybeFlush(key, value); err != nil {
 		return err
 	}
+	w.maybeAddToPrefixMap(key.UserKey)
+	if w.indexFirstKeys && w.block.nEntries == 0 && len(w.indexGroup) == 0 {
+		// The key is the first key of a new group of blocks.
+		w.indexFirstKey.UserKey = append(w.indexFirstKey.UserKey[:0], key.UserKey...)
+		w.indexFirstKey.Trailer = key.Trailer
+	}
 
 	for i := range w.propCollectors {
 		if err := w.propCollectors[i].Add(key, value); err != nil {
@@ -218,19 +540,46 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 	if w.props.NumEntries == 0 {
 		w.meta.SmallestPoint = key.Clone()
 	}
+	if w.block.nEntries == 0 {
+		w.blockFirstKey = append(w.blockFirstKey[:0], key.UserKey...)
+	}
 	w.props.NumEntries++
 	switch key.Kind() {
 	case InternalKeyKindDelete:
 		w.props.NumDeletions++
+		w.props.RawPointTombstoneKeySize += uint64(key.Size())
 	case InternalKeyKindMerge:
 		w.props.NumMergeOperands++
 	}
 	w.props.RawKeySize += uint64(key.Size())
 	w.props.RawValueSize += uint64(len(value))
+	if n := uint64(len(value)); n > w.meta.LargestValueSize {
+		w.meta.LargestValueSize = n
+	}
+	if w.compressKey != nil {
+		size := key.Size()
+		if cap(w.lastKey) < size {
+			w.lastKey = make([]byte, 0, size*2)
+		}
+		w.lastKey = w.lastKey[:size]
+		key.Encode(w.lastKey)
+		w.keyBuf = w.compressKey(w.keyBuf[:0], key.UserKey)
+		key.UserKey = w.keyBuf
+	}
 	w.block.add(key, value)
 	return nil
 }
 
+// blockLastKey returns the last key added to the current data block. Note that
+// finishing a block does not reset it, so it still holds the last key in the
+// finished block.
+func (w *Writer) blockLastKey() InternalKey {
+	if w.compressKey != nil {
+		return base.DecodeInternalKey(w.lastKey)
+	}
+	return base.DecodeInternalKey(w.block.curKey)
+}
+
 func (w *Writer) addTombstone(key InternalKey, value []byte) error {
 	if !w.rangeDelV1Format && w.rangeDelBlock.nEntries > 0 {
 		// Check that tombstones are being added in fragmented order. If the two
@@ -299,13 +648,19 @@ func (w *Writer) maybeAddToFilter(key []byte) {
 	}
 }
 
-func (w *Writer) maybeFlush(key InternalKey, value []byte) error {
+// shouldFlush returns true if the current data block should be finished
+// before the specified entry is added to the table.
+func (w *Writer) shouldFlush(key InternalKey, value []byte) bool {
+	if w.maxKeysPerBlock > 0 && w.block.nEntries >= w.maxKeysPerBlock {
+		// The block holds the maximum number of keys, regardless of its size.
+		return true
+	}
 	if size := w.block.estimatedSize(); size < w.blockSize {
 		// The block is currently smaller than the target size.
 		if size <= w.blockSizeThreshold {
 			// The block is smaller than the threshold size at which we'll consider
 			// flushing it.
-			return nil
+			return false
 		}
 		newSize := size + key.Size() + len(value)
 		if w.block.nEntries&w.block.restartInterval == 0 {
@@ -316,43 +671,131 @@ func (w *Writer) maybeFlush(key InternalKey, value []byte) error {
 		newSize += uvarintLen(uint32(len(value))) // varint for value size
 		if newSize <= w.blockSize {
 			// The block plus the new entry is smaller than the target size.
-			return nil
+			return false
 		}
 	}
+	return true
+}
+
+func (w *Writer) maybeFlush(key InternalKey, value []byte) error {
+	if !w.shouldFlush(key, value) {
+		return nil
+	}
 
+	hasEntries := w.block.nEntries > 0
 	bh, err := w.finishBlock(&w.block)
 	if err != nil {
 		w.err = err
 		return w.err
 	}
+	if hasEntries {
+		w.addDataBlockSummary(bh)
+		w.maybeAddToUserKeyIndex(bh)
+	}
 	w.pendingBH = bh
 	w.flushPendingBH(key)
 	return nil
 }
 
-// flushPendingBH adds any pending block handle to the index entries.
+// addDataBlockSummary records the bounds and size of the data block that was
+// just finished.
+func (w *Writer) addDataBlockSummary(bh blockHandle) {
+	largest := w.blockLastKey().UserKey
+	w.dataBlocks = append(w.dataBlocks, dataBlockSummary{
+		bh:       bh,
+		smallest: append([]byte(nil), w.blockFirstKey...),
+		largest:  append([]byte(nil), largest...),
+		size:     bh.length + blockTrailerLen,
+	})
+}
+
+// maybeAddToUserKeyIndex adds an entry for the data block that was just
+// finished to the user-key index, if the user-key index is enabled.
+func (w *Writer) maybeAddToUserKeyIndex(bh blockHandle) {
+	if w.userKeyIndexBlock == nil {
+		return
+	}
+	n := encodeBlockHandle(w.tmp[:], bh)
+	w.userKeyIndexBlock.add(InternalKey{UserKey: w.blockFirstKey}, w.tmp[:n])
+}
+
+// estimateRangeDelBytes returns an estimate of the number of bytes in the data
+// blocks that are covered by the range tombstones in the finished range-del
+// block b. A data block is considered covered if any of its keys might fall
+// within a tombstone, and each covered data block is counted once.
+func (w *Writer) estimateRangeDelBytes(b []byte) (uint64, error) {
+	if len(w.dataBlocks) == 0 {
+		return 0, nil
+	}
+	iter := &blockIter{}
+	if err := iter.init(w.compare, b, 0 /* globalSeqNum */); err != nil {
+		return 0, err
+	}
+	covered := make([]bool, len(w.dataBlocks))
+	for key, end := iter.First(); key != nil; key, end = iter.Next() {
+		start := key.UserKey
+		// Find the first block whose largest key is >= start and the first block
+		// whose smallest key is >= end. The blocks in between overlap the
+		// tombstone [start, end).
+		i := sort.Search(len(w.dataBlocks), func(j int) bool {
+			return w.compare(w.dataBlocks[j].largest, start) >= 0
+		})
+		j := sort.Search(len(w.dataBlocks), func(j int) bool {
+			return w.compare(w.dataBlocks[j].smallest, end) >= 0
+		})
+		for ; i < j; i++ {
+			covered[i] = true
+		}
+	}
+	var size uint64
+	for i := range covered {
+		if covered[i] {
+			size += w.dataBlocks[i].size
+		}
+	}
+	return size, iter.Close()
+}
+
+// flushPendingBH adds any pending block handle to the index entries. With a
+// sparse index, the handle is added to the current group of blocks, and the
+// index entry for the group is only added once the group is full or the final
+// block has been written, signified by an empty key.
 func (w *Writer) flushPendingBH(key InternalKey) {
 	if w.pendingBH.length == 0 {
 		// A valid blockHandle must be non-zero.
 		// In particular, it must have a non-zero length.
 		return
 	}
-	prevKey := base.DecodeInternalKey(w.block.curKey)
+	w.indexGroup = append(w.indexGroup, w.pendingBH)
+	w.pendingBH = blockHandle{}
+	final := key.UserKey == nil && key.Trailer == 0
+	if len(w.indexGroup) < w.indexSparsity && !final {
+		return
+	}
+	prevKey := w.blockLastKey()
 	var sep InternalKey
-	if key.UserKey == nil && key.Trailer == 0 {
+	switch {
+	case w.indexFirstKeys:
+		sep = w.indexFirstKey
+	case final:
 		sep = prevKey.Successor(w.compare, w.successor, nil)
-	} else {
+	default:
 		sep = prevKey.Separator(w.compare, w.separator, nil, key)
 	}
-	n := encodeBlockHandle(w.tmp[:], w.pendingBH)
-	w.indexBlock.add(sep, w.tmp[:n])
-	w.pendingBH = blockHandle{}
+	w.indexEntryBuf = appendIndexEntry(w.indexEntryBuf[:0], w.indexGroup)
+	w.indexBlock.add(sep, w.indexEntryBuf)
+	w.numDataBlocks += len(w.indexGroup)
+	w.indexGroup = w.indexGroup[:0]
 }
 
 // finishBlock finishes the current block and returns its block handle, which is
 // its offset and length in the table.
 func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
-	bh, err := w.writeRawBlock(block.finish(), w.compression)
+	b := block.finish()
+	bh, err := w.writeRawBlock(b, w.compression)
+	if err == nil && block == &w.block {
+		w.sampleCompression(len(b), bh)
+	}
 
 	// Calculate filters.
 	if w.filter != nil {
@@ -364,9 +807,37 @@ func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
 	return bh, err
 }
 
+// compressionSampleBlocks is the number of data blocks at the start of a table
+// whose compression ratio is compared against TableOptions.MinCompressionRatio.
+const compressionSampleBlocks = 8
+
+// sampleCompression accounts for a data block of rawSize bytes which was
+// written as bh. Once compressionSampleBlocks data blocks have been written,
+// compression is abandoned for the remainder of the table if the blocks did
+// not compress to within the minimum compression ratio.
+func (w *Writer) sampleCompression(rawSize int, bh blockHandle) {
+	if w.minCompressionRatio <= 0 || w.compression == NoCompression ||
+		w.sampledBlocks >= compressionSampleBlocks {
+		return
+	}
+	stored := bh.length
+	if w.cipher != nil {
+		stored -= uint64(w.cipher.Overhead())
+	}
+	w.sampledBlocks++
+	w.sampledRawSize += uint64(rawSize)
+	w.sampledStoredSize += stored
+	if w.sampledBlocks == compressionSampleBlocks &&
+		float64(w.sampledRawSize) < w.minCompressionRatio*float64(w.sampledStoredSize) {
+		w.compression = NoCompression
+		w.props.CompressionAbandoned = true
+	}
+}
+
 func (w *Writer) writeRawBlock(b []byte, compression Compression) (blockHandle, error) {
 	blockType := noCompressionBlockType
-	if compression == SnappyCompression {
+	switch compression {
+	case SnappyCompression:
 		// Compress the buffer, discarding the result if the improvement isn't at
 		// least 12.5%.
 		compressed := snappy.Encode(w.compressedBuf, b)
@@ -375,12 +846,38 @@ func (w *Writer) writeRawBlock(b []byte, compression Compression) (blockHandle,
 			blockType = snappyCompressionBlockType
 			b = compressed
 		}
+	case ZstdCompression:
+		compressed := encodeZstd(w.compressedBuf[:0], b)
+		w.compressedBuf = compressed[:cap(compressed)]
+		if len(compressed) < len(b)-len(b)/8 {
+			blockType = zstdCompressionBlockType
+			b = compressed
+		}
 	}
+	return w.writeCompressedBlock(b, blockType)
+}
+
+// writeCompressedBlock writes the block b, which has already been compressed
+// as specified by blockType, encrypting it if the table is encrypted.
+func (w *Writer) writeCompressedBlock(b []byte, blockType byte) (blockHandle, error) {
 	w.tmp[0] = blockType
 
+	if w.cipher != nil {
+		sealed := w.cipher.Seal(w.sealedBuf[:0], b, w.meta.Size)
+		w.sealedBuf = sealed[:cap(sealed)]
+		b = sealed
+	}
+
 	// Calculate the checksum.
-	checksum := crc.New(b).Update(w.tmp[:1]).Value()
-	binary.LittleEndian.PutUint32(w.tmp[1:5], checksum)
+	if w.checksumType == checksumXXHash64 {
+		d := xxhash.New()
+		d.Write(b)
+		d.Write(w.tmp[:1])
+		binary.LittleEndian.PutUint32(w.tmp[1:blockTrailerLen], uint32(d.Sum64()))
+	} else {
+		checksum := crc.New(b).Update(w.tmp[:1]).Value()
+		binary.LittleEndian.PutUint32(w.tmp[1:blockTrailerLen], checksum)
+	}
 	bh := blockHandle{w.meta.Size, uint64(len(b))}
 
 	// Write the bytes to the file.
@@ -398,10 +895,94 @@ func (w *Writer) writeRawBlock(b []byte, compression Compression) (blockHandle,
 	return bh, nil
 }
 
+// namedMetaBlock is a meta block added by AddMetaBlock.
+type namedMetaBlock struct {
+	name string
+	data []byte
+}
+
+// metaindexEntry is an entry of the metaindex block, mapping the name of a meta
+// block to its handle.
+type metaindexEntry struct {
+	name string
+	bh   blockHandle
+}
+
+// metaindexWriter collects the entries of the metaindex block. The entries of
+// the block must be sorted by name, while the meta blocks are written in an
+// order determined by the layout of the table, so the entries are sorted when
+// the block is finished.
+type metaindexWriter struct {
+	entries []metaindexEntry
+}
+
+func (w *metaindexWriter) add(name string, bh blockHandle) {
+	w.entries = append(w.entries, metaindexEntry{name: name, bh: bh})
+}
+
+// finish returns the encoded metaindex block, using tmp to encode the block
+// handles.
+func (w *metaindexWriter) finish(tmp []byte) []byte {
+	sort.Slice(w.entries, func(i, j int) bool {
+		return w.entries[i].name < w.entries[j].name
+	})
+	var block rawBlockWriter
+	block.restartInterval = 1
+	for _, e := range w.entries {
+		n := encodeBlockHandle(tmp, e.bh)
+		block.add(InternalKey{UserKey: []byte(e.name)}, tmp[:n])
+	}
+	return block.finish()
+}
+
+// reservedMetaBlockPrefixes are the prefixes of the names of the meta blocks
+// written by Pebble and RocksDB, such as the properties, filter and range-del
+// blocks.
+var reservedMetaBlockPrefixes = []string{
+	"rocksdb.", "pebble.", "filter.", "fullfilter.", "partitionedfilter.",
+}
+
+// AddMetaBlock adds a meta block with the specified name and contents to the
+// table, such as a schema descriptor. The block is written when the table is
+// finished, compressed in the same way as the other blocks of the table, and
+// can be retrieved by name using Reader.RawMetaBlock. The name must be
+// non-empty, must not have been added before, and must not begin with one of
+// the prefixes reserved for the meta blocks written by Pebble and RocksDB:
+// "rocksdb.", "pebble.", "filter.", "fullfilter." and "partitionedfilter.". An
+// invalid name is rejected without affecting the Writer. The contents are
+// copied, so the caller may reuse the buffer.
+func (w *Writer) AddMetaBlock(name string, data []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if name == "" {
+		return errors.New("pebble: meta block name must not be empty")
+	}
+	for _, prefix := range reservedMetaBlockPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return fmt.Errorf("pebble: meta block name %q is reserved", name)
+		}
+	}
+	for i := range w.metaBlocks {
+		if w.metaBlocks[i].name == name {
+			return fmt.Errorf("pebble: meta block %q already added", name)
+		}
+	}
+	w.metaBlocks = append(w.metaBlocks, namedMetaBlock{
+		name: name,
+		data: append([]byte(nil), data...),
+	})
+	return nil
+}
+
 // Close finishes writing the table and closes the underlying file that the
 // table was written to.
 func (w *Writer) Close() (err error) {
 	defer func() {
+		if f, ok := w.filter.(*backgroundFilterWriter); ok {
+			// Ensure the background goroutine exits if Close returns early.
+			f.stop()
+		}
 		if w.syncer == nil {
 			return
 		}
@@ -411,6 +992,84 @@ func (w *Writer) Close() (err error) {
 		}
 		w.syncer = nil
 	}()
+	return w.finish()
+}
+
+// Finish finishes writing the table, closes the underlying file that the table
+// was written to, and returns a Reader for the table which reads it through f,
+// such as the file reopened for reading. The footer, metaindex, properties,
+// index and filter of the table are taken from the memory of the Writer rather
+// than read back from f, so the Reader is ready to serve reads as soon as it is
+// returned, which benefits a table that is read immediately after being
+// written. The Reader is configured with the Options the Writer was created
+// with and the extra options, and reads the filter of the table using the
+// filter policy of the Writer. fileNum identifies the table in the block
+// cache. Closing the Reader will close f, which is also closed if an error is
+// returned.
+func (w *Writer) Finish(f vfs.File, fileNum uint64, extraOpts ...ReaderOption) (*Reader, error) {
+	if f == nil {
+		return nil, errors.New("pebble: nil file")
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := w.finished
+
+	o := w.opts
+	if w.filterPolicy != nil {
+		// The filter policy of the Writer takes precedence over the filter
+		// policies of the Options.
+		oc := *o
+		oc.Levels = append([]TableOptions{{FilterPolicy: w.filterPolicy}}, o.Levels...)
+		o = &oc
+	}
+	r := newReader(f, fileNum, o, extraOpts)
+	r.size = int64(w.meta.Size)
+	r.checksumType = t.footer.checksum
+	r.format = t.footer.format
+	r.metaindexBH = t.footer.metaindexBH
+	r.cipher = w.cipher
+	meta, err := decodeMetaindex(t.metaindex)
+	if err == nil {
+		err = r.Properties.load(t.properties, meta[metaPropertiesName].offset)
+	}
+	if err == nil {
+		err = r.initMeta(t.footer, meta, o)
+	}
+	if err != nil {
+		r.err = err
+		r.Close()
+		return nil, err
+	}
+	r.index.bh = t.footer.indexBH
+	r.index.handle = residentBlock(t.index)
+	if r.tableFilter != nil && t.filter != nil {
+		r.filter.handle = residentBlock(t.filter)
+	}
+	if r.verifyHandles {
+		if err := r.verifyBlockHandles(); err != nil {
+			r.err = err
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// finishedTable holds the blocks of a finished table which are needed to
+// construct a Reader for the table, in their decoded form.
+type finishedTable struct {
+	footer     footer
+	metaindex  []byte
+	properties []byte
+	index      []byte
+	filter     []byte
+}
+
+// finish writes the remainder of the table and flushes it to the file,
+// without closing the file.
+func (w *Writer) finish() (err error) {
 	if w.err != nil {
 		return w.err
 	}
@@ -418,44 +1077,107 @@ func (w *Writer) Close() (err error) {
 	// Finish the last data block, or force an empty data block if there
 	// aren't any data blocks at all.
 	w.flushPendingBH(InternalKey{})
-	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
+	if w.block.nEntries > 0 || w.numDataBlocks == 0 {
+		hasEntries := w.block.nEntries > 0
 		bh, err := w.finishBlock(&w.block)
 		if err != nil {
 			w.err = err
 			return w.err
 		}
+		if hasEntries {
+			w.addDataBlockSummary(bh)
+			w.maybeAddToUserKeyIndex(bh)
+		}
 		w.pendingBH = bh
 		w.flushPendingBH(InternalKey{})
 	}
 	w.props.DataSize = w.meta.Size
-	w.props.NumDataBlocks = uint64(w.indexBlock.nEntries)
+	if w.recordLargestValue {
+		w.props.LargestValueSize = w.meta.LargestValueSize
+	}
+	w.props.NumDataBlocks = uint64(w.numDataBlocks)
 	// NB: RocksDB includes the block trailer length in the index size
 	// property, though it doesn't include the trailer in the filter size
 	// property.
 	w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
 
-	// Write the filter block.
-	var metaindex rawBlockWriter
-	metaindex.restartInterval = 1
+	// Write the filter block, unless it is small enough to be embedded in the
+	// index block.
+	var metaindex metaindexWriter
+	var embeddedFilter, filter []byte
+	w.props.FilterEmbedded = false
 	if w.filter != nil {
 		b, err := w.filter.finish()
 		if err != nil {
 			w.err = err
 			return w.err
 		}
-		bh, err := w.writeRawBlock(b, NoCompression)
+		w.props.FilterPolicyName = w.filter.policyName()
+		if len(b)+w.indexBlock.estimatedSize() < w.filterEmbedThreshold {
+			embeddedFilter = b
+			w.props.FilterEmbedded = true
+			w.props.FilterSize = uint64(len(b))
+		} else {
+			filter = b
+			bh, err := w.writeRawBlock(b, NoCompression)
+			if err != nil {
+				w.err = err
+				return w.err
+			}
+			metaindex.add(w.filter.metaName(), bh)
+			w.props.FilterSize = bh.length
+		}
+	}
+
+	// Write the user-key index block.
+	if w.userKeyIndexBlock != nil {
+		bh, err := w.finishBlock(&w.userKeyIndexBlock.blockWriter)
 		if err != nil {
 			w.err = err
 			return w.err
 		}
-		n := encodeBlockHandle(w.tmp[:], bh)
-		metaindex.add(InternalKey{UserKey: []byte(w.filter.metaName())}, w.tmp[:n])
-		w.props.FilterPolicyName = w.filter.policyName()
-		w.props.FilterSize = bh.length
+		metaindex.add(metaUserKeyIndexName, bh)
+		w.props.UserKeyIndexSize = bh.length + blockTrailerLen
+	}
+
+	// Write the prefix map block.
+	if b := w.finishPrefixMap(); b != nil {
+		bh, err := w.writeRawBlock(b, w.compression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		metaindex.add(metaPrefixMapName, bh)
+	}
+
+	// Write the block key ranges block.
+	if b := w.finishBlockKeyRanges(); b != nil {
+		bh, err := w.writeRawBlock(b, w.compression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		metaindex.add(metaBlockKeyRangesName, bh)
+	}
+
+	// Write the column family ranges block.
+	if b := w.finishCFRanges(); b != nil {
+		bh, err := w.writeRawBlock(b, w.compression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		metaindex.add(metaCFRangesName, bh)
 	}
 
-	// Write the index block.
-	indexBH, err := w.finishBlock(&w.indexBlock)
+	// Write the index block. An embedded filter precedes the index entries,
+	// which are parsed from the end of the block.
+	index := w.indexBlock.finish()
+	if w.props.FilterEmbedded {
+		index = append(embeddedFilter[:len(embeddedFilter):len(embeddedFilter)], index...)
+	}
+	indexBH, err := w.writeRawBlock(index, w.compression)
+	w.indexBlock.reset()
 	if err != nil {
 		w.err = err
 		return w.err
@@ -471,29 +1193,85 @@ func (w *Writer) Close() (err error) {
 			w.meta.LargestRange = base.MakeRangeDeleteSentinelKey(w.rangeDelBlock.curValue)
 		}
 		b := w.rangeDelBlock.finish()
+		w.props.RangeDeletionsBytesEstimate, err = w.estimateRangeDelBytes(b)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
 		bh, err := w.writeRawBlock(b, w.compression)
 		if err != nil {
 			w.err = err
 			return w.err
 		}
-		n := encodeBlockHandle(w.tmp[:], bh)
 		// The v2 range-del block encoding is backwards compatible with the v1
 		// encoding. We add meta-index entries for both the old name and the new
 		// name so that old code can continue to find the range-del block and new
 		// code knows that the range tombstones in the block are fragmented and
 		// sorted.
-		metaindex.add(InternalKey{UserKey: []byte(metaRangeDelName)}, w.tmp[:n])
+		metaindex.add(metaRangeDelName, bh)
 		if !w.rangeDelV1Format {
-			metaindex.add(InternalKey{UserKey: []byte(metaRangeDelV2Name)}, w.tmp[:n])
+			metaindex.add(metaRangeDelV2Name, bh)
+		}
+	}
+
+	// Write the range-key block.
+	if len(w.rangeKeys.keys) > 0 {
+		rangeKeyBlock := blockWriter{restartInterval: 1}
+		err := w.rangeKeys.finish(func(key InternalKey, value []byte) error {
+			switch key.Kind() {
+			case InternalKeyKindRangeKeyDelete:
+				w.props.NumRangeKeyDels++
+			case InternalKeyKindRangeKeyUnset:
+				w.props.NumRangeKeyUnsets++
+			case InternalKeyKindRangeKeySet:
+				w.props.NumRangeKeySets++
+			}
+			rangeKeyBlock.add(key, value)
+			return nil
+		})
+		if err != nil {
+			w.err = err
+			return w.err
 		}
+		bh, err := w.writeRawBlock(rangeKeyBlock.finish(), w.compression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		metaindex.add(metaRangeKeyName, bh)
 	}
 
+	// Write the meta blocks added by AddMetaBlock.
+	for _, m := range w.metaBlocks {
+		bh, err := w.writeRawBlock(m.data, w.compression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		metaindex.add(m.name, bh)
+	}
+
+	var properties []byte
 	{
+		// Each collector adds its properties to a separate map, so that a
+		// property added by more than one collector is detected.
 		userProps := make(map[string]string)
+		owners := make(map[string]string)
 		for i := range w.propCollectors {
-			if err := w.propCollectors[i].Finish(userProps); err != nil {
+			c := w.propCollectors[i]
+			collected := make(map[string]string)
+			if err := c.Finish(collected); err != nil {
 				return err
 			}
+			for k, v := range collected {
+				if owner, ok := owners[k]; ok {
+					w.err = fmt.Errorf("pebble: property %q added by both property collectors %s and %s",
+						k, owner, c.Name())
+					return w.err
+				}
+				userProps[k] = v
+				owners[k] = c.Name()
+			}
 		}
 		if len(userProps) > 0 {
 			w.props.UserProperties = userProps
@@ -507,18 +1285,19 @@ func (w *Writer) Close() (err error) {
 		raw.restartInterval = propertiesBlockRestartInterval
 		w.props.CompressionOptions = rocksDBCompressionOptions
 		w.props.save(&raw)
-		bh, err := w.writeRawBlock(raw.finish(), NoCompression)
+		properties = raw.finish()
+		bh, err := w.writeRawBlock(properties, NoCompression)
 		if err != nil {
 			w.err = err
 			return w.err
 		}
-		n := encodeBlockHandle(w.tmp[:], bh)
-		metaindex.add(InternalKey{UserKey: []byte(metaPropertiesName)}, w.tmp[:n])
+		metaindex.add(metaPropertiesName, bh)
 	}
 
 	// Write the metaindex block. It might be an empty block, if the filter
 	// policy is nil.
-	metaindexBH, err := w.finishBlock(&metaindex.blockWriter)
+	metaindexBlock := metaindex.finish(w.tmp[:])
+	metaindexBH, err := w.writeRawBlock(metaindexBlock, w.compression)
 	if err != nil {
 		w.err = err
 		return w.err
@@ -526,10 +1305,11 @@ func (w *Writer) Close() (err error) {
 
 	// Write the table footer.
 	footer := footer{
-		format:      w.tableFormat,
-		checksum:    checksumCRC32c,
-		metaindexBH: metaindexBH,
-		indexBH:     indexBH,
+		format:         w.tableFormat,
+		checksum:       w.checksumType,
+		metaindexBH:    metaindexBH,
+		indexBH:        indexBH,
+		handleChecksum: w.footerChecksum,
 	}
 	var n int
 	if n, err = w.writer.Write(footer.encode(w.tmp[:])); err != nil {
@@ -546,9 +1326,19 @@ func (w *Writer) Close() (err error) {
 		}
 	}
 
-	if err := w.syncer.Sync(); err != nil {
-		w.err = err
-		return err
+	if !w.disableSyncOnClose {
+		if err := w.syncer.Sync(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+
+	w.finished = &finishedTable{
+		footer:     footer,
+		metaindex:  metaindexBlock,
+		properties: properties,
+		index:      index,
+		filter:     filter,
 	}
 
 	// Make any future calls to Set or Close return an error.
@@ -571,6 +1361,41 @@ func (w *Writer) Metadata() (*WriterMetadata, error) {
 	return &w.meta, nil
 }
 
+// BlockRange is the location and the user key bounds of a data block of a
+// table.
+type BlockRange struct {
+	// Offset and Length locate the data block in the table, excluding the
+	// block trailer.
+	Offset uint64
+	Length uint64
+	// Smallest and Largest are the smallest and largest user keys in the data
+	// block.
+	Smallest []byte
+	Largest  []byte
+}
+
+// BlockRanges returns the ranges of the data blocks of the finished sstable,
+// in order. Data blocks which do not contain any keys are omitted. The block
+// ranges can be persisted alongside the table, such as by the caller of a
+// compaction writing the table, in order to map a key range to the blocks
+// containing it without reading the index of the table. Only valid to call
+// after the sstable has been finished.
+func (w *Writer) BlockRanges() ([]BlockRange, error) {
+	if w.syncer != nil {
+		return nil, errors.New("pebble: writer is not closed")
+	}
+	ranges := make([]BlockRange, len(w.dataBlocks))
+	for i, b := range w.dataBlocks {
+		ranges[i] = BlockRange{
+			Offset:   b.bh.offset,
+			Length:   b.bh.length,
+			Smallest: b.smallest,
+			Largest:  b.largest,
+		}
+	}
+	return ranges, nil
+}
+
 // NewWriter returns a new table writer for the file. Closing the writer will
 // close the file.
 func NewWriter(f writeCloseSyncer, o *Options, lo TableOptions) *Writer {
@@ -579,34 +1404,84 @@ func NewWriter(f writeCloseSyncer, o *Options, lo TableOptions) *Writer {
 
 	w := &Writer{
 		syncer: f,
+		opts:   o,
 		meta: WriterMetadata{
 			SmallestSeqNum: math.MaxUint64,
 		},
-		blockSize:          lo.BlockSize,
-		blockSizeThreshold: (lo.BlockSize*lo.BlockSizeThreshold + 99) / 100,
-		compare:            o.Comparer.Compare,
-		split:              o.Comparer.Split,
-		compression:        lo.Compression,
-		separator:          o.Comparer.Separator,
-		successor:          o.Comparer.Successor,
-		tableFormat:        o.TableFormat,
+		blockSize:            lo.BlockSize,
+		blockSizeThreshold:   (lo.BlockSize*lo.BlockSizeThreshold + 99) / 100,
+		maxKeysPerBlock:      lo.MaxKeysPerBlock,
+		compare:              o.Comparer.Compare,
+		split:                o.Comparer.Split,
+		compression:          lo.Compression,
+		separator:            o.Comparer.Separator,
+		successor:            o.Comparer.Successor,
+		tableFormat:          o.TableFormat,
+		footerChecksum:       lo.FooterChecksum,
+		indexSparsity:        lo.IndexSparsity,
+		indexFirstKeys:       lo.IndexFirstKeys,
+		disableSyncOnClose:   lo.DisableSyncOnClose,
+		recordLargestValue:   lo.RecordLargestValueSize,
+		minCompressionRatio:  lo.MinCompressionRatio,
+		filterEmbedThreshold: lo.FilterEmbedThreshold,
+		blockKeyRanges:       lo.BlockKeyRanges,
+		checksumType:         checksumCRC32c,
 		block: blockWriter{
 			restartInterval: lo.BlockRestartInterval,
 		},
 		indexBlock: blockWriter{
-			restartInterval: 1,
+			restartInterval: lo.IndexBlockRestartInterval,
 		},
 		rangeDelBlock: blockWriter{
 			restartInterval: 1,
 		},
+		rangeKeys: rangeKeyFragmenter{
+			cmp: o.Comparer.Compare,
+		},
 	}
 	if f == nil {
 		w.err = errors.New("pebble: nil file")
 		return w
 	}
+	if lo.ChecksumType == XXHash64Checksum {
+		// The LevelDB footer does not record the checksum type, so a reader
+		// of a LevelDB table assumes CRC32c checksums.
+		if w.tableFormat == TableFormatLevelDB {
+			w.err = errors.New("pebble: xxHash64 checksums require the RocksDB table format")
+			return w
+		}
+		w.checksumType = checksumXXHash64
+	}
+	// The presence of the footer checksum is recorded in the footer version,
+	// which the LevelDB footer does not have.
+	if lo.FooterChecksum && w.tableFormat == TableFormatLevelDB {
+		w.err = errors.New("pebble: footer checksums require the RocksDB table format")
+		return w
+	}
+	var salt []byte
+	if o.BlockCipher != nil {
+		var err error
+		if w.cipher, salt, err = newTableCipher(o.BlockCipher); err != nil {
+			w.err = err
+			return w
+		}
+	}
+
+	if lo.UserKeyIndex {
+		w.userKeyIndexBlock = &rawBlockWriter{
+			blockWriter: blockWriter{restartInterval: 1},
+		}
+	}
+
+	// The prefix map identifies index entries by ordinal, which requires a
+	// restart point at every index entry.
+	if lo.PrefixMapThreshold > 0 && w.split != nil && lo.IndexBlockRestartInterval == 1 {
+		w.prefixMapThreshold = lo.PrefixMapThreshold
+	}
 
 	w.props.PrefixExtractorName = "nullptr"
 	if lo.FilterPolicy != nil {
+		w.filterPolicy = lo.FilterPolicy
 		switch lo.FilterType {
 		case TableFilter:
 			w.filter = newTableFilterWriter(lo.FilterPolicy)
@@ -619,21 +1494,35 @@ func NewWriter(f writeCloseSyncer, o *Options, lo TableOptions) *Writer {
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", lo.FilterType))
 		}
+		if lo.BackgroundFilter {
+			w.filter = newBackgroundFilterWriter(w.filter)
+		}
 	}
 
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparatorName = o.Comparer.Name
+	if o.Comparer.CompressKey != nil && o.Comparer.DecompressKey != nil {
+		w.compressKey = o.Comparer.CompressKey
+		w.props.KeysCompressed = true
+	}
 	w.props.CompressionName = lo.Compression.String()
+	w.props.IndexFirstKeys = lo.IndexFirstKeys
+	if lo.IndexSparsity > 1 {
+		w.props.IndexSparsity = uint64(lo.IndexSparsity)
+	}
 	w.props.MergeOperatorName = o.Merger.Name
 	w.props.PropertyCollectorNames = "[]"
 	w.props.Version = 2 // TODO(peter): what is this?
 
-	if len(o.TablePropertyCollectors) > 0 {
-		w.propCollectors = make([]TablePropertyCollector, len(o.TablePropertyCollectors))
+	var newCollectors []func() TablePropertyCollector
+	newCollectors = append(newCollectors, o.TablePropertyCollectors...)
+	newCollectors = append(newCollectors, lo.TablePropertyCollectors...)
+	if len(newCollectors) > 0 {
+		w.propCollectors = make([]TablePropertyCollector, len(newCollectors))
 		var buf bytes.Buffer
 		buf.WriteString("[")
-		for i := range o.TablePropertyCollectors {
-			w.propCollectors[i] = o.TablePropertyCollectors[i]()
+		for i := range newCollectors {
+			w.propCollectors[i] = newCollectors[i]()
 			if i > 0 {
 				buf.WriteString(",")
 			}
@@ -650,5 +1539,14 @@ func NewWriter(f writeCloseSyncer, o *Options, lo TableOptions) *Writer {
 		w.bufWriter = bufio.NewWriter(f)
 		w.writer = w.bufWriter
 	}
+
+	// The salt of an encrypted table precedes the first data block.
+	if salt != nil {
+		n, err := w.writer.Write(salt)
+		w.meta.Size += uint64(n)
+		if err != nil {
+			w.err = err
+		}
+	}
 	return w
 }
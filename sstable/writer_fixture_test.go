@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -167,3 +168,49 @@ func TestFixtureOutput(t *testing.T) {
 		})
 	}
 }
+
+// TestXXHash64FixtureOutput checks that the data blocks written using the
+// xxHash64 checksum type, including their checksums, match those of the
+// pre-made table written by RocksDB. The remainder of the table differs, as
+// newer versions of RocksDB write additional properties.
+func TestXXHash64FixtureOutput(t *testing.T) {
+	const filename = "testdata/h.xxhash64.no-compression.sst"
+	want, err := ioutil.ReadFile(filepath.FromSlash(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFile, err := os.Open(filepath.FromSlash(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(wantFile, 0, nil)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.checksumType != checksumXXHash64 {
+		t.Fatalf("expected checksum type %d, but found %d", checksumXXHash64, r.checksumType)
+	}
+	dataSize := r.Properties.DataSize
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := buildWithChecksum(base.NoCompression, nil, base.TableFilter, nil,
+		func() TablePropertyCollector {
+			return &keyCountPropertyCollector{}
+		}, XXHash64Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, stat.Size())
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(got)) < dataSize || !bytes.Equal(got[:dataSize], want[:dataSize]) {
+		t.Fatalf("built data blocks do not match the pre-made table %s", filename)
+	}
+}
@@ -6,15 +6,23 @@ package sstable
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/internal/base"
 	"github.com/petermattis/pebble/internal/datadriven"
 	"github.com/petermattis/pebble/internal/rangedel"
 	"github.com/petermattis/pebble/vfs"
+	"golang.org/x/exp/rand"
 )
 
 func TestWriter(t *testing.T) {
@@ -137,7 +145,7 @@ func TestWriter(t *testing.T) {
 				meta.SmallestSeqNum, meta.LargestSeqNum)
 
 		case "scan":
-			iter := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+			iter := NewLegacyIterAdapter(r.NewIter(nil /* lower */, nil /* upper */))
 			defer iter.Close()
 
 			var buf bytes.Buffer
@@ -146,6 +154,43 @@ func TestWriter(t *testing.T) {
 			}
 			return buf.String()
 
+		case "read-at", "scan-visible":
+			var iter *SnapshotIterator
+			if td.Cmd == "read-at" {
+				var seqNum uint64
+				td.ScanArgs(t, "seq", &seqNum)
+				iter = r.ReadAt(seqNum)
+			} else {
+				iter = r.NewVisibleIter()
+			}
+			defer iter.Close()
+
+			var forward, reverse []string
+			for key, val := iter.First(); key != nil; key, val = iter.Next() {
+				forward = append(forward, fmt.Sprintf("%s:%s\n", key, val))
+			}
+			for key, val := iter.Last(); key != nil; key, val = iter.Prev() {
+				reverse = append([]string{fmt.Sprintf("%s:%s\n", key, val)}, reverse...)
+			}
+			if f, r := strings.Join(forward, ""), strings.Join(reverse, ""); f != r {
+				return fmt.Sprintf("forward and reverse iteration differ:\n%s---\n%s", f, r)
+			}
+			return strings.Join(forward, "")
+
+		case "get-at":
+			var seqNum uint64
+			td.ScanArgs(t, "seq", &seqNum)
+			var buf bytes.Buffer
+			for _, key := range strings.Fields(td.Input) {
+				value, err := r.GetAt([]byte(key), seqNum)
+				if err != nil {
+					fmt.Fprintf(&buf, "%s: %v\n", key, err)
+				} else {
+					fmt.Fprintf(&buf, "%s:%s\n", key, value)
+				}
+			}
+			return buf.String()
+
 		case "scan-range-del":
 			iter := r.NewRangeDelIter()
 			if iter == nil {
@@ -164,3 +209,1165 @@ func TestWriter(t *testing.T) {
 		}
 	})
 }
+
+func TestWriterRangeDeletionsBytesEstimate(t *testing.T) {
+	build := func(tombstones [][2]string) *Reader {
+		// The block size is chosen so that each key is placed in its own data
+		// block.
+		return newTestReader(t, nil, TableOptions{
+			BlockSize:   20,
+			Compression: NoCompression,
+		}, func(w *Writer) error {
+			for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+				if err := w.Set([]byte(k), []byte("v")); err != nil {
+					return err
+				}
+			}
+			if err := w.Delete([]byte("k")); err != nil {
+				return err
+			}
+			for _, ts := range tombstones {
+				if err := w.DeleteRange([]byte(ts[0]), []byte(ts[1])); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// Each data block holding a point set has the same size. The final data
+	// block holds the point deletion which has an empty value.
+	r := build(nil)
+	if v := r.Properties.NumDataBlocks; v != 11 {
+		t.Fatalf("expected 11 data blocks, but found %d", v)
+	}
+	if v := r.Properties.RawPointTombstoneKeySize; v != 9 {
+		t.Fatalf("expected point tombstone key size 9, but found %d", v)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	const setBlockSize = 26
+	const deleteBlockSize = 25
+
+	testCases := []struct {
+		tombstones [][2]string
+		expected   uint64
+	}{
+		{nil, 0},
+		{[][2]string{{"c", "f"}}, 3 * setBlockSize},
+		{[][2]string{{"c", "e"}, {"e", "f"}, {"f", "h"}}, 5 * setBlockSize},
+		{[][2]string{{"a", "b"}, {"i", "z"}}, 3*setBlockSize + deleteBlockSize},
+		{[][2]string{{"b0", "b1"}}, 0},
+		{[][2]string{{"x", "z"}}, 0},
+		{[][2]string{{"0", "zz"}}, 10*setBlockSize + deleteBlockSize},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			r := build(c.tombstones)
+			defer r.Close()
+			if v := r.Properties.RangeDeletionsBytesEstimate; c.expected != v {
+				t.Fatalf("%v: expected %d, but found %d", c.tombstones, c.expected, v)
+			}
+		})
+	}
+}
+
+// userPropsCollector adds a number of user properties. The properties are
+// stored in a map and thus exercise the ordering of the properties block.
+type userPropsCollector struct {
+	count int
+}
+
+func (c *userPropsCollector) Add(key InternalKey, value []byte) error {
+	c.count++
+	return nil
+}
+
+func (c *userPropsCollector) Finish(userProps map[string]string) error {
+	for i := 0; i < 20; i++ {
+		userProps[fmt.Sprintf("test.prop-%02d", i)] = fmt.Sprint(c.count * i)
+	}
+	return nil
+}
+
+func (c *userPropsCollector) Name() string {
+	return "UserPropsCollector"
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	build := func() ([]byte, error) {
+		mem := vfs.NewMem()
+		f, err := mem.Create("test")
+		if err != nil {
+			return nil, err
+		}
+		w := NewWriter(f, &Options{
+			TablePropertyCollectors: []func() TablePropertyCollector{
+				func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+				func() TablePropertyCollector { return &userPropsCollector{} },
+			},
+		}, TableOptions{
+			BlockSize:    128,
+			Compression:  SnappyCompression,
+			FilterPolicy: bloom.FilterPolicy(10),
+			UserKeyIndex: true,
+		})
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%05d", i))
+			switch i % 10 {
+			case 0:
+				err = w.Delete(key)
+			case 1:
+				err = w.Merge(key, key)
+			default:
+				err = w.Set(key, bytes.Repeat(key, i%7))
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		for i := 0; i < 1000; i += 100 {
+			start := []byte(fmt.Sprintf("%05d", i))
+			end := []byte(fmt.Sprintf("%05d", i+50))
+			if err := w.DeleteRange(start, end); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		f, err = mem.Open("test")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ioutil.ReadAll(f)
+	}
+
+	expected, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	results := make([][]byte, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = build()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !bytes.Equal(expected, results[i]) {
+			t.Fatalf("build %d: expected identical tables, but found differences", i)
+		}
+	}
+}
+
+type syncCountingFile struct {
+	vfs.File
+	syncs   int
+	syncErr error
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs++
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	return f.File.Sync()
+}
+
+func TestWriterSyncOnClose(t *testing.T) {
+	syncErr := errors.New("injected sync error")
+	testCases := []struct {
+		disableSync bool
+		syncErr     error
+		syncs       int
+	}{
+		{false, nil, 1},
+		{false, syncErr, 1},
+		{true, nil, 0},
+		{true, syncErr, 0},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("disable=%t,err=%t", c.disableSync, c.syncErr != nil), func(t *testing.T) {
+			mem := vfs.NewMem()
+			f0, err := mem.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &syncCountingFile{File: f0, syncErr: c.syncErr}
+			w := NewWriter(f, nil, TableOptions{DisableSyncOnClose: c.disableSync})
+			if err := w.Set([]byte("a"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if !c.disableSync && c.syncErr != nil {
+				if err != syncErr {
+					t.Fatalf("expected %v, but found %v", syncErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if f.syncs != c.syncs {
+				t.Fatalf("expected %d syncs, but found %d", c.syncs, f.syncs)
+			}
+		})
+	}
+}
+
+func buildBackgroundFilterTable(numKeys int, background bool) ([]byte, error) {
+	mem := vfs.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		return nil, err
+	}
+	w := NewWriter(f, nil, TableOptions{
+		BackgroundFilter: background,
+		FilterPolicy:     bloom.FilterPolicy(10),
+	})
+	var key [8]byte
+	for i := 0; i < numKeys; i++ {
+		// NB: the key buffer is re-used for each key.
+		binary.BigEndian.PutUint64(key[:], uint64(i))
+		if err := w.Set(key[:], nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	f, err = mem.Open("test")
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+func TestWriterBackgroundFilter(t *testing.T) {
+	for _, numKeys := range []int{0, 1, backgroundFilterBatchSize, 10000} {
+		t.Run(fmt.Sprintf("keys=%d", numKeys), func(t *testing.T) {
+			expected, err := buildBackgroundFilterTable(numKeys, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := buildBackgroundFilterTable(numKeys, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, result) {
+				t.Fatalf("expected identical tables, but found differences")
+			}
+		})
+	}
+
+	// Closing a Writer which has failed stops the background goroutine.
+	f, err := vfs.NewMem().Create("failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, TableOptions{
+		BackgroundFilter: true,
+		FilterPolicy:     bloom.FilterPolicy(10),
+	})
+	if err := w.Set([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Set([]byte("a"), nil); err == nil {
+		t.Fatalf("expected out of order error")
+	}
+	if err := w.Close(); err == nil {
+		t.Fatalf("expected out of order error")
+	}
+	if f := w.filter.(*backgroundFilterWriter); !f.stopped {
+		t.Fatalf("expected background filter to be stopped")
+	}
+}
+
+func BenchmarkWriterBackgroundFilter(b *testing.B) {
+	for _, background := range []bool{false, true} {
+		b.Run(fmt.Sprintf("background=%t", background), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := buildBackgroundFilterTable(100000, background); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterEmptyValues(t *testing.T) {
+	// Every third key is a SET of a nil value, a SET of a zero-length value and
+	// a DELETE respectively.
+	const numKeys = 1000
+	keyKind := func(i int) InternalKeyKind {
+		if i%3 == 2 {
+			return InternalKeyKindDelete
+		}
+		return InternalKeyKindSet
+	}
+	for _, compression := range []Compression{NoCompression, SnappyCompression} {
+		for _, userKeyIndex := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s,userKeyIndex=%t", compression, userKeyIndex), func(t *testing.T) {
+				r := newTestReader(t, nil, TableOptions{
+					BlockSize:    256,
+					Compression:  compression,
+					UserKeyIndex: userKeyIndex,
+				}, func(w *Writer) error {
+					for i := 0; i < numKeys; i++ {
+						key := []byte(fmt.Sprintf("%04d", i))
+						var err error
+						switch i % 3 {
+						case 0:
+							err = w.Set(key, nil)
+						case 1:
+							err = w.Set(key, []byte{})
+						case 2:
+							err = w.Delete(key)
+						}
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				defer r.Close()
+
+				check := func(i int, key *InternalKey, value []byte) {
+					t.Helper()
+					if key == nil {
+						t.Fatalf("%d: expected key", i)
+					}
+					if kind := keyKind(i); key.Kind() != kind {
+						t.Fatalf("%s: expected kind %s, but found %s", key.UserKey, kind, key.Kind())
+					}
+					if key.Kind() == InternalKeyKindSet && (value == nil || len(value) != 0) {
+						t.Fatalf("%s: expected empty non-nil value, but found %#v", key.UserKey, value)
+					}
+				}
+
+				iter := r.NewIter(nil /* lower */, nil /* upper */)
+				i := 0
+				for key, value := iter.First(); key != nil; key, value = iter.Next() {
+					check(i, key, value)
+					if v := iter.Value(); v == nil || len(v) != 0 {
+						t.Fatalf("%s: expected empty non-nil value, but found %#v", key.UserKey, v)
+					}
+					i++
+				}
+				if i != numKeys {
+					t.Fatalf("expected %d keys, but found %d", numKeys, i)
+				}
+				for key, value := iter.Last(); key != nil; key, value = iter.Prev() {
+					i--
+					check(i, key, value)
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				for i := 0; i < numKeys; i++ {
+					if keyKind(i) != InternalKeyKindSet {
+						continue
+					}
+					key := []byte(fmt.Sprintf("%04d", i))
+					value, err := r.get(key)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if value == nil || len(value) != 0 {
+						t.Fatalf("%s: expected empty non-nil value, but found %#v", key, value)
+					}
+				}
+			})
+		}
+	}
+}
+
+// streamSink is a write-only sink which does not support seeking or reading.
+type streamSink struct {
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (s *streamSink) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write after close")
+	}
+	return s.buf.Write(p)
+}
+
+func (s *streamSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *streamSink) Sync() error {
+	return nil
+}
+
+func TestWriterStreamProperties(t *testing.T) {
+	sink := &streamSink{}
+	w := NewWriter(sink, &Options{
+		TablePropertyCollectors: []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+		},
+	}, TableOptions{
+		BlockSize:    256,
+		FilterPolicy: bloom.FilterPolicy(10),
+	})
+	var rawKeySize uint64
+	for i := 0; i < 1000; i++ {
+		key := base.MakeInternalKey([]byte(fmt.Sprintf("%04d", i)), uint64(i), InternalKeyKindSet)
+		if i%10 == 0 {
+			key.SetKind(InternalKeyKindDelete)
+		}
+		rawKeySize += uint64(key.Size())
+		if err := w.Add(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.DeleteRange([]byte("0100"), []byte("0200")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !sink.closed {
+		t.Fatalf("expected sink to be closed")
+	}
+
+	// The streamed bytes form a readable table whose properties reflect all of
+	// the entries.
+	mem := vfs.NewMem()
+	f0, err := mem.Create("streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f0.Write(sink.buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f0.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.Open("streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err := ReadProperties(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props.NumEntries != 1000 || props.NumDeletions != 100 ||
+		props.NumRangeDeletions != 1 || props.RawKeySize != rawKeySize ||
+		props.RawValueSize != 5*1000 || props.FilterPolicyName != "rocksdb.BuiltinBloomFilter" ||
+		props.UserProperties["test.key-count"] != "1001" {
+		t.Fatalf("unexpected properties:\n%s", props)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterBlockRanges(t *testing.T) {
+	mem := vfs.NewMem()
+	w := writeTestTable(t, mem, "test", nil, TableOptions{BlockSize: 256}, func(w *Writer) error {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := w.Set(key, bytes.Repeat(key, i%7)); err != nil {
+				return err
+			}
+		}
+		if _, err := w.BlockRanges(); err == nil {
+			t.Fatalf("expected error before the writer is closed")
+		}
+		return nil
+	})
+	ranges, err := w.BlockRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := openTestTable(t, mem, "test", nil)
+	defer r.Close()
+	if n := r.Properties.NumDataBlocks; uint64(len(ranges)) != n || n < 10 {
+		t.Fatalf("expected %d block ranges, but found %d", n, len(ranges))
+	}
+
+	// The ranges cover the table without gaps, both in the file and in the key
+	// space.
+	for i := 1; i < len(ranges); i++ {
+		prev, cur := ranges[i-1], ranges[i]
+		if prev.Offset+prev.Length+blockTrailerLen != cur.Offset {
+			t.Fatalf("%d: gap between blocks %d/%d and %d/%d",
+				i, prev.Offset, prev.Length, cur.Offset, cur.Length)
+		}
+		if bytes.Compare(prev.Largest, cur.Smallest) >= 0 {
+			t.Fatalf("%d: block ranges overlap: %s, %s", i, prev.Largest, cur.Smallest)
+		}
+	}
+	if first, last := ranges[0], ranges[len(ranges)-1]; string(first.Smallest) != "0000" ||
+		string(last.Largest) != "0999" || first.Offset != 0 ||
+		last.Offset+last.Length+blockTrailerLen != r.Properties.DataSize {
+		t.Fatalf("block ranges do not cover the table: %+v, %+v", first, last)
+	}
+
+	// The ranges match the blocks read by the Reader.
+	var found []BlockRange
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		userKey := append([]byte(nil), key.UserKey...)
+		if n := len(found); n > 0 && found[n-1].Offset == iter.dataBH.offset {
+			found[n-1].Largest = userKey
+			continue
+		}
+		found = append(found, BlockRange{
+			Offset:   iter.dataBH.offset,
+			Length:   iter.dataBH.length,
+			Smallest: userKey,
+			Largest:  userKey,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ranges, found) {
+		t.Fatalf("expected\n%+v\nbut found\n%+v", found, ranges)
+	}
+}
+
+func TestWriterMaxKeysPerBlock(t *testing.T) {
+	const numKeys = 5000
+	const maxKeys = 37
+	// The keys are tiny, so the blocks would hold thousands of entries if they
+	// were only bounded by size.
+	lo := TableOptions{BlockSize: 64 << 10, MaxKeysPerBlock: maxKeys}
+	r := newTestReader(t, nil, lo, func(w *Writer) error {
+		for i := 0; i < numKeys; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%05d", 2*i)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+	if expected := uint64((numKeys + maxKeys - 1) / maxKeys); r.Properties.NumDataBlocks != expected {
+		t.Fatalf("expected %d data blocks, but found %d", expected, r.Properties.NumDataBlocks)
+	}
+
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	defer iter.Close()
+	counts := make(map[uint64]int)
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		counts[iter.dataBH.offset]++
+	}
+	for offset, n := range counts {
+		if n > maxKeys {
+			t.Fatalf("block at offset %d holds %d keys, more than %d", offset, n, maxKeys)
+		}
+	}
+
+	// Seeks find the present keys, and the successors of the absent keys.
+	for i := 0; i < 2*numKeys; i++ {
+		expected := fmt.Sprintf("%05d", i+i%2)
+		key, _ := iter.SeekGE([]byte(fmt.Sprintf("%05d", i)))
+		if i+i%2 == 2*numKeys {
+			if key != nil {
+				t.Fatalf("%d: unexpected key %s", i, key)
+			}
+			continue
+		}
+		if key == nil || string(key.UserKey) != expected {
+			t.Fatalf("%d: expected %s, but found %v", i, expected, key)
+		}
+		if i == 0 {
+			continue
+		}
+		expected = fmt.Sprintf("%05d", (i-1)/2*2)
+		if key, _ = iter.SeekLT([]byte(fmt.Sprintf("%05d", i))); key == nil || string(key.UserKey) != expected {
+			t.Fatalf("%d: expected %s, but found %v", i, expected, key)
+		}
+	}
+}
+
+func TestWriterAddMetaBlock(t *testing.T) {
+	schema := []byte(strings.Repeat("column int64;", 100))
+	r := newTestReader(t, &Options{
+		Levels: []TableOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+	}, TableOptions{
+		BlockKeyRanges: true,
+		FilterPolicy:   bloom.FilterPolicy(10),
+		UserKeyIndex:   true,
+	}, func(w *Writer) error {
+		if err := w.Set([]byte("a"), []byte("1")); err != nil {
+			return err
+		}
+		if err := w.DeleteRange([]byte("b"), []byte("c")); err != nil {
+			return err
+		}
+		if err := w.RangeKeySet([]byte("d"), []byte("e"), nil, []byte("2")); err != nil {
+			return err
+		}
+		if err := w.AddMetaBlock("app.schema", schema); err != nil {
+			return err
+		}
+		if err := w.AddMetaBlock("app.empty", nil); err != nil {
+			return err
+		}
+
+		// The names of the meta blocks written by the Writer are reserved, as are
+		// the names of added meta blocks.
+		for _, name := range []string{
+			"",
+			"rocksdb.properties",
+			"rocksdb.range_del",
+			"rocksdb.range_del2",
+			"fullfilter.rocksdb.BuiltinBloomFilter",
+			"pebble.range_key",
+			"app.schema",
+		} {
+			if err := w.AddMetaBlock(name, []byte("x")); err == nil {
+				t.Fatalf("%q: expected error", name)
+			}
+		}
+		return nil
+	})
+	defer r.Close()
+	if b, err := r.RawMetaBlock("app.schema"); err != nil || !bytes.Equal(b, schema) {
+		t.Fatalf("expected schema, but found %q (%v)", b, err)
+	}
+	if b, err := r.RawMetaBlock("app.empty"); err != nil || len(b) != 0 {
+		t.Fatalf("expected empty meta block, but found %q (%v)", b, err)
+	}
+	if _, err := r.RawMetaBlock("app.missing"); err == nil {
+		t.Fatalf("expected error for missing meta block")
+	}
+
+	// The entries of the metaindex are sorted by name, regardless of the order
+	// in which the meta blocks were written.
+	metaindex, err := r.RawMetaBlock("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := newRawBlockIter(bytes.Compare, metaindex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		names = append(names, string(iter.Key().UserKey))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Fatalf("expected sorted metaindex, but found %q", names)
+	}
+	if len(names) != 9 {
+		t.Fatalf("expected 9 meta blocks, but found %q", names)
+	}
+
+	// The standard blocks are unaffected by the added meta blocks.
+	if r.tableFilter == nil || r.rangeDel.bh.length == 0 || r.rangeKey.bh.length == 0 ||
+		r.userKeyIndex.bh.length == 0 || r.blockKeyRanges.bh.length == 0 {
+		t.Fatalf("expected filter, range-del, range-key, user-key index and block key ranges blocks")
+	}
+	if v, err := r.get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected a=1, but found %q (%v)", v, err)
+	}
+}
+
+func TestWriterLargestValueSize(t *testing.T) {
+	rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	mem := vfs.NewMem()
+	build := func(sizes []int, record bool) (*Reader, *WriterMetadata) {
+		lo := TableOptions{RecordLargestValueSize: record}
+		w := writeTestTable(t, mem, "test", nil, lo, func(w *Writer) error {
+			for i, size := range sizes {
+				if err := w.Set([]byte(fmt.Sprintf("%05d", i)), make([]byte, size)); err != nil {
+					return err
+				}
+			}
+			// The end key of a range deletion is stored as its value, but is not a
+			// value of a point entry.
+			return w.DeleteRange([]byte("a"), bytes.Repeat([]byte("z"), 100000))
+		})
+		meta, err := w.Metadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return openTestTable(t, mem, "test", nil), meta
+	}
+
+	// A table without values records a largest value size of zero.
+	r, meta := build(nil, true)
+	if v := r.Properties.LargestValueSize; v != 0 || meta.LargestValueSize != 0 {
+		t.Fatalf("expected largest value size 0, but found %d and %d", v, meta.LargestValueSize)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := make([]int, 1000)
+	var largest int
+	for i := range sizes {
+		sizes[i] = rng.Intn(10000)
+		if sizes[i] > largest {
+			largest = sizes[i]
+		}
+	}
+	for _, record := range []bool{false, true} {
+		r, meta := build(sizes, record)
+		if meta.LargestValueSize != uint64(largest) {
+			t.Fatalf("expected largest value size %d, but found %d", largest, meta.LargestValueSize)
+		}
+		// The property is only recorded if requested.
+		var expected uint64
+		if record {
+			expected = uint64(largest)
+		}
+		if v := r.Properties.LargestValueSize; v != expected {
+			t.Fatalf("expected largest value size property %d, but found %d", expected, v)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriterMinCompressionRatio(t *testing.T) {
+	rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	mem := vfs.NewMem()
+	// build writes a table of 1000 entries whose values are produced by value,
+	// and returns the reader for the table along with the block types of its data
+	// blocks.
+	build := func(ratio float64, value func() []byte) (*Reader, []byte) {
+		writeTestTable(t, mem, "test", nil, TableOptions{
+			BlockSize:           1024,
+			Compression:         SnappyCompression,
+			MinCompressionRatio: ratio,
+		}, func(w *Writer) error {
+			for i := 0; i < 1000; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("%05d", i)), value()); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		r := openTestTable(t, mem, "test", nil)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+
+		indexBlock, err := r.readIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var index blockIter
+		if err := index.init(r.compare, indexBlock, 0 /* globalSeqNum */); err != nil {
+			t.Fatal(err)
+		}
+		var types []byte
+		var group []blockHandle
+		for key, value := index.First(); key != nil; key, value = index.Next() {
+			if group, err = r.decodeIndexEntry(group[:0], value); err != nil {
+				t.Fatal(err)
+			}
+			for _, bh := range group {
+				var typ [1]byte
+				if _, err := r.file.ReadAt(typ[:], int64(bh.offset+bh.length)); err != nil {
+					t.Fatal(err)
+				}
+				types = append(types, typ[0])
+			}
+		}
+		if err := index.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every entry reads back regardless of how its block was stored.
+		iter := r.NewIter(nil /* lower */, nil /* upper */)
+		var count int
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			count++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1000 {
+			t.Fatalf("expected 1000 entries, but found %d", count)
+		}
+		return r, types
+	}
+
+	random := func() []byte {
+		v := make([]byte, 100)
+		rng.Read(v)
+		return v
+	}
+	repeated := func() []byte {
+		return bytes.Repeat([]byte("a"), 100)
+	}
+
+	// Snappy discards the compressed form of the random blocks, so the sampled
+	// ratio is 1, while the repeated blocks compress well and are always
+	// stored compressed.
+	testCases := []struct {
+		name       string
+		ratio      float64
+		value      func() []byte
+		abandoned  bool
+		compressed bool
+	}{
+		{"incompressible", 1.1, random, true, false},
+		{"incompressible-disabled", 0, random, false, false},
+		{"compressible", 1.1, repeated, false, true},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			r, types := build(c.ratio, c.value)
+			defer r.Close()
+			if r.Properties.CompressionAbandoned != c.abandoned {
+				t.Fatalf("expected compression abandoned %t, but found %t",
+					c.abandoned, r.Properties.CompressionAbandoned)
+			}
+			if len(types) <= compressionSampleBlocks {
+				t.Fatalf("expected more than %d data blocks, but found %d",
+					compressionSampleBlocks, len(types))
+			}
+			for i, typ := range types {
+				if compressed := typ == snappyCompressionBlockType; compressed != c.compressed {
+					t.Fatalf("expected block %d compressed %t, but found %t", i, c.compressed, compressed)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterAddRangeDel(t *testing.T) {
+	mem := vfs.NewMem()
+	writeTestTable(t, mem, "test", nil, TableOptions{}, func(w *Writer) error {
+		for i := 0; i < 10; i++ {
+			key := base.MakeInternalKey([]byte(fmt.Sprintf("%02d", i)), 20, InternalKeyKindSet)
+			if err := w.Add(key, nil); err != nil {
+				return err
+			}
+		}
+		// The tombstones are fragmented: overlapping fragments share their bounds
+		// and are added in decreasing order of sequence number.
+		for _, rd := range []struct {
+			start, end string
+			seqNum     uint64
+		}{
+			{"01", "03", 30},
+			{"03", "05", 32},
+			{"03", "05", 31},
+			{"07", "10", 33},
+		} {
+			if err := w.AddRangeDel([]byte(rd.start), []byte(rd.end), rd.seqNum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	r := openTestTable(t, mem, "test", nil)
+	defer r.Close()
+	if v := r.Properties.NumRangeDeletions; v != 4 {
+		t.Fatalf("expected 4 range deletions, but found %d", v)
+	}
+
+	tombstones := func() string {
+		iter := r.NewRangeDelIter()
+		if iter == nil {
+			t.Fatalf("expected a range-del block")
+		}
+		var buf bytes.Buffer
+		for key, value := iter.First(); key != nil; key, value = iter.Next() {
+			fmt.Fprintf(&buf, "%s-%s#%d\n", key.UserKey, value, key.SeqNum())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	if s, expected := tombstones(), "01-03#30\n03-05#32\n03-05#31\n07-10#33\n"; s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	// The sequence numbers of the tombstones are replaced by the global
+	// sequence number of an ingested table, as are those of the point entries.
+	r.Properties.GlobalSeqNum = 42
+	if s, expected := tombstones(), "01-03#42\n03-05#42\n03-05#42\n07-10#42\n"; s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	// Tombstones which are not fragmented are rejected.
+	f, err := mem.Create("unfragmented")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, TableOptions{})
+	if err := w.AddRangeDel([]byte("01"), []byte("05"), 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRangeDel([]byte("03"), []byte("08"), 31); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestWriterFinish(t *testing.T) {
+	fp := bloom.FilterPolicy(10)
+	for _, c := range []struct {
+		name string
+		lo   TableOptions
+	}{
+		{"default", TableOptions{}},
+		{"filter", TableOptions{FilterPolicy: fp, FilterEmbedThreshold: 1}},
+		{"embedded-filter", TableOptions{FilterPolicy: fp, FilterEmbedThreshold: 1 << 20}},
+		{"zstd", TableOptions{Compression: ZstdCompression, IndexFirstKeys: true}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			mem := vfs.NewMem()
+			f0, err := mem.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.lo.BlockSize = 128
+			w := NewWriter(f0, nil, c.lo)
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("%05d", 2*i))
+				if err := w.Set(key, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.AddRangeDel([]byte("00100"), []byte("00200"), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			f1, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counting := &readCountingFile{File: f1}
+			r1, err := w.Finish(counting, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r1.Close()
+			if err := w.Close(); err == nil {
+				t.Fatalf("expected error closing a finished writer")
+			}
+
+			// The Reader is constructed without reading the table, and serves a
+			// seek by reading a single data block.
+			if counting.reads != 0 {
+				t.Fatalf("expected no reads, but found %d", counting.reads)
+			}
+			iter := r1.NewIter(nil /* lower */, nil /* upper */)
+			if key, _ := iter.SeekGE([]byte("01000")); key == nil || string(key.UserKey) != "01000" {
+				t.Fatalf("expected 01000, but found %v", key)
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if counting.reads != 1 {
+				t.Fatalf("expected 1 read, but found %d", counting.reads)
+			}
+
+			// The Reader behaves identically to one which reads the table.
+			r2 := openTestTable(t, mem, "test", &Options{Levels: []TableOptions{{FilterPolicy: fp}}})
+			defer r2.Close()
+			if r2.err != nil {
+				t.Fatal(r2.err)
+			}
+			if !reflect.DeepEqual(r1.Properties, r2.Properties) {
+				t.Fatalf("expected properties\n%s\nbut found\n%s", r2.Properties.String(), r1.Properties.String())
+			}
+			if r1.Features() != r2.Features() {
+				t.Fatalf("expected features %+v, but found %+v", r2.Features(), r1.Features())
+			}
+			if (r1.tableFilter == nil) != (r2.tableFilter == nil) {
+				t.Fatalf("expected filter %t, but found %t", r2.tableFilter != nil, r1.tableFilter != nil)
+			}
+
+			scan := func(r *Reader) string {
+				var buf bytes.Buffer
+				iter := r.NewIter(nil /* lower */, nil /* upper */)
+				for key, val := iter.First(); key != nil; key, val = iter.Next() {
+					fmt.Fprintf(&buf, "%s:%s,", key, val)
+				}
+				for key, val := iter.Last(); key != nil; key, val = iter.Prev() {
+					fmt.Fprintf(&buf, "%s:%s,", key, val)
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				rangeDel := r.NewRangeDelIter()
+				for key, val := rangeDel.First(); key != nil; key, val = rangeDel.Next() {
+					fmt.Fprintf(&buf, "%s-%s,", key, val)
+				}
+				if err := rangeDel.Close(); err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 2000; i += 7 {
+					key := []byte(fmt.Sprintf("%05d", i))
+					val, err := r.get(key)
+					fmt.Fprintf(&buf, "%s=%s/%v,", key, val, err)
+				}
+				return buf.String()
+			}
+			if s1, s2 := scan(r1), scan(r2); s1 != s2 {
+				t.Fatalf("expected\n%s\nbut found\n%s", s2, s1)
+			}
+		})
+	}
+
+	// A Writer which has failed returns its error, and closes the file.
+	mem := vfs.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, TableOptions{})
+	if err := w.Set([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Set([]byte("a"), nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Finish(f1, 0); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// largestValuePropertyCollector records the size of the largest value added.
+type largestValuePropertyCollector struct {
+	largest int
+}
+
+func (c *largestValuePropertyCollector) Add(key InternalKey, value []byte) error {
+	if len(value) > c.largest {
+		c.largest = len(value)
+	}
+	return nil
+}
+
+func (c *largestValuePropertyCollector) Finish(userProps map[string]string) error {
+	userProps["test.largest-value"] = fmt.Sprint(c.largest)
+	return nil
+}
+
+func (c *largestValuePropertyCollector) Name() string {
+	return "LargestValuePropertyCollector"
+}
+
+// seqNumRangePropertyCollector records the range of sequence numbers added.
+type seqNumRangePropertyCollector struct {
+	smallest, largest uint64
+	n                 int
+}
+
+func (c *seqNumRangePropertyCollector) Add(key InternalKey, value []byte) error {
+	if c.n == 0 || key.SeqNum() < c.smallest {
+		c.smallest = key.SeqNum()
+	}
+	if c.n == 0 || key.SeqNum() > c.largest {
+		c.largest = key.SeqNum()
+	}
+	c.n++
+	return nil
+}
+
+func (c *seqNumRangePropertyCollector) Finish(userProps map[string]string) error {
+	userProps["test.seqnum-range"] = fmt.Sprintf("%d-%d", c.smallest, c.largest)
+	return nil
+}
+
+func (c *seqNumRangePropertyCollector) Name() string {
+	return "SeqNumRangePropertyCollector"
+}
+
+func TestWriterMultiplePropertyCollectors(t *testing.T) {
+	mem := vfs.NewMem()
+	write := func(o *Options, lo TableOptions) (*Reader, error) {
+		f, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, o, lo)
+		for i := 0; i < 10; i++ {
+			key := base.MakeInternalKey([]byte(fmt.Sprintf("%02d", i)), uint64(10+i), InternalKeyKindSet)
+			if err := w.Add(key, bytes.Repeat([]byte("x"), i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		f, err = mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, nil)
+		return r, r.err
+	}
+
+	// The collectors of the Options and the TableOptions all contribute to
+	// the user properties of the table.
+	r, err := write(&Options{
+		TablePropertyCollectors: []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+		},
+	}, TableOptions{
+		TablePropertyCollectors: []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &largestValuePropertyCollector{} },
+			func() TablePropertyCollector { return &seqNumRangePropertyCollector{} },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"test.key-count":     "10",
+		"test.largest-value": "9",
+		"test.seqnum-range":  "10-19",
+	}
+	if !reflect.DeepEqual(expected, r.Properties.UserProperties) {
+		t.Fatalf("expected %v, but found %v", expected, r.Properties.UserProperties)
+	}
+	const names = "[KeyCountPropertyCollector,LargestValuePropertyCollector,SeqNumRangePropertyCollector]"
+	if v := r.Properties.PropertyCollectorNames; v != names {
+		t.Fatalf("expected %s, but found %s", names, v)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two collectors adding the same property fail the table.
+	_, err = write(&Options{
+		TablePropertyCollectors: []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+		},
+	}, TableOptions{
+		TablePropertyCollectors: []func() TablePropertyCollector{
+			func() TablePropertyCollector { return &keyCountPropertyCollector{} },
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), `property "test.key-count"`) {
+		t.Fatalf("expected duplicate property error, but found %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The zstd encoder and decoder are shared by all Writers and Readers. Both are
+// safe for concurrent use through EncodeAll and DecodeAll, and are expensive
+// to create, so they are only created when first needed.
+var zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func initZstdCodec() {
+	zstdCodec.once.Do(func() {
+		var err error
+		zstdCodec.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		zstdCodec.decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			panic(err)
+		}
+	})
+}
+
+// encodeZstd appends the zstd compressed form of b to dst. As in RocksDB
+// tables, the compressed block is preceded by the uvarint encoded length of
+// the decompressed block.
+func encodeZstd(dst, b []byte) []byte {
+	initZstdCodec()
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(b)))
+	return zstdCodec.encoder.EncodeAll(b, append(dst, tmp[:n]...))
+}
+
+// zstdDictMagic is the magic number of a zstd dictionary in the format
+// produced by dictionary training. Any other dictionary is raw content.
+const zstdDictMagic = "\x37\xa4\x30\xec"
+
+// zstdDictOption returns the decoder option registering the dictionary dict.
+// RocksDB uses the sampled data blocks of a table as a raw content dictionary
+// unless dictionary training is enabled, and the frames compressed against a
+// raw content dictionary have a dictionary ID of 0.
+func zstdDictOption(dict []byte) zstd.DOption {
+	if bytes.HasPrefix(dict, []byte(zstdDictMagic)) {
+		return zstd.WithDecoderDicts(dict)
+	}
+	return zstd.WithDecoderDictRaw(0, dict)
+}
+
+// zstdDictDecoder is the decoder of the zstd blocks of a table which are
+// compressed against the compression dictionary of the table. The decoder is
+// created when first needed, and is shared by a Reader and its views.
+type zstdDictDecoder struct {
+	once    sync.Once
+	dict    []byte
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (d *zstdDictDecoder) get() (*zstd.Decoder, error) {
+	d.once.Do(func() {
+		d.decoder, d.err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstdDictOption(d.dict))
+		if d.err != nil {
+			d.err = fmt.Errorf("pebble/table: invalid table (bad zstd dictionary): %v", d.err)
+		}
+	})
+	return d.decoder, d.err
+}
+
+// decodeZstd decompresses a block compressed using zstd. A non-nil dict is the
+// compression dictionary of the table, against which the block was compressed.
+func (r *Reader) decodeZstd(b, dict []byte) ([]byte, error) {
+	decodedLen, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.New("pebble/table: invalid table (bad zstd block length)")
+	}
+	if err := r.checkBlockSize(decodedLen); err != nil {
+		return nil, err
+	}
+	if r.streamDecompression(decodedLen) {
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if dict != nil {
+			opts = append(opts, zstdDictOption(dict))
+		}
+		zr, err := zstd.NewReader(bytes.NewReader(b[n:]), opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		decoded, err := r.decompressChunked(zr, decodedLen)
+		if err != nil {
+			return nil, fmt.Errorf("pebble/table: invalid table (bad zstd block): %v", err)
+		}
+		return decoded, nil
+	}
+	initZstdCodec()
+	decoder := zstdCodec.decoder
+	if dict != nil {
+		var err error
+		if decoder, err = r.zstdDict.get(); err != nil {
+			return nil, err
+		}
+	}
+	decoded := r.alloc(int(decodedLen))
+	result, err := decoder.DecodeAll(b[n:], decoded[:0])
+	if err != nil {
+		return nil, fmt.Errorf("pebble/table: invalid table (bad zstd block): %v", err)
+	}
+	if len(result) != len(decoded) || (len(result) > 0 && &result[0] != &decoded[0]) {
+		return nil, errors.New("pebble/table: invalid table (bad zstd block length)")
+	}
+	return decoded, nil
+}